@@ -0,0 +1,49 @@
+// Drag and drop reordering of the images on the gallery edit page.
+// The hidden order inputs are kept in step with the images so saving
+// the form posts the new order.
+(function() {
+  var list = document.getElementById("gallery-images");
+  var form = document.getElementById("image-order-form");
+  if (!list || !form) {
+    return;
+  }
+  var dragged = null;
+
+  list.addEventListener("dragstart", function(e) {
+    dragged = e.target.closest(".gallery-image");
+    if (!dragged) {
+      return;
+    }
+    dragged.classList.add("dragging");
+    e.dataTransfer.effectAllowed = "move";
+    e.dataTransfer.setData("text/plain", dragged.dataset.uid);
+  });
+
+  list.addEventListener("dragover", function(e) {
+    var target = e.target.closest(".gallery-image");
+    if (!dragged || !target || target === dragged) {
+      return;
+    }
+    e.preventDefault();
+    var rect = target.getBoundingClientRect();
+    var after = e.clientX > rect.left + rect.width / 2;
+    list.insertBefore(dragged, after ? target.nextSibling : target);
+  });
+
+  list.addEventListener("dragend", function() {
+    if (!dragged) {
+      return;
+    }
+    dragged.classList.remove("dragging");
+    dragged = null;
+    updateOrder();
+  });
+
+  function updateOrder() {
+    var inputs = form.querySelectorAll("input[name=order]");
+    var items = list.querySelectorAll(".gallery-image");
+    for (var i = 0; i < items.length && i < inputs.length; i++) {
+      inputs[i].value = items[i].dataset.uid;
+    }
+  }
+})();
@@ -0,0 +1,101 @@
+// Passkey registration and sign in. Forms with a data-passkey attribute
+// of "create" or "get" fetch their options from data-options-url, ask the
+// browser for a credential and submit it in their credential input.
+(function() {
+  var forms = document.querySelectorAll("form[data-passkey]");
+  if (!forms.length) {
+    return;
+  }
+  if (!window.PublicKeyCredential) {
+    forms.forEach(function(form) {
+      form.hidden = true;
+    });
+    return;
+  }
+
+  function decode(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    var bin = atob(s);
+    var bytes = new Uint8Array(bin.length);
+    for (var i = 0; i < bin.length; i++) {
+      bytes[i] = bin.charCodeAt(i);
+    }
+    return bytes.buffer;
+  }
+
+  function encode(buf) {
+    if (!buf) {
+      return "";
+    }
+    var bytes = new Uint8Array(buf);
+    var bin = "";
+    for (var i = 0; i < bytes.length; i++) {
+      bin += String.fromCharCode(bytes[i]);
+    }
+    return btoa(bin).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function decodeOptions(opts) {
+    opts.challenge = decode(opts.challenge);
+    if (opts.user) {
+      opts.user.id = decode(opts.user.id);
+    }
+    (opts.excludeCredentials || opts.allowCredentials || []).forEach(function(c) {
+      c.id = decode(c.id);
+    });
+    return opts;
+  }
+
+  function encodeCredential(cred) {
+    var resp = cred.response;
+    var out = { id: cred.id, clientDataJSON: encode(resp.clientDataJSON) };
+    if (resp.attestationObject) {
+      out.attestationObject = encode(resp.attestationObject);
+    } else {
+      out.authenticatorData = encode(resp.authenticatorData);
+      out.signature = encode(resp.signature);
+      out.userHandle = encode(resp.userHandle);
+    }
+    return JSON.stringify(out);
+  }
+
+  forms.forEach(function(form) {
+    var error = form.querySelector(".passkey-error");
+    form.addEventListener("submit", function(e) {
+      if (form.elements.credential.value) {
+        return;
+      }
+      e.preventDefault();
+      if (error) {
+        error.hidden = true;
+      }
+      fetch(form.dataset.optionsUrl, {
+        method: "POST",
+        credentials: "same-origin",
+        headers: { "X-CSRF-Token": form.elements["gorilla.csrf.Token"].value }
+      })
+        .then(function(res) {
+          if (!res.ok) {
+            throw new Error(res.statusText);
+          }
+          return res.json();
+        })
+        .then(function(opts) {
+          var publicKey = decodeOptions(opts);
+          if (form.dataset.passkey === "create") {
+            return navigator.credentials.create({ publicKey: publicKey });
+          }
+          return navigator.credentials.get({ publicKey: publicKey });
+        })
+        .then(function(cred) {
+          form.elements.credential.value = encodeCredential(cred);
+          form.submit();
+        })
+        .catch(function() {
+          if (error) {
+            error.hidden = false;
+          }
+        });
+    });
+  });
+})();
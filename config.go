@@ -6,6 +6,9 @@ import (
 	"log"
 	"os"
 	"strings"
+
+	"lenslocked.com/storage"
+	"lenslocked.com/webauthn"
 )
 
 type PostgresConfig struct {
@@ -45,13 +48,98 @@ type MailGunConfig struct {
 	PublicKey string `json:"public_key"`
 }
 
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	PublicURL string `json:"public_url"`
+}
+
+// StorageConfig selects where uploaded images are kept. Driver is one
+// of "local", "s3" or "memory".
+type StorageConfig struct {
+	Driver string   `json:"driver"`
+	Path   string   `json:"path"`
+	S3     S3Config `json:"s3"`
+}
+
+// BlobStore returns the storage backend selected by Driver.
+func (c StorageConfig) BlobStore() (storage.BlobStore, error) {
+	switch strings.ToLower(c.Driver) {
+	case "", "local":
+		return storage.NewLocal(c.Path, imagesURL), nil
+	case "memory":
+		return storage.NewMemory(imagesURL), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  c.S3.Endpoint,
+			Region:    c.S3.Region,
+			Bucket:    c.S3.Bucket,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+			PublicURL: c.S3.PublicURL,
+		}, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", c.Driver)
+	}
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Driver: "local",
+		Path:   "images",
+	}
+}
+
+// WebAuthnConfig is the site passkeys are registered with. RPID is its
+// domain and Origin the URL pages are served from, e.g.
+// "https://lenslocked.com".
+type WebAuthnConfig struct {
+	RPID   string `json:"rp_id"`
+	Origin string `json:"origin"`
+}
+
+// RelyingParty returns the webauthn.RelyingParty the config describes.
+func (c WebAuthnConfig) RelyingParty() webauthn.RelyingParty {
+	return webauthn.RelyingParty{
+		ID:     c.RPID,
+		Name:   "LensLocked",
+		Origin: c.Origin,
+	}
+}
+
+func DefaultWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{
+		RPID:   "localhost",
+		Origin: "http://localhost:3000",
+	}
+}
+
+// RateLimitConfig selects where rate limits are counted. Driver is
+// "memory", which only counts requests to this server, or "postgres" to
+// share the counts between servers.
+type RateLimitConfig struct {
+	Driver string `json:"driver"`
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Driver: "memory",
+	}
+}
+
 type Config struct {
-	Port     int            `json:"port"`
-	Env      string         `json:"env"`
-	Pepper   string         `json:"pepper"`
-	HMACKey  string         `json:"hmac_key"`
-	Database PostgresConfig `json:"database"`
-	Email    MailGunConfig  `json:"email"`
+	Port      int             `json:"port"`
+	Env       string          `json:"env"`
+	Pepper    string          `json:"pepper"`
+	HMACKey   string          `json:"hmac_key"`
+	Database  PostgresConfig  `json:"database"`
+	Email     MailGunConfig   `json:"email"`
+	Storage   StorageConfig   `json:"storage"`
+	WebAuthn  WebAuthnConfig  `json:"webauthn"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
 }
 
 func (c Config) IsProd() bool {
@@ -60,11 +148,14 @@ func (c Config) IsProd() bool {
 
 func DefaultConfig() Config {
 	return Config{
-		Port:     3000,
-		Env:      "dev",
-		Pepper:   "7SZ5t9epC5RFv&*",
-		HMACKey:  "secret-key",
-		Database: DefaultPostgresConfig(),
+		Port:      3000,
+		Env:       "dev",
+		Pepper:    "7SZ5t9epC5RFv&*",
+		HMACKey:   "secret-key",
+		Database:  DefaultPostgresConfig(),
+		Storage:   DefaultStorageConfig(),
+		WebAuthn:  DefaultWebAuthnConfig(),
+		RateLimit: DefaultRateLimitConfig(),
 	}
 }
 
@@ -10,6 +10,10 @@ const (
 	// user a private type to ensure that there's no chance of collision with
 	// other context values of the same name (but different type)
 	userKey privateKey = "user"
+	// accessTokenKey holds the access token a request was authenticated with.
+	accessTokenKey privateKey = "access_token"
+	// sessionKey holds the session a request was authenticated with.
+	sessionKey privateKey = "session"
 )
 
 type privateKey string
@@ -26,3 +30,35 @@ func User(ctx context.Context) *models.User {
 	}
 	return nil
 }
+
+// WithAccessToken records the access token the request was authenticated with.
+func WithAccessToken(ctx context.Context, token *models.AccessToken) context.Context {
+	return context.WithValue(ctx, accessTokenKey, token)
+}
+
+// AccessToken returns the access token the request was authenticated with,
+// or nil if it was authenticated some other way.
+func AccessToken(ctx context.Context) *models.AccessToken {
+	if temp := ctx.Value(accessTokenKey); temp != nil {
+		if token, ok := temp.(*models.AccessToken); ok {
+			return token
+		}
+	}
+	return nil
+}
+
+// WithSession records the session the request was authenticated with.
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session the request was authenticated with, or nil
+// if it was authenticated some other way.
+func Session(ctx context.Context) *models.Session {
+	if temp := ctx.Value(sessionKey); temp != nil {
+		if session, ok := temp.(*models.Session); ok {
+			return session
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// maxAccessTokenDays is the longest an access token can be valid for, 0
+// days creates a token that doesn't expire.
+const maxAccessTokenDays = 365
+
+// NewAccessTokens is used to create a new AccessTokens controller.
+// This function will panic if the templates are not parsed
+// correctly so should only be used during initial setup.
+func NewAccessTokens(ats models.AccessTokenService) *AccessTokens {
+	return &AccessTokens{
+		IndexView: views.NewView("bootstrap", "users/tokens"),
+		ats:       ats,
+	}
+}
+
+// AccessTokens lets users manage their personal access tokens.
+type AccessTokens struct {
+	IndexView *views.View
+	ats       models.AccessTokenService
+}
+
+// AccessTokenList is rendered by the IndexView.
+type AccessTokenList struct {
+	Tokens []models.AccessToken
+	// Created is the token that was just created. Its value is only
+	// shown this once.
+	Created *models.AccessToken
+	Scopes  []models.Scope
+}
+
+type AccessTokenForm struct {
+	Name   string   `schema:"name"`
+	Scopes []string `schema:"scopes"`
+	Days   int      `schema:"days"`
+}
+
+// Index lists the user's access tokens.
+//
+// GET /account/tokens
+func (at *AccessTokens) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	at.render(w, r, vd, nil)
+}
+
+// Create creates an access token and shows it to the user.
+//
+// POST /account/tokens
+func (at *AccessTokens) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccessTokenForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		at.render(w, r, vd, nil)
+		return
+	}
+	if form.Days < 0 || form.Days > maxAccessTokenDays {
+		vd.AlertError(fmt.Sprintf("Tokens can be valid for at most %d days.", maxAccessTokenDays))
+		at.render(w, r, vd, nil)
+		return
+	}
+	token := models.AccessToken{
+		UserID: context.User(r.Context()).ID,
+		Name:   form.Name,
+	}
+	scopes := make([]models.Scope, len(form.Scopes))
+	for i, scope := range form.Scopes {
+		scopes[i] = models.Scope(scope)
+	}
+	token.SetScopes(scopes)
+	if form.Days > 0 {
+		expires := time.Now().AddDate(0, 0, form.Days)
+		token.ExpiresAt = &expires
+	}
+	if err := at.ats.Create(&token); err != nil {
+		vd.SetAlert(err)
+		at.render(w, r, vd, nil)
+		return
+	}
+	alert := views.AlertSuccess("Your token has been created. Copy it now, you won't be able to see it again.")
+	vd.Alert = &alert
+	at.render(w, r, vd, &token)
+}
+
+// Delete revokes one of the user's access tokens.
+//
+// POST /account/tokens/:id/delete
+func (at *AccessTokens) Delete(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	err = at.ats.Delete(context.User(r.Context()).ID, uint(id))
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		at.render(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/tokens", http.StatusFound,
+		views.AlertSuccess("The token has been revoked."),
+	)
+}
+
+// render renders the list of the user's tokens with vd, showing the
+// value of created if it is not nil.
+func (at *AccessTokens) render(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.AccessToken) {
+	list := AccessTokenList{
+		Created: created,
+		Scopes:  models.Scopes,
+	}
+	tokens, err := at.ats.ByUserID(context.User(r.Context()).ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	list.Tokens = tokens
+	vd.Yield = &list
+	at.IndexView.Render(w, r, vd)
+}
@@ -0,0 +1,544 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	// maxAPIBodyBytes limits the size of JSON request bodies.
+	maxAPIBodyBytes = 1 << 20 // 1 MB
+
+	// apiLoginTokenDays is how long tokens created by Login are valid for.
+	apiLoginTokenDays = 30
+)
+
+// actionScopes maps gallery actions to the scope an access token needs
+// to perform them through the API.
+var actionScopes = map[models.Action]models.Scope{
+	models.ActionView:   models.ScopeGalleriesRead,
+	models.ActionUpload: models.ScopeImagesWrite,
+	models.ActionEdit:   models.ScopeImagesWrite,
+	models.ActionManage: models.ScopeGalleriesWrite,
+}
+
+// NewAPI is used to create a new API controller.
+func NewAPI(gs models.GalleryService, is models.ImageService, us models.UserService, tfs models.TwoFactorService, ats models.AccessTokenService) *API {
+	return &API{
+		gs:  gs,
+		is:  is,
+		us:  us,
+		tfs: tfs,
+		ats: ats,
+	}
+}
+
+// API serves the JSON API under /api/v1. It is used by our mobile apps and
+// automation tools in place of the HTML pages.
+type API struct {
+	gs  models.GalleryService
+	is  models.ImageService
+	us  models.UserService
+	tfs models.TwoFactorService
+	ats models.AccessTokenService
+}
+
+// apiError is the body of every error response of the API.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiUser struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type apiGallery struct {
+	ID          uint       `json:"id"`
+	Title       string     `json:"title"`
+	Visibility  string     `json:"visibility"`
+	Tags        []string   `json:"tags"`
+	ParentID    uint       `json:"parent_id,omitempty"`
+	Role        string     `json:"role"`
+	HasPassword bool       `json:"has_password"`
+	ImageCount  *int       `json:"image_count,omitempty"`
+	Images      []apiImage `json:"images,omitempty"`
+	NextCursor  string     `json:"next_cursor,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+type apiImage struct {
+	UID         string            `json:"uid"`
+	GalleryID   uint              `json:"gallery_id"`
+	Title       string            `json:"title"`
+	Caption     string            `json:"caption"`
+	AltText     string            `json:"alt_text"`
+	Tags        []string          `json:"tags"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Camera      string            `json:"camera,omitempty"`
+	TakenAt     *time.Time        `json:"taken_at,omitempty"`
+	URL         string            `json:"url"`
+	Sizes       map[string]string `json:"sizes,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+// apiImageSizes are the derivatives linked to from apiImage.
+var apiImageSizes = []string{"thumb", "medium", "large"}
+
+func newAPIGallery(gallery *models.Gallery) apiGallery {
+	tags := gallery.TagList()
+	if tags == nil {
+		tags = []string{}
+	}
+	return apiGallery{
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Visibility:  string(gallery.Visibility),
+		Tags:        tags,
+		ParentID:    gallery.ParentID,
+		Role:        string(gallery.Role),
+		HasPassword: gallery.HasPassword(),
+		CreatedAt:   gallery.CreatedAt,
+		UpdatedAt:   gallery.UpdatedAt,
+	}
+}
+
+// newAPIImage returns the JSON representation of the image. Image URLs are
+// absolute so clients can fetch them with their access token.
+func newAPIImage(r *http.Request, image *models.Image) apiImage {
+	tags := image.TagList()
+	if tags == nil {
+		tags = []string{}
+	}
+	img := apiImage{
+		UID:         image.UID,
+		GalleryID:   image.GalleryID,
+		Title:       image.Title,
+		Caption:     image.Caption,
+		AltText:     image.AltText,
+		Tags:        tags,
+		ContentType: image.ContentType,
+		Size:        image.Size,
+		Width:       image.Width,
+		Height:      image.Height,
+		Camera:      image.Camera(),
+		TakenAt:     image.TakenAt,
+		URL:         absoluteURL(r, image.Path()),
+		CreatedAt:   image.CreatedAt,
+	}
+	if image.HasSizes() {
+		img.Sizes = make(map[string]string, len(apiImageSizes))
+		for _, size := range apiImageSizes {
+			img.Sizes[size] = absoluteURL(r, image.SizePath(size))
+		}
+	}
+	return img
+}
+
+type apiLoginForm struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// OTP is required from users with two-factor authentication, it is
+	// either a TOTP code or a recovery code.
+	OTP string `json:"otp"`
+	// Name is shown in the user's list of access tokens.
+	Name string `json:"name"`
+}
+
+// Login exchanges an email address and password for an access token with
+// every scope that expires after 30 days. Tools that can't ask users for
+// their password should use a token created on the account page instead.
+//
+// POST /api/v1/login
+func (a *API) Login(w http.ResponseWriter, r *http.Request) {
+	var form apiLoginForm
+	if !a.decode(w, r, &form) {
+		return
+	}
+	user, err := a.us.Authenticate(form.Email, form.Password)
+	if err != nil {
+		if err == models.ErrNotFound {
+			err = models.ErrPasswordIncorrect
+		}
+		a.error(w, err)
+		return
+	}
+	if user.TOTPEnabled {
+		if form.OTP == "" {
+			a.errorStatus(w, http.StatusUnauthorized, "otp_required", "A two-factor authentication code is required.")
+			return
+		}
+		if err := a.tfs.Verify(user, form.OTP); err != nil {
+			a.error(w, err)
+			return
+		}
+	}
+	if form.Name == "" {
+		form.Name = "API login"
+	}
+	expires := time.Now().AddDate(0, 0, apiLoginTokenDays)
+	token := models.AccessToken{
+		UserID:    user.ID,
+		Name:      form.Name,
+		ExpiresAt: &expires,
+	}
+	token.SetScopes(models.Scopes)
+	if err := a.ats.Create(&token); err != nil {
+		a.error(w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, map[string]interface{}{
+		"token":      token.Token,
+		"expires_at": expires,
+	})
+}
+
+// GET /api/v1/user
+func (a *API) User(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	a.respond(w, http.StatusOK, apiUser{
+		ID:    user.ID,
+		Name:  user.Name,
+		Email: user.Email,
+	})
+}
+
+// Galleries lists the galleries the user owns or is a member of, a page
+// at a time.
+//
+// GET /api/v1/galleries?sort=title&cursor=...
+func (a *API) Galleries(w http.ResponseWriter, r *http.Request) {
+	if !a.scoped(w, r, models.ScopeGalleriesRead) {
+		return
+	}
+	q := r.URL.Query()
+	user := context.User(r.Context())
+	galleries, next, err := a.gs.ByUserIDPage(user.ID, q.Get("cursor"),
+		galleriesPerPage, models.GallerySort(q.Get("sort")))
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	list := make([]apiGallery, len(galleries))
+	for i := range galleries {
+		galleries[i].Role, err = a.gs.RoleOf(user, &galleries[i])
+		if err != nil {
+			a.error(w, err)
+			return
+		}
+		list[i] = newAPIGallery(&galleries[i])
+		count := galleries[i].ImageCount
+		list[i].ImageCount = &count
+	}
+	a.respond(w, http.StatusOK, map[string]interface{}{
+		"galleries":   list,
+		"next_cursor": next,
+	})
+}
+
+// Gallery returns the gallery along with a page of its images.
+//
+// GET /api/v1/galleries/:id?cursor=...
+func (a *API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.gallery(w, r, models.ActionView)
+	if !ok {
+		return
+	}
+	images, next, err := a.is.ByGalleryIDPage(gallery.ID, r.URL.Query().Get("cursor"), imagesPerPage)
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	body := newAPIGallery(gallery)
+	body.Images = make([]apiImage, len(images))
+	for i := range images {
+		body.Images[i] = newAPIImage(r, &images[i])
+	}
+	body.NextCursor = next
+	a.respond(w, http.StatusOK, body)
+}
+
+// apiGalleryForm is used to create and update galleries. Fields that are
+// left out of an update are not changed.
+type apiGalleryForm struct {
+	Title          *string   `json:"title"`
+	Visibility     *string   `json:"visibility"`
+	Password       *string   `json:"password"`
+	RemovePassword bool      `json:"remove_password"`
+	Tags           *[]string `json:"tags"`
+	ParentID       *uint     `json:"parent_id"`
+}
+
+// apply sets the fields included in the form on the gallery.
+func (form *apiGalleryForm) apply(gallery *models.Gallery) {
+	if form.Title != nil {
+		gallery.Title = *form.Title
+	}
+	if form.Visibility != nil {
+		gallery.Visibility = models.Visibility(*form.Visibility)
+	}
+	if form.Password != nil {
+		gallery.Password = *form.Password
+	}
+	if form.RemovePassword {
+		gallery.PasswordHash = ""
+	}
+	if form.Tags != nil {
+		gallery.Tags = strings.Join(*form.Tags, ",")
+	}
+	if form.ParentID != nil {
+		gallery.ParentID = *form.ParentID
+	}
+}
+
+// POST /api/v1/galleries
+func (a *API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	if !a.scoped(w, r, models.ScopeGalleriesWrite) {
+		return
+	}
+	var form apiGalleryForm
+	if !a.decode(w, r, &form) {
+		return
+	}
+	gallery := models.Gallery{UserID: context.User(r.Context()).ID}
+	form.apply(&gallery)
+	if err := a.gs.Create(&gallery); err != nil {
+		a.error(w, err)
+		return
+	}
+	gallery.Role = models.RoleOwner
+	a.respond(w, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// PATCH /api/v1/galleries/:id
+func (a *API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.gallery(w, r, models.ActionManage)
+	if !ok {
+		return
+	}
+	var form apiGalleryForm
+	if !a.decode(w, r, &form) {
+		return
+	}
+	form.apply(gallery)
+	if err := a.gs.Update(gallery); err != nil {
+		a.error(w, err)
+		return
+	}
+	a.respond(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// DELETE /api/v1/galleries/:id
+func (a *API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.gallery(w, r, models.ActionManage)
+	if !ok {
+		return
+	}
+	if err := a.is.DeleteAll(gallery.ID); err != nil {
+		a.error(w, err)
+		return
+	}
+	if err := a.gs.Delete(gallery.ID); err != nil {
+		a.error(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadImages adds the images of the multipart form field "images" to
+// the gallery.
+//
+// POST /api/v1/galleries/:id/images
+func (a *API) UploadImages(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.gallery(w, r, models.ActionUpload)
+	if !ok {
+		return
+	}
+	if r.ContentLength > models.MaxUploadBytes {
+		a.error(w, models.ErrUploadTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxUploadBytes)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		a.errorStatus(w, http.StatusBadRequest, "invalid_request", "The request must be a multipart form with images.")
+		return
+	}
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		a.errorStatus(w, http.StatusBadRequest, "invalid_request", "No images were uploaded.")
+		return
+	}
+	created := make([]apiImage, 0, len(files))
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			a.error(w, err)
+			return
+		}
+		image, err := a.is.Create(gallery.ID, file, f.Filename)
+		if err != nil {
+			a.error(w, err)
+			return
+		}
+		created = append(created, newAPIImage(r, image))
+	}
+	a.respond(w, http.StatusCreated, map[string]interface{}{"images": created})
+}
+
+// DELETE /api/v1/galleries/:id/images/:image
+func (a *API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, ok := a.gallery(w, r, models.ActionEdit)
+	if !ok {
+		return
+	}
+	image, err := a.is.ByUID(mux.Vars(r)["image"])
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err == nil {
+		err = a.is.Delete(image)
+	}
+	if err != nil {
+		a.error(w, err)
+		return
+	}
+	if gallery.CoverImageID == image.ID {
+		gallery.CoverImageID = 0
+		if err := a.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gallery looks up the gallery addressed by the id route variable and
+// writes an error response unless the user is allowed to perform action
+// on it. Galleries the user may not view are reported as not found.
+func (a *API) gallery(w http.ResponseWriter, r *http.Request, action models.Action) (*models.Gallery, bool) {
+	if !a.scoped(w, r, actionScopes[action]) {
+		return nil, false
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		a.error(w, models.ErrNotFound)
+		return nil, false
+	}
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		a.error(w, err)
+		return nil, false
+	}
+	user := context.User(r.Context())
+	gallery.Role, err = a.gs.RoleOf(user, gallery)
+	if err != nil {
+		a.error(w, err)
+		return nil, false
+	}
+	if gallery.Allows(action) {
+		return gallery, true
+	}
+	if action == models.ActionView && gallery.CanView(user) && !gallery.Locked(user) {
+		return gallery, true
+	}
+	if gallery.Allows(models.ActionView) {
+		a.errorStatus(w, http.StatusForbidden, "forbidden", "You are not allowed to do that with this gallery.")
+		return nil, false
+	}
+	a.error(w, models.ErrNotFound)
+	return nil, false
+}
+
+// scoped writes an error response and returns false unless the access
+// token the request was authenticated with was granted scope.
+func (a *API) scoped(w http.ResponseWriter, r *http.Request, scope models.Scope) bool {
+	token := context.AccessToken(r.Context())
+	if token == nil || !token.HasScope(scope) {
+		a.errorStatus(w, http.StatusForbidden, "insufficient_scope",
+			fmt.Sprintf("This request needs a token with the %s scope.", scope))
+		return false
+	}
+	return true
+}
+
+// decode reads the JSON request body into dst, writing an error
+// response and returning false if it is not valid.
+func (a *API) decode(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)).Decode(dst)
+	if err != nil {
+		a.errorStatus(w, http.StatusBadRequest, "invalid_request", "The request body must be valid JSON.")
+		return false
+	}
+	return true
+}
+
+func (a *API) respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println(err)
+	}
+}
+
+// error writes the JSON error response for err. Errors that are safe to
+// show to users are returned with their message, any other error is
+// logged and reported as an internal error.
+func (a *API) error(w http.ResponseWriter, err error) {
+	switch err {
+	case models.ErrNotFound:
+		a.errorStatus(w, http.StatusNotFound, "not_found", "The resource could not be found.")
+		return
+	case models.ErrPasswordIncorrect:
+		a.errorStatus(w, http.StatusUnauthorized, "unauthorized", "Incorrect email address or password.")
+		return
+	case models.ErrTooManyAttempts:
+		a.errorStatus(w, http.StatusTooManyRequests, "rate_limited", err.(views.PublicError).Public())
+		return
+	case models.ErrAccountLocked:
+		a.errorStatus(w, http.StatusLocked, "account_locked", err.(views.PublicError).Public())
+		return
+	case models.ErrTOTPCodeInvalid:
+		a.errorStatus(w, http.StatusUnauthorized, "otp_invalid", err.(views.PublicError).Public())
+		return
+	case models.ErrEmailUnverified:
+		a.errorStatus(w, http.StatusForbidden, "email_unverified", err.(views.PublicError).Public())
+		return
+	case models.ErrIDInvalid, models.ErrUserIDRequired:
+		a.errorStatus(w, http.StatusBadRequest, "invalid_request", "The request is not valid.")
+		return
+	case models.ErrImageTooLarge, models.ErrUploadTooLarge:
+		a.errorStatus(w, http.StatusRequestEntityTooLarge, "too_large", err.(views.PublicError).Public())
+		return
+	}
+	if pErr, ok := err.(views.PublicError); ok {
+		a.errorStatus(w, http.StatusUnprocessableEntity, "invalid", pErr.Public())
+		return
+	}
+	log.Println(err)
+	a.errorStatus(w, http.StatusInternalServerError, "internal_error", "Something went wrong, please try again.")
+}
+
+func (a *API) errorStatus(w http.ResponseWriter, status int, code, message string) {
+	a.respond(w, status, apiError{
+		Error: apiErrorDetail{Code: code, Message: message},
+	})
+}
@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+// testUsers is a UserService that signs in a single user.
+type testUsers struct {
+	models.UserService
+	user *models.User
+}
+
+func (tu *testUsers) Authenticate(email, password string) (*models.User, error) {
+	switch {
+	case email != tu.user.Email:
+		return nil, models.ErrNotFound
+	case password != "secret":
+		return nil, models.ErrPasswordIncorrect
+	}
+	user := *tu.user
+	return &user, nil
+}
+
+// testTwoFactor is a TwoFactorService accepting the code "123456".
+type testTwoFactor struct {
+	models.TwoFactorService
+}
+
+func (tf *testTwoFactor) Verify(user *models.User, code string) error {
+	if code != "123456" {
+		return models.ErrTOTPCodeInvalid
+	}
+	return nil
+}
+
+// testAccessTokens is an AccessTokenService that keeps the tokens it
+// creates.
+type testAccessTokens struct {
+	models.AccessTokenService
+	tokens []models.AccessToken
+}
+
+func (ta *testAccessTokens) Create(token *models.AccessToken) error {
+	token.Token = fmt.Sprintf("%stoken%d", models.AccessTokenPrefix, len(ta.tokens))
+	ta.tokens = append(ta.tokens, *token)
+	return nil
+}
+
+// withToken authenticates r as user with an access token granted scopes.
+func withToken(r *http.Request, user *models.User, scopes ...models.Scope) *http.Request {
+	token := &models.AccessToken{UserID: user.ID}
+	token.SetScopes(scopes)
+	ctx := context.WithUser(r.Context(), user)
+	return r.WithContext(context.WithAccessToken(ctx, token))
+}
+
+// decodeAPIError returns the code of the error response recorded in w.
+func decodeAPIError(t *testing.T, w *httptest.ResponseRecorder) string {
+	var body apiError
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Error.Code
+}
+
+func TestAPIError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{models.ErrNotFound, http.StatusNotFound, "not_found"},
+		{models.ErrPasswordIncorrect, http.StatusUnauthorized, "unauthorized"},
+		{models.ErrIDInvalid, http.StatusBadRequest, "invalid_request"},
+		{models.ErrImageTooLarge, http.StatusRequestEntityTooLarge, "too_large"},
+		{models.ErrTitleRequired, http.StatusUnprocessableEntity, "invalid"},
+		{errors.New("pq: connection refused"), http.StatusInternalServerError, "internal_error"},
+	}
+	a := &API{}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		a.error(w, tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: expected %d. Received %d", tt.err, tt.status, w.Code)
+		}
+		if code := decodeAPIError(t, w); code != tt.code {
+			t.Errorf("%v: expected code %q. Received %q", tt.err, tt.code, code)
+		}
+	}
+}
+
+func TestAPILogin(t *testing.T) {
+	us := &testUsers{user: &models.User{Email: "jon@example.com"}}
+	ats := &testAccessTokens{}
+	a := NewAPI(nil, nil, us, &testTwoFactor{}, ats)
+	login := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.Login(w, httptest.NewRequest("POST", "/api/v1/login", strings.NewReader(body)))
+		return w
+	}
+
+	w := login(`{"email": "jon@example.com", "password": "secret"}`)
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(ats.tokens) != 1 || body.Token != ats.tokens[0].Token {
+		t.Fatalf("Expected a new access token. Received %d %q", w.Code, body.Token)
+	}
+	token := ats.tokens[0]
+	for _, scope := range models.Scopes {
+		if !token.HasScope(scope) {
+			t.Errorf("Expected the token to be granted %s", scope)
+		}
+	}
+	if token.Name != "API login" || token.ExpiresAt == nil || !token.ExpiresAt.Equal(body.ExpiresAt) {
+		t.Errorf("Expected an expiring token named %q. Received %q expiring %v", "API login", token.Name, token.ExpiresAt)
+	}
+	for _, body := range []string{
+		`{"email": "jon@example.com", "password": "guess"}`,
+		`{"email": "bob@example.com", "password": "secret"}`,
+	} {
+		if w := login(body); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d. Received %d", body, http.StatusUnauthorized, w.Code)
+		}
+	}
+	if w := login(`{`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid JSON to be refused. Received %d", w.Code)
+	}
+
+	us.user.TOTPEnabled = true
+	tests := []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"email": "jon@example.com", "password": "secret"}`, http.StatusUnauthorized, "otp_required"},
+		{`{"email": "jon@example.com", "password": "secret", "otp": "000000"}`, http.StatusUnauthorized, "otp_invalid"},
+		{`{"email": "jon@example.com", "password": "guess", "otp": "123456"}`, http.StatusUnauthorized, "unauthorized"},
+	}
+	for _, tt := range tests {
+		w := login(tt.body)
+		if code := decodeAPIError(t, w); w.Code != tt.status || code != tt.code {
+			t.Errorf("%s: expected %d %s. Received %d %s", tt.body, tt.status, tt.code, w.Code, code)
+		}
+	}
+	if w := login(`{"email": "jon@example.com", "password": "secret", "otp": "123456"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected a valid code to sign in. Received %d", w.Code)
+	}
+}
+
+func TestAPIGalleryAccess(t *testing.T) {
+	a := NewAPI(newTestGalleries(), nil, nil, nil, nil)
+	owner := &models.User{Model: gorm.Model{ID: 1}}
+	other := &models.User{Model: gorm.Model{ID: 2}}
+	member := &models.User{Model: gorm.Model{ID: 3}}
+	tests := []struct {
+		name   string
+		id     string
+		user   *models.User
+		action models.Action
+		status int
+	}{
+		{"owner", "1", owner, models.ActionManage, http.StatusOK},
+		{"member view", "1", member, models.ActionView, http.StatusOK},
+		{"member edit", "1", member, models.ActionEdit, http.StatusForbidden},
+		{"private", "1", other, models.ActionView, http.StatusNotFound},
+		{"unlisted", "2", other, models.ActionView, http.StatusNotFound},
+		{"public", "3", other, models.ActionView, http.StatusOK},
+		{"public edit", "3", other, models.ActionEdit, http.StatusNotFound},
+		{"password protected", "5", other, models.ActionView, http.StatusNotFound},
+		{"missing", "4", owner, models.ActionView, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/galleries/"+tt.id, nil)
+		r = mux.SetURLVars(r, map[string]string{"id": tt.id})
+		r = withToken(r, tt.user, models.Scopes...)
+		w := httptest.NewRecorder()
+		gallery, ok := a.gallery(w, r, tt.action)
+		if ok != (tt.status == http.StatusOK) || (ok && gallery == nil) {
+			t.Errorf("%s: expected access %v. Received %v", tt.name, tt.status == http.StatusOK, ok)
+		}
+		if !ok && w.Code != tt.status {
+			t.Errorf("%s: expected %d. Received %d", tt.name, tt.status, w.Code)
+		}
+	}
+}
+
+func TestAPIScopes(t *testing.T) {
+	a := NewAPI(newTestGalleries(), nil, nil, nil, nil)
+	owner := &models.User{Model: gorm.Model{ID: 1}}
+	tests := []struct {
+		name   string
+		action models.Action
+		scopes []models.Scope
+		ok     bool
+	}{
+		{"view", models.ActionView, []models.Scope{models.ScopeGalleriesRead}, true},
+		{"view without read", models.ActionView, []models.Scope{models.ScopeImagesWrite}, false},
+		{"upload", models.ActionUpload, []models.Scope{models.ScopeImagesWrite}, true},
+		{"upload read only", models.ActionUpload, []models.Scope{models.ScopeGalleriesRead}, false},
+		{"edit", models.ActionEdit, []models.Scope{models.ScopeImagesWrite}, true},
+		{"manage", models.ActionManage, []models.Scope{models.ScopeGalleriesWrite}, true},
+		{"manage images only", models.ActionManage, []models.Scope{models.ScopeImagesWrite}, false},
+		{"no scopes", models.ActionView, nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/galleries/1", nil)
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		r = withToken(r, owner, tt.scopes...)
+		w := httptest.NewRecorder()
+		if _, ok := a.gallery(w, r, tt.action); ok != tt.ok {
+			t.Errorf("%s: expected access %v. Received %v", tt.name, tt.ok, ok)
+			continue
+		}
+		if tt.ok {
+			continue
+		}
+		if code := decodeAPIError(t, w); w.Code != http.StatusForbidden || code != "insufficient_scope" {
+			t.Errorf("%s: expected %d insufficient_scope. Received %d %s", tt.name, http.StatusForbidden, w.Code, code)
+		}
+	}
+
+	// requests signed in with a cookie have no token and can't use the API
+	r := httptest.NewRequest("POST", "/api/v1/galleries", nil)
+	r = r.WithContext(context.WithUser(r.Context(), owner))
+	w := httptest.NewRecorder()
+	a.CreateGallery(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a request without a token to be refused. Received %d", w.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+type VerifyEmailForm struct {
+	Token string `schema:"token"`
+}
+
+type ChangeEmailForm struct {
+	Email    string `schema:"email"`
+	Password string `schema:"password"`
+}
+
+// sendVerification emails the user a link to verify their address with.
+// Failing to send it isn't fatal, they can ask for another from their
+// account page.
+func (u *Users) sendVerification(user *models.User) {
+	token, err := u.us.InitiateVerification(user)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := u.emailer.VerifyEmail(user.Name, user.Email, token); err != nil {
+		log.Println(err)
+	}
+}
+
+// VerifyEmail asks the user to confirm the email address the token in
+// the link we emailed them was sent to. Following the link doesn't verify
+// it by itself, so mail scanners that open links can't.
+//
+// GET /verify
+func (u *Users) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form VerifyEmailForm
+	vd.Yield = &form
+
+	if err := ParseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.VerifyEmailView.Render(w, r, vd)
+}
+
+// CompleteVerification verifies the user's email address, changing it to
+// the new one if that is what the token was sent to.
+//
+// POST /verify
+func (u *Users) CompleteVerification(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form VerifyEmailForm
+	vd.Yield = &form
+
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.VerifyEmailView.Render(w, r, vd)
+		return
+	}
+	user, err := u.us.CompleteVerification(form.Token)
+	if err != nil {
+		vd.SetAlert(err)
+		u.VerifyEmailView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound,
+		views.AlertSuccess(fmt.Sprintf("Thanks, %s is verified.", user.Email)),
+	)
+}
+
+// ResendVerification emails the current user another link to verify
+// their address with.
+//
+// POST /account/verify
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if user.Verified() {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	u.sendVerification(user)
+	views.RedirectAlert(w, r, "/account", http.StatusFound,
+		views.AlertSuccess(fmt.Sprintf("We have sent a new link to %s.", user.Email)),
+	)
+}
+
+// ChangeEmail starts changing the current user's email address. It only
+// changes once they follow the link we send to the new address.
+//
+// POST /account/email
+func (u *Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ChangeEmailForm
+	user := context.User(r.Context())
+	vd.Yield = user
+
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	token, err := u.us.InitiateEmailChange(user, form.Email, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	if err := u.emailer.VerifyEmail(user.Name, strings.TrimSpace(form.Email), token); err != nil {
+		log.Println(err)
+		vd.AlertError("We couldn't send an email to that address, please try again.")
+		u.AccountView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound,
+		views.AlertSuccess("Please follow the link we emailed to your new address, your email address changes once it is verified."),
+	)
+}
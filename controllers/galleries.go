@@ -5,9 +5,12 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/email"
 	"lenslocked.com/models"
 	"lenslocked.com/views"
 )
@@ -17,48 +20,107 @@ const (
 	EditGallery = "edit_gallery"
 
 	maxMultipartMem = 1 << 20 // 1 MB
+
+	// maxShareDays is the longest a share link can be valid for.
+	maxShareDays = 90
+
+	galleriesPerPage = 20
+	// imagesPerPage is a multiple of the 3 columns of the show page.
+	imagesPerPage = 30
 )
 
 // NewGalleries is used to create a new Galleries controller.
 // This function will panic if the templates are not parsed
 // correctly so should only be used during initial setup.
-func NewGalleries(gs models.GalleryService, is models.ImageService, r *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, us models.UserService, emailer email.MailClient, r *mux.Router) *Galleries {
 	return &Galleries{
-		New:       views.NewView("bootstrap", "galleries/new"),
-		ShowView:  views.NewView("bootstrap", "galleries/show"),
-		EditView:  views.NewView("bootstrap", "galleries/edit"),
-		IndexView: views.NewView("bootstrap", "galleries/index"),
-		gs:        gs,
-		is:        is,
-		r:         r,
+		New:        views.NewView("bootstrap", "galleries/new"),
+		ShowView:   views.NewView("bootstrap", "galleries/show"),
+		EditView:   views.NewView("bootstrap", "galleries/edit"),
+		IndexView:  views.NewView("bootstrap", "galleries/index"),
+		UnlockView: views.NewView("bootstrap", "galleries/unlock"),
+		gs:         gs,
+		is:         is,
+		us:         us,
+		emailer:    emailer,
+		r:          r,
 	}
 }
 
 type Galleries struct {
-	New       *views.View
-	ShowView  *views.View
-	EditView  *views.View
-	IndexView *views.View
-	gs        models.GalleryService
-	is        models.ImageService
-	r         *mux.Router
+	New        *views.View
+	ShowView   *views.View
+	EditView   *views.View
+	IndexView  *views.View
+	UnlockView *views.View
+	gs         models.GalleryService
+	is         models.ImageService
+	us         models.UserService
+	emailer    email.MailClient
+	r          *mux.Router
 }
 
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title          string `schema:"title"`
+	Visibility     string `schema:"visibility"`
+	Password       string `schema:"password"`
+	RemovePassword bool   `schema:"remove_password"`
+	ParentID       uint   `schema:"parent"`
+	Tags           string `schema:"tags"`
+}
+
+type GalleryListForm struct {
+	Sort   string `schema:"sort"`
+	Cursor string `schema:"cursor"`
 }
 
-// GET /galleries
+// GalleryList is a page of the galleries index.
+type GalleryList struct {
+	Galleries []models.Gallery
+	Sort      models.GallerySort
+	NextPage  string
+	FirstPage string
+}
+
+// Index lists the galleries the user owns or is a member of, a page at a time.
+//
+// GET /galleries?sort=title&cursor=...
 func (g *Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form GalleryListForm
+	list := GalleryList{Sort: models.SortCreated}
+	vd.Yield = &list
+	if err := ParseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
+		return
+	}
+	if form.Sort != "" {
+		list.Sort = models.GallerySort(form.Sort)
+	}
 	user := context.User(r.Context())
-	galleries, err := g.gs.ByUserID(user.ID)
+	galleries, next, err := g.gs.ByUserIDPage(user.ID, form.Cursor, galleriesPerPage, list.Sort)
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		vd.SetAlert(err)
+		g.IndexView.Render(w, r, vd)
 		return
 	}
-	var vd views.Data
-	vd.Yield = galleries
-	// fmt.Fprint(w, galleries)
+	if next != "" {
+		list.NextPage = pageURL(r, next)
+	}
+	if form.Cursor != "" {
+		list.FirstPage = pageURL(r, "")
+	}
+	for i := range galleries {
+		galleries[i].Role, err = g.gs.RoleOf(user, &galleries[i])
+		if err != nil {
+			log.Println(err)
+		}
+		if err := setCover(g.is, &galleries[i]); err != nil {
+			log.Println(err)
+		}
+	}
+	list.Galleries = galleries
 	g.IndexView.Render(w, r, vd)
 }
 
@@ -68,11 +130,53 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	g.show(w, r, gallery)
+}
+
+// ShowBySlug is used to view unlisted galleries through their share link.
+//
+// GET /g/:slug
+func (g *Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.show(w, r, gallery)
+}
 
+func (g *Galleries) show(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	var vd views.Data
 	vd.Yield = gallery
 
-	// fmt.Fprintln(w, gallery)
+	cursor := r.URL.Query().Get("cursor")
+	images, next, err := g.is.ByGalleryIDPage(gallery.ID, cursor, imagesPerPage)
+	if err != nil {
+		vd.SetAlert(err)
+		g.ShowView.Render(w, r, vd)
+		return
+	}
+	gallery.Images = images
+	if next != "" {
+		gallery.NextPage = pageURL(r, next)
+	}
+	if cursor != "" {
+		gallery.FirstPage = pageURL(r, "")
+	}
+	if link := shareLink(g.gs, r, gallery, ""); link != nil {
+		// visitors with a share link need it to load the images too
+		for i := range gallery.Images {
+			gallery.Images[i].AddQuery(link.Query())
+		}
+	}
+	owner, err := g.us.ByID(gallery.UserID)
+	if err != nil || !owner.ShowLocation {
+		for i := range gallery.Images {
+			gallery.Images[i].HideLocation()
+		}
+	}
+	if err := g.setAlbums(r, gallery); err != nil {
+		log.Println(err)
+	}
 	g.ShowView.Render(w, r, vd)
 }
 
@@ -82,15 +186,11 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.can(w, r, gallery, models.ActionUpload) {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
-
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, gallery, vd)
 }
 
 // POST /galleries/:id/delete
@@ -99,23 +199,20 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.can(w, r, gallery, models.ActionManage) {
 		return
 	}
 	var vd views.Data
 	err = g.is.DeleteAll(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
 	err = g.gs.Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
-		vd.Yield = gallery
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
 	http.Redirect(w, r, "/galleries", http.StatusFound)
@@ -127,34 +224,38 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.can(w, r, gallery, models.ActionManage) {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
 
 	var form GalleryForm
 	if err := ParseForm(r, &form); err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
 
 	gallery.Title = form.Title
+	gallery.Visibility = models.Visibility(form.Visibility)
+	gallery.Password = form.Password
+	gallery.ParentID = form.ParentID
+	gallery.Tags = form.Tags
+	if form.RemovePassword {
+		gallery.PasswordHash = ""
+	}
 	//fmt.Fprintln(w, gallery)
 	err = g.gs.Update(gallery)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
 	vd.Alert = &views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: "Gallery successfully updated!",
 	}
-	g.EditView.Render(w, r, vd)
+	g.renderEdit(w, r, gallery, vd)
 }
 
 // Create is used to process the signup form. This creates a new user account.
@@ -172,8 +273,11 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 
 	user := context.User(r.Context())
 	gallery := models.Gallery{
-		Title:  form.Title,
-		UserID: user.ID,
+		Title:      form.Title,
+		UserID:     user.ID,
+		Visibility: models.Visibility(form.Visibility),
+		Password:   form.Password,
+		Tags:       form.Tags,
 	}
 
 	if err := g.gs.Create(&gallery); err != nil {
@@ -181,13 +285,7 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 		g.New.Render(w, r, vd)
 		return
 	}
-	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
-	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
-		return
-	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	g.redirectToEdit(w, r, &gallery)
 }
 
 func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
@@ -201,38 +299,118 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		return nil, err
 	}
 	gallery, err := g.gs.ByID(uint(id))
+	if err == nil {
+		err = g.access(r, gallery, gallery.CanView)
+	}
+	return g.galleryOrError(w, r, gallery, err)
+}
+
+func (g *Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	slug := mux.Vars(r)["slug"]
+	gallery, err := g.gs.BySlug(slug)
+	if err == nil {
+		err = g.access(r, gallery, gallery.CanViewBySlug)
+	}
+	return g.galleryOrError(w, r, gallery, err)
+}
+
+// access returns ErrNotFound if the visitor is not allowed to view the
+// gallery and ErrGalleryLocked if they first need to enter its password.
+// canView is either the gallery's CanView or CanViewBySlug method. The
+// owner, members and share links are allowed access regardless of
+// visibility and passwords. The visitor's role is set on the gallery.
+func (g *Galleries) access(r *http.Request, gallery *models.Gallery, canView func(*models.User) bool) error {
+	role, err := g.gs.RoleOf(context.User(r.Context()), gallery)
+	if err != nil {
+		return err
+	}
+	gallery.Role = role
+	if role != "" || shareLink(g.gs, r, gallery, "") != nil {
+		return nil
+	}
+	if !canView(context.User(r.Context())) {
+		return models.ErrNotFound
+	}
+	if !unlocked(g.gs, r, gallery) {
+		return models.ErrGalleryLocked
+	}
+	return nil
+}
+
+// galleryOrError writes the error response for err from looking up a
+// gallery, or returns the gallery if there was no error. The gallery's
+// images are not loaded, listings only load the page of them they show.
+func (g *Galleries) galleryOrError(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error) (*models.Gallery, error) {
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
 			http.Error(w, "Gallery not found", http.StatusNotFound)
+		case models.ErrGalleryLocked:
+			form := UnlockForm{
+				GalleryID: gallery.ID,
+				Return:    r.URL.Path,
+			}
+			var vd views.Data
+			vd.Yield = &form
+			g.UnlockView.Render(w, r, vd)
 		default:
 			log.Println(err)
 			http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
 		}
 		return nil, err
 	}
-	images, err := g.is.ByGalleryID(gallery.ID)
-	gallery.Images = images
 	return gallery, nil
 }
 
+// can writes an error response and returns false unless the current
+// user is allowed to perform action on the gallery.
+func (g *Galleries) can(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, action models.Action) bool {
+	ok, err := g.gs.Can(context.User(r.Context()), gallery, action)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// verified checks the current user has verified their email address,
+// which they need to share galleries. Otherwise the edit page is rendered
+// with an error.
+func (g *Galleries) verified(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) bool {
+	if context.User(r.Context()).Verified() {
+		return true
+	}
+	var vd views.Data
+	vd.SetAlert(models.ErrEmailUnverified)
+	g.renderEdit(w, r, gallery, vd)
+	return false
+}
+
 // POST /galleries/:id/images
 func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.can(w, r, gallery, models.ActionUpload) {
 		return
 	}
 	var vd views.Data
-	vd.Yield = gallery
+	if r.ContentLength > models.MaxUploadBytes {
+		vd.SetAlert(models.ErrUploadTooLarge)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxUploadBytes)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
 
@@ -243,7 +421,7 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		file, err := f.Open()
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, gallery, vd)
 			return
 		}
 		defer file.Close()
@@ -251,44 +429,562 @@ func (g *Galleries) ImageUpload(w http.ResponseWriter, r *http.Request) {
 		_, err = g.is.Create(gallery.ID, file, f.Filename)
 		if err != nil {
 			vd.SetAlert(err)
-			g.EditView.Render(w, r, vd)
+			g.renderEdit(w, r, gallery, vd)
 			return
 		}
 	}
-	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/images/:image/delete
+func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/galleries", http.StatusFound)
 		return
 	}
-	http.Redirect(w, r, url.Path, http.StatusFound)
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByUID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	err = g.is.Delete(image)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	if gallery.CoverImageID == image.ID {
+		gallery.CoverImageID = 0
+		if err := g.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+	g.redirectToEdit(w, r, gallery)
 }
 
-// POST /galleries/:id/images/:filename/delete
-func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
+// POST /galleries/:id/images/:image/rotate
+func (g *Galleries) ImageRotate(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
 		return
 	}
-	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "Gallery not found", http.StatusNotFound)
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByUID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	err = g.is.Rotate(image)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+// POST /galleries/:id/images/:image/cover
+func (g *Galleries) ImageCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByUID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	gallery.CoverImageID = image.ID
+	err = g.gs.Update(gallery)
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+type ImageForm struct {
+	Title   string `schema:"title"`
+	Caption string `schema:"caption"`
+	AltText string `schema:"alt_text"`
+	Tags    string `schema:"tags"`
+}
+
+// POST /galleries/:id/images/:image/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	image, err := g.imageByUID(w, r, gallery)
+	if err != nil {
+		return
+	}
+	var vd views.Data
+
+	var form ImageForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	image.Title = form.Title
+	image.Caption = form.Caption
+	image.AltText = form.AltText
+	image.Tags = form.Tags
+	err = g.is.Update(image)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+type UnlockForm struct {
+	GalleryID uint   `schema:"-"`
+	Password  string `schema:"password"`
+	Return    string `schema:"return"`
+}
+
+// Unlock checks the password of a password protected gallery and lets the
+// visitor view the gallery for a while by setting a cookie.
+//
+// POST /galleries/:id/unlock
+func (g *Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusNotFound)
+		return
+	}
+	gallery, err := g.gs.ByID(uint(id))
+	// the gallery's slug is not known here so the less strict
+	// check is used. Unlocking an unlisted gallery does not make
+	// it visible at its numeric ID.
+	if err == nil && !gallery.CanViewBySlug(context.User(r.Context())) {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var vd views.Data
+	form := UnlockForm{GalleryID: gallery.ID}
+	vd.Yield = &form
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+	token, expires, err := g.gs.Unlock(gallery, form.Password)
+	if err != nil {
+		switch err {
+		case models.ErrPasswordIncorrect:
+			vd.AlertError("Incorrect password, please try again.")
+		default:
+			vd.SetAlert(err)
+		}
+		form.Password = ""
+		g.UnlockView.Render(w, r, vd)
+		return
+	}
+	cookies.SetGalleryUnlock(w, gallery.ID, token, expires)
+
+	// only return to the pages this gallery can be viewed at
+	url := fmt.Sprintf("/galleries/%v", gallery.ID)
+	if form.Return == "/g/"+gallery.Slug {
+		url = form.Return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+type ShareForm struct {
+	Image    string `schema:"image"`
+	Days     int    `schema:"days"`
+	Download bool   `schema:"download"`
+}
+
+// Share creates a link that gives access to the gallery, or to one
+// of its images, for a number of days without making it public.
+//
+// POST /galleries/:id/share
+func (g *Galleries) Share(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionManage) {
+		return
+	}
+	var vd views.Data
+	if !g.verified(w, r, gallery) {
+		return
+	}
+
+	var form ShareForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	if form.Days < 1 || form.Days > maxShareDays {
+		vd.AlertError(fmt.Sprintf("Share links can be valid for 1 to %d days.", maxShareDays))
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	if form.Image != "" {
+		image, err := g.is.ByUID(form.Image)
+		if err != nil || image.GalleryID != gallery.ID {
+			vd.AlertError("The image to share could not be found.")
+			g.renderEdit(w, r, gallery, vd)
+			return
+		}
+	}
+	perms := models.SharePermView
+	if form.Download {
+		perms |= models.SharePermDownload
+	}
+	expires := time.Now().AddDate(0, 0, form.Days)
+	link, err := g.gs.ShareLink(gallery, form.Image, perms, expires)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
-	filename := mux.Vars(r)["filename"]
-	i := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	vd.Alert = &views.Alert{
+		Level: views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Share link valid until %s: %s",
+			expires.Format("2 Jan 2006"), absoluteURL(r, link.Path())),
+	}
+	g.renderEdit(w, r, gallery, vd)
+}
+
+// RevokeShares invalidates all share links created for the gallery.
+//
+// POST /galleries/:id/share/revoke
+func (g *Galleries) RevokeShares(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionManage) {
+		return
+	}
+	var vd views.Data
+	err = g.gs.RevokeShareLinks(gallery)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
 	}
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "All share links for this gallery have been revoked.",
+	}
+	g.renderEdit(w, r, gallery, vd)
+}
 
-	err = g.is.Delete(&i)
+type MemberForm struct {
+	Email string `schema:"email"`
+	Role  string `schema:"role"`
+}
+
+// Invite adds the user with the given email address to the gallery
+// and lets them know by email.
+//
+// POST /galleries/:id/members
+func (g *Galleries) Invite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionManage) {
+		return
+	}
+	var vd views.Data
+	if !g.verified(w, r, gallery) {
+		return
+	}
+
+	var form MemberForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	member, err := g.us.ByEmail(form.Email)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			vd.AlertError("There is no account with that email address, please ask them to sign up first.")
+		default:
+			vd.SetAlert(err)
+		}
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	err = g.gs.AddMember(gallery, member, models.Role(form.Role))
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	inviter := context.User(r.Context())
+	path := fmt.Sprintf("/galleries/%v", gallery.ID)
+	err = g.emailer.GalleryInvite(member.Name, member.Email, inviter.Name, gallery.Title, form.Role, path)
+	if err != nil {
+		log.Println(err)
+	}
+	alert := views.AlertSuccess(fmt.Sprintf("%s can now access this gallery as %s.", member.Name, form.Role))
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%v/edit", gallery.ID), http.StatusFound, alert)
+}
+
+// POST /galleries/:id/members/:user/delete
+func (g *Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionManage) {
+		return
+	}
+	userID, err := strconv.Atoi(mux.Vars(r)["user"])
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	err = g.gs.DeleteMember(gallery.ID, uint(userID))
 	if err != nil {
 		var vd views.Data
-		vd.Yield = gallery
 		vd.SetAlert(err)
-		g.EditView.Render(w, r, vd)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+type ImageOrderForm struct {
+	Order []string `schema:"order"`
+}
+
+// ImageOrder saves the order of the gallery's images set
+// by dragging them around on the edit page.
+//
+// POST /galleries/:id/images/order
+func (g *Galleries) ImageOrder(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	var vd views.Data
+
+	var form ImageOrderForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	err = g.is.Reorder(gallery.ID, form.Order)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	g.redirectToEdit(w, r, gallery)
+}
+
+type ImageMoveForm struct {
+	Images      []string `schema:"images"`
+	Destination uint     `schema:"destination"`
+	Copy        bool     `schema:"copy"`
+}
+
+// ImageMove moves or copies the selected images to another gallery. The
+// user needs to be allowed to edit the images of the gallery they are
+// taken from and to upload to the gallery they are added to.
+//
+// POST /galleries/:id/images/move
+func (g *Galleries) ImageMove(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if !g.can(w, r, gallery, models.ActionEdit) {
+		return
+	}
+	var vd views.Data
+
+	var form ImageMoveForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	dst, err := g.gs.ByID(form.Destination)
+	if err == nil && dst.ID == gallery.ID {
+		err = models.ErrImageMoveInvalid
+	}
+	if err == nil {
+		var ok bool
+		ok, err = g.gs.Can(context.User(r.Context()), dst, models.ActionUpload)
+		if err == nil && !ok {
+			err = models.ErrNotFound
+		}
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			vd.AlertError("The gallery to move the images to could not be found.")
+		default:
+			vd.SetAlert(err)
+		}
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	selected := make(map[string]bool, len(form.Images))
+	for _, uid := range form.Images {
+		selected[uid] = true
+	}
+	all, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
 		return
 	}
+	var images []models.Image
+	coverMoved := false
+	for _, image := range all {
+		if selected[image.UID] {
+			images = append(images, image)
+			coverMoved = coverMoved || image.ID == gallery.CoverImageID
+		}
+	}
+
+	verb := "moved"
+	if form.Copy {
+		verb = "copied"
+		_, err = g.is.Copy(images, dst.ID)
+	} else {
+		err = g.is.Move(images, dst.ID)
+	}
+	if err != nil {
+		vd.SetAlert(err)
+		g.renderEdit(w, r, gallery, vd)
+		return
+	}
+	if coverMoved && !form.Copy {
+		gallery.CoverImageID = 0
+		if err := g.gs.Update(gallery); err != nil {
+			log.Println(err)
+		}
+	}
+	alert := views.AlertSuccess(fmt.Sprintf("%d images %s to %s.", len(images), verb, dst.Title))
+	views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%v/edit", gallery.ID), http.StatusFound, alert)
+}
+
+// renderEdit renders the edit page of the gallery with vd. All of the
+// gallery's images are loaded so they can be reordered, as are the members
+// of the gallery for users who manage it and the other galleries the user
+// can move images to.
+func (g *Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, vd views.Data) {
+	vd.Yield = gallery
+	images, err := g.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	gallery.Images = images
+	if err := g.setAlbums(r, gallery); err != nil {
+		log.Println(err)
+	}
+	if gallery.Allows(models.ActionManage) {
+		members, err := g.gs.Members(gallery.ID)
+		if err != nil {
+			log.Println(err)
+		}
+		gallery.Members = members
+	}
+	user := context.User(r.Context())
+	owned, err := g.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	shared, err := g.gs.ByMemberID(user.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	gallery.OtherGalleries = nil
+	for _, other := range append(owned, shared...) {
+		if other.ID == gallery.ID {
+			continue
+		}
+		if ok, err := g.gs.Can(user, &other, models.ActionUpload); err != nil || !ok {
+			continue
+		}
+		gallery.OtherGalleries = append(gallery.OtherGalleries, other)
+	}
+	g.EditView.Render(w, r, vd)
+}
+
+// setAlbums loads the albums the gallery is in and the galleries in it,
+// leaving out those the visitor is not allowed to see.
+func (g *Galleries) setAlbums(r *http.Request, gallery *models.Gallery) error {
+	ancestors, err := g.gs.Ancestors(gallery)
+	if err != nil {
+		return err
+	}
+	children, err := g.gs.ByParentID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	gallery.Breadcrumbs = g.visible(r, ancestors)
+	gallery.Children = g.visible(r, children)
+	return nil
+}
+
+// visible returns the galleries the visitor is allowed to find through
+// links, which are their own, those shared with them and public ones.
+func (g *Galleries) visible(r *http.Request, galleries []models.Gallery) []models.Gallery {
+	user := context.User(r.Context())
+	var visible []models.Gallery
+	for _, gallery := range galleries {
+		role, err := g.gs.RoleOf(user, &gallery)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if role != "" || gallery.CanView(user) {
+			visible = append(visible, gallery)
+		}
+	}
+	return visible
+}
+
+func (g *Galleries) redirectToEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	url, err := g.r.Get(EditGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
 	if err != nil {
 		log.Println(err)
@@ -297,3 +993,24 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
+
+// imageByUID looks up the image addressed by the image route variable and
+// makes sure it belongs to the provided gallery.
+func (g *Galleries) imageByUID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	uid := mux.Vars(r)["image"]
+	image, err := g.is.ByUID(uid)
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return image, nil
+}
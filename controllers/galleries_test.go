@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+func TestGalleryAccess(t *testing.T) {
+	g := &Galleries{gs: newTestGalleries()}
+	owner := &models.User{Model: gorm.Model{ID: 1}}
+	other := &models.User{Model: gorm.Model{ID: 2}}
+	member := &models.User{Model: gorm.Model{ID: 3}}
+	link := models.ShareLink{Perms: models.SharePermView, Expires: time.Now().Add(time.Hour), Signature: "gallery"}
+
+	tests := []struct {
+		name      string
+		galleryID uint
+		user      *models.User
+		bySlug    bool
+		query     string
+		cookie    string
+		want      error
+		role      models.Role
+	}{
+		{"owner", 1, owner, false, "", "", nil, models.RoleOwner},
+		{"member", 1, member, false, "", "", nil, models.RoleViewer},
+		{"other user", 1, other, false, "", "", models.ErrNotFound, ""},
+		{"share link", 1, nil, false, link.Query().Encode(), "", nil, ""},
+		{"image share link", 1, nil, false, "expires=9999999999&perm=1&sig=image", "", models.ErrNotFound, ""},
+		{"unlisted by id", 2, nil, false, "", "", models.ErrNotFound, ""},
+		{"unlisted by slug", 2, nil, true, "", "", nil, ""},
+		{"public", 3, nil, false, "", "", nil, ""},
+		{"locked", 5, nil, false, "", "", models.ErrGalleryLocked, ""},
+		{"unlocked", 5, nil, false, "", "unlocked", nil, ""},
+		{"locked owner", 5, owner, false, "", "", nil, models.RoleOwner},
+		{"locked share link", 5, nil, false, link.Query().Encode(), "", nil, ""},
+	}
+	for _, tt := range tests {
+		gallery, err := g.gs.ByID(tt.galleryID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/galleries?"+tt.query, nil)
+		r = r.WithContext(context.WithUser(r.Context(), tt.user))
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "gallery_unlock_5", Value: tt.cookie})
+		}
+		canView := gallery.CanView
+		if tt.bySlug {
+			canView = gallery.CanViewBySlug
+		}
+		if err := g.access(r, gallery, canView); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+		if gallery.Role != tt.role {
+			t.Errorf("%s: expected role %q. Received %q", tt.name, tt.role, gallery.Role)
+		}
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"net/url"
 
 	schema "github.com/gorilla/Schema"
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
 )
 
 // Declared globally due to metadata caching benefit.
@@ -34,3 +37,74 @@ func parseValues(values url.Values, dst interface{}) error {
 
 	return nil
 }
+
+// shareLink returns the share link in the request's query when it is valid
+// for the gallery, or for the image with imageUID if it is not empty.
+func shareLink(gs models.GalleryService, r *http.Request, gallery *models.Gallery, imageUID string) *models.ShareLink {
+	link := models.ParseShareLink(r.URL.Query(), gallery.ID, imageUID)
+	if link == nil {
+		return nil
+	}
+	if err := gs.VerifyShareLink(gallery, link); err != nil {
+		return nil
+	}
+	return link
+}
+
+// unlocked reports whether the visitor is able to view the gallery as far
+// as its password is concerned, i.e. the gallery has no password, is owned
+// by the visitor or has been unlocked by them.
+func unlocked(gs models.GalleryService, r *http.Request, gallery *models.Gallery) bool {
+	if !gallery.Locked(context.User(r.Context())) {
+		return true
+	}
+	token := cookies.GetGalleryUnlock(r, gallery.ID)
+	return gs.VerifyUnlock(gallery, token) == nil
+}
+
+// absoluteURL turns path into a URL on the host the request was made to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// pageURL returns the URL of the current page with its cursor query
+// parameter set to cursor, or removed for the first page. Other query
+// parameters, like the sort order and share links, are kept.
+func pageURL(r *http.Request, cursor string) string {
+	q := r.URL.Query()
+	q.Del("cursor")
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if len(q) == 0 {
+		return r.URL.Path
+	}
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// setCover loads the cover image of the gallery, falling back to its first
+// image if no cover has been chosen.
+func setCover(is models.ImageService, gallery *models.Gallery) error {
+	if gallery.CoverImageID > 0 {
+		image, err := is.ByID(gallery.CoverImageID)
+		if err == nil && image.GalleryID == gallery.ID {
+			gallery.Cover = image
+			return nil
+		}
+		if err != nil && err != models.ErrNotFound {
+			return err
+		}
+	}
+	images, err := is.ByGalleryID(gallery.ID)
+	if err != nil {
+		return err
+	}
+	if len(images) > 0 {
+		gallery.Cover = &images[0]
+	}
+	return nil
+}
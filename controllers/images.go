@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+// imageMaxAge is how long browsers may cache images for. Image URLs
+// change whenever the image does so this can be fairly long.
+const imageMaxAge = "86400"
+
+// NewImages is used to create a new Images controller.
+func NewImages(gs models.GalleryService, is models.ImageService) *Images {
+	return &Images{
+		gs: gs,
+		is: is,
+	}
+}
+
+// Images serves the stored image files.
+type Images struct {
+	gs models.GalleryService
+	is models.ImageService
+}
+
+// Show streams the image, or one of its derivatives, to users that are
+// allowed to view the gallery it belongs to. Conditional and range
+// requests are handled by http.ServeContent.
+//
+// GET /images/:image
+// GET /images/:image/:size
+func (i *Images) Show(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	image, err := i.is.ByUID(vars["image"])
+	var gallery *models.Gallery
+	if err == nil {
+		gallery, err = i.gs.ByID(image.GalleryID)
+	}
+	if err == nil {
+		err = i.access(r, gallery, image, vars["size"])
+	}
+	var rc io.ReadCloser
+	if err == nil {
+		rc, err = i.is.Open(image, vars["size"])
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image not found", http.StatusNotFound)
+		default:
+			log.Println(err)
+			http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer rc.Close()
+
+	// http.ServeContent needs to seek to serve range requests. Files
+	// from the local store can seek, other stores are read into memory.
+	content, ok := rc.(io.ReadSeeker)
+	if !ok {
+		b, err := ioutil.ReadAll(rc)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Opps! Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	cache := "private"
+	if gallery.Visibility == models.VisibilityPublic {
+		cache = "public"
+	}
+	header := w.Header()
+	header.Set("Cache-Control", cache+", max-age="+imageMaxAge)
+	header.Set("Content-Type", image.SizeContentType(vars["size"]))
+	header.Set("ETag", image.ETag(vars["size"]))
+	header.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", image.UpdatedAt, content)
+}
+
+// access returns ErrNotFound unless the visitor is a member of the gallery,
+// has a share link for the image or may view the gallery's images given
+// its visibility and password.
+func (i *Images) access(r *http.Request, gallery *models.Gallery, image *models.Image, size string) error {
+	user := context.User(r.Context())
+	if token := context.AccessToken(r.Context()); token != nil && !token.HasScope(models.ScopeGalleriesRead) {
+		// the token can't be used to view galleries
+		user = nil
+	}
+	ok, err := i.gs.Can(user, gallery, models.ActionView)
+	if err != nil || ok {
+		return err
+	}
+	if i.shared(r, gallery, image, size) {
+		return nil
+	}
+	if !gallery.CanViewImages(user) || !unlocked(i.gs, r, gallery) {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// shared reports whether the request carries a share link for the image
+// or its gallery that allows access to the requested size. Originals are
+// only served to links that allow downloads.
+func (i *Images) shared(r *http.Request, gallery *models.Gallery, image *models.Image, size string) bool {
+	link := shareLink(i.gs, r, gallery, image.UID)
+	if link == nil {
+		link = shareLink(i.gs, r, gallery, "")
+	}
+	if link == nil {
+		return false
+	}
+	if size == "" && image.HasSizes() {
+		return link.Perms.Has(models.SharePermDownload)
+	}
+	return link.Perms.Has(models.SharePermView)
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+)
+
+// testGalleries is a GalleryService holding a fixed set of galleries.
+type testGalleries struct {
+	models.GalleryService
+	galleries map[uint]*models.Gallery
+	// links maps the signatures of valid share links to the UID of the
+	// image they were created for, empty for links to a whole gallery.
+	links map[string]string
+	// roles maps user IDs to the role they have in every gallery
+	// they don't own.
+	roles map[uint]models.Role
+}
+
+func (tg *testGalleries) ByID(id uint) (*models.Gallery, error) {
+	gallery, ok := tg.galleries[id]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	g := *gallery
+	return &g, nil
+}
+
+func (tg *testGalleries) VerifyShareLink(gallery *models.Gallery, link *models.ShareLink) error {
+	uid, ok := tg.links[link.Signature]
+	if !ok || uid != link.ImageUID {
+		return models.ErrShareLinkInvalid
+	}
+	return nil
+}
+
+func (tg *testGalleries) RoleOf(user *models.User, gallery *models.Gallery) (models.Role, error) {
+	switch {
+	case user == nil:
+		return "", nil
+	case gallery.IsOwner(user):
+		return models.RoleOwner, nil
+	}
+	return tg.roles[user.ID], nil
+}
+
+func (tg *testGalleries) Can(user *models.User, gallery *models.Gallery, action models.Action) (bool, error) {
+	role, err := tg.RoleOf(user, gallery)
+	return role.Allows(action), err
+}
+
+// VerifyUnlock accepts the token "unlocked" for every gallery.
+func (tg *testGalleries) VerifyUnlock(gallery *models.Gallery, token string) error {
+	if token != "unlocked" {
+		return models.ErrGalleryLocked
+	}
+	return nil
+}
+
+// testImages is an ImageService serving a fixed set of images.
+type testImages struct {
+	models.ImageService
+	images map[string]*models.Image
+}
+
+func (ti *testImages) ByUID(uid string) (*models.Image, error) {
+	image, ok := ti.images[uid]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	return image, nil
+}
+
+func (ti *testImages) Open(i *models.Image, size string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("pixels")), nil
+}
+
+// newTestGalleries returns galleries owned by user 1, in which user 3
+// is a viewer: 1 is private, 2 unlisted, 3 public and 5 is public but
+// password protected. Share links signed "gallery" are valid for any
+// of them and links signed "image" for the image "private".
+func newTestGalleries() *testGalleries {
+	return &testGalleries{
+		galleries: map[uint]*models.Gallery{
+			1: {Model: gorm.Model{ID: 1}, UserID: 1, Visibility: models.VisibilityPrivate},
+			2: {Model: gorm.Model{ID: 2}, UserID: 1, Visibility: models.VisibilityUnlisted},
+			3: {Model: gorm.Model{ID: 3}, UserID: 1, Visibility: models.VisibilityPublic},
+			5: {Model: gorm.Model{ID: 5}, UserID: 1, Visibility: models.VisibilityPublic, PasswordHash: "hash"},
+		},
+		links: map[string]string{"gallery": "", "image": "private"},
+		roles: map[uint]models.Role{3: models.RoleViewer},
+	}
+}
+
+func newTestImages() *Images {
+	images := map[string]*models.Image{
+		"private":  {GalleryID: 1, UID: "private", ContentType: "image/png", Width: 10, Height: 10},
+		"other":    {GalleryID: 1, UID: "other", ContentType: "image/png", Width: 10, Height: 10},
+		"unlisted": {GalleryID: 2, UID: "unlisted", ContentType: "image/png"},
+		"public":   {GalleryID: 3, UID: "public", ContentType: "image/png"},
+		"orphaned": {GalleryID: 4, UID: "orphaned", ContentType: "image/png"},
+		"locked":   {GalleryID: 5, UID: "locked", ContentType: "image/png"},
+	}
+	return NewImages(newTestGalleries(), &testImages{images: images})
+}
+
+func TestImageShowAccess(t *testing.T) {
+	owner := &models.User{Model: gorm.Model{ID: 1}}
+	other := &models.User{Model: gorm.Model{ID: 2}}
+	member := &models.User{Model: gorm.Model{ID: 3}}
+	tests := []struct {
+		image string
+		user  *models.User
+		want  int
+	}{
+		{"private", owner, http.StatusOK},
+		{"private", other, http.StatusNotFound},
+		{"private", nil, http.StatusNotFound},
+		{"private", member, http.StatusOK},
+		{"unlisted", nil, http.StatusOK},
+		{"public", nil, http.StatusOK},
+		{"orphaned", owner, http.StatusNotFound},
+		{"missing", owner, http.StatusNotFound},
+		{"locked", owner, http.StatusOK},
+		{"locked", other, http.StatusNotFound},
+		{"locked", member, http.StatusOK},
+	}
+	ic := newTestImages()
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/images/"+tt.image, nil)
+		r = mux.SetURLVars(r, map[string]string{"image": tt.image})
+		r = r.WithContext(context.WithUser(r.Context(), tt.user))
+		w := httptest.NewRecorder()
+		ic.Show(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s image as %v: expected %d. Received %d", tt.image, tt.user, tt.want, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "pixels" {
+			t.Errorf("%s image: expected the image to be served. Received %q", tt.image, w.Body)
+		}
+	}
+}
+
+func TestImageShowUnlocked(t *testing.T) {
+	ic := newTestImages()
+	for token, want := range map[string]int{"unlocked": http.StatusOK, "forged": http.StatusNotFound} {
+		r := httptest.NewRequest("GET", "/images/locked", nil)
+		r = mux.SetURLVars(r, map[string]string{"image": "locked"})
+		r.AddCookie(&http.Cookie{Name: "gallery_unlock_5", Value: token})
+		w := httptest.NewRecorder()
+		ic.Show(w, r)
+		if w.Code != want {
+			t.Errorf("%s token: expected %d. Received %d", token, want, w.Code)
+		}
+	}
+}
+
+func TestImageShowAccessToken(t *testing.T) {
+	owner := &models.User{Model: gorm.Model{ID: 1}}
+	tests := []struct {
+		image  string
+		scopes []models.Scope
+		want   int
+	}{
+		{"private", []models.Scope{models.ScopeGalleriesRead}, http.StatusOK},
+		{"private", []models.Scope{models.ScopeImagesWrite}, http.StatusNotFound},
+		{"public", []models.Scope{models.ScopeImagesWrite}, http.StatusOK},
+	}
+	ic := newTestImages()
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/images/"+tt.image, nil)
+		r = mux.SetURLVars(r, map[string]string{"image": tt.image})
+		r = withToken(r, owner, tt.scopes...)
+		w := httptest.NewRecorder()
+		ic.Show(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s image with %v: expected %d. Received %d", tt.image, tt.scopes, tt.want, w.Code)
+		}
+	}
+}
+
+func TestImageShowCaching(t *testing.T) {
+	ic := newTestImages()
+	for image, want := range map[string]string{"public": "public", "unlisted": "private"} {
+		r := httptest.NewRequest("GET", "/images/"+image, nil)
+		r = mux.SetURLVars(r, map[string]string{"image": image})
+		w := httptest.NewRecorder()
+		ic.Show(w, r)
+		if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, want+",") {
+			t.Errorf("%s image: expected %s caching. Received %q", image, want, cc)
+		}
+	}
+}
+
+func TestImageShowShareLink(t *testing.T) {
+	view, download := models.SharePermView, models.SharePermView|models.SharePermDownload
+	tests := []struct {
+		name  string
+		image string
+		size  string
+		sig   string
+		perms models.SharePerm
+		want  int
+	}{
+		{"gallery link", "private", "large", "gallery", view, http.StatusOK},
+		{"gallery link original", "private", "", "gallery", view, http.StatusNotFound},
+		{"gallery download link original", "private", "", "gallery", download, http.StatusOK},
+		{"image link", "private", "large", "image", view, http.StatusOK},
+		{"image link for another image", "other", "large", "image", view, http.StatusNotFound},
+		{"invalid link", "private", "large", "forged", view, http.StatusNotFound},
+	}
+	ic := newTestImages()
+	for _, tt := range tests {
+		link := models.ShareLink{Perms: tt.perms, Expires: time.Now().Add(time.Hour), Signature: tt.sig}
+		r := httptest.NewRequest("GET", "/images/"+tt.image+"?"+link.Query().Encode(), nil)
+		r = mux.SetURLVars(r, map[string]string{"image": tt.image, "size": tt.size})
+		w := httptest.NewRecorder()
+		ic.Show(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: expected %d. Received %d", tt.name, tt.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"net/http"
+
+	"lenslocked.com/views"
+)
+
+type UnlockAccountForm struct {
+	Token string `schema:"token"`
+}
+
+// UnlockAccount asks the user to confirm unlocking their account with the
+// token in the link we emailed them when it was locked.
+//
+// GET /unlock
+func (u *Users) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form UnlockAccountForm
+	vd.Yield = &form
+
+	if err := ParseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+	}
+	u.UnlockView.Render(w, r, vd)
+}
+
+// CompleteUnlock unlocks the user's account so they can sign in again.
+//
+// POST /unlock
+func (u *Users) CompleteUnlock(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form UnlockAccountForm
+	vd.Yield = &form
+
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.UnlockView.Render(w, r, vd)
+		return
+	}
+	if _, err := u.us.UnlockAccount(form.Token); err != nil {
+		vd.SetAlert(err)
+		u.UnlockView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound,
+		views.AlertSuccess("Your account has been unlocked, you can sign in again."),
+	)
+}
@@ -0,0 +1,394 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+// NewOAuth is used to create a new OAuth controller.
+// This function will panic if the templates are not parsed
+// correctly so should only be used during initial setup.
+func NewOAuth(oas models.OAuthService) *OAuth {
+	return &OAuth{
+		AuthorizeView: views.NewView("bootstrap", "oauth/authorize"),
+		AppsView:      views.NewView("bootstrap", "oauth/apps"),
+		oas:           oas,
+	}
+}
+
+// OAuth lets third-party applications ask users for access to their
+// account, and lets users register their own applications.
+type OAuth struct {
+	AuthorizeView *views.View
+	AppsView      *views.View
+	oas           models.OAuthService
+}
+
+// AuthorizeForm holds the parameters of an authorization request. They are
+// sent by the client in the query and repeated by the consent screen.
+type AuthorizeForm struct {
+	ResponseType        string `schema:"response_type"`
+	ClientID            string `schema:"client_id"`
+	RedirectURI         string `schema:"redirect_uri"`
+	Scope               string `schema:"scope"`
+	State               string `schema:"state"`
+	CodeChallenge       string `schema:"code_challenge"`
+	CodeChallengeMethod string `schema:"code_challenge_method"`
+	// Approve is set when the user approves the request on the consent
+	// screen.
+	Approve bool `schema:"approve"`
+}
+
+// Consent is rendered by the AuthorizeView to ask the user to approve a
+// client's request.
+type Consent struct {
+	Form   AuthorizeForm
+	Client *models.OAuthClient
+	Scopes []models.Scope
+}
+
+// Authorize asks the user to approve a client's authorization request.
+//
+// GET /oauth/authorize
+func (o *OAuth) Authorize(w http.ResponseWriter, r *http.Request) {
+	var form AuthorizeForm
+	req, ok := o.request(w, r, &form, ParseURLParams)
+	if !ok {
+		return
+	}
+	var vd views.Data
+	vd.Yield = &Consent{
+		Form:   form,
+		Client: req.Client,
+		Scopes: req.Scopes,
+	}
+	o.AuthorizeView.Render(w, r, vd)
+}
+
+// Approve sends the user back to the client with an authorization code,
+// or with an error if they denied the request.
+//
+// POST /oauth/authorize
+func (o *OAuth) Approve(w http.ResponseWriter, r *http.Request) {
+	var form AuthorizeForm
+	req, ok := o.request(w, r, &form, ParseForm)
+	if !ok {
+		return
+	}
+	if !form.Approve {
+		o.redirect(w, r, req.Client, form.State, url.Values{
+			"error": {"access_denied"},
+		})
+		return
+	}
+	code, err := o.oas.Authorize(req)
+	if err != nil {
+		log.Println(err)
+		o.redirect(w, r, req.Client, form.State, url.Values{
+			"error": {"server_error"},
+		})
+		return
+	}
+	o.redirect(w, r, req.Client, form.State, url.Values{
+		"code": {code},
+	})
+}
+
+// request parses the authorization request in r into form and validates
+// it. Unless the request is valid a response is written and false is
+// returned. Users are only sent back to the client with an error once we
+// know the client and its redirect URI, anything else is shown to them.
+func (o *OAuth) request(w http.ResponseWriter, r *http.Request, form *AuthorizeForm, parse func(*http.Request, interface{}) error) (*models.OAuthRequest, bool) {
+	var vd views.Data
+	if err := parse(r, form); err != nil {
+		vd.SetAlert(err)
+		o.AuthorizeView.Render(w, r, vd)
+		return nil, false
+	}
+	client, err := o.oas.ByClientID(form.ClientID)
+	if err != nil {
+		if err == models.ErrNotFound {
+			vd.AlertError("The application asking for access to your account is not registered with us.")
+		} else {
+			vd.SetAlert(err)
+		}
+		o.AuthorizeView.Render(w, r, vd)
+		return nil, false
+	}
+	req := models.OAuthRequest{
+		Client:              client,
+		UserID:              context.User(r.Context()).ID,
+		RedirectURI:         form.RedirectURI,
+		Scopes:              models.ParseScopes(form.Scope),
+		CodeChallenge:       form.CodeChallenge,
+		CodeChallengeMethod: form.CodeChallengeMethod,
+	}
+	err = o.oas.ValidateRequest(&req)
+	switch {
+	case err == models.ErrRedirectURIMismatch:
+		vd.SetAlert(err)
+		o.AuthorizeView.Render(w, r, vd)
+		return nil, false
+	case form.ResponseType != "code":
+		o.redirect(w, r, client, form.State, url.Values{
+			"error": {"unsupported_response_type"},
+		})
+		return nil, false
+	case err == models.ErrScopeRequired || err == models.ErrScopeInvalid:
+		o.redirect(w, r, client, form.State, url.Values{
+			"error": {"invalid_scope"},
+		})
+		return nil, false
+	case err == models.ErrCodeChallengeInvalid:
+		o.redirect(w, r, client, form.State, url.Values{
+			"error":             {"invalid_request"},
+			"error_description": {err.(views.PublicError).Public()},
+		})
+		return nil, false
+	case err != nil:
+		log.Println(err)
+		o.redirect(w, r, client, form.State, url.Values{
+			"error": {"server_error"},
+		})
+		return nil, false
+	}
+	return &req, true
+}
+
+// redirect sends the user back to the client with params and state added
+// to the query of its redirect URI.
+func (o *OAuth) redirect(w http.ResponseWriter, r *http.Request, client *models.OAuthClient, state string, params url.Values) {
+	// redirect URIs are checked when clients are registered
+	u, _ := url.Parse(client.RedirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+type TokenForm struct {
+	GrantType    string `schema:"grant_type"`
+	Code         string `schema:"code"`
+	RedirectURI  string `schema:"redirect_uri"`
+	CodeVerifier string `schema:"code_verifier"`
+	RefreshToken string `schema:"refresh_token"`
+	Scope        string `schema:"scope"`
+	ClientID     string `schema:"client_id"`
+	ClientSecret string `schema:"client_secret"`
+}
+
+// tokenResponse is the body of a successful token response.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// Token exchanges an authorization code or a refresh token for an access
+// token. Clients that aren't public authenticate with HTTP basic auth or
+// the client_secret parameter.
+//
+// POST /oauth/token
+func (o *OAuth) Token(w http.ResponseWriter, r *http.Request) {
+	var form TokenForm
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+	if err := ParseForm(r, &form); err != nil {
+		o.tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientID, secret := form.ClientID, form.ClientSecret
+	if id, s, ok := r.BasicAuth(); ok {
+		clientID, secret = id, s
+	}
+	client, err := o.oas.AuthenticateClient(clientID, secret)
+	if err != nil {
+		if err != models.ErrClientInvalid {
+			log.Println(err)
+			o.tokenError(w, http.StatusInternalServerError, "server_error")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="lenslocked"`)
+		o.tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var tokens *models.OAuthTokens
+	switch form.GrantType {
+	case "authorization_code":
+		tokens, err = o.oas.Exchange(client, form.Code, form.RedirectURI, form.CodeVerifier)
+	case "refresh_token":
+		tokens, err = o.oas.Refresh(client, form.RefreshToken, models.ParseScopes(form.Scope))
+	default:
+		o.tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	switch err {
+	case nil:
+	case models.ErrGrantInvalid:
+		o.tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case models.ErrScopeInvalid:
+		o.tokenError(w, http.StatusBadRequest, "invalid_scope")
+		return
+	default:
+		log.Println(err)
+		o.tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	token := tokens.AccessToken
+	o.tokenRespond(w, http.StatusOK, tokenResponse{
+		AccessToken:  token.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(*token.ExpiresAt).Seconds()),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        token.Scopes,
+	})
+}
+
+// tokenError writes an error response of the token endpoint.
+func (o *OAuth) tokenError(w http.ResponseWriter, status int, code string) {
+	o.tokenRespond(w, status, map[string]string{"error": code})
+}
+
+func (o *OAuth) tokenRespond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println(err)
+	}
+}
+
+// AppList is rendered by the AppsView.
+type AppList struct {
+	// Clients are the applications the user registered.
+	Clients []models.OAuthClient
+	// Authorized are the applications the user granted access to their
+	// account.
+	Authorized []models.OAuthClient
+	// Created is the client that was just registered. Its secret is only
+	// shown this once.
+	Created *models.OAuthClient
+}
+
+type AppForm struct {
+	Name        string `schema:"name"`
+	RedirectURI string `schema:"redirect_uri"`
+	Public      bool   `schema:"public"`
+}
+
+// Apps lists the applications the user registered or authorized.
+//
+// GET /account/apps
+func (o *OAuth) Apps(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	o.renderApps(w, r, vd, nil)
+}
+
+// CreateApp registers an application.
+//
+// POST /account/apps
+func (o *OAuth) CreateApp(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AppForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	client := models.OAuthClient{
+		UserID:      context.User(r.Context()).ID,
+		Name:        form.Name,
+		RedirectURI: form.RedirectURI,
+		Public:      form.Public,
+	}
+	if err := o.oas.CreateClient(&client); err != nil {
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	msg := "Your application has been registered."
+	if !client.Public {
+		msg += " Copy its secret now, you won't be able to see it again."
+	}
+	alert := views.AlertSuccess(msg)
+	vd.Alert = &alert
+	o.renderApps(w, r, vd, &client)
+}
+
+// DeleteApp deletes one of the user's applications, revoking the access
+// every user granted it.
+//
+// POST /account/apps/:id/delete
+func (o *OAuth) DeleteApp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	err = o.oas.DeleteClient(context.User(r.Context()).ID, uint(id))
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/apps", http.StatusFound,
+		views.AlertSuccess("The application has been deleted."),
+	)
+}
+
+// RevokeApp removes an application's access to the user's account.
+//
+// POST /account/apps/:id/revoke
+func (o *OAuth) RevokeApp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Application not found", http.StatusNotFound)
+		return
+	}
+	err = o.oas.Revoke(context.User(r.Context()).ID, uint(id))
+	if err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		o.renderApps(w, r, vd, nil)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/apps", http.StatusFound,
+		views.AlertSuccess("The application can no longer access your account."),
+	)
+}
+
+// renderApps renders the user's applications with vd, showing the secret
+// of created if it is not nil.
+func (o *OAuth) renderApps(w http.ResponseWriter, r *http.Request, vd views.Data, created *models.OAuthClient) {
+	user := context.User(r.Context())
+	list := AppList{Created: created}
+	var err error
+	list.Clients, err = o.oas.ClientsByUserID(user.ID)
+	if err == nil {
+		list.Authorized, err = o.oas.AuthorizedClients(user.ID)
+	}
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	vd.Yield = &list
+	o.AppsView.Render(w, r, vd)
+}
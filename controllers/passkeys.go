@@ -0,0 +1,160 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+	"lenslocked.com/webauthn"
+)
+
+// PasskeyForm is submitted by assets/webauthn.js once the browser created
+// or used a passkey. Credential is the JSON encoded response of the
+// browser's authenticator.
+type PasskeyForm struct {
+	Name       string `schema:"name"`
+	Credential string `schema:"credential"`
+}
+
+// PasskeyList is rendered by the PasskeysView.
+type PasskeyList struct {
+	Credentials []models.WebAuthnCredential
+}
+
+// PasskeyLoginOptions starts signing in with a passkey, responding with
+// the options for navigator.credentials.get.
+//
+// POST /login/passkey/options
+func (u *Users) PasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	opts, err := u.was.BeginLogin()
+	passkeyOptions(w, opts, err)
+}
+
+// PasskeyLogin signs a user in with a passkey. Users with two-factor
+// authentication aren't asked for their code, the passkey already
+// verified them with a PIN or biometrics.
+//
+// POST /login/passkey
+func (u *Users) PasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PasskeyForm
+	vd.Yield = &LoginForm{}
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	var resp webauthn.AssertionResponse
+	if err := json.Unmarshal([]byte(form.Credential), &resp); err != nil {
+		vd.SetAlert(models.ErrPasskeyInvalid)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	user, err := u.was.FinishLogin(&resp)
+	if err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+		return
+	}
+	if err := u.completeLogin(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginView.Render(w, r, vd)
+	}
+}
+
+// Passkeys lists the user's passkeys and lets them register another.
+//
+// GET /account/passkeys
+func (u *Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderPasskeys(w, r, vd)
+}
+
+// PasskeyOptions starts registering a passkey, responding with the
+// options for navigator.credentials.create.
+//
+// POST /account/passkeys/options
+func (u *Users) PasskeyOptions(w http.ResponseWriter, r *http.Request) {
+	opts, err := u.was.BeginRegistration(context.User(r.Context()))
+	passkeyOptions(w, opts, err)
+}
+
+// CreatePasskey stores the passkey the user's browser just created.
+//
+// POST /account/passkeys
+func (u *Users) CreatePasskey(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PasskeyForm
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.renderPasskeys(w, r, vd)
+		return
+	}
+	var resp webauthn.AttestationResponse
+	if err := json.Unmarshal([]byte(form.Credential), &resp); err != nil {
+		vd.SetAlert(models.ErrPasskeyInvalid)
+		u.renderPasskeys(w, r, vd)
+		return
+	}
+	_, err := u.was.FinishRegistration(context.User(r.Context()), form.Name, &resp)
+	if err != nil {
+		vd.SetAlert(err)
+		u.renderPasskeys(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/passkeys", http.StatusFound,
+		views.AlertSuccess("Your passkey has been added. You can now sign in with it."),
+	)
+}
+
+// DeletePasskey removes one of the user's passkeys.
+//
+// POST /account/passkeys/:id/delete
+func (u *Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+	if err := u.was.DeleteCredential(context.User(r.Context()).ID, uint(id)); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderPasskeys(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/passkeys", http.StatusFound,
+		views.AlertSuccess("The passkey has been removed."),
+	)
+}
+
+// renderPasskeys renders the user's passkeys with vd.
+func (u *Users) renderPasskeys(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	var list PasskeyList
+	creds, err := u.was.CredentialsByUserID(context.User(r.Context()).ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	list.Credentials = creds
+	vd.Yield = &list
+	u.PasskeysView.Render(w, r, vd)
+}
+
+// passkeyOptions responds with the options the browser starts a WebAuthn
+// ceremony with.
+func passkeyOptions(w http.ResponseWriter, opts interface{}, err error) {
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(opts); err != nil {
+		log.Println(err)
+	}
+}
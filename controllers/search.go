@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+
+	"lenslocked.com/context"
+	"lenslocked.com/models"
+	"lenslocked.com/views"
+)
+
+const (
+	searchGalleriesPerPage = 6
+	searchImagesPerPage    = 24
+)
+
+// NewSearch is used to create a new Search controller.
+// This function will panic if the templates are not parsed
+// correctly so should only be used during initial setup.
+func NewSearch(gs models.GalleryService, is models.ImageService) *Search {
+	return &Search{
+		ResultsView: views.NewView("bootstrap", "search/results"),
+		gs:          gs,
+		is:          is,
+	}
+}
+
+type Search struct {
+	ResultsView *views.View
+	gs          models.GalleryService
+	is          models.ImageService
+}
+
+type SearchForm struct {
+	Query string `schema:"q"`
+	Page  int    `schema:"page"`
+}
+
+// SearchResults is a page of galleries and images matching a query.
+type SearchResults struct {
+	Query     string
+	Page      int
+	HasNext   bool
+	Galleries []models.Gallery
+	Images    []models.Image
+}
+
+// PrevPage returns the number of the previous page, or 0 on the first page.
+func (sr *SearchResults) PrevPage() int {
+	return sr.Page - 1
+}
+
+// NextPage returns the number of the next page, or 0 on the last page.
+func (sr *SearchResults) NextPage() int {
+	if !sr.HasNext {
+		return 0
+	}
+	return sr.Page + 1
+}
+
+// Search finds the galleries and images the visitor is allowed to see
+// that match the query.
+//
+// GET /search?q=beach+2023&page=2
+func (s *Search) Search(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form SearchForm
+	results := SearchResults{Page: 1}
+	vd.Yield = &results
+	if err := ParseURLParams(r, &form); err != nil {
+		vd.SetAlert(err)
+		s.ResultsView.Render(w, r, vd)
+		return
+	}
+	results.Query = form.Query
+	if form.Page > 1 {
+		results.Page = form.Page
+	}
+
+	var userID uint
+	if user := context.User(r.Context()); user != nil {
+		userID = user.ID
+	}
+	// fetch one more result than shown to tell if there is a next page
+	galleries, err := s.gs.Search(userID, form.Query,
+		searchGalleriesPerPage+1, (results.Page-1)*searchGalleriesPerPage)
+	if err != nil {
+		vd.SetAlert(err)
+		s.ResultsView.Render(w, r, vd)
+		return
+	}
+	images, err := s.is.Search(userID, form.Query,
+		searchImagesPerPage+1, (results.Page-1)*searchImagesPerPage)
+	if err != nil {
+		vd.SetAlert(err)
+		s.ResultsView.Render(w, r, vd)
+		return
+	}
+	if len(galleries) > searchGalleriesPerPage {
+		galleries = galleries[:searchGalleriesPerPage]
+		results.HasNext = true
+	}
+	if len(images) > searchImagesPerPage {
+		images = images[:searchImagesPerPage]
+		results.HasNext = true
+	}
+	for i := range galleries {
+		if err := setCover(s.is, &galleries[i]); err != nil {
+			log.Println(err)
+		}
+	}
+	results.Galleries = galleries
+	results.Images = images
+	s.ResultsView.Render(w, r, vd)
+}
@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"net/http"
+
+	"lenslocked.com/context"
+	"lenslocked.com/cookies"
+	"lenslocked.com/models"
+	"lenslocked.com/totp"
+	"lenslocked.com/views"
+)
+
+type TwoFactorForm struct {
+	Code     string `schema:"code"`
+	Password string `schema:"password"`
+}
+
+// TwoFactorPage is rendered by the TwoFactorView.
+type TwoFactorPage struct {
+	Enabled bool
+	// Secret and URI are set while the user sets up their authenticator
+	// app.
+	Secret string
+	URI    string
+	// RecoveryCodes are only shown once, right after two-factor
+	// authentication was enabled.
+	RecoveryCodes     []string
+	RecoveryCodesLeft int
+}
+
+// challenge asks the user, who entered their password, for their second
+// factor.
+func (u *Users) challenge(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	token, err := u.tfs.Challenge(user)
+	if err != nil {
+		return err
+	}
+	cookies.SetLoginChallenge(w, token)
+	http.Redirect(w, r, "/login/two-factor", http.StatusFound)
+	return nil
+}
+
+// challengeUser returns the user the login challenge cookie is for, or
+// sends them back to the login page if it expired.
+func (u *Users) challengeUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user, err := u.tfs.ChallengeUser(cookies.GetLoginChallenge(r))
+	if err != nil {
+		cookies.ClearLoginChallenge(w)
+		views.RedirectAlert(w, r, "/login", http.StatusFound, views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "Your login has expired, please enter your password again.",
+		})
+		return nil, false
+	}
+	return user, true
+}
+
+// LoginTwoFactorForm asks users that entered their password for their
+// second factor.
+//
+// GET /login/two-factor
+func (u *Users) LoginTwoFactorForm(w http.ResponseWriter, r *http.Request) {
+	if _, ok := u.challengeUser(w, r); !ok {
+		return
+	}
+	u.LoginTwoFactorView.Render(w, r, nil)
+}
+
+// LoginTwoFactor completes the login of a user with their second factor.
+//
+// POST /login/two-factor
+func (u *Users) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	user, ok := u.challengeUser(w, r)
+	if !ok {
+		return
+	}
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.LoginTwoFactorView.Render(w, r, vd)
+		return
+	}
+	if err := u.tfs.Verify(user, form.Code); err != nil {
+		vd.SetAlert(err)
+		if err == models.ErrAccountLocked {
+			// the challenge is no use until the account is unlocked
+			cookies.ClearLoginChallenge(w)
+			views.RedirectAlert(w, r, "/login", http.StatusFound, *vd.Alert)
+			return
+		}
+		u.LoginTwoFactorView.Render(w, r, vd)
+		return
+	}
+	cookies.ClearLoginChallenge(w)
+	if err := u.completeLogin(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.LoginTwoFactorView.Render(w, r, vd)
+	}
+}
+
+// TwoFactor shows whether two-factor authentication is enabled and lets
+// the user set it up or turn it off.
+//
+// GET /account/two-factor
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	page := TwoFactorPage{Enabled: user.TOTPEnabled}
+	if user.TOTPEnabled {
+		left, err := u.tfs.RecoveryCodesLeft(user)
+		if err != nil {
+			vd.SetAlert(err)
+		}
+		page.RecoveryCodesLeft = left
+	}
+	vd.Yield = &page
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// SetupTwoFactor generates a new secret for the user's authenticator app.
+//
+// POST /account/two-factor/setup
+func (u *Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	if err := u.tfs.Setup(user); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = &TwoFactorPage{Enabled: user.TOTPEnabled}
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	vd.Yield = setupPage(user)
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user
+// entered a code from their authenticator app, and shows their recovery
+// codes.
+//
+// POST /account/two-factor/enable
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	user := context.User(r.Context())
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		vd.Yield = setupPage(user)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	codes, err := u.tfs.Enable(user, form.Code)
+	if err != nil {
+		vd.SetAlert(err)
+		vd.Yield = setupPage(user)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	alert := views.AlertSuccess("Two-factor authentication is now enabled. Keep your recovery codes somewhere safe.")
+	vd.Alert = &alert
+	vd.Yield = &TwoFactorPage{
+		Enabled:           true,
+		RecoveryCodes:     codes,
+		RecoveryCodesLeft: len(codes),
+	}
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// DisableTwoFactor turns off two-factor authentication once the user
+// confirmed their password.
+//
+// POST /account/two-factor/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	user := context.User(r.Context())
+	vd.Yield = &TwoFactorPage{Enabled: user.TOTPEnabled}
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	if err := u.tfs.Disable(user, form.Password); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorView.Render(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/two-factor", http.StatusFound,
+		views.AlertSuccess("Two-factor authentication has been turned off."),
+	)
+}
+
+// setupPage shows the user the secret they are setting up, unless they
+// haven't got one.
+func setupPage(user *models.User) *TwoFactorPage {
+	page := TwoFactorPage{Enabled: user.TOTPEnabled}
+	if !user.TOTPEnabled && user.TOTPSecret != "" {
+		page.Secret = user.TOTPSecret
+		page.URI = totp.URI(models.TOTPIssuer, user.Email, user.TOTPSecret)
+	}
+	return &page
+}
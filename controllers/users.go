@@ -2,39 +2,61 @@ package controllers
 
 import (
 	"fmt"
+	"log"
 	"net/http"
-	"time"
+	"strconv"
 
+	"github.com/gorilla/mux"
 	"lenslocked.com/cookies"
 
 	"lenslocked.com/context"
 	"lenslocked.com/email"
+	"lenslocked.com/middleware"
 	"lenslocked.com/models"
-	"lenslocked.com/rand"
 	"lenslocked.com/views"
 )
 
 // NewUsers is used to create a new Users controller.
 // This function will panic if the templates are not parsed
 // correctly so should only be used during initial setup.
-func NewUsers(us models.UserService, mc email.MailClient) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, tfs models.TwoFactorService, was models.WebAuthnService, mc email.MailClient) *Users {
 	return &Users{
-		NewView:      views.NewView("bootstrap", "users/new"),
-		LoginView:    views.NewView("bootstrap", "users/login"),
-		ForgotPwView: views.NewView("bootstrap", "users/forgot_pw"),
-		ResetPwView:  views.NewView("bootstrap", "users/reset_pw"),
-		us:           us,
-		emailer:      mc,
+		NewView:            views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		ForgotPwView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:        views.NewView("bootstrap", "users/reset_pw"),
+		AccountView:        views.NewView("bootstrap", "users/account"),
+		DevicesView:        views.NewView("bootstrap", "users/devices"),
+		LoginTwoFactorView: views.NewView("bootstrap", "users/login_two_factor"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		PasskeysView:       views.NewView("bootstrap", "users/passkeys"),
+		VerifyEmailView:    views.NewView("bootstrap", "users/verify_email"),
+		UnlockView:         views.NewView("bootstrap", "users/unlock"),
+		us:                 us,
+		ss:                 ss,
+		tfs:                tfs,
+		was:                was,
+		emailer:            mc,
 	}
 }
 
 type Users struct {
-	NewView      *views.View
-	LoginView    *views.View
-	ForgotPwView *views.View
-	ResetPwView  *views.View
-	us           models.UserService
-	emailer      email.MailClient
+	NewView            *views.View
+	LoginView          *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	AccountView        *views.View
+	DevicesView        *views.View
+	LoginTwoFactorView *views.View
+	TwoFactorView      *views.View
+	PasskeysView       *views.View
+	VerifyEmailView    *views.View
+	UnlockView         *views.View
+	us                 models.UserService
+	ss                 models.SessionService
+	tfs                models.TwoFactorService
+	was                models.WebAuthnService
+	emailer            email.MailClient
 }
 
 // New is used to render the signup form.
@@ -78,7 +100,7 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := u.signIn(w, &user)
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
@@ -86,10 +108,11 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 
 	// Send welcome email
 	// u.emailer.Welcome(user.Name, user.Email)
+	u.sendVerification(&user)
 
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
-		Message: "Welcome to LensLocked.com!",
+		Message: "Welcome to LensLocked.com! Please follow the link we emailed you to verify your address.",
 	}
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
@@ -126,12 +149,25 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.signIn(w, user)
+	if user.TOTPEnabled {
+		err = u.challenge(w, r, user)
+	} else {
+		err = u.completeLogin(w, r, user)
+	}
 	if err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
 		return
 	}
+}
+
+// completeLogin signs the user in and sends them to the page they were
+// trying to see when they had to log in.
+func (u *Users) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	err := u.signIn(w, r, user)
+	if err != nil {
+		return err
+	}
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
 		Message: fmt.Sprintf("Welcome back%s!", " "+user.Name),
@@ -144,26 +180,21 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 
 	views.RedirectAlert(w, r, url, http.StatusFound, alert)
 	//http.Redirect(w, r, "/galleries", http.StatusFound)
+	return nil
 }
 
-// Logout is used to delete a user's session cookie and update their remember token
-// to prevent stored cookies being valid.
+// Logout is used to delete a user's session cookie and the session it
+// refers to, signing them out of this device only.
 //
 // POST /logout
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    "",
-		Expires:  time.Now(),
-		HttpOnly: true,
-	}
-	http.SetCookie(w, &cookie)
+	cookies.ClearSession(w)
 
-	// Invalidate any stored remember_tokens
-	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.UpdateRememberHash(user)
+	if session := context.Session(r.Context()); session != nil {
+		if err := u.ss.Delete(session.UserID, session.ID); err != nil {
+			log.Println(err)
+		}
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
@@ -179,7 +210,6 @@ type resetPwForm struct {
 //
 // POST /forgot
 func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
-	// TODO: process frogot pw form and initiate process
 	var vd views.Data
 	var form resetPwForm
 
@@ -197,15 +227,13 @@ func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_ = token
-
-	// Send reset password email
-	// err = u.emailer.ResetPw(form.Email, token)
-	// if err != nil {
-	// 	vd.SetAlert(err)
-	// 	u.ForgotPwView.Render(w, r, vd)
-	// 	return
-	// }
+	err = u.emailer.ResetPw(form.Email, token)
+	if err != nil {
+		log.Println(err)
+		vd.AlertError("We couldn't send you an email, please try again.")
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
 
 	views.RedirectAlert(w, r, "/reset", http.StatusFound,
 		views.AlertSuccess("Instructions for resetting your password have been emailed to you."),
@@ -248,43 +276,156 @@ func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
 		u.ResetPwView.Render(w, r, vd)
 		return
 	}
-	u.signIn(w, user)
+	// whoever knew the old password is signed out everywhere
+	if err := u.ss.DeleteOthers(user.ID, 0); err != nil {
+		log.Println(err)
+	}
+	if user.TOTPEnabled {
+		// the reset link only replaces the password, not the second factor
+		if err := u.challenge(w, r, user); err != nil {
+			vd.SetAlert(err)
+			u.ResetPwView.Render(w, r, vd)
+		}
+		return
+	}
+	u.signIn(w, r, user)
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound,
 		views.AlertSuccess("Your password has been reset successfully!"),
 	)
 }
 
-// signIn sets the cookie for the user's session
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.UpdateRememberHash(user)
-		if err != nil {
-			return err
-		}
+type AccountForm struct {
+	ShowLocation bool `schema:"show_location"`
+}
+
+// Account displays the account settings of the current user.
+//
+// GET /account
+func (u *Users) Account(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = context.User(r.Context())
+	u.AccountView.Render(w, r, vd)
+}
+
+// UpdateAccount processes the account settings form.
+//
+// POST /account
+func (u *Users) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	user := context.User(r.Context())
+	vd.Yield = user
+
+	if err := ParseForm(r, &form); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
 	}
-	// need to set cookie before writing to ResponseWriter
-	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
-		HttpOnly: true, // prevents non-http access to cookie e.g. from client javascript
+	user.ShowLocation = form.ShowLocation
+	if err := u.us.Update(user); err != nil {
+		vd.SetAlert(err)
+		u.AccountView.Render(w, r, vd)
+		return
 	}
-	http.SetCookie(w, &cookie)
+	views.RedirectAlert(w, r, "/account", http.StatusFound,
+		views.AlertSuccess("Your settings have been saved."),
+	)
+}
+
+// signIn starts a session for the user on the device r was made from and
+// sets the cookie for it.
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        middleware.ClientIP(r),
+	}
+	if err := u.ss.Create(&session); err != nil {
+		return err
+	}
+	// need to set cookie before writing to ResponseWriter
+	cookies.SetSession(w, session.Token, session.ExpiresAt)
 	return nil
 }
 
-// CookieTest is used to display cookies set on the current user
-func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("remember_token")
+// DeviceList is rendered by the DevicesView.
+type DeviceList struct {
+	Sessions []models.Session
+	// CurrentID is the ID of the session the list is viewed with.
+	CurrentID uint
+}
+
+// Devices lists the devices the user is signed in on.
+//
+// GET /account/devices
+func (u *Users) Devices(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	u.renderDevices(w, r, vd)
+}
+
+// SignOutDevice ends one of the user's sessions.
+//
+// POST /account/devices/:id/delete
+func (u *Users) SignOutDevice(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	user := context.User(r.Context())
+	if err := u.ss.Delete(user.ID, uint(id)); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderDevices(w, r, vd)
 		return
 	}
-	user, err := u.us.ByRemember(cookie.Value)
+	if session := context.Session(r.Context()); session != nil && session.ID == uint(id) {
+		cookies.ClearSession(w)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/devices", http.StatusFound,
+		views.AlertSuccess("The device has been signed out."),
+	)
+}
+
+// SignOutOtherDevices ends every session of the user but the current one.
+//
+// POST /account/devices/others/delete
+func (u *Users) SignOutOtherDevices(w http.ResponseWriter, r *http.Request) {
+	var keepID uint
+	if session := context.Session(r.Context()); session != nil {
+		keepID = session.ID
+	}
+	if err := u.ss.DeleteOthers(context.User(r.Context()).ID, keepID); err != nil {
+		var vd views.Data
+		vd.SetAlert(err)
+		u.renderDevices(w, r, vd)
+		return
+	}
+	views.RedirectAlert(w, r, "/account/devices", http.StatusFound,
+		views.AlertSuccess("You have been signed out of every other device."),
+	)
+}
+
+// renderDevices renders the user's sessions with vd.
+func (u *Users) renderDevices(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	var list DeviceList
+	if session := context.Session(r.Context()); session != nil {
+		list.CurrentID = session.ID
+	}
+	sessions, err := u.ss.ByUserID(context.User(r.Context()).ID)
+	if err != nil && vd.Alert == nil {
+		vd.SetAlert(err)
+	}
+	list.Sessions = sessions
+	vd.Yield = &list
+	u.DevicesView.Render(w, r, vd)
+}
+
+// CookieTest is used to display cookies set on the current user
+func (u *Users) CookieTest(w http.ResponseWriter, r *http.Request) {
+	user, _, err := u.ss.Authenticate(cookies.GetSession(r), middleware.ClientIP(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
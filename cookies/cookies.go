@@ -1,6 +1,7 @@
 package cookies
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 )
@@ -10,6 +11,7 @@ func SetRedirect(w http.ResponseWriter, originalURL string) {
 	redirect := http.Cookie{
 		Name:     "redirect",
 		Value:    originalURL,
+		Path:     "/",
 		Expires:  expiresAt,
 		HttpOnly: true,
 	}
@@ -21,6 +23,7 @@ func ClearRedirect(w http.ResponseWriter) {
 	redirect := http.Cookie{
 		Name:     "redirect",
 		Value:    "",
+		Path:     "/",
 		Expires:  expiresAt,
 		HttpOnly: true,
 	}
@@ -34,3 +37,100 @@ func GetRedirect(r *http.Request) string {
 	}
 	return redirect.Value
 }
+
+// galleryUnlockName returns the name of the cookie holding the unlock
+// token of a gallery. Each gallery has its own cookie so that unlocking
+// one gallery does not affect any other.
+func galleryUnlockName(galleryID uint) string {
+	return fmt.Sprintf("gallery_unlock_%v", galleryID)
+}
+
+func SetGalleryUnlock(w http.ResponseWriter, galleryID uint, token string, expiresAt time.Time) {
+	unlock := http.Cookie{
+		Name:     galleryUnlockName(galleryID),
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &unlock)
+}
+
+func GetGalleryUnlock(r *http.Request, galleryID uint) string {
+	unlock, err := r.Cookie(galleryUnlockName(galleryID))
+	if err != nil {
+		return ""
+	}
+	return unlock.Value
+}
+
+// sessionName is the name of the cookie holding the token of the user's
+// session.
+const sessionName = "session"
+
+func SetSession(w http.ResponseWriter, token string, expiresAt time.Time) {
+	session := http.Cookie{
+		Name:     sessionName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true, // prevents non-http access to cookie e.g. from client javascript
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &session)
+}
+
+func ClearSession(w http.ResponseWriter) {
+	session := http.Cookie{
+		Name:     sessionName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &session)
+}
+
+func GetSession(r *http.Request) string {
+	session, err := r.Cookie(sessionName)
+	if err != nil {
+		return ""
+	}
+	return session.Value
+}
+
+// loginChallengeName is the name of the cookie identifying a user that
+// still needs to enter their second factor to sign in.
+const loginChallengeName = "login_challenge"
+
+func SetLoginChallenge(w http.ResponseWriter, token string) {
+	challenge := http.Cookie{
+		Name:     loginChallengeName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(10 * time.Minute),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &challenge)
+}
+
+func ClearLoginChallenge(w http.ResponseWriter) {
+	challenge := http.Cookie{
+		Name:     loginChallengeName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &challenge)
+}
+
+func GetLoginChallenge(r *http.Request) string {
+	challenge, err := r.Cookie(loginChallengeName)
+	if err != nil {
+		return ""
+	}
+	return challenge.Value
+}
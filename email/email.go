@@ -2,6 +2,7 @@ package email
 
 import (
 	"fmt"
+	"html"
 	"net/url"
 
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
@@ -10,6 +11,8 @@ import (
 const (
 	siteURL      = "https://wwww.lenslocked.com"
 	resetBaseURL = siteURL + "/reset"
+	verifyURL    = siteURL + "/verify"
+	unlockURL    = siteURL + "/unlock"
 
 	welcomeTextBody = `Hi %s!
 	
@@ -24,6 +27,9 @@ const (
 
 	welcomeSubject = "Welcome to Lenslocked.com!"
 	resetSubject   = "Reset password instructions"
+	inviteSubject  = "%s shared a gallery with you"
+	verifySubject  = "Please verify your email address"
+	lockedSubject  = "Your account has been locked"
 
 	resetTextTmpl = `Hi there!
 
@@ -56,6 +62,82 @@ link below to update your password:</p>
 <p>If you did not request a password reset you can safely ignore this email,<br>
 your account will not change.</p>
 
+<p>Best,<br>
+LensLocked Support</p>
+`
+
+	verifyTextTmpl = `Hi %s!
+
+Please follow the link below to verify that this is your email address:
+
+%s
+
+The link is valid for 48 hours. If you did not sign up or change your email address
+on LensLocked you can safely ignore this email.
+
+Best,
+LensLocked Support
+`
+
+	verifyHTMLTmpl = `<p>Hi %s!</p>
+
+<p>Please follow the link below to verify that this is your email address:</p>
+
+<a href="%s">%s</a><br>
+
+<p>The link is valid for 48 hours. If you did not sign up or change your email address<br>
+on LensLocked you can safely ignore this email.</p>
+
+<p>Best,<br>
+LensLocked Support</p>
+`
+
+	lockedTextTmpl = `Hi %s!
+
+Someone tried to sign in to your LensLocked account with the wrong password too many
+times, so we have locked it for 30 minutes. If this was you, you can unlock it now by
+following the link below:
+
+%s
+
+If it wasn't you, your account is safe, but we recommend choosing a new password that
+you don't use anywhere else.
+
+Best,
+LensLocked Support
+`
+
+	lockedHTMLTmpl = `<p>Hi %s!</p>
+
+<p>Someone tried to sign in to your LensLocked account with the wrong password too many<br>
+times, so we have locked it for 30 minutes. If this was you, you can unlock it now by<br>
+following the link below:</p>
+
+<a href="%s">%s</a><br>
+
+<p>If it wasn't you, your account is safe, but we recommend choosing a new password that<br>
+you don't use anywhere else.</p>
+
+<p>Best,<br>
+LensLocked Support</p>
+`
+
+	inviteTextTmpl = `Hi %s!
+
+%s has shared the gallery "%s" with you as %s. You can view it here:
+
+%s
+
+Best,
+LensLocked Support
+`
+
+	inviteHTMLTmpl = `<p>Hi %s!</p>
+
+<p>%s has shared the gallery "%s" with you as %s. You can view it here:</p>
+
+<a href="%s">%s</a><br>
+
 <p>Best,<br>
 LensLocked Support</p>
 `
@@ -65,6 +147,15 @@ type MailClient interface {
 	Send(name, toAddress, subject, textBody, htmlBody string) error
 	Welcome(name, toAddress string) error
 	ResetPw(toAddress, token string) error
+	// VerifyEmail sends the link users verify toAddress with, which is
+	// either the address they signed up with or their new one.
+	VerifyEmail(name, toAddress, token string) error
+	// AccountLocked lets a user know their account was locked after too
+	// many failed logins, with the link to unlock it.
+	AccountLocked(name, toAddress, token string) error
+	// GalleryInvite lets a user know that they have been made a member of
+	// a gallery. path is the path of the gallery on our site.
+	GalleryInvite(name, toAddress, inviterName, galleryTitle, role, path string) error
 }
 
 type Client struct {
@@ -124,6 +215,43 @@ func (mc *Client) ResetPw(toAddress, token string) error {
 	return err
 }
 
+func (mc *Client) VerifyEmail(name, toAddress, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	link := verifyURL + "?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, name, link)
+	verifyHTML := fmt.Sprintf(verifyHTMLTmpl, html.EscapeString(name), link, link)
+	msg := mc.mg.NewMessage(mc.from, verifySubject, verifyText, buildEmailField(name, toAddress))
+	msg.SetHtml(verifyHTML)
+	_, _, err := mc.mg.Send(msg)
+	return err
+}
+
+func (mc *Client) AccountLocked(name, toAddress, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	link := unlockURL + "?" + v.Encode()
+	lockedText := fmt.Sprintf(lockedTextTmpl, name, link)
+	lockedHTML := fmt.Sprintf(lockedHTMLTmpl, html.EscapeString(name), link, link)
+	msg := mc.mg.NewMessage(mc.from, lockedSubject, lockedText, buildEmailField(name, toAddress))
+	msg.SetHtml(lockedHTML)
+	_, _, err := mc.mg.Send(msg)
+	return err
+}
+
+func (mc *Client) GalleryInvite(name, toAddress, inviterName, galleryTitle, role, path string) error {
+	galleryURL := siteURL + path
+	subject := fmt.Sprintf(inviteSubject, inviterName)
+	inviteText := fmt.Sprintf(inviteTextTmpl, name, inviterName, galleryTitle, role, galleryURL)
+	inviteHTML := fmt.Sprintf(inviteHTMLTmpl,
+		html.EscapeString(name), html.EscapeString(inviterName), html.EscapeString(galleryTitle),
+		role, galleryURL, galleryURL)
+	msg := mc.mg.NewMessage(mc.from, subject, inviteText, buildEmailField(name, toAddress))
+	msg.SetHtml(inviteHTML)
+	_, _, err := mc.mg.Send(msg)
+	return err
+}
+
 func buildEmailField(name, email string) string {
 	if name == "" {
 		return email
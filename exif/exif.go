@@ -0,0 +1,569 @@
+// Package exif reads the EXIF metadata embedded in JPEG, PNG and WebP
+// images, removes location data from it and resets the orientation.
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoExif is returned when an image does not contain EXIF metadata.
+	ErrNoExif = errors.New("exif: no exif data found")
+
+	// ErrInvalid is returned when the EXIF metadata can not be parsed.
+	ErrInvalid = errors.New("exif: invalid exif data")
+)
+
+// Tags we read from the IFDs.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829a
+	tagFNumber          = 0x829d
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920a
+	tagLensModel        = 0xa434
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// typeSizes maps TIFF field types to the size in bytes of a single value.
+var typeSizes = map[uint16]uint32{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+	13: 4, // IFD
+}
+
+// Data is the metadata we extract from an image.
+type Data struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	// TakenAt is the zero time if the capture date is unknown.
+	TakenAt time.Time
+	// Orientation is the EXIF orientation from 1 to 8, or 0 if unset.
+	Orientation int
+
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+}
+
+// Decode extracts the EXIF metadata from a JPEG, PNG or WebP image.
+func Decode(img []byte) (*Data, error) {
+	loc, err := locate(img)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTIFF(img[loc.start:loc.end])
+	if err != nil {
+		return nil, err
+	}
+	return t.data()
+}
+
+// StripLocation returns a copy of img with the GPS data removed from its
+// EXIF metadata and any XMP packets, which can repeat the location, removed.
+// The rest of the EXIF metadata is left intact. Images without either are
+// returned unchanged.
+func StripLocation(img []byte) ([]byte, error) {
+	img, err := stripXMP(img)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := locate(img)
+	if err == ErrNoExif {
+		return img, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(img))
+	copy(out, img)
+	t, err := newTIFF(out[loc.start:loc.end])
+	if err != nil {
+		return nil, err
+	}
+	if err := t.removeGPS(); err != nil {
+		return nil, err
+	}
+	loc.fixup(out)
+	return out, nil
+}
+
+// SetOrientation returns a copy of img with the EXIF Orientation tag set to
+// o. Images without EXIF metadata or an Orientation tag are returned unchanged.
+func SetOrientation(img []byte, o int) ([]byte, error) {
+	loc, err := locate(img)
+	if err == ErrNoExif {
+		return img, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(img))
+	copy(out, img)
+	t, err := newTIFF(out[loc.start:loc.end])
+	if err != nil {
+		return nil, err
+	}
+	entries, err := t.ifd(t.ifd0)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.tag == tagOrientation && e.typ == 3 {
+			t.order.PutUint16(t.b[e.pos+8:], uint16(o))
+		}
+	}
+	loc.fixup(out)
+	return out, nil
+}
+
+// ExtractJPEG returns the APP1 segment holding the EXIF metadata of a JPEG,
+// including its marker and length, so it can be copied into a re-encoded image.
+func ExtractJPEG(img []byte) ([]byte, error) {
+	if !bytes.HasPrefix(img, []byte{0xff, 0xd8}) {
+		return nil, ErrNoExif
+	}
+	loc, err := locateJPEG(img)
+	if err != nil {
+		return nil, err
+	}
+	// the segment starts with the 2 byte marker, 2 byte length
+	// and the 6 byte "Exif\0\0" header.
+	return img[loc.start-10 : loc.end], nil
+}
+
+// InsertJPEG returns a copy of the JPEG img with the APP1 segment seg,
+// as returned by ExtractJPEG, inserted after the start of image marker.
+func InsertJPEG(img, seg []byte) ([]byte, error) {
+	if len(img) < 2 || img[0] != 0xff || img[1] != 0xd8 {
+		return nil, ErrInvalid
+	}
+	out := make([]byte, 0, len(img)+len(seg))
+	out = append(out, img[:2]...)
+	out = append(out, seg...)
+	return append(out, img[2:]...), nil
+}
+
+// location records where the TIFF structure holding the EXIF data
+// is within an image, and how to fix up checksums after changing it.
+type location struct {
+	start, end int
+	// crc is the offset of the PNG chunk type preceding the data,
+	// or -1 if there is no checksum to update.
+	crc int
+}
+
+func (l location) fixup(img []byte) {
+	if l.crc < 0 {
+		return
+	}
+	sum := crc32.ChecksumIEEE(img[l.crc:l.end])
+	binary.BigEndian.PutUint32(img[l.end:], sum)
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+func locate(img []byte) (location, error) {
+	switch {
+	case bytes.HasPrefix(img, []byte{0xff, 0xd8}):
+		return locateJPEG(img)
+	case bytes.HasPrefix(img, []byte("\x89PNG\r\n\x1a\n")):
+		return locatePNG(img)
+	case len(img) >= 12 && string(img[:4]) == "RIFF" && string(img[8:12]) == "WEBP":
+		return locateWebP(img)
+	}
+	return location{}, ErrNoExif
+}
+
+func locateJPEG(img []byte) (location, error) {
+	i := 2
+	for i+4 <= len(img) {
+		if img[i] != 0xff {
+			return location{}, ErrInvalid
+		}
+		marker := img[i+1]
+		switch {
+		case marker == 0xff:
+			// fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// markers without a length
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// start of scan or end of image, metadata comes before these
+			return location{}, ErrNoExif
+		}
+		length := int(binary.BigEndian.Uint16(img[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(img) {
+			return location{}, ErrInvalid
+		}
+		seg := img[i+4 : end]
+		if marker == 0xe1 && bytes.HasPrefix(seg, exifHeader) {
+			return location{start: i + 4 + len(exifHeader), end: end, crc: -1}, nil
+		}
+		i = end
+	}
+	return location{}, ErrNoExif
+}
+
+func locatePNG(img []byte) (location, error) {
+	i := 8
+	for i+12 <= len(img) {
+		length := int(binary.BigEndian.Uint32(img[i:]))
+		typ := string(img[i+4 : i+8])
+		end := i + 8 + length
+		if length < 0 || end+4 > len(img) {
+			return location{}, ErrInvalid
+		}
+		if typ == "eXIf" {
+			return location{start: i + 8, end: end, crc: i + 4}, nil
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		i = end + 4
+	}
+	return location{}, ErrNoExif
+}
+
+func locateWebP(img []byte) (location, error) {
+	i := 12
+	for i+8 <= len(img) {
+		length := int(binary.LittleEndian.Uint32(img[i+4:]))
+		end := i + 8 + length
+		if length < 0 || end > len(img) {
+			return location{}, ErrInvalid
+		}
+		if string(img[i:i+4]) == "EXIF" {
+			start := i + 8
+			// some encoders include the JPEG style header
+			if bytes.HasPrefix(img[start:end], exifHeader) {
+				start += len(exifHeader)
+			}
+			return location{start: start, end: end, crc: -1}, nil
+		}
+		// chunks are padded to an even size
+		i = end + length%2
+	}
+	return location{}, ErrNoExif
+}
+
+// tiff provides access to the IFDs of a TIFF structure.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+	ifd0  uint32
+}
+
+type entry struct {
+	// pos is the offset of the entry within the TIFF structure.
+	pos   uint32
+	tag   uint16
+	typ   uint16
+	count uint32
+}
+
+func newTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, ErrInvalid
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrInvalid
+	}
+	if t.order.Uint16(b[2:]) != 42 {
+		return nil, ErrInvalid
+	}
+	t.ifd0 = t.order.Uint32(b[4:])
+	return &t, nil
+}
+
+// ifd returns the entries of the IFD at offset.
+func (t *tiff) ifd(offset uint32) ([]entry, error) {
+	if uint64(offset)+2 > uint64(len(t.b)) {
+		return nil, ErrInvalid
+	}
+	n := uint32(t.order.Uint16(t.b[offset:]))
+	end := uint64(offset) + 2 + uint64(n)*12 + 4
+	if end > uint64(len(t.b)) {
+		return nil, ErrInvalid
+	}
+	entries := make([]entry, n)
+	for i := range entries {
+		pos := offset + 2 + uint32(i)*12
+		entries[i] = entry{
+			pos:   pos,
+			tag:   t.order.Uint16(t.b[pos:]),
+			typ:   t.order.Uint16(t.b[pos+2:]),
+			count: t.order.Uint32(t.b[pos+4:]),
+		}
+	}
+	return entries, nil
+}
+
+// value returns the raw bytes of an entry's value, which are
+// stored inline if they fit in 4 bytes and at an offset otherwise.
+func (t *tiff) value(e entry) ([]byte, error) {
+	size, ok := typeSizes[e.typ]
+	if !ok {
+		return nil, ErrInvalid
+	}
+	n := uint64(size) * uint64(e.count)
+	if n <= 4 {
+		return t.b[e.pos+8 : uint64(e.pos)+8+n], nil
+	}
+	offset := t.order.Uint32(t.b[e.pos+8:])
+	if uint64(offset)+n > uint64(len(t.b)) {
+		return nil, ErrInvalid
+	}
+	return t.b[offset : uint64(offset)+n], nil
+}
+
+func (t *tiff) string(e entry) string {
+	b, err := t.value(e)
+	if err != nil || e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+}
+
+func (t *tiff) uint(e entry) int {
+	b, err := t.value(e)
+	if err != nil || len(b) == 0 {
+		return 0
+	}
+	switch e.typ {
+	case 3:
+		return int(t.order.Uint16(b))
+	case 4:
+		return int(t.order.Uint32(b))
+	}
+	return 0
+}
+
+// rationals returns the numerators and denominators of a RATIONAL entry.
+func (t *tiff) rationals(e entry) ([][2]uint32, error) {
+	b, err := t.value(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.typ != 5 {
+		return nil, ErrInvalid
+	}
+	ret := make([][2]uint32, e.count)
+	for i := range ret {
+		ret[i] = [2]uint32{t.order.Uint32(b[i*8:]), t.order.Uint32(b[i*8+4:])}
+	}
+	return ret, nil
+}
+
+func (t *tiff) float(e entry) float64 {
+	r, err := t.rationals(e)
+	if err != nil || len(r) == 0 || r[0][1] == 0 {
+		return 0
+	}
+	return float64(r[0][0]) / float64(r[0][1])
+}
+
+func (t *tiff) data() (*Data, error) {
+	var d Data
+	ifd0, err := t.ifd(t.ifd0)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			d.Make = t.string(e)
+		case tagModel:
+			d.Model = t.string(e)
+		case tagOrientation:
+			d.Orientation = t.uint(e)
+		case tagExifIFD:
+			sub, err := t.ifd(t.order.Uint32(t.b[e.pos+8:]))
+			if err != nil {
+				return nil, err
+			}
+			t.exifData(&d, sub)
+		case tagGPSIFD:
+			sub, err := t.ifd(t.order.Uint32(t.b[e.pos+8:]))
+			if err != nil {
+				return nil, err
+			}
+			t.gpsData(&d, sub)
+		}
+	}
+	return &d, nil
+}
+
+func (t *tiff) exifData(d *Data, entries []entry) {
+	for _, e := range entries {
+		switch e.tag {
+		case tagExposureTime:
+			r, err := t.rationals(e)
+			if err == nil && len(r) > 0 {
+				d.ExposureTime = formatExposure(r[0][0], r[0][1])
+			}
+		case tagFNumber:
+			d.FNumber = t.float(e)
+		case tagISO:
+			d.ISO = t.uint(e)
+		case tagFocalLength:
+			d.FocalLength = t.float(e)
+		case tagLensModel:
+			d.LensModel = t.string(e)
+		case tagDateTimeOriginal:
+			taken, err := time.Parse("2006:01:02 15:04:05", t.string(e))
+			if err == nil {
+				d.TakenAt = taken
+			}
+		}
+	}
+}
+
+func (t *tiff) gpsData(d *Data, entries []entry) {
+	var latRef, lonRef string
+	var lat, lon float64
+	var haveLat, haveLon bool
+	for _, e := range entries {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.string(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.string(e)
+		case tagGPSLatitude:
+			lat, haveLat = t.degrees(e)
+		case tagGPSLongitude:
+			lon, haveLon = t.degrees(e)
+		}
+	}
+	if !haveLat || !haveLon {
+		return
+	}
+	if latRef == "S" {
+		lat = -lat
+	}
+	if lonRef == "W" {
+		lon = -lon
+	}
+	d.HasLocation = true
+	d.Latitude = lat
+	d.Longitude = lon
+}
+
+// degrees converts a degrees, minutes, seconds triple to decimal degrees.
+func (t *tiff) degrees(e entry) (float64, bool) {
+	r, err := t.rationals(e)
+	if err != nil || len(r) != 3 {
+		return 0, false
+	}
+	var ret float64
+	for i, div := range []float64{1, 60, 3600} {
+		if r[i][1] == 0 {
+			return 0, false
+		}
+		ret += float64(r[i][0]) / float64(r[i][1]) / div
+	}
+	return ret, true
+}
+
+// removeGPS zeroes the GPS IFD along with any values it points to and
+// removes the pointer to it from IFD0. Everything is changed in place so the
+// size of the TIFF structure, and all other offsets within it, stay the same.
+func (t *tiff) removeGPS() error {
+	entries, err := t.ifd(t.ifd0)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.tag != tagGPSIFD {
+			continue
+		}
+		offset := t.order.Uint32(t.b[e.pos+8:])
+		gps, err := t.ifd(offset)
+		if err != nil {
+			return err
+		}
+		for _, g := range gps {
+			// we can't tell where the value of a type we don't know is
+			// stored. The entry itself is zeroed with the IFD below.
+			if _, ok := typeSizes[g.typ]; !ok {
+				continue
+			}
+			b, err := t.value(g)
+			if err != nil {
+				return err
+			}
+			zero(b)
+		}
+		zero(t.b[offset : offset+2+uint32(len(gps))*12+4])
+
+		// shift the remaining entries and the next IFD offset over the
+		// GPS pointer and zero the now unused space at the end.
+		n := uint32(len(entries))
+		end := t.ifd0 + 2 + n*12 + 4
+		copy(t.b[e.pos:end], t.b[e.pos+12:end])
+		zero(t.b[end-12 : end])
+		t.order.PutUint16(t.b[t.ifd0:], uint16(n-1))
+		return nil
+	}
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// formatExposure formats an exposure time the way photographers
+// expect to read it, e.g. "1/250" or "2.5".
+func formatExposure(num, den uint32) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	if num < den {
+		if den%num == 0 {
+			return fmt.Sprintf("1/%d", den/num)
+		}
+		return fmt.Sprintf("%d/%d", num, den)
+	}
+	return fmt.Sprintf("%g", float64(num)/float64(den))
+}
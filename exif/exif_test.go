@@ -0,0 +1,289 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+	"time"
+)
+
+// testTIFF builds a little endian TIFF structure with an IFD0 holding
+// Make, Orientation and pointers to an Exif IFD and a GPS IFD.
+func testTIFF() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 400)
+	copy(b, "II")
+	le.PutUint16(b[2:], 42)
+	le.PutUint32(b[4:], 8)
+
+	putEntry := func(pos int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(b[pos:], tag)
+		le.PutUint16(b[pos+2:], typ)
+		le.PutUint32(b[pos+4:], count)
+		le.PutUint32(b[pos+8:], value)
+	}
+	putRational := func(pos int, num, den uint32) {
+		le.PutUint32(b[pos:], num)
+		le.PutUint32(b[pos+4:], den)
+	}
+
+	// IFD0 at 8 with 4 entries, ends at 8+2+48+4 = 62
+	le.PutUint16(b[8:], 4)
+	putEntry(10, tagMake, 2, 6, 200)
+	putEntry(22, tagOrientation, 3, 1, 6)
+	putEntry(34, tagGPSIFD, 4, 1, 120)
+	putEntry(46, tagExifIFD, 4, 1, 64)
+	copy(b[200:], "Canon\x00")
+
+	// Exif IFD at 64 with 3 entries, ends at 64+2+36+4 = 106
+	le.PutUint16(b[64:], 3)
+	putEntry(66, tagExposureTime, 5, 1, 220)
+	putEntry(78, tagISO, 3, 1, 400)
+	putEntry(90, tagDateTimeOriginal, 2, 20, 240)
+	putRational(220, 1, 250)
+	copy(b[240:], "2019:04:30 12:34:56\x00")
+
+	// GPS IFD at 120 with 4 entries, ends at 120+2+48+4 = 174
+	le.PutUint16(b[120:], 4)
+	putEntry(122, tagGPSLatitudeRef, 2, 2, 'S')
+	putEntry(134, tagGPSLatitude, 5, 3, 280)
+	putEntry(146, tagGPSLongitudeRef, 2, 2, 'E')
+	putEntry(158, tagGPSLongitude, 5, 3, 320)
+	putRational(280, 33, 1)
+	putRational(288, 52, 1)
+	putRational(296, 12, 1)
+	putRational(320, 151, 1)
+	putRational(328, 12, 1)
+	putRational(336, 36, 1)
+	return b
+}
+
+func testJPEG(tiff []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+	binary.Write(&buf, binary.BigEndian, uint16(2+len(exifHeader)+len(tiff)))
+	buf.Write(exifHeader)
+	buf.Write(tiff)
+	buf.Write([]byte{0xff, 0xd9})
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	d, err := Decode(testJPEG(testTIFF()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Make != "Canon" {
+		t.Errorf("Expected Make Canon. Received %q", d.Make)
+	}
+	if d.Orientation != 6 {
+		t.Errorf("Expected Orientation 6. Received %d", d.Orientation)
+	}
+	if d.ExposureTime != "1/250" {
+		t.Errorf("Expected ExposureTime 1/250. Received %q", d.ExposureTime)
+	}
+	if d.ISO != 400 {
+		t.Errorf("Expected ISO 400. Received %d", d.ISO)
+	}
+	if !d.TakenAt.Equal(time.Date(2019, 4, 30, 12, 34, 56, 0, time.UTC)) {
+		t.Errorf("Unexpected TakenAt %s", d.TakenAt)
+	}
+	if !d.HasLocation {
+		t.Fatal("Expected location to be found")
+	}
+	if math.Abs(d.Latitude+33.87) > 0.001 || math.Abs(d.Longitude-151.21) > 0.001 {
+		t.Errorf("Unexpected location %f, %f", d.Latitude, d.Longitude)
+	}
+}
+
+func TestStripLocation(t *testing.T) {
+	img := testJPEG(testTIFF())
+	stripped, err := StripLocation(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripped) != len(img) {
+		t.Errorf("Expected image size to be unchanged")
+	}
+	d, err := Decode(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HasLocation {
+		t.Errorf("Expected location to be removed. Received %f, %f", d.Latitude, d.Longitude)
+	}
+	if d.Make != "Canon" || d.ISO != 400 {
+		t.Errorf("Expected other metadata to be kept. Received %+v", d)
+	}
+	// the coordinates must not be left anywhere in the file.
+	lat := make([]byte, 8)
+	binary.LittleEndian.PutUint32(lat, 33)
+	binary.LittleEndian.PutUint32(lat[4:], 1)
+	if bytes.Contains(stripped, lat) {
+		t.Errorf("Expected GPS values to be zeroed")
+	}
+}
+
+func TestStripLocationUnknownType(t *testing.T) {
+	// add a fifth GPS entry, of a type we don't know, in place
+	// of the GPS IFD's next IFD offset.
+	b := testTIFF()
+	binary.LittleEndian.PutUint16(b[120:], 5)
+	binary.LittleEndian.PutUint16(b[170:], 0x001e)
+	binary.LittleEndian.PutUint16(b[172:], 99)
+	binary.LittleEndian.PutUint32(b[174:], 1)
+	binary.LittleEndian.PutUint32(b[178:], 0xdeadbeef)
+
+	stripped, err := StripLocation(testJPEG(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HasLocation {
+		t.Errorf("Expected location to be removed. Received %f, %f", d.Latitude, d.Longitude)
+	}
+	if bytes.Contains(stripped, []byte{0xef, 0xbe, 0xad, 0xde}) {
+		t.Errorf("Expected the unknown GPS entry to be zeroed")
+	}
+}
+
+func TestNoExif(t *testing.T) {
+	img := []byte{0xff, 0xd8, 0xff, 0xd9}
+	if _, err := Decode(img); err != ErrNoExif {
+		t.Errorf("Expected ErrNoExif. Received %v", err)
+	}
+	out, err := StripLocation(img)
+	if err != nil || !bytes.Equal(out, img) {
+		t.Errorf("Expected image without exif to be returned unchanged")
+	}
+}
+
+func TestSetOrientation(t *testing.T) {
+	out, err := SetOrientation(testJPEG(testTIFF()), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Orientation != 1 {
+		t.Errorf("Expected Orientation 1. Received %d", d.Orientation)
+	}
+}
+
+// testXMP is an XMP packet repeating the location of testTIFF, as cameras
+// and photo editors write it.
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="33,52.2S" exif:GPSLongitude="151,12.6E"/>` +
+	`</rdf:RDF></x:xmpmeta>`
+
+func testXMPJPEG() []byte {
+	img := testJPEG(testTIFF())
+	var seg bytes.Buffer
+	for _, header := range [][]byte{xmpHeader, xmpExtHeader} {
+		seg.Write([]byte{0xff, 0xe1})
+		binary.Write(&seg, binary.BigEndian, uint16(2+len(header)+len(testXMP)))
+		seg.Write(header)
+		seg.WriteString(testXMP)
+	}
+	out := append([]byte{}, img[:2]...)
+	out = append(out, seg.Bytes()...)
+	return append(out, img[2:]...)
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	b := []byte(typ)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func testXMPWebP() []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = vp8xXMP | 0x08 // XMP and EXIF
+	var body []byte
+	body = append(body, "WEBP"...)
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("EXIF", testTIFF())...)
+	body = append(body, webpChunk("XMP ", []byte(testXMP+" "))...)
+	body = append(body, webpChunk("VP8L", []byte("pixels"))...)
+	out := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	sum := crc32.ChecksumIEEE(b[4:])
+	return append(b, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+func testXMPPNG() []byte {
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = append(out, pngChunk("IHDR", make([]byte, 13))...)
+	out = append(out, pngChunk("eXIf", testTIFF())...)
+	out = append(out, pngChunk("iTXt", append(append([]byte{}, xmpKeyword...), "\x00\x00\x00"+testXMP...))...)
+	out = append(out, pngChunk("IDAT", []byte("pixels"))...)
+	return append(out, pngChunk("IEND", nil)...)
+}
+
+func TestStripLocationXMP(t *testing.T) {
+	tests := []struct {
+		name string
+		img  []byte
+	}{
+		{"jpeg", testXMPJPEG()},
+		{"webp", testXMPWebP()},
+		{"png", testXMPPNG()},
+	}
+	for _, tt := range tests {
+		if !bytes.Contains(tt.img, []byte("GPSLatitude")) {
+			t.Fatalf("%s: fixture is missing its XMP", tt.name)
+		}
+		stripped, err := StripLocation(tt.img)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if bytes.Contains(stripped, []byte("GPSLatitude")) || bytes.Contains(stripped, []byte("xmpmeta")) {
+			t.Errorf("%s: Expected the XMP packet to be removed", tt.name)
+		}
+		if !bytes.Contains(stripped, []byte("pixels")) && tt.name != "jpeg" {
+			t.Errorf("%s: Expected the image data to be kept", tt.name)
+		}
+		d, err := Decode(stripped)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if d.HasLocation || d.Make != "Canon" {
+			t.Errorf("%s: Expected EXIF without location. Received %+v", tt.name, d)
+		}
+	}
+
+	webp, _ := StripLocation(testXMPWebP())
+	if size := binary.LittleEndian.Uint32(webp[4:]); int(size) != len(webp)-8 {
+		t.Errorf("Expected the RIFF size to be updated. Received %d for %d bytes", size, len(webp))
+	}
+	if flags := webp[20]; flags&vp8xXMP != 0 || flags&0x08 == 0 {
+		t.Errorf("Expected only the XMP flag to be cleared. Received %#x", flags)
+	}
+
+	png, _ := StripLocation(testXMPPNG())
+	for _, chunk := range []string{"IHDR", "eXIf", "IDAT", "IEND"} {
+		if !bytes.Contains(png, []byte(chunk)) {
+			t.Errorf("Expected the %s chunk to be kept", chunk)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var (
+	// xmpHeader starts the APP1 segment of a JPEG holding an XMP packet,
+	// xmpExtHeader the segments holding the rest of a packet that
+	// didn't fit.
+	xmpHeader    = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+
+	// xmpKeyword is the keyword of the PNG iTXt chunk holding XMP.
+	xmpKeyword = []byte("XML:com.adobe.xmp\x00")
+)
+
+// vp8xXMP is the flag of a WebP VP8X chunk saying the file has XMP.
+const vp8xXMP = 0x04
+
+// stripXMP returns img without its XMP packets. XMP duplicates much of the
+// EXIF metadata, including the location, so rather than editing it we drop
+// it. Images without XMP are returned as they are.
+func stripXMP(img []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(img, []byte{0xff, 0xd8}):
+		return stripXMPJPEG(img)
+	case bytes.HasPrefix(img, []byte("\x89PNG\r\n\x1a\n")):
+		return stripXMPPNG(img)
+	case len(img) >= 12 && string(img[:4]) == "RIFF" && string(img[8:12]) == "WEBP":
+		return stripXMPWebP(img)
+	}
+	return img, nil
+}
+
+func stripXMPJPEG(img []byte) ([]byte, error) {
+	out := make([]byte, 0, len(img))
+	out = append(out, img[:2]...)
+	i := 2
+	for i+4 <= len(img) {
+		if img[i] != 0xff {
+			return nil, ErrInvalid
+		}
+		marker := img[i+1]
+		switch {
+		case marker == 0xff:
+			out = append(out, img[i])
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			out = append(out, img[i:i+2]...)
+			i += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			// metadata comes before the image data
+			return append(out, img[i:]...), nil
+		}
+		length := int(binary.BigEndian.Uint16(img[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(img) {
+			return nil, ErrInvalid
+		}
+		seg := img[i+4 : end]
+		xmp := marker == 0xe1 && (bytes.HasPrefix(seg, xmpHeader) || bytes.HasPrefix(seg, xmpExtHeader))
+		if !xmp {
+			out = append(out, img[i:end]...)
+		}
+		i = end
+	}
+	return append(out, img[i:]...), nil
+}
+
+func stripXMPPNG(img []byte) ([]byte, error) {
+	out := make([]byte, 0, len(img))
+	out = append(out, img[:8]...)
+	i := 8
+	for i+12 <= len(img) {
+		length := int(binary.BigEndian.Uint32(img[i:]))
+		typ := string(img[i+4 : i+8])
+		end := i + 8 + length
+		if length < 0 || end+4 > len(img) {
+			return nil, ErrInvalid
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		if !(typ == "iTXt" && bytes.HasPrefix(img[i+8:end], xmpKeyword)) {
+			out = append(out, img[i:end+4]...)
+		}
+		i = end + 4
+	}
+	return append(out, img[i:]...), nil
+}
+
+func stripXMPWebP(img []byte) ([]byte, error) {
+	out := make([]byte, 0, len(img))
+	out = append(out, img[:12]...)
+	vp8x := -1
+	i := 12
+	for i+8 <= len(img) {
+		length := int(binary.LittleEndian.Uint32(img[i+4:]))
+		end := i + 8 + length
+		if length < 0 || end > len(img) {
+			return nil, ErrInvalid
+		}
+		// chunks are padded to an even size
+		next := end + length%2
+		if next > len(img) {
+			next = len(img)
+		}
+		switch string(img[i : i+4]) {
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(out)
+			out = append(out, img[i:next]...)
+		default:
+			out = append(out, img[i:next]...)
+		}
+		i = next
+	}
+	out = append(out, img[i:]...)
+	if vp8x >= 0 && vp8x+8 < len(out) {
+		out[vp8x+8] &^= vp8xXMP
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+	// register the WebP decoder with image.Decode
+	_ "golang.org/x/image/webp"
+)
+
+// ErrFormatUnsupported is returned when an image can not be
+// encoded in the requested format.
+var ErrFormatUnsupported = errors.New("imaging: unsupported image format")
+
+// Size is a named derivative size. Derivatives are scaled
+// to fit within a MaxDim x MaxDim box.
+type Size struct {
+	Name   string
+	MaxDim int
+}
+
+// Decode decodes an image and returns it along with the name
+// of its format, e.g. "jpeg", "png" or "gif". Importing this package
+// registers the JPEG, PNG, GIF and WebP decoders.
+func Decode(r io.Reader) (image.Image, string, error) {
+	return image.Decode(r)
+}
+
+// DecodeConfig returns the dimensions and format of an image
+// without decoding the whole image.
+func DecodeConfig(r io.Reader) (image.Config, string, error) {
+	return image.DecodeConfig(r)
+}
+
+// Fit returns the dimensions of a w x h image scaled down to fit within
+// a maxDim x maxDim box, preserving the aspect ratio. Images that already
+// fit are not scaled up.
+func Fit(w, h, maxDim int) (int, int) {
+	if w <= maxDim && h <= maxDim {
+		return w, h
+	}
+	if w >= h {
+		return maxDim, max(1, h*maxDim/w)
+	}
+	return max(1, w*maxDim/h), maxDim
+}
+
+// Resize scales img down to fit within a maxDim x maxDim box.
+func Resize(img image.Image, maxDim int) image.Image {
+	b := img.Bounds()
+	w, h := Fit(b.Dx(), b.Dy(), maxDim)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// DerivativeFormat returns the format derivatives of an image in the
+// given format are encoded in. Photos stay JPEG while everything else
+// is encoded as PNG to preserve transparency.
+func DerivativeFormat(format string) string {
+	if format == "jpeg" {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// Ext returns the file extension used for the given format.
+func Ext(format string) string {
+	switch format {
+	case "jpeg":
+		return ".jpg"
+	case "gif":
+		return ".gif"
+	case "webp":
+		return ".webp"
+	default:
+		return ".png"
+	}
+}
+
+// ContentType returns the MIME type of the given format.
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+// Encode writes img to w in the given format.
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return ErrFormatUnsupported
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,59 @@
+package imaging
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Orient returns img transformed so that it displays upright given
+// the EXIF orientation it was stored with. Orientations outside the
+// range 2 to 8 leave the image unchanged.
+func Orient(img image.Image, orientation int) image.Image {
+	src := toRGBA(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	switch orientation {
+	case 2: // flipped horizontally
+		return transform(src, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	case 3: // rotated 180°
+		return transform(src, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 4: // flipped vertically
+		return transform(src, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	case 5: // transposed
+		return transform(src, h, w, func(x, y int) (int, int) { return y, x })
+	case 6: // rotated 90° counter clockwise
+		return transform(src, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	case 7: // transversed
+		return transform(src, h, w, func(x, y int) (int, int) { return w - 1 - y, h - 1 - x })
+	case 8: // rotated 90° clockwise
+		return transform(src, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	}
+	return img
+}
+
+// Rotate90 returns img rotated 90° clockwise.
+func Rotate90(img image.Image) image.Image {
+	// an image stored with orientation 6 needs a clockwise rotation to display.
+	return Orient(img, 6)
+}
+
+// transform returns a w x h image where each pixel is copied
+// from the src pixel at the position returned by fn.
+func transform(src *image.RGBA, w, h int, fn func(x, y int) (int, int)) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := fn(x, y)
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
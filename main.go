@@ -5,30 +5,50 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"lenslocked.com/controllers"
 	"lenslocked.com/email"
 	"lenslocked.com/middleware"
 	"lenslocked.com/models"
 	"lenslocked.com/rand"
+	"lenslocked.com/ratelimit"
 
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 )
 
+// imagesURL is the base URL of blobs in the local and memory stores.
+// Images themselves are served through the Images controller.
+const imagesURL = "/images/"
+
 // TODO: Add a 404 page
-// TODO: Change gallery ID to unique id to deter discover without an invite link
 func main() {
 	prodPtr := flag.Bool("prod", false, "Include this flag in production. This ensures use of .config for application settings and will panic instead of using dev defaults.")
 	flag.Parse()
 
 	cfg := LoadConfig(*prodPtr)
 	dbCfg := cfg.Database
+	store, err := cfg.Storage.BlobStore()
+	must(err)
+
+	mailCfg := cfg.Email
+	emailer := email.NewClient(
+		email.WithSender("Lenslocked.com Support", "support@lenslocked.com"),
+		email.WithMailgun(mailCfg.Domain, mailCfg.APIKey, mailCfg.PublicKey),
+	)
+
 	services, err := models.NewServices(
 		models.WithGorm(dbCfg.Dialect(), dbCfg.ConnectionInfo()),
-		models.WithUser(cfg.HMACKey, cfg.Pepper),
-		models.WithGallery(),
-		models.WithImage(),
+		models.WithRateLimits(cfg.RateLimit.Driver),
+		models.WithUser(cfg.HMACKey, cfg.Pepper, emailer),
+		models.WithSession(cfg.HMACKey),
+		models.WithTwoFactor(cfg.HMACKey),
+		models.WithWebAuthn(cfg.WebAuthn.RelyingParty()),
+		models.WithGallery(cfg.HMACKey, cfg.Pepper),
+		models.WithImage(store),
+		models.WithAccessToken(cfg.HMACKey),
+		models.WithOAuth(cfg.HMACKey),
 		models.WithLogMode(!cfg.IsProd()),
 	)
 	must(err)
@@ -36,27 +56,42 @@ func main() {
 	services.AutoMigrate()
 	// must(services.DestructiveReset())
 
-	mailCfg := cfg.Email
-	emailer := email.NewClient(
-		email.WithSender("Lenslocked.com Support", "support@lenslocked.com"),
-		email.WithMailgun(mailCfg.Domain, mailCfg.APIKey, mailCfg.PublicKey),
-	)
-
 	r := mux.NewRouter()
 	staticController := controllers.NewStatic()
-	usersController := controllers.NewUsers(services.User, emailer)
-	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, r)
+	usersController := controllers.NewUsers(services.User, services.Session, services.TwoFactor, services.WebAuthn, emailer)
+	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, services.User, emailer, r)
+	imagesController := controllers.NewImages(services.Gallery, services.Image)
+	searchController := controllers.NewSearch(services.Gallery, services.Image)
+	apiController := controllers.NewAPI(services.Gallery, services.Image, services.User, services.TwoFactor, services.AccessToken)
+	accessTokensController := controllers.NewAccessTokens(services.AccessToken)
+	oauthController := controllers.NewOAuth(services.OAuth)
 
 	bytes, err := rand.Bytes(32)
 	must(err)
 
 	csrfMw := csrf.Protect(bytes, csrf.Secure(cfg.IsProd()))
 	userMw := middleware.User{
-		UserService: services.User,
+		Sessions:     services.Session,
+		AccessTokens: services.AccessToken,
 	}
 	requireUserMw := middleware.RequireUser{
 		User: userMw,
 	}
+	requireAPIUserMw := middleware.RequireAPIUser{
+		User: userMw,
+	}
+	// accounts and galleries limit password guesses themselves, these
+	// stop a single address guessing across many of them or flooding
+	// inboxes
+	loginLimitMw := middleware.RateLimit{
+		Limiter: ratelimit.NewLimiter(services.RateLimits, "login-ip", 20, 15*time.Minute),
+	}
+	forgotLimitMw := middleware.RateLimit{
+		Limiter: ratelimit.NewLimiter(services.RateLimits, "forgot-ip", 5, time.Hour),
+	}
+	unlockLimitMw := middleware.RateLimit{
+		Limiter: ratelimit.NewLimiter(services.RateLimits, "gallery-unlock-ip", 20, 15*time.Minute),
+	}
 
 	// Static page routes
 	r.Handle("/", staticController.Home).Methods("GET")
@@ -64,14 +99,44 @@ func main() {
 
 	// User routes
 	r.Handle("/login", usersController.LoginView).Methods("GET")
-	r.HandleFunc("/login", usersController.Login).Methods("POST")
+	r.HandleFunc("/login", loginLimitMw.ApplyFN(usersController.Login)).Methods("POST")
+	r.HandleFunc("/login/two-factor", usersController.LoginTwoFactorForm).Methods("GET")
+	r.HandleFunc("/login/two-factor", loginLimitMw.ApplyFN(usersController.LoginTwoFactor)).Methods("POST")
+	r.HandleFunc("/login/passkey/options", usersController.PasskeyLoginOptions).Methods("POST")
+	r.HandleFunc("/login/passkey", usersController.PasskeyLogin).Methods("POST")
 	r.HandleFunc("/logout", requireUserMw.ApplyFN(usersController.Logout)).Methods("POST")
 	r.HandleFunc("/signup", usersController.New).Methods("GET")
 	r.HandleFunc("/signup", usersController.Create).Methods("POST")
 	r.Handle("/forgot", usersController.ForgotPwView).Methods("GET")
-	r.HandleFunc("/forgot", usersController.InitiateReset).Methods("POST")
+	r.HandleFunc("/forgot", forgotLimitMw.ApplyFN(usersController.InitiateReset)).Methods("POST")
 	r.HandleFunc("/reset", usersController.ResetPw).Methods("GET")
 	r.HandleFunc("/reset", usersController.CompleteReset).Methods("POST")
+	r.HandleFunc("/verify", usersController.VerifyEmail).Methods("GET")
+	r.HandleFunc("/verify", usersController.CompleteVerification).Methods("POST")
+	r.HandleFunc("/unlock", usersController.UnlockAccount).Methods("GET")
+	r.HandleFunc("/unlock", usersController.CompleteUnlock).Methods("POST")
+	r.HandleFunc("/account", requireUserMw.ApplyFN(usersController.Account)).Methods("GET")
+	r.HandleFunc("/account", requireUserMw.ApplyFN(usersController.UpdateAccount)).Methods("POST")
+	r.HandleFunc("/account/devices", requireUserMw.ApplyFN(usersController.Devices)).Methods("GET")
+	r.HandleFunc("/account/devices/others/delete", requireUserMw.ApplyFN(usersController.SignOutOtherDevices)).Methods("POST")
+	r.HandleFunc("/account/devices/{id:[0-9]+}/delete", requireUserMw.ApplyFN(usersController.SignOutDevice)).Methods("POST")
+	r.HandleFunc("/account/two-factor", requireUserMw.ApplyFN(usersController.TwoFactor)).Methods("GET")
+	r.HandleFunc("/account/two-factor/setup", requireUserMw.ApplyFN(usersController.SetupTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/two-factor/enable", requireUserMw.ApplyFN(usersController.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/two-factor/disable", requireUserMw.ApplyFN(usersController.DisableTwoFactor)).Methods("POST")
+	r.HandleFunc("/account/verify", requireUserMw.ApplyFN(usersController.ResendVerification)).Methods("POST")
+	r.HandleFunc("/account/email", requireUserMw.ApplyFN(usersController.ChangeEmail)).Methods("POST")
+	r.HandleFunc("/account/passkeys", requireUserMw.ApplyFN(usersController.Passkeys)).Methods("GET")
+	r.HandleFunc("/account/passkeys", requireUserMw.ApplyFN(usersController.CreatePasskey)).Methods("POST")
+	r.HandleFunc("/account/passkeys/options", requireUserMw.ApplyFN(usersController.PasskeyOptions)).Methods("POST")
+	r.HandleFunc("/account/passkeys/{id:[0-9]+}/delete", requireUserMw.ApplyFN(usersController.DeletePasskey)).Methods("POST")
+	r.HandleFunc("/account/tokens", requireUserMw.ApplyFN(accessTokensController.Index)).Methods("GET")
+	r.HandleFunc("/account/tokens", requireUserMw.ApplyFN(accessTokensController.Create)).Methods("POST")
+	r.HandleFunc("/account/tokens/{id:[0-9]+}/delete", requireUserMw.ApplyFN(accessTokensController.Delete)).Methods("POST")
+	r.HandleFunc("/account/apps", requireUserMw.ApplyFN(oauthController.Apps)).Methods("GET")
+	r.HandleFunc("/account/apps", requireUserMw.ApplyFN(oauthController.CreateApp)).Methods("POST")
+	r.HandleFunc("/account/apps/{id:[0-9]+}/delete", requireUserMw.ApplyFN(oauthController.DeleteApp)).Methods("POST")
+	r.HandleFunc("/account/apps/{id:[0-9]+}/revoke", requireUserMw.ApplyFN(oauthController.RevokeApp)).Methods("POST")
 	//r.HandleFunc("/cookietest", usersController.CookieTest).Methods("GET")
 
 	// Static assets
@@ -79,8 +144,11 @@ func main() {
 	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", assetHandler))
 
 	// Image routes
-	imageHandler := http.FileServer(http.Dir("./images"))
-	r.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	r.HandleFunc("/images/{image:[A-Za-z0-9_-]+}", imagesController.Show).Methods("GET")
+	r.HandleFunc("/images/{image:[A-Za-z0-9_-]+}/{size:[a-z]+}", imagesController.Show).Methods("GET")
+
+	// Search routes
+	r.HandleFunc("/search", searchController.Search).Methods("GET")
 
 	// Galleries middleware & routes
 	r.HandleFunc("/galleries", requireUserMw.ApplyFN(galleriesController.Index)).Methods("GET")
@@ -89,11 +157,41 @@ func main() {
 	r.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFN(galleriesController.Edit)).Methods("GET").Name(controllers.EditGallery)
 	r.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFN(galleriesController.Update)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFN(galleriesController.ImageUpload)).Methods("POST")
-	r.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFN(galleriesController.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/order", requireUserMw.ApplyFN(galleriesController.ImageOrder)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/move", requireUserMw.ApplyFN(galleriesController.ImageMove)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image:[A-Za-z0-9_-]+}/update", requireUserMw.ApplyFN(galleriesController.ImageUpdate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image:[A-Za-z0-9_-]+}/delete", requireUserMw.ApplyFN(galleriesController.ImageDelete)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image:[A-Za-z0-9_-]+}/rotate", requireUserMw.ApplyFN(galleriesController.ImageRotate)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/images/{image:[A-Za-z0-9_-]+}/cover", requireUserMw.ApplyFN(galleriesController.ImageCover)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/unlock", unlockLimitMw.ApplyFN(galleriesController.Unlock)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share", requireUserMw.ApplyFN(galleriesController.Share)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/share/revoke", requireUserMw.ApplyFN(galleriesController.RevokeShares)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members", requireUserMw.ApplyFN(galleriesController.Invite)).Methods("POST")
+	r.HandleFunc("/galleries/{id:[0-9]+}/members/{user:[0-9]+}/delete", requireUserMw.ApplyFN(galleriesController.RemoveMember)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFN(galleriesController.Delete)).Methods("POST")
 	r.HandleFunc("/galleries/{id:[0-9]+}", galleriesController.Show).Methods("GET").Name(controllers.ShowGallery)
+	r.HandleFunc("/g/{slug:[A-Za-z0-9_=-]+}", galleriesController.ShowBySlug).Methods("GET")
+
+	// OAuth routes, the tokens issued here are accepted by the API like
+	// personal access tokens
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFN(oauthController.Authorize)).Methods("GET")
+	r.HandleFunc("/oauth/authorize", requireUserMw.ApplyFN(oauthController.Approve)).Methods("POST")
+	r.HandleFunc(middleware.OAuthTokenPath, oauthController.Token).Methods("POST")
+
+	// API routes
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/login", loginLimitMw.ApplyFN(apiController.Login)).Methods("POST")
+	api.HandleFunc("/user", requireAPIUserMw.ApplyFN(apiController.User)).Methods("GET")
+	api.HandleFunc("/galleries", requireAPIUserMw.ApplyFN(apiController.Galleries)).Methods("GET")
+	api.HandleFunc("/galleries", requireAPIUserMw.ApplyFN(apiController.CreateGallery)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFN(apiController.Gallery)).Methods("GET")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFN(apiController.UpdateGallery)).Methods("PATCH")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFN(apiController.DeleteGallery)).Methods("DELETE")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images", requireAPIUserMw.ApplyFN(apiController.UploadImages)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images/{image:[A-Za-z0-9_-]+}", requireAPIUserMw.ApplyFN(apiController.DeleteImage)).Methods("DELETE")
+
 	log.Printf("Server listening on port: %d...\n", cfg.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(r))))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), middleware.SkipAPICSRF(csrfMw(userMw.Apply(r)))))
 }
 
 func must(err error) {
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lenslocked.com/ratelimit"
+)
+
+// RateLimit limits how often each IP address can make requests, e.g. to
+// stop one address guessing passwords for many accounts. Requests over
+// the limit are refused with 429 Too Many Requests.
+type RateLimit struct {
+	Limiter *ratelimit.Limiter
+}
+
+func (mw *RateLimit) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFN(next.ServeHTTP)
+}
+
+func (mw *RateLimit) ApplyFN(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retry, err := mw.Limiter.Allow(ClientIP(r))
+		if err != nil {
+			// failing open keeps the site usable if the store is down,
+			// accounts are still protected by their own limits
+			log.Println(err)
+			next(w, r)
+			return
+		}
+		if ok {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		if strings.HasPrefix(r.URL.Path, APIPrefix) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]string{
+					"code":    "rate_limited",
+					"message": "Too many requests, please try again later.",
+				},
+			})
+			return
+		}
+		http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+	})
+}
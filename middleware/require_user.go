@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"net"
 	"net/http"
 	"strings"
 
@@ -9,8 +10,20 @@ import (
 	"lenslocked.com/models"
 )
 
+// User looks up the user a request was made by, from their session
+// cookie or an access token.
 type User struct {
-	models.UserService
+	Sessions     models.SessionService
+	AccessTokens models.AccessTokenService
+}
+
+// ClientIP returns the IP address the request was made from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func (mw *User) Apply(next http.Handler) http.HandlerFunc {
@@ -19,25 +32,50 @@ func (mw *User) Apply(next http.Handler) http.HandlerFunc {
 
 func (mw *User) ApplyFN(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// If the user is requesting a static asset or image we can skip looking up the user.
+		// If the user is requesting a static asset we can skip looking up the user.
+		// Images are not skipped as private galleries are only visible to their owner.
 		// Can also resolve this with sub-routers with different middlewares applied.
 		path := r.URL.Path
-		if strings.HasPrefix(path, "/assets/") || strings.HasPrefix(path, "/images/") {
+		if strings.HasPrefix(path, "/assets/") {
 			next(w, r)
 			return
 		}
 
-		cookie, err := r.Cookie("remember_token")
-		if err != nil {
+		// API requests and image downloads can be authenticated with an
+		// access token instead of cookies.
+		api := strings.HasPrefix(path, APIPrefix)
+		if api || strings.HasPrefix(path, "/images/") {
+			if token, ok := bearerToken(r); ok {
+				user, at, err := mw.AccessTokens.Authenticate(token)
+				if err != nil {
+					next(w, r)
+					return
+				}
+				ctx := context.WithUser(r.Context(), user)
+				ctx = context.WithAccessToken(ctx, at)
+				next(w, r.WithContext(ctx))
+				return
+			}
+		}
+		if api {
+			// the API is exempt from CSRF protection so it must
+			// never be authenticated by cookies.
+			next(w, r)
+			return
+		}
+
+		token := cookies.GetSession(r)
+		if token == "" {
 			next(w, r)
 			return
 		}
-		user, err := mw.ByRemember(cookie.Value)
+		user, session, err := mw.Sessions.Authenticate(token, ClientIP(r))
 		if err != nil {
 			next(w, r)
 			return
 		}
 		ctx := context.WithUser(r.Context(), user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 		next(w, r)
 	})
@@ -57,7 +95,8 @@ func (mw *RequireUser) ApplyFN(next http.HandlerFunc) http.HandlerFunc {
 	return mw.User.ApplyFN(func(w http.ResponseWriter, r *http.Request) {
 		user := context.User(r.Context())
 		if user == nil {
-			url := r.URL.Path
+			// keep the query, OAuth authorization requests rely on it
+			url := r.URL.RequestURI()
 			cookies.SetRedirect(w, url)
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
@@ -0,0 +1,340 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+// Scope limits what an access token can be used for.
+type Scope string
+
+const (
+	// ScopeGalleriesRead allows viewing galleries and their images.
+	ScopeGalleriesRead Scope = "galleries:read"
+	// ScopeGalleriesWrite allows creating, changing and deleting galleries.
+	ScopeGalleriesWrite Scope = "galleries:write"
+	// ScopeImagesWrite allows uploading and deleting images.
+	ScopeImagesWrite Scope = "images:write"
+)
+
+// Scopes lists every scope in the order they are shown to users.
+var Scopes = []Scope{ScopeGalleriesRead, ScopeGalleriesWrite, ScopeImagesWrite}
+
+// Description explains to users what the scope allows.
+func (s Scope) Description() string {
+	switch s {
+	case ScopeGalleriesRead:
+		return "View your galleries and their photos"
+	case ScopeGalleriesWrite:
+		return "Create, change and delete your galleries"
+	case ScopeImagesWrite:
+		return "Upload, change and delete photos"
+	default:
+		return string(s)
+	}
+}
+
+// ParseScopes splits a space separated list of scopes.
+func ParseScopes(s string) []Scope {
+	var scopes []Scope
+	for _, scope := range strings.Fields(s) {
+		scopes = append(scopes, Scope(scope))
+	}
+	return scopes
+}
+
+// validScopes returns ErrScopeRequired if scopes is empty and
+// ErrScopeInvalid if it contains a scope we don't know about.
+func validScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return ErrScopeRequired
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range Scopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return ErrScopeInvalid
+		}
+	}
+	return nil
+}
+
+// joinScopes returns scopes space separated, the way they are stored.
+func joinScopes(scopes []Scope) string {
+	s := make([]string, len(scopes))
+	for i, scope := range scopes {
+		s[i] = string(scope)
+	}
+	return strings.Join(s, " ")
+}
+
+const (
+	// AccessTokenPrefix starts every personal access token so they can be
+	// told apart from other tokens, e.g. by secret scanners.
+	AccessTokenPrefix = "llpat_"
+	// OAuthAccessTokenPrefix starts the access tokens issued to OAuth
+	// clients.
+	OAuthAccessTokenPrefix = "lloat_"
+
+	maxAccessTokenNameLength = 100
+
+	// accessTokenTouchInterval is how often the last use of a token is
+	// recorded, so not every request needs to write to the DB.
+	accessTokenTouchInterval = time.Minute
+)
+
+// AccessToken is a personal access token a user created to use the API
+// from scripts and other tools, or a token issued to an OAuth client the
+// user authorized. Only a hash of the token is stored.
+type AccessToken struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"not null;index"`
+	// ClientID is the OAuthClient the token was issued to, it is 0 for
+	// personal access tokens.
+	ClientID uint   `gorm:"not null;default:0;index"`
+	Name     string `gorm:"not null"`
+	// Token is only set when the token is created.
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// Scopes are stored space separated.
+	Scopes string `gorm:"not null"`
+	// ExpiresAt is nil for tokens that don't expire.
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// ScopeList returns the scopes granted to the token.
+func (t *AccessToken) ScopeList() []Scope {
+	return ParseScopes(t.Scopes)
+}
+
+// HasScope reports whether the token was granted scope.
+func (t *AccessToken) HasScope(scope Scope) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token can no longer be used.
+func (t *AccessToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+// SetScopes sets the scopes granted to the token.
+func (t *AccessToken) SetScopes(scopes []Scope) {
+	t.Scopes = joinScopes(scopes)
+}
+
+// AccessTokenDB is used to interact with the access_tokens table.
+type AccessTokenDB interface {
+	// ByToken looks up a token by its unhashed value.
+	ByToken(token string) (*AccessToken, error)
+	// ByUserID returns the user's personal access tokens, newest first.
+	ByUserID(userID uint) ([]AccessToken, error)
+	// Create generates the token and stores its hash. The unhashed
+	// token is set on the AccessToken and can't be retrieved again.
+	Create(token *AccessToken) error
+	// Touch records that the token was just used.
+	Touch(token *AccessToken) error
+	// Delete revokes the user's token with id.
+	Delete(userID, id uint) error
+}
+
+// AccessTokenService is used to work with personal access tokens.
+type AccessTokenService interface {
+	// Authenticate returns the user a token belongs to along with the
+	// token itself. ErrTokenInvalid is returned for unknown or expired
+	// tokens.
+	Authenticate(token string) (*User, *AccessToken, error)
+	AccessTokenDB
+}
+
+// NewAccessTokenService returns an AccessTokenService storing tokens in db,
+// hashed with hmacKey.
+func NewAccessTokenService(db *gorm.DB, hmacKey string) AccessTokenService {
+	return &accessTokenService{
+		AccessTokenDB: &accessTokenValidator{
+			AccessTokenDB: &accessTokenGorm{db},
+			hmac:          hash.NewHMAC(hmacKey),
+		},
+		userDB: &userGorm{db},
+	}
+}
+
+type accessTokenService struct {
+	AccessTokenDB
+	userDB UserDB
+}
+
+func (ats *accessTokenService) Authenticate(token string) (*User, *AccessToken, error) {
+	at, err := ats.ByToken(token)
+	switch {
+	case err == ErrNotFound:
+		return nil, nil, ErrTokenInvalid
+	case err != nil:
+		return nil, nil, err
+	case at.Expired():
+		return nil, nil, ErrTokenInvalid
+	}
+	user, err := ats.userDB.ByID(at.UserID)
+	if err == ErrNotFound {
+		return nil, nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if at.LastUsedAt == nil || time.Since(*at.LastUsedAt) > accessTokenTouchInterval {
+		if err := ats.Touch(at); err != nil {
+			return nil, nil, err
+		}
+	}
+	return user, at, nil
+}
+
+type accessTokenValFunc func(*AccessToken) error
+
+func runAccessTokenValFuncs(token *AccessToken, fns ...accessTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type accessTokenValidator struct {
+	AccessTokenDB
+	hmac hash.HMAC
+}
+
+func (atv *accessTokenValidator) ByToken(token string) (*AccessToken, error) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) && !strings.HasPrefix(token, OAuthAccessTokenPrefix) {
+		return nil, ErrNotFound
+	}
+	at := AccessToken{Token: token}
+	if err := atv.hmacToken(&at); err != nil {
+		return nil, err
+	}
+	return atv.AccessTokenDB.ByToken(at.TokenHash)
+}
+
+func (atv *accessTokenValidator) Create(token *AccessToken) error {
+	err := runAccessTokenValFuncs(token,
+		atv.requireUserID,
+		atv.nameRequired,
+		atv.scopesValid,
+		atv.expiryInFuture,
+		atv.setToken,
+		atv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return atv.AccessTokenDB.Create(token)
+}
+
+func (atv *accessTokenValidator) Delete(userID, id uint) error {
+	if userID <= 0 || id <= 0 {
+		return ErrIDInvalid
+	}
+	return atv.AccessTokenDB.Delete(userID, id)
+}
+
+func (atv *accessTokenValidator) requireUserID(token *AccessToken) error {
+	if token.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (atv *accessTokenValidator) nameRequired(token *AccessToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	switch {
+	case token.Name == "":
+		return ErrTokenNameRequired
+	case utf8.RuneCountInString(token.Name) > maxAccessTokenNameLength:
+		return ErrTokenNameTooLong
+	}
+	return nil
+}
+
+// scopesValid makes sure the token is granted at least one scope and
+// only scopes we know about.
+func (atv *accessTokenValidator) scopesValid(token *AccessToken) error {
+	return validScopes(token.ScopeList())
+}
+
+func (atv *accessTokenValidator) expiryInFuture(token *AccessToken) error {
+	if token.Expired() {
+		return ErrTokenExpiryInvalid
+	}
+	return nil
+}
+
+// setToken generates the token, it is never set by the caller.
+func (atv *accessTokenValidator) setToken(token *AccessToken) error {
+	s, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	prefix := AccessTokenPrefix
+	if token.ClientID != 0 {
+		prefix = OAuthAccessTokenPrefix
+	}
+	token.Token = prefix + s
+	return nil
+}
+
+func (atv *accessTokenValidator) hmacToken(token *AccessToken) error {
+	if token.Token == "" {
+		return nil
+	}
+	token.TokenHash = atv.hmac.Hash(token.Token)
+	return nil
+}
+
+type accessTokenGorm struct {
+	db *gorm.DB
+}
+
+func (atg *accessTokenGorm) ByToken(tokenHash string) (*AccessToken, error) {
+	var token AccessToken
+	err := first(atg.db.Where("token_hash = ?", tokenHash), &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (atg *accessTokenGorm) ByUserID(userID uint) ([]AccessToken, error) {
+	var tokens []AccessToken
+	err := atg.db.Where("user_id = ? AND client_id = 0", userID).Order("created_at desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (atg *accessTokenGorm) Create(token *AccessToken) error {
+	return atg.db.Create(token).Error
+}
+
+func (atg *accessTokenGorm) Touch(token *AccessToken) error {
+	now := time.Now()
+	token.LastUsedAt = &now
+	return atg.db.Model(token).UpdateColumn("last_used_at", now).Error
+}
+
+func (atg *accessTokenGorm) Delete(userID, id uint) error {
+	return atg.db.Where("user_id = ? AND id = ?", userID, id).Delete(&AccessToken{}).Error
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+)
+
+// memAccessTokens is an AccessTokenDB keeping tokens by their hash.
+type memAccessTokens struct {
+	tokens  map[string]*AccessToken
+	touched int
+}
+
+func (m *memAccessTokens) ByToken(tokenHash string) (*AccessToken, error) {
+	token, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t := *token
+	return &t, nil
+}
+
+func (m *memAccessTokens) ByUserID(userID uint) ([]AccessToken, error) {
+	var tokens []AccessToken
+	for _, token := range m.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, *token)
+		}
+	}
+	return tokens, nil
+}
+
+func (m *memAccessTokens) Create(token *AccessToken) error {
+	token.ID = uint(len(m.tokens) + 1)
+	t := *token
+	t.Token = ""
+	m.tokens[token.TokenHash] = &t
+	return nil
+}
+
+func (m *memAccessTokens) Touch(token *AccessToken) error {
+	now := time.Now()
+	token.LastUsedAt = &now
+	m.tokens[token.TokenHash].LastUsedAt = &now
+	m.touched++
+	return nil
+}
+
+func (m *memAccessTokens) Delete(userID, id uint) error {
+	for hash, token := range m.tokens {
+		if token.UserID == userID && token.ID == id {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
+
+func TestAccessTokenCreate(t *testing.T) {
+	atv := &accessTokenValidator{
+		AccessTokenDB: &memAccessTokens{tokens: map[string]*AccessToken{}},
+		hmac:          hash.NewHMAC("test-key"),
+	}
+	past := time.Now().Add(-time.Minute)
+	tests := []struct {
+		name  string
+		token AccessToken
+		want  error
+	}{
+		{"valid", AccessToken{UserID: 1, Name: " cli ", Scopes: "galleries:read images:write"}, nil},
+		{"no user", AccessToken{Name: "cli", Scopes: "galleries:read"}, ErrUserIDRequired},
+		{"no name", AccessToken{UserID: 1, Name: "  ", Scopes: "galleries:read"}, ErrTokenNameRequired},
+		{"long name", AccessToken{UserID: 1, Name: strings.Repeat("a", 101), Scopes: "galleries:read"}, ErrTokenNameTooLong},
+		{"no scopes", AccessToken{UserID: 1, Name: "cli"}, ErrScopeRequired},
+		{"unknown scope", AccessToken{UserID: 1, Name: "cli", Scopes: "galleries:read users:write"}, ErrScopeInvalid},
+		{"expired", AccessToken{UserID: 1, Name: "cli", Scopes: "galleries:read", ExpiresAt: &past}, ErrTokenExpiryInvalid},
+	}
+	for _, tt := range tests {
+		token := tt.token
+		if err := atv.Create(&token); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+			continue
+		}
+		if tt.want != nil {
+			continue
+		}
+		if token.Name != "cli" {
+			t.Errorf("%s: expected the name to be trimmed. Received %q", tt.name, token.Name)
+		}
+		if !strings.HasPrefix(token.Token, AccessTokenPrefix) || token.TokenHash == "" || token.TokenHash == token.Token {
+			t.Errorf("%s: expected a prefixed token stored as a hash. Received %q %q", tt.name, token.Token, token.TokenHash)
+		}
+		found, err := atv.ByToken(token.Token)
+		if err != nil || found.ID != token.ID {
+			t.Errorf("%s: expected to find the token by its value. Received %v", tt.name, err)
+		}
+		if _, err := atv.ByToken(token.TokenHash); err != ErrNotFound {
+			t.Errorf("%s: expected the hash not to work as a token. Received %v", tt.name, err)
+		}
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	var token AccessToken
+	token.SetScopes([]Scope{ScopeGalleriesRead, ScopeImagesWrite})
+	if token.Scopes != "galleries:read images:write" {
+		t.Errorf("Expected space separated scopes. Received %q", token.Scopes)
+	}
+	if !token.HasScope(ScopeGalleriesRead) || !token.HasScope(ScopeImagesWrite) || token.HasScope(ScopeGalleriesWrite) {
+		t.Errorf("Expected only the granted scopes. Received %v", token.ScopeList())
+	}
+}
+
+func TestAccessTokenAuthenticate(t *testing.T) {
+	db := &memAccessTokens{tokens: map[string]*AccessToken{}}
+	hmac := hash.NewHMAC("test-key")
+	ats := &accessTokenService{
+		AccessTokenDB: &accessTokenValidator{AccessTokenDB: db, hmac: hmac},
+		userDB:        memUsers{1: &User{Model: gorm.Model{ID: 1}}},
+	}
+	create := func(userID uint, expires time.Time) string {
+		token := AccessToken{UserID: userID, Name: "cli", Scopes: "galleries:read", ExpiresAt: &expires}
+		if err := ats.Create(&token); err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+	valid := create(1, time.Now().Add(time.Hour))
+	user, token, err := ats.Authenticate(valid)
+	if err != nil || user.ID != 1 || !token.HasScope(ScopeGalleriesRead) {
+		t.Fatalf("Expected the token to authenticate user 1. Received %v", err)
+	}
+	if _, _, err := ats.Authenticate(valid); err != nil || db.touched != 1 {
+		t.Errorf("Expected the last use to be recorded once a minute. Received %v, %d touches", err, db.touched)
+	}
+
+	// tokens can only be created with an expiry in the future
+	expired := create(1, time.Now().Add(time.Hour))
+	past := time.Now().Add(-time.Second)
+	db.tokens[hmac.Hash(expired)].ExpiresAt = &past
+	orphaned := create(2, time.Now().Add(time.Hour))
+	for name, token := range map[string]string{
+		"expired":  expired,
+		"orphaned": orphaned,
+		"unknown":  AccessTokenPrefix + "guess",
+		"remember": "guess",
+	} {
+		if _, _, err := ats.Authenticate(token); err != ErrTokenInvalid {
+			t.Errorf("%s token: expected ErrTokenInvalid. Received %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// memVerifications is an in-memory emailVerificationDB keyed by token
+// hash.
+type memVerifications map[string]*emailVerification
+
+func (m memVerifications) ByToken(tokenHash string) (*emailVerification, error) {
+	ev, ok := m[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ev, nil
+}
+
+func (m memVerifications) Create(ev *emailVerification) error {
+	ev.ID = uint(len(m) + 1)
+	ev.CreatedAt = time.Now()
+	m[ev.TokenHash] = ev
+	return nil
+}
+
+func (m memVerifications) DeleteByUserID(userID uint) error {
+	for k, ev := range m {
+		if ev.UserID == userID {
+			delete(m, k)
+		}
+	}
+	return nil
+}
+
+// testVerifyUserService returns a user service that validates users like
+// the real one, along with an unverified user with the password "secret"
+// and another user.
+func testVerifyUserService(t *testing.T) (*userService, memVerifications, *User) {
+	users := memUsers{}
+	us := testUserService(nil)
+	us.UserDB = users
+	user := testPasswordUser(t, us, "jon@example.com")
+	testPasswordUser(t, us, "sam@example.com")
+
+	uv := newUserValidator(users, us.pepper)
+	us.UserDB, us.emailDB = uv, uv
+	verifications := memVerifications{}
+	us.verifyDB = newEmailVerificationValidator(verifications, hash.NewHMAC("test-key"))
+	return us, verifications, user
+}
+
+func TestCompleteVerification(t *testing.T) {
+	us, verifications, user := testVerifyUserService(t)
+	token, err := us.InitiateVerification(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := us.InitiateVerification(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range verifications {
+		if ev.Token == expired {
+			ev.CreatedAt = time.Now().Add(-emailVerificationDuration - time.Minute)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"unknown", "bogus"},
+		{"tampered", token + "x"},
+		{"expired", expired},
+	}
+	for _, tt := range tests {
+		if _, err := us.CompleteVerification(tt.token); err != ErrTokenInvalid {
+			t.Errorf("%s: expected ErrTokenInvalid. Received %v", tt.name, err)
+		}
+	}
+
+	verified, err := us.CompleteVerification(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verified.Verified() || verified.Email != "jon@example.com" {
+		t.Errorf("Expected jon@example.com to be verified. Received %s, %v", verified.Email, verified.VerifiedAt)
+	}
+	if _, err := us.CompleteVerification(token); err != ErrTokenInvalid {
+		t.Errorf("Expected tokens to only be used once. Received %v", err)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     error
+	}{
+		{"wrong password", "jon@example.org", "wrong", ErrPasswordIncorrect},
+		{"unchanged", " JON@example.com", "secret", ErrEmailUnchanged},
+		{"taken", "sam@example.com", "secret", ErrEmailTaken},
+		{"invalid", "jon@", "secret", ErrEmailInvalid},
+		{"new address", " Jon@Example.org", "secret", nil},
+	}
+	for _, tt := range tests {
+		us, _, user := testVerifyUserService(t)
+		token, err := us.InitiateEmailChange(user, tt.email, tt.password)
+		if err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+		if err != nil {
+			continue
+		}
+		if user, _ := us.ByID(user.ID); user.Email != "jon@example.com" {
+			t.Errorf("%s: expected the address not to change before it is verified. Received %s", tt.name, user.Email)
+		}
+		changed, err := us.CompleteVerification(token)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if changed.Email != "jon@example.org" || !changed.Verified() {
+			t.Errorf("%s: expected jon@example.org to be verified. Received %s, %v", tt.name, changed.Email, changed.VerifiedAt)
+		}
+	}
+}
+
+func TestUpdateEmailUnverified(t *testing.T) {
+	us, _, user := testVerifyUserService(t)
+	user.Email = "jon@example.org"
+	if err := us.Update(user); err != ErrEmailChangeUnverified {
+		t.Errorf("Expected ErrEmailChangeUnverified. Received %v", err)
+	}
+}
@@ -12,6 +12,15 @@ const (
 	// ErrPasswordIncorrect is returned when the credentials provided to Authenticate() are incorrect.
 	ErrPasswordIncorrect modelError = "models: incorrect password"
 
+	// ErrTooManyAttempts is returned when a user signs in again too soon after failed attempts.
+	ErrTooManyAttempts modelError = "models: too many failed attempts, please wait a few seconds and try again"
+
+	// ErrAccountLocked is returned when a user signs in to an account that was locked after too many failed attempts.
+	ErrAccountLocked modelError = "models: this account has been locked after too many failed sign in attempts, follow the link we emailed you or try again in 30 minutes"
+
+	// ErrTooManyResets is returned when password reset emails were sent to an address too often recently.
+	ErrTooManyResets modelError = "models: we have already emailed you several reset links, please check your inbox or try again in an hour"
+
 	// ErrEmailRequired is returned when an email address is not provided for user creation\update.
 	ErrEmailRequired modelError = "models: email address is required"
 
@@ -21,6 +30,16 @@ const (
 	// ErrEmailTaken is returned when a user attempts to register an email address that is taken by another user.
 	ErrEmailTaken modelError = "models: email address is already taken"
 
+	// ErrEmailUnchanged is returned when a user changes their email address to the one they already have.
+	ErrEmailUnchanged modelError = "models: that is already your email address"
+
+	// ErrEmailChangeUnverified is returned when a user's email address is updated without verifying the new one.
+	ErrEmailChangeUnverified modelError = "models: your new email address must be verified before it can be used"
+
+	// ErrEmailUnverified is returned when a user who has not verified their email address shares a gallery, makes
+	// it public or unlisted, or protects it with a password.
+	ErrEmailUnverified modelError = "models: please verify your email address before sharing galleries, you can resend the link from your account page"
+
 	// ErrPasswordRequired is returned if the user does not provide a password when signing up.
 	ErrPasswordRequired modelError = "models: password is required"
 
@@ -34,18 +53,153 @@ const (
 	// ErrTitleRequired is returned when a user attempts to create a gallery without a title.
 	ErrTitleRequired modelError = "models: title is required"
 
+	// ErrVisibilityInvalid is returned when a gallery's visibility is not private, unlisted or public.
+	ErrVisibilityInvalid modelError = "models: visibility must be private, unlisted or public"
+
+	// ErrShareLinkInvalid is returned when a share link was not signed for the gallery or has been revoked.
+	ErrShareLinkInvalid modelError = "models: this link is not valid"
+
+	// ErrShareLinkExpired is returned when a share link has expired.
+	ErrShareLinkExpired modelError = "models: this link has expired"
+
+	// ErrShareExpiryInvalid is returned when a share link would expire in the past.
+	ErrShareExpiryInvalid modelError = "models: share links must expire in the future"
+
+	// ErrGalleryPasswordTooShort is returned when a gallery password is shorter than 6 characters.
+	ErrGalleryPasswordTooShort modelError = "models: gallery passwords must be at least 6 characters long"
+
+	// ErrGalleryLocked is returned when a gallery has not been unlocked with its password.
+	ErrGalleryLocked modelError = "models: this gallery is password protected"
+
+	// ErrRoleInvalid is returned when a gallery member's role is not viewer, contributor or editor.
+	ErrRoleInvalid modelError = "models: role must be viewer, contributor or editor"
+
+	// ErrMemberIsOwner is returned when the owner of a gallery is added as one of its members.
+	ErrMemberIsOwner modelError = "models: you already own this gallery"
+
+	// ErrParentInvalid is returned when a gallery is placed in an album that does not exist, is owned by
+	// someone else, or is the gallery itself or one of the galleries inside it.
+	ErrParentInvalid modelError = "models: the gallery can not be placed in that album"
+
+	// ErrImageMoveInvalid is returned when images are moved to the gallery they are already in.
+	ErrImageMoveInvalid modelError = "models: images can only be moved to a different gallery"
+
+	// ErrNoImagesSelected is returned when images are moved or copied without selecting any.
+	ErrNoImagesSelected modelError = "models: please select the images to move or copy"
+
+	// ErrTokenNameRequired is returned when an access token is created without a name.
+	ErrTokenNameRequired modelError = "models: please name the token so you can recognise it later"
+
+	// ErrTokenNameTooLong is returned when an access token's name is longer than 100 characters.
+	ErrTokenNameTooLong modelError = "models: token names must be 100 characters or less"
+
+	// ErrScopeRequired is returned when an access token is created without any scopes.
+	ErrScopeRequired modelError = "models: please select at least one scope for the token"
+
+	// ErrScopeInvalid is returned when an access token is granted a scope we don't know about.
+	ErrScopeInvalid modelError = "models: the requested scope is not valid"
+
+	// ErrTokenExpiryInvalid is returned when an access token would expire in the past.
+	ErrTokenExpiryInvalid modelError = "models: tokens must expire in the future"
+
+	// ErrClientNameRequired is returned when an OAuth client is registered without a name.
+	ErrClientNameRequired modelError = "models: please name your application"
+
+	// ErrClientNameTooLong is returned when an OAuth client's name is longer than 100 characters.
+	ErrClientNameTooLong modelError = "models: application names must be 100 characters or less"
+
+	// ErrRedirectURIInvalid is returned when an OAuth client's redirect URI is not an https URL, or http for localhost.
+	ErrRedirectURIInvalid modelError = "models: redirect URIs must be https URLs without a fragment, http is only allowed for localhost"
+
+	// ErrRedirectURIMismatch is returned when an authorization request's redirect URI is not the one registered for the client.
+	ErrRedirectURIMismatch modelError = "models: the redirect URI does not match the one registered for this application"
+
+	// ErrCodeChallengeInvalid is returned when an authorization request has no S256 PKCE code challenge.
+	ErrCodeChallengeInvalid modelError = "models: a S256 code challenge is required"
+
+	// ErrClientInvalid is returned when an OAuth client is unknown or provided the wrong secret.
+	ErrClientInvalid modelError = "models: client authentication failed"
+
+	// ErrGrantInvalid is returned when an authorization code or refresh token is unknown, expired, already used
+	// or was issued to another client.
+	ErrGrantInvalid modelError = "models: the authorization code or refresh token is invalid or has expired"
+
+	// ErrTOTPCodeInvalid is returned when a two-factor authentication code or recovery code is wrong or was already used.
+	ErrTOTPCodeInvalid modelError = "models: that code is not valid, please try again"
+
+	// ErrTwoFactorNotSetUp is returned when two-factor authentication is enabled before a secret was generated.
+	ErrTwoFactorNotSetUp modelError = "models: please set up your authenticator app first"
+
+	// ErrTwoFactorEnabled is returned when two-factor authentication is set up while it is already enabled.
+	ErrTwoFactorEnabled modelError = "models: two-factor authentication is already enabled"
+
+	// ErrPasskeyInvalid is returned when a passkey registration or sign in can not be verified, or its challenge
+	// has expired or was already used.
+	ErrPasskeyInvalid modelError = "models: your passkey could not be verified, please try again"
+
+	// ErrPasskeyRegistered is returned when a passkey that is already registered is registered again.
+	ErrPasskeyRegistered modelError = "models: that passkey is already registered"
+
+	// ErrPasskeyNameTooLong is returned when a passkey's name is longer than 100 characters.
+	ErrPasskeyNameTooLong modelError = "models: passkey names must be 100 characters or less"
+
 	ErrTokenInvalid modelError = "models: token provided is invalid"
 
-	// ErrRememberTooShort is returned if a user's remember token is less than 32 bytes.
-	ErrRememberTooShort privateError = "models: remember token must be at least 32 bytes"
+	// ErrImageTypeInvalid is returned when an uploaded file is not one of the image types we accept.
+	ErrImageTypeInvalid modelError = "models: only jpeg, png, gif and webp images can be uploaded"
+
+	// ErrImageTooLarge is returned when an uploaded image is larger than MaxImageBytes.
+	ErrImageTooLarge modelError = "models: images must be smaller than 20 MB"
+
+	// ErrUploadTooLarge is returned when the images uploaded in a single request exceed MaxUploadBytes.
+	ErrUploadTooLarge modelError = "models: please upload fewer than 100 MB of images at a time"
+
+	// ErrImageDimensions is returned when an uploaded image exceeds MaxImageDim or MaxImagePixels.
+	ErrImageDimensions modelError = "models: images must be at most 10000 pixels wide or high and 50 megapixels in total"
 
-	// ErrRememberHashRequired is returned if a remember hash is not present on user create and update.
-	ErrRememberHashRequired privateError = "models: remember hash is required"
+	// ErrImageMetadataInvalid is returned when the EXIF metadata of an uploaded image can not be read.
+	ErrImageMetadataInvalid modelError = "models: the metadata of this image could not be read"
+
+	// ErrImageNotRotatable is returned when an image is in a format we are unable to rotate.
+	ErrImageNotRotatable modelError = "models: images of this type can not be rotated"
+
+	// ErrImageOrderInvalid is returned when a new image order does not list each image of the gallery once.
+	ErrImageOrderInvalid modelError = "models: the gallery's images have changed, please reload the page and try again"
+
+	// ErrImageTitleTooLong is returned when an image title is longer than 100 characters.
+	ErrImageTitleTooLong modelError = "models: image titles must be 100 characters or less"
+
+	// ErrImageCaptionTooLong is returned when an image caption is longer than 2000 characters.
+	ErrImageCaptionTooLong modelError = "models: image captions must be 2000 characters or less"
+
+	// ErrImageAltTextTooLong is returned when an image's alt text is longer than 250 characters.
+	ErrImageAltTextTooLong modelError = "models: image alt text must be 250 characters or less"
+
+	// ErrTagTooLong is returned when a tag is longer than 30 characters.
+	ErrTagTooLong modelError = "models: tags must be 30 characters or less"
+
+	// ErrTooManyTags is returned when a gallery or image has more than 20 tags.
+	ErrTooManyTags modelError = "models: galleries and images can have at most 20 tags"
+
+	// ErrSearchQueryTooLong is returned when a search query is longer than 200 characters.
+	ErrSearchQueryTooLong modelError = "models: search queries must be 200 characters or less"
+
+	// ErrCursorInvalid is returned when a page cursor can not be decoded or was created for another sort order.
+	ErrCursorInvalid modelError = "models: this page link is not valid, please start again from the first page"
+
+	// ErrSortInvalid is returned when galleries are listed in an order we don't support.
+	ErrSortInvalid modelError = "models: galleries can be sorted by created, updated, title or images"
+
+	// ErrFilenameInvalid is returned when an uploaded file name is empty or contains a path.
+	ErrFilenameInvalid modelError = "models: image file name is invalid"
 
 	// ErrIDInvalid is returned when an invalid ID is provided to a method like Delete.
 	ErrIDInvalid privateError = "models: ID provided is invalid"
 
 	ErrUserIDRequired privateError = "models: user ID is required"
+
+	// ErrGrantUsed is returned when an OAuth code or refresh token that was already used is presented again.
+	ErrGrantUsed privateError = "models: the authorization code or refresh token was already used"
 )
 
 type modelError string
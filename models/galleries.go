@@ -3,16 +3,130 @@ package models
 import (
 	"log"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+	"lenslocked.com/ratelimit"
+)
+
+// minGalleryPasswordLength is the shortest password a gallery can be
+// protected with. Gallery passwords are shared with clients so we do not
+// require them to be as complex as account passwords.
+const minGalleryPasswordLength = 6
+
+// maxGalleryDepth limits how deeply galleries can be nested in albums.
+const maxGalleryDepth = 10
+
+// Visibility controls who is able to view a gallery.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be viewed by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be viewed by anyone with a link
+	// containing the gallery's slug.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be viewed by anyone.
+	VisibilityPublic Visibility = "public"
 )
 
 // Gallery is our image container resource
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not null;index"`
-	Title  string  `gorm:"not null"`
-	Images []Image `gorm:"-"`
+	UserID uint   `gorm:"not null;index"`
+	Title  string `gorm:"not null"`
+	// ParentID is the album the gallery is part of, or 0 for top-level galleries.
+	ParentID   uint       `gorm:"not null;default:0;index"`
+	Visibility Visibility `gorm:"not null;default:'private'"`
+	// Tags are stored lowercase and comma separated.
+	Tags string `gorm:"not null;default:''"`
+	// Slug is the unguessable identifier used in links to share
+	// unlisted galleries.
+	Slug string `gorm:"unique_index"`
+	// ShareSecret is used when signing share links for the gallery.
+	// Rotating it revokes all of the gallery's share links.
+	ShareSecret string
+	// Password is only set when the owner changes the gallery's
+	// password. Only the hash is stored.
+	Password     string `gorm:"-"`
+	PasswordHash string
+	// CoverImageID is the image shown for the gallery in listings.
+	// When it is not set the first image is used.
+	CoverImageID uint
+	Images       []Image `gorm:"-"`
+	Cover        *Image  `gorm:"-"`
+	// ImageCount is set on galleries returned by ByUserIDPage.
+	ImageCount int `gorm:"-"`
+	// NextPage and FirstPage link to the next and first page of the
+	// gallery's images when only a page of them is loaded.
+	NextPage  string `gorm:"-"`
+	FirstPage string `gorm:"-"`
+	// Role is the role of the user viewing the gallery.
+	Role Role `gorm:"-"`
+	// Members are the users the gallery has been shared with.
+	Members []GalleryMember `gorm:"-"`
+	// Breadcrumbs are the albums the gallery is in, outermost first.
+	Breadcrumbs []Gallery `gorm:"-"`
+	// Children are the galleries in this album.
+	Children []Gallery `gorm:"-"`
+	// OtherGalleries are the viewing user's other galleries that images can
+	// be moved to and, when they own them, the gallery can be placed in.
+	OtherGalleries []Gallery `gorm:"-"`
+}
+
+// Allows reports whether the user viewing the gallery is allowed to
+// perform action on it. It relies on Role having been set.
+func (g *Gallery) Allows(action Action) bool {
+	return g.Role.Allows(action)
+}
+
+// IsOwner reports whether user owns the gallery.
+func (g *Gallery) IsOwner(user *User) bool {
+	return user != nil && user.ID == g.UserID
+}
+
+// TagList returns the gallery's tags.
+func (g *Gallery) TagList() []string {
+	return splitTags(g.Tags)
+}
+
+// TagsInput returns the gallery's tags formatted for a form input.
+func (g *Gallery) TagsInput() string {
+	return joinTags(g.Tags)
+}
+
+// HasPassword reports whether the gallery is password protected.
+func (g *Gallery) HasPassword() bool {
+	return g.PasswordHash != ""
+}
+
+// Locked reports whether user needs to enter the gallery's password
+// before being able to view it.
+func (g *Gallery) Locked(user *User) bool {
+	return g.HasPassword() && !g.IsOwner(user)
+}
+
+// CanView reports whether user is able to view the gallery at its
+// numeric ID. Unlisted galleries can only be viewed by others through
+// their slug, see CanViewBySlug.
+func (g *Gallery) CanView(user *User) bool {
+	return g.Visibility == VisibilityPublic || g.IsOwner(user)
+}
+
+// CanViewBySlug reports whether user is able to view the gallery
+// through its share link.
+func (g *Gallery) CanViewBySlug(user *User) bool {
+	return g.Visibility != VisibilityPrivate || g.IsOwner(user)
+}
+
+// CanViewImages reports whether user is able to view the gallery's
+// images. Images of unlisted galleries are addressed by random IDs
+// so they can be shown to anyone who was given a link to them.
+func (g *Gallery) CanViewImages(user *User) bool {
+	return g.CanViewBySlug(user)
 }
 
 // ImagesSplitN sorts the images into N buckets for optimal
@@ -32,34 +146,98 @@ func (g *Gallery) ImagesSplitN(n int) [][]Image {
 
 type GalleryService interface {
 	GalleryDB
+	// ShareLink signs a link granting perms to the gallery, or to the
+	// image with imageUID when it is not empty, until expires.
+	ShareLink(gallery *Gallery, imageUID string, perms SharePerm, expires time.Time) (*ShareLink, error)
+	// VerifyShareLink returns an error unless the link is valid for the gallery.
+	VerifyShareLink(gallery *Gallery, link *ShareLink) error
+	// RevokeShareLinks invalidates all share links of the gallery.
+	RevokeShareLinks(gallery *Gallery) error
+	// Unlock checks password against the gallery's password and returns
+	// a token proving the gallery was unlocked, valid until expires.
+	// ErrTooManyAttempts is returned while the gallery makes visitors wait
+	// after wrong passwords.
+	Unlock(gallery *Gallery, password string) (token string, expires time.Time, err error)
+	// VerifyUnlock returns ErrGalleryLocked unless token was
+	// created by Unlock for the gallery and has not expired.
+	VerifyUnlock(gallery *Gallery, token string) error
+	// RoleOf returns the role user has in the gallery, which is
+	// empty if they are neither its owner nor a member.
+	RoleOf(user *User, gallery *Gallery) (Role, error)
+	// Can reports whether user is allowed to perform action on the gallery.
+	Can(user *User, gallery *Gallery, action Action) (bool, error)
+	// AddMember gives user the role in the gallery, replacing
+	// any role they had before.
+	AddMember(gallery *Gallery, user *User, role Role) error
+	// Ancestors returns the albums the gallery is in, outermost first.
+	Ancestors(gallery *Gallery) ([]Gallery, error)
 }
 
 type GalleryDB interface {
 	ByID(id uint) (*Gallery, error)
+	BySlug(slug string) (*Gallery, error)
 	ByUserID(id uint) ([]Gallery, error)
+	// ByMemberID returns the galleries the user is a member of.
+	ByMemberID(userID uint) ([]Gallery, error)
+	// ByUserIDPage returns a page of up to limit galleries the user owns or
+	// is a member of in the given order, starting at cursor. The cursor of
+	// the first page is empty. The cursor of the next page is returned
+	// along with the galleries, it is empty on the last page.
+	ByUserIDPage(userID uint, cursor string, limit int, sort GallerySort) ([]Gallery, string, error)
+	// ByParentID returns the galleries in the album with parentID.
+	ByParentID(parentID uint) ([]Gallery, error)
+	// Search returns the galleries the user with userID can find whose
+	// title or tags match query, best matches first.
+	Search(userID uint, query string, limit, offset int) ([]Gallery, error)
 	Create(gallery *Gallery) error
 	Delete(id uint) error
 	Update(gallery *Gallery) error
+
+	Member(galleryID, userID uint) (*GalleryMember, error)
+	// Members returns the members of the gallery with their User loaded.
+	Members(galleryID uint) ([]GalleryMember, error)
+	SaveMember(member *GalleryMember) error
+	DeleteMember(galleryID, userID uint) error
 }
 
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, hmacKey, pepper string, store ratelimit.Store) GalleryService {
 	return &galleryService{
-		GalleryDB: &galleryValidator{&galleryGorm{db}},
+		GalleryDB: &galleryValidator{
+			GalleryDB: &galleryGorm{db},
+			users:     &userGorm{db},
+			pepper:    pepper,
+		},
+		hmac:    hash.NewHMAC(hmacKey),
+		pepper:  pepper,
+		unlocks: newUnlockBackoff(store),
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	hmac    hash.HMAC
+	pepper  string
+	unlocks *ratelimit.Backoff
 }
 
 type galleryValidator struct {
 	GalleryDB
+	users  UserDB
+	pepper string
 }
 
 func (gv *galleryValidator) Create(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.titleRequired,
-		gv.userIDRequired)
+		gv.userIDRequired,
+		gv.visibilityValid,
+		gv.ownerVerified,
+		gv.tagsNormalize,
+		gv.parentValid,
+		gv.setDefaultSlug,
+		gv.setDefaultShareSecret,
+		gv.passwordMinLength,
+		gv.bcryptPassword)
 	if err != nil {
 		return err
 	}
@@ -80,7 +258,15 @@ func (gv *galleryValidator) Delete(id uint) error {
 func (gv *galleryValidator) Update(gallery *Gallery) error {
 	err := runGalleryValFuncs(gallery,
 		gv.titleRequired,
-		gv.userIDRequired)
+		gv.userIDRequired,
+		gv.visibilityValid,
+		gv.ownerVerified,
+		gv.tagsNormalize,
+		gv.parentValid,
+		gv.setDefaultSlug,
+		gv.setDefaultShareSecret,
+		gv.passwordMinLength,
+		gv.bcryptPassword)
 	if err != nil {
 		return err
 	}
@@ -102,6 +288,168 @@ func (gv *galleryValidator) userIDRequired(gallery *Gallery) error {
 	return nil
 }
 
+// visibilityValid defaults the visibility of galleries to private.
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	switch gallery.Visibility {
+	case "":
+		gallery.Visibility = VisibilityPrivate
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+	default:
+		return ErrVisibilityInvalid
+	}
+	return nil
+}
+
+// ownerVerified makes sure galleries are only shared, by making them
+// public or unlisted or by giving them a new password, once their owner
+// verified their email address. Galleries that were already shared can
+// still be edited.
+func (gv *galleryValidator) ownerVerified(gallery *Gallery) error {
+	if gallery.Password == "" {
+		if gallery.Visibility == VisibilityPrivate {
+			return nil
+		}
+		if gallery.ID != 0 {
+			existing, err := gv.GalleryDB.ByID(gallery.ID)
+			if err != nil {
+				return err
+			}
+			if existing.Visibility != VisibilityPrivate {
+				return nil
+			}
+		}
+	}
+	owner, err := gv.users.ByID(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	if !owner.Verified() {
+		return ErrEmailUnverified
+	}
+	return nil
+}
+
+func (gv *galleryValidator) tagsNormalize(gallery *Gallery) error {
+	tags, err := normalizeTags(gallery.Tags)
+	if err != nil {
+		return err
+	}
+	gallery.Tags = tags
+	return nil
+}
+
+// parentValid makes sure the gallery's album belongs to the same user and
+// that the gallery is not placed inside itself or one of its own albums.
+// The galleries inside the gallery count towards maxGalleryDepth too, as
+// they move along with it.
+func (gv *galleryValidator) parentValid(gallery *Gallery) error {
+	if gallery.ParentID == 0 {
+		return nil
+	}
+	depth := 0
+	if gallery.ID != 0 {
+		height, err := gv.height(gallery.ID, maxGalleryDepth+1)
+		if err != nil {
+			return err
+		}
+		depth = height
+	}
+	for parentID := gallery.ParentID; parentID != 0; depth++ {
+		if parentID == gallery.ID || depth >= maxGalleryDepth {
+			return ErrParentInvalid
+		}
+		parent, err := gv.ByID(parentID)
+		switch err {
+		case nil:
+		case ErrNotFound:
+			return ErrParentInvalid
+		default:
+			return err
+		}
+		if parent.UserID != gallery.UserID {
+			return ErrParentInvalid
+		}
+		parentID = parent.ParentID
+	}
+	return nil
+}
+
+// height returns how many levels of galleries are nested inside the
+// album with id, looking no more than limit levels down.
+func (gv *galleryValidator) height(id uint, limit int) (int, error) {
+	if limit <= 0 {
+		return 0, nil
+	}
+	children, err := gv.ByParentID(id)
+	if err != nil {
+		return 0, err
+	}
+	height := 0
+	for _, child := range children {
+		h, err := gv.height(child.ID, limit-1)
+		if err != nil {
+			return 0, err
+		}
+		if h+1 > height {
+			height = h + 1
+		}
+	}
+	return height, nil
+}
+
+// setDefaultSlug gives galleries a slug if they do not have one yet.
+// This also covers galleries created before slugs were introduced
+// the first time they are updated.
+func (gv *galleryValidator) setDefaultSlug(gallery *Gallery) error {
+	if gallery.Slug != "" {
+		return nil
+	}
+	slug, err := rand.GallerySlug()
+	if err != nil {
+		return err
+	}
+	gallery.Slug = slug
+	return nil
+}
+
+func (gv *galleryValidator) setDefaultShareSecret(gallery *Gallery) error {
+	if gallery.ShareSecret != "" {
+		return nil
+	}
+	secret, err := rand.ShareSecret()
+	if err != nil {
+		return err
+	}
+	gallery.ShareSecret = secret
+	return nil
+}
+
+func (gv *galleryValidator) passwordMinLength(gallery *Gallery) error {
+	if gallery.Password == "" {
+		return nil
+	}
+	if len(gallery.Password) < minGalleryPasswordLength {
+		return ErrGalleryPasswordTooShort
+	}
+	return nil
+}
+
+// bcryptPassword hashes the gallery's password the same way user
+// passwords are hashed.
+func (gv *galleryValidator) bcryptPassword(gallery *Gallery) error {
+	if gallery.Password == "" {
+		return nil
+	}
+	pwBytes := []byte(gallery.Password + gv.pepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(pwBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	gallery.PasswordHash = string(hashedBytes)
+	gallery.Password = ""
+	return nil
+}
+
 func (gv *galleryValidator) idGreaterThan(n uint) galleryValFunc {
 	return galleryValFunc(func(gallery *Gallery) error {
 		if gallery.ID <= n {
@@ -121,9 +469,26 @@ func (gg *galleryGorm) Create(gallery *Gallery) error {
 	return gg.db.Create(gallery).Error
 }
 
+// Delete removes the gallery and its members. Galleries in the
+// deleted album are moved up into the album that contained it.
 func (gg *galleryGorm) Delete(id uint) error {
-	gallery := Gallery{Model: gorm.Model{ID: id}}
-	return gg.db.Delete(&gallery).Error
+	existing, err := gg.ByID(id)
+	if err != nil {
+		return err
+	}
+	return gg.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Gallery{}).Where("parent_id = ?", id).
+			Update("parent_id", existing.ParentID).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("gallery_id = ?", id).Delete(&GalleryMember{}).Error
+		if err != nil {
+			return err
+		}
+		gallery := Gallery{Model: gorm.Model{ID: id}}
+		return tx.Delete(&gallery).Error
+	})
 }
 
 func (gg *galleryGorm) Update(gallery *Gallery) error {
@@ -140,6 +505,25 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, err
 }
 
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ?", slug)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, err
+}
+
+func (gg *galleryGorm) ByParentID(parentID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.Where("parent_id = ?", parentID).Order("title asc").Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
 func (gg *galleryGorm) ByUserID(userID uint) ([]Gallery, error) {
 	var galleries []Gallery
 	err := gg.db.Where("user_id = ?", userID).Find(&galleries).Error
@@ -160,3 +544,17 @@ func runGalleryValFuncs(gallery *Gallery, fns ...galleryValFunc) error {
 	}
 	return nil
 }
+
+func (gs *galleryService) Ancestors(gallery *Gallery) ([]Gallery, error) {
+	var ancestors []Gallery
+	parentID := gallery.ParentID
+	for len(ancestors) < maxGalleryDepth && parentID != 0 {
+		parent, err := gs.ByID(parentID)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append([]Gallery{*parent}, ancestors...)
+		parentID = parent.ParentID
+	}
+	return ancestors, nil
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestGalleryVisibility(t *testing.T) {
+	gv := &galleryValidator{}
+	gallery := Gallery{UserID: 1}
+	if err := runGalleryValFuncs(&gallery, gv.visibilityValid, gv.setDefaultSlug); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.Visibility != VisibilityPrivate {
+		t.Errorf("Expected galleries to default to private. Received %q", gallery.Visibility)
+	}
+	if gallery.Slug == "" {
+		t.Errorf("Expected the gallery to be given a slug")
+	}
+	slug := gallery.Slug
+	if err := gv.setDefaultSlug(&gallery); err != nil || gallery.Slug != slug {
+		t.Errorf("Expected the slug to be kept. Received %q", gallery.Slug)
+	}
+	gallery.Visibility = "friends"
+	if err := gv.visibilityValid(&gallery); err != ErrVisibilityInvalid {
+		t.Errorf("Expected ErrVisibilityInvalid. Received %v", err)
+	}
+
+	owner := &User{Model: gorm.Model{ID: 1}}
+	other := &User{Model: gorm.Model{ID: 2}}
+	tests := []struct {
+		visibility    Visibility
+		user          *User
+		canView       bool
+		canViewBySlug bool
+	}{
+		{VisibilityPrivate, owner, true, true},
+		{VisibilityPrivate, other, false, false},
+		{VisibilityPrivate, nil, false, false},
+		{VisibilityUnlisted, other, false, true},
+		{VisibilityUnlisted, nil, false, true},
+		{VisibilityPublic, nil, true, true},
+	}
+	for _, tt := range tests {
+		gallery := Gallery{UserID: 1, Visibility: tt.visibility}
+		if got := gallery.CanView(tt.user); got != tt.canView {
+			t.Errorf("%s: CanView(%v) = %v, want %v", tt.visibility, tt.user, got, tt.canView)
+		}
+		if got := gallery.CanViewBySlug(tt.user); got != tt.canViewBySlug {
+			t.Errorf("%s: CanViewBySlug(%v) = %v, want %v", tt.visibility, tt.user, got, tt.canViewBySlug)
+		}
+	}
+}
+
+// memGalleries is a GalleryDB that can only look galleries up by
+// ID and parent.
+type memGalleries struct {
+	GalleryDB
+	galleries map[uint]*Gallery
+}
+
+func (m *memGalleries) ByID(id uint) (*Gallery, error) {
+	gallery, ok := m.galleries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	g := *gallery
+	return &g, nil
+}
+
+func (m *memGalleries) ByParentID(parentID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	for _, gallery := range m.galleries {
+		if gallery.ParentID == parentID {
+			galleries = append(galleries, *gallery)
+		}
+	}
+	return galleries, nil
+}
+
+func TestGalleryParentValid(t *testing.T) {
+	// 1 contains 2 which contains 3, 4 belongs to someone else
+	galleries := map[uint]*Gallery{
+		1: {Model: gorm.Model{ID: 1}, UserID: 1},
+		2: {Model: gorm.Model{ID: 2}, UserID: 1, ParentID: 1},
+		3: {Model: gorm.Model{ID: 3}, UserID: 1, ParentID: 2},
+		4: {Model: gorm.Model{ID: 4}, UserID: 2},
+	}
+	// 100 galleries deep, each in the one before
+	for id := uint(100); id < 100+maxGalleryDepth+1; id++ {
+		galleries[id] = &Gallery{Model: gorm.Model{ID: id}, UserID: 1, ParentID: id - 1}
+	}
+	galleries[100].ParentID = 0
+	gv := &galleryValidator{GalleryDB: &memGalleries{galleries: galleries}}
+
+	tests := []struct {
+		name     string
+		id       uint
+		parentID uint
+		want     error
+	}{
+		{"top level", 1, 0, nil},
+		{"new gallery", 0, 3, nil},
+		{"into its grandparent", 3, 1, nil},
+		{"in itself", 1, 1, ErrParentInvalid},
+		{"in its child", 1, 2, ErrParentInvalid},
+		{"in its grandchild", 1, 3, ErrParentInvalid},
+		{"in other user's album", 3, 4, ErrParentInvalid},
+		{"in missing album", 3, 99, ErrParentInvalid},
+		{"too deep", 0, 100 + maxGalleryDepth, ErrParentInvalid},
+		// 1 brings two levels of galleries along with it
+		{"with its galleries", 1, 100 + maxGalleryDepth - 3, nil},
+		{"with its galleries too deep", 1, 100 + maxGalleryDepth - 2, ErrParentInvalid},
+	}
+	for _, tt := range tests {
+		gallery := Gallery{Model: gorm.Model{ID: tt.id}, UserID: 1, ParentID: tt.parentID}
+		if err := gv.parentValid(&gallery); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestGalleryOwnerVerified(t *testing.T) {
+	now := time.Now()
+	users := memUsers{
+		1: &User{Model: gorm.Model{ID: 1}, VerifiedAt: &now},
+		2: &User{Model: gorm.Model{ID: 2}},
+	}
+	// 10 is private and 11 was shared before its owner had to verify
+	galleries := map[uint]*Gallery{
+		10: {Model: gorm.Model{ID: 10}, UserID: 2, Visibility: VisibilityPrivate},
+		11: {Model: gorm.Model{ID: 11}, UserID: 2, Visibility: VisibilityPublic, PasswordHash: "hash"},
+	}
+	gv := &galleryValidator{GalleryDB: &memGalleries{galleries: galleries}, users: users}
+	tests := []struct {
+		name    string
+		gallery Gallery
+		want    error
+	}{
+		{"unverified private", Gallery{UserID: 2, Visibility: VisibilityPrivate}, nil},
+		{"unverified unlisted", Gallery{UserID: 2, Visibility: VisibilityUnlisted}, ErrEmailUnverified},
+		{"unverified public", Gallery{UserID: 2, Visibility: VisibilityPublic}, ErrEmailUnverified},
+		{"unverified password", Gallery{UserID: 2, Visibility: VisibilityPrivate, Password: "secret"}, ErrEmailUnverified},
+		{"verified public", Gallery{UserID: 1, Visibility: VisibilityPublic}, nil},
+		{"verified password", Gallery{UserID: 1, Visibility: VisibilityPrivate, Password: "secret"}, nil},
+		{"unverified publishing", Gallery{Model: gorm.Model{ID: 10}, UserID: 2, Visibility: VisibilityPublic}, ErrEmailUnverified},
+		{"unverified editing shared", Gallery{Model: gorm.Model{ID: 11}, UserID: 2, Visibility: VisibilityUnlisted, PasswordHash: "hash"}, nil},
+		{"unverified new password", Gallery{Model: gorm.Model{ID: 11}, UserID: 2, Visibility: VisibilityPublic, Password: "secret"}, ErrEmailUnverified},
+		{"unverified making private", Gallery{Model: gorm.Model{ID: 11}, UserID: 2, Visibility: VisibilityPrivate, PasswordHash: "hash"}, nil},
+	}
+	for _, tt := range tests {
+		if err := gv.ownerVerified(&tt.gallery); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+}
@@ -1,120 +1,1099 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
-)
+	"time"
+	"unicode/utf8"
 
-const (
-	imagePath = "images/galleries"
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/exif"
+	"lenslocked.com/imaging"
+	"lenslocked.com/rand"
+	"lenslocked.com/storage"
 )
 
+// imagesURL is the path images are served from by the Images controller.
+const imagesURL = "/images/"
+
+// imageSizes are the derivatives generated for every uploaded image
+// that we are able to decode.
+var imageSizes = []imaging.Size{
+	{Name: "thumb", MaxDim: 320},
+	{Name: "medium", MaxDim: 800},
+	{Name: "large", MaxDim: 1600},
+}
+
+// Image is used to represent images stored in a Gallery.
+// The record is persisted in the DB while the image bytes
+// are kept in the BlobStore the ImageService was created with.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	ID        uint `gorm:"primary_key"`
+	GalleryID uint `gorm:"not null;index"`
+	// UID is the random ID the image is stored and addressed by.
+	UID string `gorm:"not null;unique_index"`
+	// Filename is the name the image is stored under, made up of the UID
+	// and an extension matching the image type.
+	Filename string `gorm:"not null"`
+	// OriginalFilename is the name the image was uploaded with. It is only
+	// used for display.
+	OriginalFilename string
+	ContentType      string
+	Size             int64
+	Checksum         string
+	// Width and Height are the dimensions of the original image. They are
+	// left as zero if the image could not be decoded, in which case no
+	// derivatives were generated.
+	Width  int
+	Height int
+	// Position orders the images within their gallery, starting at 1.
+	Position int `gorm:"not null;default:0"`
+
+	// Title, Caption and AltText are set by the gallery owner.
+	Title   string
+	Caption string `gorm:"type:text"`
+	AltText string
+	// Tags are stored lowercase and comma separated.
+	Tags string `gorm:"not null;default:''"`
+
+	// Metadata read from the image's EXIF data on upload.
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	// Latitude and Longitude are only kept in the DB, they are removed from
+	// the stored image. They are nil if the image had no location data.
+	Latitude  *float64
+	Longitude *float64
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// url and sizeURLs are set by the ImageService.
+	url      string
+	sizeURLs map[string]string
 }
 
+// Path returns the URL the original image can be requested from.
 func (i *Image) Path() string {
-	// contruct a URL with our path and output with String() to
-	// ensure that paths are url encoded.
-	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+	return i.url
+}
+
+// SizePath returns the URL of the named derivative, falling
+// back to the original if there is no such derivative.
+func (i *Image) SizePath(size string) string {
+	if url, ok := i.sizeURLs[size]; ok {
+		return url
+	}
+	return i.url
+}
+
+// ThumbPath returns the URL of the thumbnail derivative.
+func (i *Image) ThumbPath() string {
+	return i.SizePath("thumb")
+}
+
+// MediumPath returns the URL of the medium derivative.
+func (i *Image) MediumPath() string {
+	return i.SizePath("medium")
+}
+
+// LargePath returns the URL of the large derivative.
+func (i *Image) LargePath() string {
+	return i.SizePath("large")
+}
+
+// SrcSet returns the value of an img srcset attribute
+// listing every derivative along with its width.
+func (i *Image) SrcSet() string {
+	if !i.HasSizes() {
+		return ""
+	}
+	set := make([]string, 0, len(imageSizes))
+	for _, size := range imageSizes {
+		w, _ := imaging.Fit(i.Width, i.Height, size.MaxDim)
+		set = append(set, fmt.Sprintf("%s %dw", i.SizePath(size.Name), w))
+	}
+	return strings.Join(set, ", ")
+}
+
+// Alt returns the text used for the image's alt attribute, falling
+// back to its title when no alt text has been set.
+func (i *Image) Alt() string {
+	switch {
+	case i.AltText != "":
+		return i.AltText
+	case i.Title != "":
+		return i.Title
+	}
+	return "Gallery image"
+}
+
+// TagList returns the image's tags.
+func (i *Image) TagList() []string {
+	return splitTags(i.Tags)
+}
+
+// TagsInput returns the image's tags formatted for a form input.
+func (i *Image) TagsInput() string {
+	return joinTags(i.Tags)
+}
+
+// Camera returns the camera make and model, e.g. "Canon EOS 5D".
+func (i *Image) Camera() string {
+	// most cameras repeat the make in the model
+	if strings.HasPrefix(i.CameraModel, i.CameraMake) {
+		return i.CameraModel
+	}
+	return strings.TrimSpace(i.CameraMake + " " + i.CameraModel)
+}
+
+// Exposure summarises the exposure settings, e.g. "50mm f/1.8 1/250s ISO 100".
+func (i *Image) Exposure() string {
+	var parts []string
+	if i.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%gmm", i.FocalLength))
+	}
+	if i.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", i.FNumber))
+	}
+	if i.ExposureTime != "" {
+		parts = append(parts, i.ExposureTime+"s")
+	}
+	if i.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", i.ISO))
+	}
+	return strings.Join(parts, " ")
+}
+
+// HasLocation reports whether the location the image was taken at is known.
+func (i *Image) HasLocation() bool {
+	return i.Latitude != nil && i.Longitude != nil
+}
+
+// MapURL returns a link to the location the image was taken at.
+func (i *Image) MapURL() string {
+	if !i.HasLocation() {
+		return ""
+	}
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=15/%f/%f",
+		*i.Latitude, *i.Longitude, *i.Latitude, *i.Longitude)
+}
+
+// HideLocation clears the location so it is not rendered.
+func (i *Image) HideLocation() {
+	i.Latitude = nil
+	i.Longitude = nil
+}
+
+// setExif copies the metadata we keep from the EXIF data onto the image.
+func (i *Image) setExif(d *exif.Data) {
+	i.CameraMake = d.Make
+	i.CameraModel = d.Model
+	i.LensModel = d.LensModel
+	i.ExposureTime = d.ExposureTime
+	i.FNumber = d.FNumber
+	i.ISO = d.ISO
+	i.FocalLength = d.FocalLength
+	if !d.TakenAt.IsZero() {
+		takenAt := d.TakenAt
+		i.TakenAt = &takenAt
 	}
-	return temp.String()
+	if d.HasLocation {
+		lat, lng := d.Latitude, d.Longitude
+		i.Latitude = &lat
+		i.Longitude = &lng
+	}
+}
+
+// Key returns the key the original image is stored under in the BlobStore.
+func (i *Image) Key() string {
+	return fmt.Sprintf("%s/%v", galleryKey(i.GalleryID), i.Filename)
+}
+
+// SizeKey returns the key the named derivative is stored under. Derivatives
+// are stored next to the original with the size appended to the name.
+func (i *Image) SizeKey(size string) string {
+	ext := imaging.Ext(imaging.DerivativeFormat(i.format()))
+	base := strings.TrimSuffix(i.Filename, path.Ext(i.Filename))
+	return fmt.Sprintf("%s/%s_%s%s", galleryKey(i.GalleryID), base, size, ext)
+}
+
+// HasSizes reports whether derivatives were generated for the image.
+// They are missing for images we were unable to decode.
+func (i *Image) HasSizes() bool {
+	return i.Width > 0 && i.Height > 0
 }
 
-func (i *Image) RelativePath() string {
-	return fmt.Sprintf("%s/%v/%v", imagePath, i.GalleryID, i.Filename)
+// format returns the image format name derived from the content type.
+func (i *Image) format() string {
+	return strings.TrimPrefix(i.ContentType, "image/")
+}
+
+// AddQuery appends q to the URLs of the image and its derivatives.
+// It is used to pass share link signatures on to image requests.
+func (i *Image) AddQuery(q url.Values) {
+	i.url = addQuery(i.url, q)
+	for size, u := range i.sizeURLs {
+		i.sizeURLs[size] = addQuery(u, q)
+	}
+}
+
+func addQuery(u string, q url.Values) string {
+	if strings.Contains(u, "?") {
+		return u + "&" + q.Encode()
+	}
+	return u + "?" + q.Encode()
+}
+
+// SizeContentType returns the content type of the named derivative,
+// or of the original when size is empty or there are no derivatives.
+func (i *Image) SizeContentType(size string) string {
+	if size == "" || !i.HasSizes() {
+		return i.ContentType
+	}
+	return imaging.ContentType(imaging.DerivativeFormat(i.format()))
+}
+
+// ETag returns the entity tag of the named derivative, or of the
+// original when size is empty. It changes whenever the image does.
+func (i *Image) ETag(size string) string {
+	if size == "" {
+		return fmt.Sprintf("%q", i.Checksum)
+	}
+	return fmt.Sprintf("%q", i.Checksum+"-"+size)
+}
+
+func isImageSize(name string) bool {
+	for _, size := range imageSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// galleryKey returns the key prefix used for all images of a gallery.
+func galleryKey(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v", galleryID)
 }
 
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) (int64, error)
+	Create(galleryID uint, r io.ReadCloser, filename string) (*Image, error)
+	ByID(id uint) (*Image, error)
+	ByUID(uid string) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
+	// ByGalleryIDPage returns a page of up to limit images of the gallery
+	// starting at cursor, along with the cursor of the next page. The
+	// cursor of the first page is empty, as is the one after the last.
+	ByGalleryIDPage(galleryID uint, cursor string, limit int) ([]Image, string, error)
+	// Open returns the stored bytes of the image, or of the named
+	// derivative when size is not empty. Images without derivatives
+	// fall back to the original like SizePath.
+	Open(i *Image, size string) (io.ReadCloser, error)
+	// Rotate turns the image 90° clockwise.
+	Rotate(i *Image) error
+	// Update saves the title, caption, alt text and tags of the image.
+	Update(i *Image) error
+	// Reorder sets the order of a gallery's images. uids must list
+	// every image in the gallery exactly once.
+	Reorder(galleryID uint, uids []string) error
+	// Move moves the images to the end of the gallery with galleryID.
+	Move(images []Image, galleryID uint) error
+	// Copy adds copies of the images to the end of the gallery with
+	// galleryID and returns the copies.
+	Copy(images []Image, galleryID uint) ([]Image, error)
 	Delete(i *Image) error
 	DeleteAll(galleryID uint) error
+	// Search returns the images the user with userID can find that match
+	// query. Visitors who are not signed in use a userID of 0.
+	Search(userID uint, query string, limit, offset int) ([]Image, error)
 }
 
+// ImageDB is used to interact with the images table.
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByUID(uid string) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	ByGalleryIDPage(galleryID uint, cursor string, limit int) ([]Image, string, error)
+	Create(image *Image) error
+	// CreateAll creates the images in a single transaction.
+	CreateAll(images []Image) error
+	Update(image *Image) error
+	// MoveAll moves the images with ids to the end of the gallery
+	// with galleryID in a single transaction.
+	MoveAll(ids []uint, galleryID uint) error
+	// UpdatePositions sets the position of each image in uids to its
+	// index in the slice plus one.
+	UpdatePositions(galleryID uint, uids []string) error
+	Delete(id uint) error
+	DeleteByGalleryID(galleryID uint) error
+	// Search returns the images the user with userID can find whose text,
+	// tags, EXIF data or gallery match query, best matches first.
+	Search(userID uint, query string, limit, offset int) ([]Image, error)
+}
+
+const (
+	maxImageTitleLength   = 100
+	maxImageCaptionLength = 2000
+	maxImageAltTextLength = 250
+
+	// MaxImageBytes is the largest image that can be uploaded.
+	MaxImageBytes = 20 << 20 // 20 MB
+	// MaxUploadBytes is the most that can be uploaded in a single request.
+	MaxUploadBytes = 100 << 20 // 100 MB
+	// MaxImageDim is the largest width or height of an uploaded image in pixels.
+	MaxImageDim = 10000
+	// MaxImagePixels is the largest number of pixels an uploaded image can have.
+	MaxImagePixels = 50000000
+)
+
+// imageTypes maps the content types we accept to the file
+// extensions they may be uploaded with.
+var imageTypes = map[string][]string{
+	"image/jpeg": {".jpg", ".jpeg"},
+	"image/png":  {".png"},
+	"image/gif":  {".gif"},
+	"image/webp": {".webp"},
+}
+
+// imageUpload holds the contents of an uploaded file while it is validated.
+type imageUpload struct {
+	Filename string
+	Data     []byte
+}
+
+type imageValFunc func(*Image) error
+
+func runImageValFuncs(image *Image, fns ...imageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type imageUploadValFunc func(*imageUpload) error
+
+func runImageUploadValFuncs(upload *imageUpload, fns ...imageUploadValFunc) error {
+	for _, fn := range fns {
+		if err := fn(upload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageValidator checks uploads are images we are willing to
+// store before passing them on to the ImageService.
 type imageValidator struct {
 	ImageService
 }
 
 var _ ImageService = &imageValidator{&imageService{}}
 
-func NewImageService() ImageService {
-	return &imageService{}
+// NewImageService returns an ImageService storing image records in db
+// and image bytes in store.
+func NewImageService(db *gorm.DB, store storage.BlobStore) ImageService {
+	return &imageValidator{
+		ImageService: &imageService{
+			ImageDB: &imageGorm{db},
+			store:   store,
+		},
+	}
 }
 
-type imageService struct{}
+func (iv *imageValidator) Create(galleryID uint, r io.ReadCloser, filename string) (*Image, error) {
+	defer r.Close()
 
+	// read one byte more than we allow so we can tell if the limit was exceeded.
+	b, err := ioutil.ReadAll(io.LimitReader(r, MaxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	upload := imageUpload{
+		Filename: filename,
+		Data:     b,
+	}
+	err = runImageUploadValFuncs(&upload,
+		iv.filenameValid,
+		iv.maxBytes(MaxImageBytes),
+		iv.typeAllowed,
+		iv.maxDimensions(MaxImageDim, MaxImagePixels))
+	if err != nil {
+		return nil, err
+	}
+	return iv.ImageService.Create(galleryID, ioutil.NopCloser(bytes.NewReader(b)), upload.Filename)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFuncs(image,
+		iv.idGreaterThan(0),
+		iv.trimText,
+		iv.textMaxLength,
+		iv.tagsNormalize)
+	if err != nil {
+		return err
+	}
+	return iv.ImageService.Update(image)
+}
+
+func (iv *imageValidator) idGreaterThan(n uint) imageValFunc {
+	return imageValFunc(func(image *Image) error {
+		if image.ID <= n {
+			return ErrIDInvalid
+		}
+		return nil
+	})
+}
+
+func (iv *imageValidator) trimText(image *Image) error {
+	image.Title = strings.TrimSpace(image.Title)
+	image.Caption = strings.TrimSpace(image.Caption)
+	image.AltText = strings.TrimSpace(image.AltText)
+	return nil
+}
+
+func (iv *imageValidator) textMaxLength(image *Image) error {
+	switch {
+	case utf8.RuneCountInString(image.Title) > maxImageTitleLength:
+		return ErrImageTitleTooLong
+	case utf8.RuneCountInString(image.Caption) > maxImageCaptionLength:
+		return ErrImageCaptionTooLong
+	case utf8.RuneCountInString(image.AltText) > maxImageAltTextLength:
+		return ErrImageAltTextTooLong
+	}
+	return nil
+}
+
+func (iv *imageValidator) tagsNormalize(image *Image) error {
+	tags, err := normalizeTags(image.Tags)
+	if err != nil {
+		return err
+	}
+	image.Tags = tags
+	return nil
+}
+
+func (iv *imageValidator) Reorder(galleryID uint, uids []string) error {
+	images, err := iv.ImageService.ByGalleryID(galleryID)
+	if err != nil {
+		return err
+	}
+	if len(uids) != len(images) {
+		return ErrImageOrderInvalid
+	}
+	seen := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		seen[uid] = true
+	}
+	for _, image := range images {
+		if !seen[image.UID] {
+			return ErrImageOrderInvalid
+		}
+	}
+	return iv.ImageService.Reorder(galleryID, uids)
+}
+
+func (iv *imageValidator) Move(images []Image, galleryID uint) error {
+	if err := iv.imagesSelected(images, galleryID); err != nil {
+		return err
+	}
+	for _, image := range images {
+		if image.GalleryID == galleryID {
+			return ErrImageMoveInvalid
+		}
+	}
+	return iv.ImageService.Move(images, galleryID)
+}
+
+func (iv *imageValidator) Copy(images []Image, galleryID uint) ([]Image, error) {
+	if err := iv.imagesSelected(images, galleryID); err != nil {
+		return nil, err
+	}
+	return iv.ImageService.Copy(images, galleryID)
+}
+
+func (iv *imageValidator) imagesSelected(images []Image, galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	if len(images) == 0 {
+		return ErrNoImagesSelected
+	}
+	for _, image := range images {
+		if image.ID <= 0 {
+			return ErrIDInvalid
+		}
+	}
+	return nil
+}
+
+// filenameValid rejects names that are empty or contain a path
+// so an upload can never be written outside of its gallery.
+func (iv *imageValidator) filenameValid(upload *imageUpload) error {
+	name := strings.TrimSpace(upload.Filename)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return ErrFilenameInvalid
+	}
+	upload.Filename = name
+	return nil
+}
+
+func (iv *imageValidator) maxBytes(n int) imageUploadValFunc {
+	return imageUploadValFunc(func(upload *imageUpload) error {
+		if len(upload.Data) > n {
+			return ErrImageTooLarge
+		}
+		return nil
+	})
+}
+
+// typeAllowed sniffs the content type from the uploaded bytes rather
+// than trusting the client, and checks it against our allow-list. The
+// file extension must be one of that type's, so the stored name matches
+// the bytes we serve under it.
+func (iv *imageValidator) typeAllowed(upload *imageUpload) error {
+	exts, ok := imageTypes[http.DetectContentType(upload.Data)]
+	if !ok {
+		return ErrImageTypeInvalid
+	}
+	ext := strings.ToLower(path.Ext(upload.Filename))
+	for _, allowed := range exts {
+		if ext == allowed {
+			return nil
+		}
+	}
+	return ErrImageTypeInvalid
+}
+
+// maxDimensions reads the image header to check its size
+// before we ever attempt to decode the whole image.
+func (iv *imageValidator) maxDimensions(maxDim, maxPixels int) imageUploadValFunc {
+	return imageUploadValFunc(func(upload *imageUpload) error {
+		cfg, _, err := imaging.DecodeConfig(bytes.NewReader(upload.Data))
+		if err != nil {
+			return ErrImageTypeInvalid
+		}
+		if cfg.Width > maxDim || cfg.Height > maxDim || cfg.Width*cfg.Height > maxPixels {
+			return ErrImageDimensions
+		}
+		return nil
+	})
+}
+
+// imageService keeps the image records in the DB in step with
+// the image bytes held in the BlobStore.
+type imageService struct {
+	ImageDB
+	store storage.BlobStore
+}
+
+func (is *imageService) ByID(id uint) (*Image, error) {
+	image, err := is.ImageDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	is.setURL(image)
+	return image, nil
+}
+
+func (is *imageService) ByUID(uid string) (*Image, error) {
+	image, err := is.ImageDB.ByUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	is.setURL(image)
+	return image, nil
+}
+
+func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		is.setURL(&images[i])
+	}
+	return images, nil
+}
+
+// Delete removes the image from the BlobStore before removing the image record.
 func (is *imageService) Delete(i *Image) error {
-	return os.Remove(i.RelativePath())
+	if i.ID <= 0 {
+		return ErrIDInvalid
+	}
+	if err := is.store.Delete(i.Key()); err != nil {
+		return err
+	}
+	if i.HasSizes() {
+		for _, size := range imageSizes {
+			if err := is.store.Delete(i.SizeKey(size.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return is.ImageDB.Delete(i.ID)
 }
 
+// DeleteAll removes all stored images and image records for the given gallery.
 func (is *imageService) DeleteAll(galleryID uint) error {
-	return os.RemoveAll(fmt.Sprintf("%s/%d", imagePath, galleryID))
+	if galleryID <= 0 {
+		return ErrIDInvalid
+	}
+	keys, err := is.store.List(galleryKey(galleryID) + "/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := is.store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return is.ImageDB.DeleteByGalleryID(galleryID)
 }
 
-func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) (int64, error) {
+// Create stores the image in the BlobStore and records it in the DB. If the
+// record can not be created the blob is removed again so the two stay in step.
+// The image is stored under a random ID, filename is only kept for display.
+// EXIF metadata is recorded on the image and location data is removed
+// from the stored copy.
+func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) (*Image, error) {
 	defer r.Close()
 
-	path, err := is.mkImagePath(galleryID)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := rand.ImageID()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := exif.Decode(b)
+	if err != nil && err != exif.ErrNoExif {
+		log.Printf("models: ignoring exif data of %s: %v", filename, err)
+	}
+	b, err = exif.StripLocation(b)
+	if err != nil {
+		// we can't tell if the exif data holds a location, so don't store it.
+		return nil, ErrImageMetadataInvalid
+	}
+	if meta != nil && meta.Orientation > 1 {
+		// apply the orientation to the pixels so every browser,
+		// and every derivative, shows the image upright.
+		oriented, err := reencode(b, func(img image.Image) image.Image {
+			return imaging.Orient(img, meta.Orientation)
+		})
+		if err != nil {
+			log.Printf("models: not correcting orientation of %s: %v", filename, err)
+		} else {
+			b = oriented
+		}
+	}
+	contentType := http.DetectContentType(b)
+	sum := sha256.Sum256(b)
+	image := Image{
+		GalleryID:        galleryID,
+		UID:              uid,
+		Filename:         uid + imageExt(contentType, filename),
+		OriginalFilename: filename,
+		ContentType:      contentType,
+		Size:             int64(len(b)),
+		Checksum:         hex.EncodeToString(sum[:]),
+	}
+	if meta != nil {
+		image.setExif(meta)
+	}
+	err = is.store.Put(image.Key(), bytes.NewReader(b), image.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	if err := is.createSizes(&image, b); err != nil {
+		is.deleteBlobs(&image)
+		return nil, err
+	}
+	if err := is.ImageDB.Create(&image); err != nil {
+		is.deleteBlobs(&image)
+		return nil, err
+	}
+	is.setURL(&image)
+	return &image, nil
+}
+
+func (is *imageService) Reorder(galleryID uint, uids []string) error {
+	return is.ImageDB.UpdatePositions(galleryID, uids)
+}
+
+func (is *imageService) Open(i *Image, size string) (io.ReadCloser, error) {
+	key := i.Key()
+	if size != "" {
+		if !isImageSize(size) {
+			return nil, ErrNotFound
+		}
+		if i.HasSizes() {
+			key = i.SizeKey(size)
+		}
+	}
+	rc, err := is.store.Get(key)
+	if err == storage.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return rc, err
+}
+
+// Move copies the bytes of the images to their new gallery before moving the
+// records, so the images are never missing from the BlobStore. If any step
+// fails the copies are removed again and the images stay where they were.
+// The old blobs are only removed once the records have been moved.
+func (is *imageService) Move(images []Image, galleryID uint) error {
+	var src, moved []Image
+	var ids []uint
+	for _, image := range images {
+		// images already in the gallery stay where they are, copying
+		// their blobs onto themselves would destroy them.
+		if image.GalleryID == galleryID {
+			continue
+		}
+		src = append(src, image)
+		image.GalleryID = galleryID
+		moved = append(moved, image)
+		ids = append(ids, image.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	for n := range src {
+		if err := is.copyBlobs(&src[n], &moved[n]); err != nil {
+			is.deleteAllBlobs(moved[:n+1])
+			return err
+		}
+	}
+	if err := is.ImageDB.MoveAll(ids, galleryID); err != nil {
+		is.deleteAllBlobs(moved)
+		return err
+	}
+	is.deleteAllBlobs(src)
+	for n := range images {
+		images[n].GalleryID = galleryID
+		is.setURL(&images[n])
+	}
+	return nil
+}
+
+// Copy stores the bytes of each image under a new random ID in the gallery
+// before creating all of the records at once. If any step fails the copied
+// blobs are removed again.
+func (is *imageService) Copy(images []Image, galleryID uint) ([]Image, error) {
+	copies := make([]Image, len(images))
+	for n, image := range images {
+		uid, err := rand.ImageID()
+		if err != nil {
+			is.deleteAllBlobs(copies[:n])
+			return nil, err
+		}
+		c := image
+		c.ID = 0
+		c.GalleryID = galleryID
+		c.UID = uid
+		c.Filename = uid + path.Ext(image.Filename)
+		c.Position = 0
+		c.CreatedAt = time.Time{}
+		c.UpdatedAt = time.Time{}
+		copies[n] = c
+		if err := is.copyBlobs(&images[n], &copies[n]); err != nil {
+			is.deleteAllBlobs(copies[:n+1])
+			return nil, err
+		}
+	}
+	if err := is.ImageDB.CreateAll(copies); err != nil {
+		is.deleteAllBlobs(copies)
+		return nil, err
+	}
+	for n := range copies {
+		is.setURL(&copies[n])
+	}
+	return copies, nil
+}
+
+// copyBlobs copies the original and any derivatives of src to the keys of dst.
+func (is *imageService) copyBlobs(src, dst *Image) error {
+	err := is.copyBlob(src.Key(), dst.Key(), src.ContentType)
+	if err != nil || !src.HasSizes() {
+		return err
+	}
+	for _, size := range imageSizes {
+		err := is.copyBlob(src.SizeKey(size.Name), dst.SizeKey(size.Name), src.SizeContentType(size.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *imageService) copyBlob(from, to, contentType string) error {
+	rc, err := is.store.Get(from)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer rc.Close()
+	return is.store.Put(to, rc, contentType)
+}
 
-	// create destination file
-	dst, err := os.Create(path + filename)
+// Rotate turns the stored image 90° clockwise and regenerates its derivatives.
+func (is *imageService) Rotate(i *Image) error {
+	rc, err := is.store.Get(i.Key())
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	b, err = reencode(b, imaging.Rotate90)
+	if err == imaging.ErrFormatUnsupported {
+		return ErrImageNotRotatable
+	}
 	if err != nil {
-		return 0, err
+		return err
+	}
+	sum := sha256.Sum256(b)
+	i.Size = int64(len(b))
+	i.Checksum = hex.EncodeToString(sum[:])
+	err = is.store.Put(i.Key(), bytes.NewReader(b), i.ContentType)
+	if err != nil {
+		return err
+	}
+	if err := is.createSizes(i, b); err != nil {
+		return err
 	}
-	defer dst.Close()
+	if err := is.ImageDB.Update(i); err != nil {
+		return err
+	}
+	is.setURL(i)
+	return nil
+}
 
-	// copy file to destination
-	bytes, err := io.Copy(dst, r)
+// reencode decodes the image b, applies fn to it and encodes it again in its
+// original format. The EXIF metadata of JPEGs is carried over with the
+// orientation reset, as fn is expected to have been applied to the pixels.
+func reencode(b []byte, fn func(image.Image) image.Image) ([]byte, error) {
+	img, format, err := imaging.Decode(bytes.NewReader(b))
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, fn(img), format); err != nil {
+		return nil, err
 	}
+	if format != "jpeg" {
+		return buf.Bytes(), nil
+	}
+	seg, err := exif.ExtractJPEG(b)
+	if err == exif.ErrNoExif {
+		return buf.Bytes(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := exif.InsertJPEG(buf.Bytes(), seg)
+	if err != nil {
+		return nil, err
+	}
+	return exif.SetOrientation(out, 1)
+}
 
-	return bytes, nil
+// createSizes generates and stores each of the imageSizes derivatives.
+// Images we are unable to decode are stored without derivatives.
+func (is *imageService) createSizes(image *Image, b []byte) error {
+	img, format, err := imaging.Decode(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("models: not generating sizes for %s: %v", image.Key(), err)
+		return nil
+	}
+	image.ContentType = imaging.ContentType(format)
+	bounds := img.Bounds()
+	image.Width, image.Height = bounds.Dx(), bounds.Dy()
+
+	derivFormat := imaging.DerivativeFormat(format)
+	for _, size := range imageSizes {
+		var buf bytes.Buffer
+		err := imaging.Encode(&buf, imaging.Resize(img, size.MaxDim), derivFormat)
+		if err != nil {
+			return err
+		}
+		err = is.store.Put(image.SizeKey(size.Name), &buf, imaging.ContentType(derivFormat))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteBlobs removes the original and any derivatives of image from the
+// BlobStore. It is used to clean up after a failed Create, Move or Copy
+// and to remove the old blobs of moved images, so errors are ignored.
+func (is *imageService) deleteBlobs(image *Image) {
+	is.store.Delete(image.Key())
+	if image.HasSizes() {
+		for _, size := range imageSizes {
+			is.store.Delete(image.SizeKey(size.Name))
+		}
+	}
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (is *imageService) deleteAllBlobs(images []Image) {
+	for n := range images {
+		is.deleteBlobs(&images[n])
+	}
+}
+
+// imageExt returns the extension to store an image with. It is taken from
+// the detected content type, falling back to the uploaded file's extension.
+func imageExt(contentType, filename string) string {
+	if exts, ok := imageTypes[contentType]; ok {
+		return exts[0]
+	}
+	return strings.ToLower(path.Ext(filename))
+}
+
+// setURL sets the URLs of the image and its derivatives. The URLs include
+// part of the checksum so browsers fetch the image again once it changes,
+// e.g. after being rotated.
+func (is *imageService) setURL(i *Image) {
+	version := ""
+	if len(i.Checksum) >= 8 {
+		version = "?v=" + i.Checksum[:8]
+	}
+	i.url = imagesURL + i.UID + version
+	if !i.HasSizes() {
+		return
+	}
+	i.sizeURLs = make(map[string]string, len(imageSizes))
+	for _, size := range imageSizes {
+		i.sizeURLs[size.Name] = imagesURL + i.UID + "/" + size.Name + version
+	}
+}
+
+var _ ImageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
+}
+
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("id = ?", id), &image)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return galleryPath, nil
+	return &image, nil
 }
 
-func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	imageStrings, err := filepath.Glob(path + "*")
+func (ig *imageGorm) ByUID(uid string) (*Image, error) {
+	var image Image
+	err := first(ig.db.Where("uid = ?", uid), &image)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ByGalleryID returns the images of a gallery in the order set by their position.
+// Images with the same position are returned in the order they were uploaded.
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).Order("position asc, id asc").Find(&images).Error
 	if err != nil {
 		return nil, err
 	}
-	ret := make([]Image, len(imageStrings))
-	for i := range imageStrings {
-		imageStrings[i] = fwdSlashSeparators(imageStrings[i])
-		imageStrings[i] = strings.Replace(imageStrings[i], path, "", 1)
-		ret[i] = Image{
-			Filename:  imageStrings[i],
-			GalleryID: galleryID,
+	return images, nil
+}
+
+// Create places the image after the existing images of its gallery
+// unless a position has been set.
+func (ig *imageGorm) Create(image *Image) error {
+	if image.Position == 0 {
+		row := ig.db.Model(&Image{}).Where("gallery_id = ?", image.GalleryID).
+			Select("COALESCE(MAX(position), 0) + 1").Row()
+		if err := row.Scan(&image.Position); err != nil {
+			return err
+		}
+	}
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) CreateAll(images []Image) error {
+	tx := ig.db.Begin()
+	txGorm := imageGorm{tx}
+	for n := range images {
+		if err := txGorm.Create(&images[n]); err != nil {
+			tx.Rollback()
+			return err
 		}
 	}
-	return ret, nil
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) MoveAll(ids []uint, galleryID uint) error {
+	tx := ig.db.Begin()
+	var last int
+	row := tx.Model(&Image{}).Where("gallery_id = ?", galleryID).
+		Select("COALESCE(MAX(position), 0)").Row()
+	if err := row.Scan(&last); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for n, id := range ids {
+		err := tx.Model(&Image{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"gallery_id": galleryID,
+			"position":   last + n + 1,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) UpdatePositions(galleryID uint, uids []string) error {
+	tx := ig.db.Begin()
+	for i, uid := range uids {
+		err := tx.Model(&Image{}).Where("gallery_id = ? AND uid = ?", galleryID, uid).
+			Update("position", i+1).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("%s/%v/", imagePath, galleryID)
+func (ig *imageGorm) Delete(id uint) error {
+	image := Image{ID: id}
+	return ig.db.Delete(&image).Error
 }
 
-// On Windows the path separator "\" triggers html escaping,
-// so replace with unix path separators
-func fwdSlashSeparators(path string) string {
-	return strings.ReplaceAll(path, "\\", "/")
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Where("gallery_id = ?", galleryID).Delete(Image{}).Error
 }
@@ -0,0 +1,564 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"lenslocked.com/imaging"
+	"lenslocked.com/storage"
+)
+
+// memImages is an in-memory ImageDB.
+type memImages struct {
+	images []Image
+	nextID uint
+	// err is returned by Create when set.
+	err error
+}
+
+func (m *memImages) ByID(id uint) (*Image, error) {
+	for _, image := range m.images {
+		if image.ID == id {
+			return &image, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memImages) ByUID(uid string) (*Image, error) {
+	for _, image := range m.images {
+		if image.UID == uid {
+			return &image, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memImages) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	for _, image := range m.images {
+		if image.GalleryID == galleryID {
+			images = append(images, image)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].Position < images[j].Position
+	})
+	return images, nil
+}
+
+// ByGalleryIDPage returns all of the gallery's images as a single page.
+func (m *memImages) ByGalleryIDPage(galleryID uint, cursor string, limit int) ([]Image, string, error) {
+	images, err := m.ByGalleryID(galleryID)
+	return images, "", err
+}
+
+func (m *memImages) Create(image *Image) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.nextID++
+	image.ID = m.nextID
+	if image.Position == 0 {
+		image.Position = len(m.images) + 1
+	}
+	m.images = append(m.images, *image)
+	return nil
+}
+
+func (m *memImages) CreateAll(images []Image) error {
+	for n := range images {
+		if err := m.Create(&images[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memImages) MoveAll(ids []uint, galleryID uint) error {
+	if m.err != nil {
+		return m.err
+	}
+	for _, id := range ids {
+		for i := range m.images {
+			if m.images[i].ID == id {
+				m.images[i].GalleryID = galleryID
+			}
+		}
+	}
+	return nil
+}
+
+// Search is left to the DB, memImages never finds anything.
+func (m *memImages) Search(userID uint, query string, limit, offset int) ([]Image, error) {
+	return nil, nil
+}
+
+func (m *memImages) UpdatePositions(galleryID uint, uids []string) error {
+	for pos, uid := range uids {
+		for i := range m.images {
+			if m.images[i].GalleryID == galleryID && m.images[i].UID == uid {
+				m.images[i].Position = pos + 1
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memImages) Update(image *Image) error {
+	for i := range m.images {
+		if m.images[i].ID == image.ID {
+			m.images[i] = *image
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memImages) Delete(id uint) error {
+	return m.deleteWhere(func(image *Image) bool { return image.ID == id })
+}
+
+func (m *memImages) DeleteByGalleryID(galleryID uint) error {
+	return m.deleteWhere(func(image *Image) bool { return image.GalleryID == galleryID })
+}
+
+func (m *memImages) deleteWhere(match func(*Image) bool) error {
+	kept := m.images[:0]
+	for _, image := range m.images {
+		if !match(&image) {
+			kept = append(kept, image)
+		}
+	}
+	m.images = kept
+	return nil
+}
+
+// blobExists reports whether store has a blob under key.
+func blobExists(t *testing.T, store storage.BlobStore, key string) bool {
+	rc, err := store.Get(key)
+	if err == storage.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	return true
+}
+
+const testGIF = "GIF89a\x01\x00\x01\x00\x00\x00\x00;"
+
+func TestImageCreate(t *testing.T) {
+	db := &memImages{}
+	store := storage.NewMemory("/images")
+	is := &imageService{ImageDB: db, store: store}
+
+	image, err := is.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.ContentType != "image/gif" || image.Size != int64(len(testGIF)) {
+		t.Errorf("Expected a %d byte image/gif. Received %d byte %s", len(testGIF), image.Size, image.ContentType)
+	}
+	if len(image.Checksum) != 64 {
+		t.Errorf("Expected a hex encoded sha256 checksum. Received %q", image.Checksum)
+	}
+	if len(image.UID) != 16 || image.Filename != image.UID+".gif" || image.OriginalFilename != "pixel.gif" {
+		t.Errorf("Expected the image to be stored under a random ID. Received %q as %q", image.OriginalFilename, image.Filename)
+	}
+	if image.Path() != "/images/"+image.UID+"?v="+image.Checksum[:8] {
+		t.Errorf("Expected the image to be served by its UID. Received %s", image.Path())
+	}
+	if got, err := db.ByUID(image.UID); err != nil || got.ID != image.ID {
+		t.Errorf("Expected to find the image by its UID. Received %v", err)
+	}
+	rc, err := store.Get(image.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, _ := ioutil.ReadAll(rc); string(b) != testGIF {
+		t.Errorf("Expected the image to be stored under %s. Received %q", image.Key(), b)
+	}
+	if _, err := db.ByID(image.ID); err != nil {
+		t.Errorf("Expected the image to be recorded. Received %v", err)
+	}
+
+	db.err = errors.New("db down")
+	if _, err := is.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "other.gif"); err != db.err {
+		t.Errorf("Expected the DB error. Received %v", err)
+	}
+	if keys, _ := store.List("galleries/1/"); len(keys) != 1 {
+		t.Errorf("Expected the blob to be removed when it can't be recorded. Received %v", keys)
+	}
+}
+
+func TestImageDelete(t *testing.T) {
+	db := &memImages{}
+	store := storage.NewMemory("/images")
+	is := &imageService{ImageDB: db, store: store}
+	var images []*Image
+	// images uploaded with the same name must not overwrite each other.
+	for _, galleryID := range []uint{1, 1, 2} {
+		image, err := is.Create(galleryID, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image)
+	}
+
+	if err := is.Delete(&Image{}); err != ErrIDInvalid {
+		t.Errorf("Expected ErrIDInvalid. Received %v", err)
+	}
+	if err := is.Delete(images[0]); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(t, store, images[0].Key()) {
+		t.Errorf("Expected the blob to be deleted")
+	}
+	if _, err := db.ByID(images[0].ID); err != ErrNotFound {
+		t.Errorf("Expected the record to be deleted. Received %v", err)
+	}
+
+	if err := is.DeleteAll(2); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := db.ByGalleryID(2); len(left) != 0 {
+		t.Errorf("Expected the gallery's images to be deleted. Received %v", left)
+	}
+	if blobExists(t, store, images[2].Key()) {
+		t.Errorf("Expected the gallery's blobs to be deleted")
+	}
+	if !blobExists(t, store, images[1].Key()) {
+		t.Errorf("Expected other galleries to keep their images")
+	}
+}
+
+func TestImageCreateSizes(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2000, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewMemory("/images")
+	is := &imageService{ImageDB: &memImages{}, store: store}
+	image, err := is.Create(1, ioutil.NopCloser(&buf), "wide.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Width != 2000 || image.Height != 1000 {
+		t.Errorf("Expected a 2000x1000 image. Received %dx%d", image.Width, image.Height)
+	}
+	for _, size := range imageSizes {
+		key := image.SizeKey(size.Name)
+		rc, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Expected the %s derivative under %s. Received %v", size.Name, key, err)
+		}
+		img, _, err := imaging.Decode(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := img.Bounds().Dx(); w != size.MaxDim {
+			t.Errorf("Expected the %s derivative to be %d wide. Received %d", size.Name, size.MaxDim, w)
+		}
+	}
+	base, v := "/images/"+image.UID, "?v="+image.Checksum[:8]
+	if got := image.SrcSet(); got != base+"/thumb"+v+" 320w, "+base+"/medium"+v+" 800w, "+base+"/large"+v+" 1600w" {
+		t.Errorf("Unexpected srcset %q", got)
+	}
+	rc, err := is.Open(image, "thumb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if _, err := is.Open(image, "huge"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an unknown size. Received %v", err)
+	}
+
+	if err := is.Delete(image); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range imageSizes {
+		if blobExists(t, store, image.SizeKey(size.Name)) {
+			t.Errorf("Expected the %s derivative to be deleted", size.Name)
+		}
+	}
+}
+
+func TestImageValidatorCreate(t *testing.T) {
+	encode := func(w, h int) string {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	small := encode(1, 1)
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		want     error
+	}{
+		{"valid", "photo.png", small, nil},
+		{"empty name", " ", small, ErrFilenameInvalid},
+		{"path", "../photo.png", small, ErrFilenameInvalid},
+		{"not an image", "notes.png", "hello", ErrImageTypeInvalid},
+		{"too large", "photo.png", small + strings.Repeat("\x00", MaxImageBytes), ErrImageTooLarge},
+		{"too wide", "wide.png", encode(MaxImageDim+1, 1), ErrImageDimensions},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memImages{}
+			iv := &imageValidator{&imageService{ImageDB: db, store: storage.NewMemory("/images")}}
+			_, err := iv.Create(1, ioutil.NopCloser(strings.NewReader(tt.data)), tt.filename)
+			if err != tt.want {
+				t.Fatalf("Expected %v. Received %v", tt.want, err)
+			}
+			if stored, _ := db.ByGalleryID(1); tt.want != nil && len(stored) != 0 {
+				t.Errorf("Expected a rejected upload not to be stored")
+			}
+		})
+	}
+}
+
+func TestImageTypeAllowed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	pngData := buf.Bytes()
+	jpegData := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+
+	iv := &imageValidator{}
+	tests := []struct {
+		filename string
+		data     []byte
+		want     error
+	}{
+		{"photo.png", pngData, nil},
+		{"PHOTO.PNG", pngData, nil},
+		{"photo.jpg", jpegData, nil},
+		{"photo.jpeg", jpegData, nil},
+		{"photo.jpg", pngData, ErrImageTypeInvalid},
+		{"photo.png", jpegData, ErrImageTypeInvalid},
+		{"photo", pngData, ErrImageTypeInvalid},
+		{"notes.txt", []byte("hello"), ErrImageTypeInvalid},
+		{"notes.png", []byte("hello"), ErrImageTypeInvalid},
+	}
+	for _, tt := range tests {
+		err := iv.typeAllowed(&imageUpload{Filename: tt.filename, Data: tt.data})
+		if err != tt.want {
+			t.Errorf("typeAllowed(%q) = %v, want %v", tt.filename, err, tt.want)
+		}
+	}
+}
+
+func TestImageRotate(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 200))); err != nil {
+		t.Fatal(err)
+	}
+	db := &memImages{}
+	is := &imageService{ImageDB: db, store: storage.NewMemory("/images")}
+	image, err := is.Create(1, ioutil.NopCloser(&buf), "wide.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := image.Path()
+	if err := is.Rotate(image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Width != 200 || image.Height != 400 {
+		t.Errorf("Expected a 200x400 image. Received %dx%d", image.Width, image.Height)
+	}
+	if image.Path() == path {
+		t.Errorf("Expected the URL to change so browsers fetch the rotated image")
+	}
+	stored, err := db.ByID(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Width != 200 || stored.Checksum != image.Checksum {
+		t.Errorf("Expected the rotated image to be recorded. Received %+v", stored)
+	}
+}
+
+func TestImageReorder(t *testing.T) {
+	iv := &imageValidator{&imageService{ImageDB: &memImages{}, store: storage.NewMemory("/images")}}
+	var uids []string
+	for i := 0; i < 3; i++ {
+		image, err := iv.ImageService.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		uids = append(uids, image.UID)
+	}
+
+	invalid := [][]string{
+		{uids[0], uids[1]},
+		{uids[0], uids[1], uids[1]},
+		{uids[0], uids[1], "unknown"},
+	}
+	for _, order := range invalid {
+		if err := iv.Reorder(1, order); err != ErrImageOrderInvalid {
+			t.Errorf("Reorder(%v) = %v, want ErrImageOrderInvalid", order, err)
+		}
+	}
+
+	want := []string{uids[2], uids[0], uids[1]}
+	if err := iv.Reorder(1, want); err != nil {
+		t.Fatal(err)
+	}
+	images, err := iv.ByGalleryID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, image := range images {
+		if image.UID != want[i] {
+			t.Errorf("Expected image %d to be %s. Received %s", i, want[i], image.UID)
+		}
+	}
+}
+
+func TestImageUpdate(t *testing.T) {
+	db := &memImages{}
+	iv := &imageValidator{&imageService{ImageDB: db, store: storage.NewMemory("/images")}}
+	image, err := iv.ImageService.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Alt() != "Gallery image" {
+		t.Errorf("Expected a default alt text. Received %q", image.Alt())
+	}
+
+	tests := []struct {
+		name  string
+		image Image
+		want  error
+	}{
+		{"no id", Image{}, ErrIDInvalid},
+		{"title", Image{ID: image.ID, Title: strings.Repeat("é", 101)}, ErrImageTitleTooLong},
+		{"caption", Image{ID: image.ID, Caption: strings.Repeat("a", 2001)}, ErrImageCaptionTooLong},
+		{"alt text", Image{ID: image.ID, AltText: strings.Repeat("a", 251)}, ErrImageAltTextTooLong},
+	}
+	for _, tt := range tests {
+		if err := iv.Update(&tt.image); err != tt.want {
+			t.Errorf("%s: Expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+
+	image.Title = "  Sunset " + strings.Repeat("é", 90) + "  "
+	image.Caption = " Taken from the pier. "
+	if err := iv.Update(image); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.ByID(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Title != strings.TrimSpace(image.Title) || stored.Caption != "Taken from the pier." {
+		t.Errorf("Expected trimmed text to be saved. Received %q, %q", stored.Title, stored.Caption)
+	}
+	if stored.Alt() != stored.Title {
+		t.Errorf("Expected the title to be used as alt text. Received %q", stored.Alt())
+	}
+}
+
+func TestImageMove(t *testing.T) {
+	db := &memImages{}
+	store := storage.NewMemory("/images")
+	iv := &imageValidator{&imageService{ImageDB: db, store: store}}
+	var images []Image
+	for i := 0; i < 2; i++ {
+		image, err := iv.ImageService.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, *image)
+	}
+
+	if err := iv.Move(nil, 2); err != ErrNoImagesSelected {
+		t.Errorf("Expected ErrNoImagesSelected. Received %v", err)
+	}
+	if err := iv.Move(images, 1); err != ErrImageMoveInvalid {
+		t.Errorf("Expected ErrImageMoveInvalid. Received %v", err)
+	}
+	// the service leaves images that are already in the gallery alone.
+	if err := iv.ImageService.Move(images[:1], 1); err != nil {
+		t.Fatal(err)
+	}
+	if !blobExists(t, store, images[0].Key()) {
+		t.Fatalf("Expected the image to be kept when moved to its own gallery")
+	}
+	if b := readBlob(t, store, images[0].Key()); b != testGIF {
+		t.Errorf("Expected the image to be unchanged. Received %q", b)
+	}
+
+	old := images[0]
+	db.err = errors.New("db down")
+	if err := iv.Move(images[:1], 2); err != db.err {
+		t.Errorf("Expected the DB error. Received %v", err)
+	}
+	if keys, _ := store.List("galleries/2/"); len(keys) != 0 {
+		t.Errorf("Expected the copied blobs to be removed. Received %v", keys)
+	}
+	db.err = nil
+
+	if err := iv.Move(images[:1], 2); err != nil {
+		t.Fatal(err)
+	}
+	if blobExists(t, store, old.Key()) {
+		t.Errorf("Expected the old blob to be removed")
+	}
+	if b := readBlob(t, store, images[0].Key()); b != testGIF {
+		t.Errorf("Expected the image to be moved. Received %q", b)
+	}
+	if stored, _ := db.ByID(old.ID); stored.GalleryID != 2 {
+		t.Errorf("Expected the record to be moved. Received gallery %d", stored.GalleryID)
+	}
+}
+
+func TestImageCopy(t *testing.T) {
+	db := &memImages{}
+	store := storage.NewMemory("/images")
+	iv := &imageValidator{&imageService{ImageDB: db, store: store}}
+	image, err := iv.ImageService.Create(1, ioutil.NopCloser(strings.NewReader(testGIF)), "pixel.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copies, err := iv.Copy([]Image{*image}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copies) != 1 || copies[0].ID == image.ID || copies[0].UID == image.UID || copies[0].GalleryID != 2 {
+		t.Fatalf("Expected a new image in gallery 2. Received %+v", copies)
+	}
+	for _, key := range []string{image.Key(), copies[0].Key()} {
+		if b := readBlob(t, store, key); b != testGIF {
+			t.Errorf("Expected %s to hold the image. Received %q", key, b)
+		}
+	}
+}
+
+// readBlob returns the contents of the blob under key.
+func readBlob(t *testing.T, store storage.BlobStore, key string) string {
+	rc, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
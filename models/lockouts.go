@@ -0,0 +1,164 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"lenslocked.com/ratelimit"
+)
+
+const (
+	// loginFreeFailures is the number of times a password can be wrong
+	// before each further attempt has to wait, starting at
+	// loginBackoffBase and doubling up to loginBackoffMax.
+	loginFreeFailures = 3
+	loginBackoffBase  = time.Second
+	loginBackoffMax   = 30 * time.Second
+	// loginFailureWindow is how long failed logins are remembered.
+	loginFailureWindow = time.Hour
+
+	// lockoutThreshold is the number of failed logins within
+	// loginFailureWindow that lock an account for lockoutDuration.
+	lockoutThreshold = 10
+	lockoutDuration  = 30 * time.Minute
+
+	// resetLimit is the number of password reset emails that can be sent
+	// to an address every resetWindow.
+	resetLimit  = 3
+	resetWindow = time.Hour
+)
+
+// LockoutMailer lets users know their account was locked, sending them
+// the token to unlock it with. email.MailClient implements it.
+type LockoutMailer interface {
+	AccountLocked(name, toAddress, token string) error
+}
+
+// Locked reports whether the user's account is locked after too many
+// failed logins.
+func (u *User) Locked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+// newLoginBackoff returns the backoff failed logins to an account wait
+// for, keyed by user ID.
+func newLoginBackoff(store ratelimit.Store) *ratelimit.Backoff {
+	return ratelimit.NewBackoff(store, "login", loginFreeFailures,
+		loginBackoffBase, loginBackoffMax, loginFailureWindow)
+}
+
+func userKey(user *User) string {
+	return strconv.FormatUint(uint64(user.ID), 10)
+}
+
+func (us *userService) CheckLogin(user *User) error {
+	if user.Locked() {
+		return ErrAccountLocked
+	}
+	wait, err := us.logins.Wait(userKey(user))
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+func (us *userService) LoginFailed(user *User, failure error) error {
+	n, err := us.logins.Fail(userKey(user))
+	if err != nil {
+		return err
+	}
+	if n < lockoutThreshold {
+		return failure
+	}
+	if err := us.lock(user); err != nil {
+		return err
+	}
+	return ErrAccountLocked
+}
+
+func (us *userService) LoginSucceeded(user *User) {
+	if err := us.logins.Reset(userKey(user)); err != nil {
+		log.Println(err)
+	}
+}
+
+// lock locks the user's account for lockoutDuration and emails them a
+// link to unlock it sooner.
+func (us *userService) lock(user *User) error {
+	until := time.Now().Add(lockoutDuration)
+	user.LockedUntil = &until
+	if err := us.Update(user); err != nil {
+		return err
+	}
+	// failures start again once the lock ends
+	if err := us.logins.Reset(userKey(user)); err != nil {
+		log.Println(err)
+	}
+	if us.mailer == nil {
+		return nil
+	}
+	if err := us.mailer.AccountLocked(user.Name, user.Email, us.unlockToken(user)); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// unlockToken returns the token that unlocks the user's account. Tokens
+// are of the form "userID.lockedUntil.signature" and only unlock the lock
+// they were created for, once it is lifted they are no longer valid.
+func (us *userService) unlockToken(user *User) string {
+	payload := fmt.Sprintf("%d.%d", user.ID, user.LockedUntil.Unix())
+	return payload + "." + us.hmac.Hash("account-unlock:"+payload)
+}
+
+func (us *userService) UnlockAccount(token string) (*User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	payload := parts[0] + "." + parts[1]
+	sig := us.hmac.Hash("account-unlock:" + payload)
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(uint(id))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if !user.Locked() || strconv.FormatInt(user.LockedUntil.Unix(), 10) != parts[1] {
+		return nil, ErrTokenInvalid
+	}
+	user.LockedUntil = nil
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+	us.LoginSucceeded(user)
+	return user, nil
+}
+
+// allowReset reports whether another password reset email can be sent
+// to the user, so /forgot can't be used to flood their inbox.
+func (us *userService) allowReset(user *User) error {
+	ok, _, err := us.resets.Allow(userKey(user))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTooManyResets
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked.com/ratelimit"
+)
+
+// noWaitBackoff counts failed logins without making them wait, so tests
+// can reach the lockout straight away.
+func noWaitBackoff() *ratelimit.Backoff {
+	return ratelimit.NewBackoff(ratelimit.NewMemory(), "login", lockoutThreshold,
+		time.Second, time.Second, loginFailureWindow)
+}
+
+// memMailer keeps the unlock tokens it was asked to email.
+type memMailer struct {
+	tokens []string
+}
+
+func (m *memMailer) AccountLocked(name, toAddress, token string) error {
+	m.tokens = append(m.tokens, token)
+	return nil
+}
+
+func TestAuthenticateBackoff(t *testing.T) {
+	us := testUserService(nil)
+	user := testPasswordUser(t, us, "jon@example.com")
+	other := testPasswordUser(t, us, "sam@example.com")
+
+	tests := []struct {
+		password string
+		want     error
+	}{
+		{"wrong", ErrPasswordIncorrect},
+		{"wrong", ErrPasswordIncorrect},
+		{"wrong", ErrPasswordIncorrect},
+		// the failures so far were free
+		{"wrong", ErrPasswordIncorrect},
+		// and now there's a wait, even for the right password
+		{"wrong", ErrTooManyAttempts},
+		{"secret", ErrTooManyAttempts},
+	}
+	for i, tt := range tests {
+		if _, err := us.Authenticate(user.Email, tt.password); err != tt.want {
+			t.Errorf("Attempt %d: expected %v. Received %v", i+1, tt.want, err)
+		}
+	}
+	if _, err := us.Authenticate(other.Email, "secret"); err != nil {
+		t.Errorf("Expected other accounts not to wait. Received %v", err)
+	}
+	if wait := us.logins.Delay(loginFreeFailures + 1); wait != loginBackoffBase {
+		t.Errorf("Expected to wait %v after the free failures. Received %v", loginBackoffBase, wait)
+	}
+	if wait := us.logins.Delay(lockoutThreshold - 1); wait > loginBackoffMax {
+		t.Errorf("Expected to wait at most %v. Received %v", loginBackoffMax, wait)
+	}
+}
+
+func TestAuthenticateLockout(t *testing.T) {
+	us := testUserService(noWaitBackoff())
+	mailer := &memMailer{}
+	us.mailer = mailer
+	user := testPasswordUser(t, us, "jon@example.com")
+
+	for i := 1; i < lockoutThreshold; i++ {
+		if _, err := us.Authenticate(user.Email, "wrong"); err != ErrPasswordIncorrect {
+			t.Fatalf("Attempt %d: expected ErrPasswordIncorrect. Received %v", i, err)
+		}
+	}
+	if _, err := us.Authenticate(user.Email, "wrong"); err != ErrAccountLocked {
+		t.Fatalf("Expected the account to be locked. Received %v", err)
+	}
+	if _, err := us.Authenticate(user.Email, "secret"); err != ErrAccountLocked {
+		t.Errorf("Expected the right password to be refused. Received %v", err)
+	}
+	if len(mailer.tokens) != 1 {
+		t.Fatalf("Expected an unlock email. Received %d", len(mailer.tokens))
+	}
+	token := mailer.tokens[0]
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"tampered signature", token + "x"},
+		{"other user", "2." + parts[1] + "." + parts[2]},
+		{"other lock", parts[0] + ".1." + parts[2]},
+	}
+	for _, tt := range tests {
+		if _, err := us.UnlockAccount(tt.token); err != ErrTokenInvalid {
+			t.Errorf("%s: expected ErrTokenInvalid. Received %v", tt.name, err)
+		}
+	}
+	if _, err := us.UnlockAccount(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.UnlockAccount(token); err != ErrTokenInvalid {
+		t.Errorf("Expected the token to only unlock the account once. Received %v", err)
+	}
+	if _, err := us.Authenticate(user.Email, "secret"); err != nil {
+		t.Errorf("Expected to sign in once unlocked. Received %v", err)
+	}
+}
+
+func TestAllowReset(t *testing.T) {
+	us := testUserService(nil)
+	user := testPasswordUser(t, us, "jon@example.com")
+	other := testPasswordUser(t, us, "sam@example.com")
+
+	for i := 1; i <= resetLimit; i++ {
+		if err := us.allowReset(user); err != nil {
+			t.Fatalf("Reset %d: expected to be allowed. Received %v", i, err)
+		}
+	}
+	if err := us.allowReset(user); err != ErrTooManyResets {
+		t.Errorf("Expected ErrTooManyResets. Received %v", err)
+	}
+	if err := us.allowReset(other); err != nil {
+		t.Errorf("Expected other addresses to be limited separately. Received %v", err)
+	}
+}
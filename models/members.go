@@ -0,0 +1,177 @@
+package models
+
+import (
+	"time"
+)
+
+// Role is the part a user plays in a gallery.
+type Role string
+
+const (
+	// RoleViewer members can view the gallery.
+	RoleViewer Role = "viewer"
+	// RoleContributor members can also upload images.
+	RoleContributor Role = "contributor"
+	// RoleEditor members can also edit, reorder and delete images.
+	RoleEditor Role = "editor"
+	// RoleOwner is the role of the user who created the gallery. It can
+	// not be given to members.
+	RoleOwner Role = "owner"
+)
+
+// Action is something a user can do with a gallery.
+type Action string
+
+const (
+	ActionView   Action = "view"
+	ActionUpload Action = "upload"
+	ActionEdit   Action = "edit"
+	// ActionManage covers changing the gallery's settings, sharing
+	// it, managing its members and deleting it.
+	ActionManage Action = "manage"
+)
+
+// roleRanks orders the roles, each role is allowed to do
+// everything the roles below it can.
+var roleRanks = map[Role]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleEditor:      3,
+	RoleOwner:       4,
+}
+
+// actionRoles maps actions to the lowest role allowed to perform them.
+var actionRoles = map[Action]Role{
+	ActionView:   RoleViewer,
+	ActionUpload: RoleContributor,
+	ActionEdit:   RoleEditor,
+	ActionManage: RoleOwner,
+}
+
+// Allows reports whether the role is allowed to perform action.
+func (r Role) Allows(action Action) bool {
+	required, ok := actionRoles[action]
+	if !ok {
+		return false
+	}
+	return roleRanks[r] >= roleRanks[required]
+}
+
+// GalleryMember gives a user other than the owner access to a gallery.
+type GalleryMember struct {
+	ID        uint `gorm:"primary_key"`
+	GalleryID uint `gorm:"not null;unique_index:idx_gallery_members_gallery_user"`
+	UserID    uint `gorm:"not null;unique_index:idx_gallery_members_gallery_user;index"`
+	Role      Role `gorm:"not null"`
+	CreatedAt time.Time
+	// User is loaded by Members and never saved with the member.
+	User User `gorm:"association_autoupdate:false;association_autocreate:false"`
+}
+
+func (gv *galleryValidator) SaveMember(member *GalleryMember) error {
+	if member.GalleryID <= 0 || member.UserID <= 0 {
+		return ErrIDInvalid
+	}
+	switch member.Role {
+	case RoleViewer, RoleContributor, RoleEditor:
+	default:
+		return ErrRoleInvalid
+	}
+	return gv.GalleryDB.SaveMember(member)
+}
+
+func (gg *galleryGorm) Member(galleryID, userID uint) (*GalleryMember, error) {
+	var member GalleryMember
+	db := gg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID)
+	err := first(db, &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (gg *galleryGorm) Members(galleryID uint) ([]GalleryMember, error) {
+	var members []GalleryMember
+	err := gg.db.Preload("User").
+		Where("gallery_id = ?", galleryID).
+		Order("created_at asc").
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// SaveMember adds the member to the gallery, or changes their
+// role if they already are a member.
+func (gg *galleryGorm) SaveMember(member *GalleryMember) error {
+	existing, err := gg.Member(member.GalleryID, member.UserID)
+	switch err {
+	case nil:
+		member.ID = existing.ID
+		member.CreatedAt = existing.CreatedAt
+		return gg.db.Save(member).Error
+	case ErrNotFound:
+		return gg.db.Create(member).Error
+	default:
+		return err
+	}
+}
+
+func (gg *galleryGorm) DeleteMember(galleryID, userID uint) error {
+	return gg.db.Where("gallery_id = ? AND user_id = ?", galleryID, userID).
+		Delete(&GalleryMember{}).Error
+}
+
+func (gg *galleryGorm) ByMemberID(userID uint) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.
+		Joins("JOIN gallery_members ON gallery_members.gallery_id = galleries.id").
+		Where("gallery_members.user_id = ?", userID).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+// AddMember gives user the role in the gallery.
+func (gs *galleryService) AddMember(gallery *Gallery, user *User, role Role) error {
+	if gallery.IsOwner(user) {
+		return ErrMemberIsOwner
+	}
+	return gs.SaveMember(&GalleryMember{
+		GalleryID: gallery.ID,
+		UserID:    user.ID,
+		Role:      role,
+	})
+}
+
+// RoleOf returns the role user has in the gallery, or an empty
+// role if they are neither the owner nor a member.
+func (gs *galleryService) RoleOf(user *User, gallery *Gallery) (Role, error) {
+	switch {
+	case user == nil:
+		return "", nil
+	case gallery.IsOwner(user):
+		return RoleOwner, nil
+	}
+	member, err := gs.Member(gallery.ID, user.ID)
+	switch err {
+	case nil:
+		return member.Role, nil
+	case ErrNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// Can reports whether user is allowed to perform action on the gallery.
+func (gs *galleryService) Can(user *User, gallery *Gallery, action Action) (bool, error) {
+	role, err := gs.RoleOf(user, gallery)
+	if err != nil {
+		return false, err
+	}
+	return role.Allows(action), nil
+}
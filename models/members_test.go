@@ -0,0 +1,43 @@
+package models
+
+import "testing"
+
+func TestRoleAllows(t *testing.T) {
+	tests := []struct {
+		role    Role
+		allowed []Action
+		denied  []Action
+	}{
+		{"", nil, []Action{ActionView, ActionUpload, ActionEdit, ActionManage}},
+		{RoleViewer, []Action{ActionView}, []Action{ActionUpload, ActionEdit, ActionManage}},
+		{RoleContributor, []Action{ActionView, ActionUpload}, []Action{ActionEdit, ActionManage}},
+		{RoleEditor, []Action{ActionView, ActionUpload, ActionEdit}, []Action{ActionManage}},
+		{RoleOwner, []Action{ActionView, ActionUpload, ActionEdit, ActionManage}, nil},
+		{"admin", nil, []Action{ActionView}},
+	}
+	for _, tt := range tests {
+		for _, action := range tt.allowed {
+			if !tt.role.Allows(action) {
+				t.Errorf("Expected %q to be allowed to %s", tt.role, action)
+			}
+		}
+		for _, action := range tt.denied {
+			if tt.role.Allows(action) {
+				t.Errorf("Expected %q not to be allowed to %s", tt.role, action)
+			}
+		}
+	}
+	if RoleOwner.Allows("delete") {
+		t.Errorf("Expected unknown actions to be denied")
+	}
+}
+
+func TestSaveMemberRole(t *testing.T) {
+	gv := &galleryValidator{}
+	for _, role := range []Role{RoleOwner, "", "admin"} {
+		member := &GalleryMember{GalleryID: 1, UserID: 2, Role: role}
+		if err := gv.SaveMember(member); err != ErrRoleInvalid {
+			t.Errorf("%q: expected ErrRoleInvalid. Received %v", role, err)
+		}
+	}
+}
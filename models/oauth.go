@@ -0,0 +1,441 @@
+package models
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// OAuthRefreshTokenPrefix starts the refresh tokens issued to OAuth
+	// clients.
+	OAuthRefreshTokenPrefix = "llort_"
+
+	// CodeChallengeS256 is the only PKCE code challenge method we support.
+	CodeChallengeS256 = "S256"
+
+	oauthCodeDuration         = 10 * time.Minute
+	oauthAccessTokenDuration  = time.Hour
+	oauthRefreshTokenDuration = 90 * 24 * time.Hour
+)
+
+var (
+	// codeChallengeRegex matches the base64url encoded SHA-256 hash of a
+	// code verifier.
+	codeChallengeRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+	codeVerifierRegex  = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+)
+
+// OAuthRequest is a client's request for access to a user's account.
+type OAuthRequest struct {
+	Client *OAuthClient
+	UserID uint
+	// RedirectURI is the redirect_uri parameter of the request, it may be
+	// empty as clients only have one.
+	RedirectURI         string
+	Scopes              []Scope
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// OAuthTokens are issued to a client in exchange for an authorization
+// code or a refresh token.
+type OAuthTokens struct {
+	AccessToken  *AccessToken
+	RefreshToken string
+}
+
+// OAuthService implements the authorization code flow with PKCE that lets
+// third-party applications access the API on behalf of our users. The
+// access tokens it issues are AccessTokens, so they are accepted wherever
+// personal access tokens are.
+type OAuthService interface {
+	// AuthenticateClient returns the client with clientID. Clients that
+	// aren't public also need to provide their secret. ErrClientInvalid is
+	// returned if the client can't be authenticated.
+	AuthenticateClient(clientID, secret string) (*OAuthClient, error)
+	// ValidateRequest checks an authorization request before the user is
+	// asked to approve it. ErrRedirectURIMismatch is returned when the
+	// user must not be sent back to the client.
+	ValidateRequest(req *OAuthRequest) error
+	// Authorize returns the authorization code for a request the user
+	// approved.
+	Authorize(req *OAuthRequest) (string, error)
+	// Exchange swaps an authorization code for tokens. Codes can only be
+	// used once, presenting one again or after it expired revokes the
+	// tokens already issued for it as the code may have been stolen.
+	Exchange(client *OAuthClient, code, redirectURI, verifier string) (*OAuthTokens, error)
+	// Refresh issues new tokens for a refresh token, which can't be used
+	// again. The new access token can be limited to some of the scopes
+	// the user originally granted. Like codes, refresh tokens that were
+	// already used or expired revoke the client's access.
+	Refresh(client *OAuthClient, refreshToken string, scopes []Scope) (*OAuthTokens, error)
+	// Revoke removes the client's access to the user's account.
+	Revoke(userID, clientID uint) error
+	OAuthClientDB
+}
+
+// NewOAuthService returns an OAuthService storing clients and tokens in db,
+// with their secrets hashed with hmacKey.
+func NewOAuthService(db *gorm.DB, hmacKey string) OAuthService {
+	hmac := hash.NewHMAC(hmacKey)
+	return &oauthService{
+		OAuthClientDB: &oauthClientValidator{
+			OAuthClientDB: &oauthClientGorm{db},
+			hmac:          hmac,
+		},
+		grants: &oauthGrantValidator{
+			oauthGrantDB: &oauthGrantGorm{db},
+			hmac:         hmac,
+		},
+		tokens: &accessTokenValidator{
+			AccessTokenDB: &accessTokenGorm{db},
+			hmac:          hmac,
+		},
+		hmac: hmac,
+	}
+}
+
+type oauthService struct {
+	OAuthClientDB
+	grants oauthGrantDB
+	tokens AccessTokenDB
+	hmac   hash.HMAC
+}
+
+func (oas *oauthService) AuthenticateClient(clientID, secret string) (*OAuthClient, error) {
+	client, err := oas.ByClientID(clientID)
+	if err == ErrNotFound {
+		return nil, ErrClientInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client.Public {
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(oas.hmac.Hash(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrClientInvalid
+	}
+	return client, nil
+}
+
+func (oas *oauthService) ValidateRequest(req *OAuthRequest) error {
+	if req.RedirectURI != "" && req.RedirectURI != req.Client.RedirectURI {
+		return ErrRedirectURIMismatch
+	}
+	if err := validScopes(req.Scopes); err != nil {
+		return err
+	}
+	if req.CodeChallengeMethod != CodeChallengeS256 || !codeChallengeRegex.MatchString(req.CodeChallenge) {
+		return ErrCodeChallengeInvalid
+	}
+	return nil
+}
+
+func (oas *oauthService) Authorize(req *OAuthRequest) (string, error) {
+	if err := oas.ValidateRequest(req); err != nil {
+		return "", err
+	}
+	code := oauthCode{
+		ClientID:      req.Client.ID,
+		UserID:        req.UserID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        joinScopes(req.Scopes),
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(oauthCodeDuration),
+	}
+	if err := oas.grants.CreateCode(&code); err != nil {
+		return "", err
+	}
+	return code.Code, nil
+}
+
+func (oas *oauthService) Exchange(client *OAuthClient, code, redirectURI, verifier string) (*OAuthTokens, error) {
+	c, err := oas.grants.UseCode(code)
+	if err == ErrGrantUsed {
+		return nil, oas.revokeReplayed(c.UserID, c.ClientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(c.ExpiresAt) {
+		return nil, oas.revokeReplayed(c.UserID, c.ClientID)
+	}
+	if c.ClientID != client.ID || c.RedirectURI != redirectURI ||
+		!verifyCodeChallenge(c.CodeChallenge, verifier) {
+		return nil, ErrGrantInvalid
+	}
+	scopes := ParseScopes(c.Scopes)
+	return oas.issue(client, c.UserID, scopes, scopes)
+}
+
+func (oas *oauthService) Refresh(client *OAuthClient, refreshToken string, scopes []Scope) (*OAuthTokens, error) {
+	rt, err := oas.grants.UseRefreshToken(refreshToken)
+	if err == ErrGrantUsed {
+		return nil, oas.revokeReplayed(rt.UserID, rt.ClientID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(rt.ExpiresAt) {
+		return nil, oas.revokeReplayed(rt.UserID, rt.ClientID)
+	}
+	if rt.ClientID != client.ID {
+		return nil, ErrGrantInvalid
+	}
+	granted := ParseScopes(rt.Scopes)
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	for _, scope := range scopes {
+		if !containsScope(granted, scope) {
+			return nil, ErrScopeInvalid
+		}
+	}
+	return oas.issue(client, rt.UserID, scopes, granted)
+}
+
+func (oas *oauthService) Revoke(userID, clientID uint) error {
+	if userID <= 0 || clientID <= 0 {
+		return ErrIDInvalid
+	}
+	return oas.grants.DeleteGrants(userID, clientID)
+}
+
+// revokeReplayed deletes the codes and tokens the user granted the client
+// after one of them was presented again or after it expired. Either the
+// client or an attacker holds a copy, so neither can be trusted with them.
+// It always returns ErrGrantInvalid for the client.
+func (oas *oauthService) revokeReplayed(userID, clientID uint) error {
+	if err := oas.grants.DeleteGrants(userID, clientID); err != nil {
+		log.Println(err)
+	}
+	return ErrGrantInvalid
+}
+
+// issue creates an access token with scopes and a refresh token that can
+// be used to get new access tokens with up to granted scopes.
+func (oas *oauthService) issue(client *OAuthClient, userID uint, scopes, granted []Scope) (*OAuthTokens, error) {
+	expires := time.Now().Add(oauthAccessTokenDuration)
+	token := AccessToken{
+		UserID:    userID,
+		ClientID:  client.ID,
+		Name:      client.Name,
+		ExpiresAt: &expires,
+	}
+	token.SetScopes(scopes)
+	if err := oas.tokens.Create(&token); err != nil {
+		return nil, err
+	}
+	rt := oauthRefreshToken{
+		ClientID:  client.ID,
+		UserID:    userID,
+		Scopes:    joinScopes(granted),
+		ExpiresAt: time.Now().Add(oauthRefreshTokenDuration),
+	}
+	if err := oas.grants.CreateRefreshToken(&rt); err != nil {
+		return nil, err
+	}
+	return &OAuthTokens{AccessToken: &token, RefreshToken: rt.Token}, nil
+}
+
+// verifyCodeChallenge reports whether challenge is the S256 code challenge
+// of verifier.
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if !codeVerifierRegex.MatchString(verifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func containsScope(scopes []Scope, scope Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthCode is an authorization code issued to a client after the user
+// approved its request.
+type oauthCode struct {
+	ID            uint   `gorm:"primary_key"`
+	ClientID      uint   `gorm:"not null;index"`
+	UserID        uint   `gorm:"not null"`
+	Code          string `gorm:"-"`
+	CodeHash      string `gorm:"not null;unique_index"`
+	RedirectURI   string `gorm:"not null;default:''"`
+	Scopes        string `gorm:"not null"`
+	CodeChallenge string `gorm:"not null"`
+	ExpiresAt     time.Time
+	// UsedAt is set once the code was exchanged, it is kept until it
+	// expires so it can be recognised if it is presented again.
+	UsedAt *time.Time
+}
+
+// oauthRefreshToken lets a client get new access tokens without asking the
+// user again. A user has authorized a client as long as it holds one.
+type oauthRefreshToken struct {
+	ID        uint   `gorm:"primary_key"`
+	ClientID  uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Scopes    string `gorm:"not null"`
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	// UsedAt is set once the token was exchanged for new tokens.
+	UsedAt *time.Time
+}
+
+// oauthGrantDB is used to interact with the oauth_codes and
+// oauth_refresh_tokens tables.
+type oauthGrantDB interface {
+	// CreateCode generates the code and stores its hash.
+	CreateCode(code *oauthCode) error
+	// UseCode looks up a code by its unhashed value and marks it as used
+	// so it can't be used again. ErrGrantUsed is returned, along with the
+	// code, if it was already used.
+	UseCode(code string) (*oauthCode, error)
+	// CreateRefreshToken generates the token and stores its hash.
+	CreateRefreshToken(token *oauthRefreshToken) error
+	// UseRefreshToken looks up a refresh token by its unhashed value and
+	// marks it as used like UseCode.
+	UseRefreshToken(token string) (*oauthRefreshToken, error)
+	// DeleteGrants deletes the codes and tokens the user granted the
+	// client, including its access tokens.
+	DeleteGrants(userID, clientID uint) error
+}
+
+type oauthGrantValidator struct {
+	oauthGrantDB
+	hmac hash.HMAC
+}
+
+func (ogv *oauthGrantValidator) CreateCode(code *oauthCode) error {
+	if code.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	code.Code = token
+	code.CodeHash = ogv.hmac.Hash(token)
+	return ogv.oauthGrantDB.CreateCode(code)
+}
+
+func (ogv *oauthGrantValidator) UseCode(code string) (*oauthCode, error) {
+	if code == "" {
+		return nil, ErrGrantInvalid
+	}
+	return ogv.oauthGrantDB.UseCode(ogv.hmac.Hash(code))
+}
+
+func (ogv *oauthGrantValidator) CreateRefreshToken(token *oauthRefreshToken) error {
+	if token.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	s, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	token.Token = OAuthRefreshTokenPrefix + s
+	token.TokenHash = ogv.hmac.Hash(token.Token)
+	return ogv.oauthGrantDB.CreateRefreshToken(token)
+}
+
+func (ogv *oauthGrantValidator) UseRefreshToken(token string) (*oauthRefreshToken, error) {
+	if token == "" {
+		return nil, ErrGrantInvalid
+	}
+	return ogv.oauthGrantDB.UseRefreshToken(ogv.hmac.Hash(token))
+}
+
+type oauthGrantGorm struct {
+	db *gorm.DB
+}
+
+// CreateCode also deletes expired codes, used ones are kept until then.
+func (ogg *oauthGrantGorm) CreateCode(code *oauthCode) error {
+	if err := ogg.db.Where("expires_at < ?", time.Now()).Delete(&oauthCode{}).Error; err != nil {
+		return err
+	}
+	return ogg.db.Create(code).Error
+}
+
+func (ogg *oauthGrantGorm) UseCode(codeHash string) (*oauthCode, error) {
+	var code oauthCode
+	if err := ogg.use(codeHash, "code_hash", &code); err != nil {
+		if err == ErrGrantUsed {
+			return &code, err
+		}
+		return nil, err
+	}
+	return &code, nil
+}
+
+// CreateRefreshToken also deletes expired refresh tokens, used ones are
+// kept until then.
+func (ogg *oauthGrantGorm) CreateRefreshToken(token *oauthRefreshToken) error {
+	if err := ogg.db.Where("expires_at < ?", time.Now()).Delete(&oauthRefreshToken{}).Error; err != nil {
+		return err
+	}
+	return ogg.db.Create(token).Error
+}
+
+func (ogg *oauthGrantGorm) UseRefreshToken(tokenHash string) (*oauthRefreshToken, error) {
+	var token oauthRefreshToken
+	if err := ogg.use(tokenHash, "token_hash", &token); err != nil {
+		if err == ErrGrantUsed {
+			return &token, err
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+// use looks up the row with value in column into dst and marks it as used.
+// Only one of several concurrent requests using the same row succeeds, the
+// others get ErrGrantUsed like later requests.
+func (ogg *oauthGrantGorm) use(value, column string, dst interface{}) error {
+	err := first(ogg.db.Where(column+" = ?", value), dst)
+	if err == ErrNotFound {
+		return ErrGrantInvalid
+	}
+	if err != nil {
+		return err
+	}
+	res := ogg.db.Model(dst).Where(column+" = ? AND used_at IS NULL", value).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrGrantUsed
+	}
+	return nil
+}
+
+func (ogg *oauthGrantGorm) DeleteGrants(userID, clientID uint) error {
+	tx := ogg.db.Begin()
+	for _, value := range []interface{}{&oauthCode{}, &oauthRefreshToken{}, &AccessToken{}} {
+		err := tx.Where("user_id = ? AND client_id = ?", userID, clientID).Delete(value).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const maxOAuthClientNameLength = 100
+
+// OAuthClient is a third-party application registered by one of our users
+// that can ask other users for access to their galleries.
+type OAuthClient struct {
+	ID     uint   `gorm:"primary_key"`
+	UserID uint   `gorm:"not null;index"`
+	Name   string `gorm:"not null"`
+	// ClientID is the public identifier of the client.
+	ClientID string `gorm:"not null;unique_index"`
+	// Public clients, such as mobile apps, can't keep a secret and rely
+	// on PKCE alone. Other clients have to authenticate with their secret
+	// to get tokens.
+	Public bool `gorm:"not null;default:false"`
+	// Secret is only set when a client that isn't public is created.
+	Secret     string `gorm:"-"`
+	SecretHash string `gorm:"not null;default:''"`
+	// RedirectURI is the only URI users are sent back to after they
+	// approved or denied the client's request.
+	RedirectURI string `gorm:"not null"`
+	CreatedAt   time.Time
+}
+
+// TableName keeps gorm from naming the table o_auth_clients.
+func (c *OAuthClient) TableName() string {
+	return "oauth_clients"
+}
+
+// OAuthClientDB is used to interact with the oauth_clients table.
+type OAuthClientDB interface {
+	// ByClientID looks up a client by its public identifier.
+	ByClientID(clientID string) (*OAuthClient, error)
+	// ClientsByUserID returns the clients registered by the user.
+	ClientsByUserID(userID uint) ([]OAuthClient, error)
+	// AuthorizedClients returns the clients the user has granted access
+	// to their account.
+	AuthorizedClients(userID uint) ([]OAuthClient, error)
+	// CreateClient generates the client's identifier and, unless it is
+	// public, its secret.
+	CreateClient(client *OAuthClient) error
+	// DeleteClient deletes the user's client with id along with every
+	// token issued to it.
+	DeleteClient(userID, id uint) error
+}
+
+type oauthClientValFunc func(*OAuthClient) error
+
+func runOAuthClientValFuncs(client *OAuthClient, fns ...oauthClientValFunc) error {
+	for _, fn := range fns {
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type oauthClientValidator struct {
+	OAuthClientDB
+	hmac hash.HMAC
+}
+
+func (ocv *oauthClientValidator) CreateClient(client *OAuthClient) error {
+	err := runOAuthClientValFuncs(client,
+		ocv.requireUserID,
+		ocv.nameRequired,
+		ocv.redirectURIValid,
+		ocv.setClientID,
+		ocv.setSecret)
+	if err != nil {
+		return err
+	}
+	return ocv.OAuthClientDB.CreateClient(client)
+}
+
+func (ocv *oauthClientValidator) DeleteClient(userID, id uint) error {
+	if userID <= 0 || id <= 0 {
+		return ErrIDInvalid
+	}
+	return ocv.OAuthClientDB.DeleteClient(userID, id)
+}
+
+func (ocv *oauthClientValidator) requireUserID(client *OAuthClient) error {
+	if client.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (ocv *oauthClientValidator) nameRequired(client *OAuthClient) error {
+	client.Name = strings.TrimSpace(client.Name)
+	switch {
+	case client.Name == "":
+		return ErrClientNameRequired
+	case utf8.RuneCountInString(client.Name) > maxOAuthClientNameLength:
+		return ErrClientNameTooLong
+	}
+	return nil
+}
+
+// redirectURIValid only accepts absolute https URIs without a fragment,
+// http is allowed for apps listening on the loopback interface.
+func (ocv *oauthClientValidator) redirectURIValid(client *OAuthClient) error {
+	client.RedirectURI = strings.TrimSpace(client.RedirectURI)
+	u, err := url.Parse(client.RedirectURI)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return ErrRedirectURIInvalid
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+			return nil
+		}
+	}
+	return ErrRedirectURIInvalid
+}
+
+func (ocv *oauthClientValidator) setClientID(client *OAuthClient) error {
+	// 15 bytes encode to 20 characters without padding
+	id, err := rand.String(15)
+	if err != nil {
+		return err
+	}
+	client.ClientID = id
+	return nil
+}
+
+// setSecret generates the secret of clients that aren't public, it is
+// never set by the caller.
+func (ocv *oauthClientValidator) setSecret(client *OAuthClient) error {
+	client.Secret, client.SecretHash = "", ""
+	if client.Public {
+		return nil
+	}
+	secret, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	client.Secret = secret
+	client.SecretHash = ocv.hmac.Hash(secret)
+	return nil
+}
+
+type oauthClientGorm struct {
+	db *gorm.DB
+}
+
+func (ocg *oauthClientGorm) ByClientID(clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	err := first(ocg.db.Where("client_id = ?", clientID), &client)
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (ocg *oauthClientGorm) ClientsByUserID(userID uint) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	err := ocg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (ocg *oauthClientGorm) AuthorizedClients(userID uint) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	err := ocg.db.Where("id IN (SELECT client_id FROM oauth_refresh_tokens WHERE user_id = ? AND used_at IS NULL)", userID).
+		Order("name asc").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (ocg *oauthClientGorm) CreateClient(client *OAuthClient) error {
+	return ocg.db.Create(client).Error
+}
+
+func (ocg *oauthClientGorm) DeleteClient(userID, id uint) error {
+	tx := ocg.db.Begin()
+	res := tx.Where("user_id = ? AND id = ?", userID, id).Delete(&OAuthClient{})
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrNotFound
+	}
+	for _, value := range []interface{}{&oauthCode{}, &oauthRefreshToken{}, &AccessToken{}} {
+		if err := tx.Where("client_id = ?", id).Delete(value).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
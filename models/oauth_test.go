@@ -0,0 +1,228 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// memGrants is an in-memory oauthGrantDB and AccessTokenDB keyed by the
+// hashes the validators pass down, like the gorm implementations.
+type memGrants struct {
+	codes   map[string]*oauthCode
+	refresh map[string]*oauthRefreshToken
+	tokens  map[string]*AccessToken
+}
+
+func newMemGrants() *memGrants {
+	return &memGrants{
+		codes:   make(map[string]*oauthCode),
+		refresh: make(map[string]*oauthRefreshToken),
+		tokens:  make(map[string]*AccessToken),
+	}
+}
+
+func (m *memGrants) CreateCode(code *oauthCode) error {
+	c := *code
+	m.codes[code.CodeHash] = &c
+	return nil
+}
+
+func (m *memGrants) UseCode(codeHash string) (*oauthCode, error) {
+	c, ok := m.codes[codeHash]
+	if !ok {
+		return nil, ErrGrantInvalid
+	}
+	used := *c
+	if c.UsedAt != nil {
+		return &used, ErrGrantUsed
+	}
+	now := time.Now()
+	c.UsedAt = &now
+	return &used, nil
+}
+
+func (m *memGrants) CreateRefreshToken(token *oauthRefreshToken) error {
+	t := *token
+	m.refresh[token.TokenHash] = &t
+	return nil
+}
+
+func (m *memGrants) UseRefreshToken(tokenHash string) (*oauthRefreshToken, error) {
+	t, ok := m.refresh[tokenHash]
+	if !ok {
+		return nil, ErrGrantInvalid
+	}
+	used := *t
+	if t.UsedAt != nil {
+		return &used, ErrGrantUsed
+	}
+	now := time.Now()
+	t.UsedAt = &now
+	return &used, nil
+}
+
+func (m *memGrants) DeleteGrants(userID, clientID uint) error {
+	for k, c := range m.codes {
+		if c.UserID == userID && c.ClientID == clientID {
+			delete(m.codes, k)
+		}
+	}
+	for k, t := range m.refresh {
+		if t.UserID == userID && t.ClientID == clientID {
+			delete(m.refresh, k)
+		}
+	}
+	for k, t := range m.tokens {
+		if t.UserID == userID && t.ClientID == clientID {
+			delete(m.tokens, k)
+		}
+	}
+	return nil
+}
+
+func (m *memGrants) ByToken(tokenHash string) (*AccessToken, error) {
+	t, ok := m.tokens[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+func (m *memGrants) ByUserID(userID uint) ([]AccessToken, error) { return nil, nil }
+
+func (m *memGrants) Create(token *AccessToken) error {
+	t := *token
+	m.tokens[token.TokenHash] = &t
+	return nil
+}
+
+func (m *memGrants) Touch(token *AccessToken) error { return nil }
+func (m *memGrants) Delete(userID, id uint) error   { return nil }
+
+func testOAuthService(m *memGrants) *oauthService {
+	hmac := hash.NewHMAC("test-key")
+	return &oauthService{
+		grants: &oauthGrantValidator{oauthGrantDB: m, hmac: hmac},
+		tokens: &accessTokenValidator{AccessTokenDB: m, hmac: hmac},
+		hmac:   hmac,
+	}
+}
+
+const testVerifier = "dBjftJeZ4CVP-mJ92K9qyTXYS5I7A1O2_jdRn4JtCZc"
+
+// testAuthorize returns a code the user approved for client.
+func testAuthorize(t *testing.T, oas *oauthService, client *OAuthClient) string {
+	sum := sha256.Sum256([]byte(testVerifier))
+	code, err := oas.Authorize(&OAuthRequest{
+		Client:              client,
+		UserID:              7,
+		Scopes:              []Scope{ScopeGalleriesRead},
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: CodeChallengeS256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func testOAuthClient(id uint) *OAuthClient {
+	return &OAuthClient{ID: id, Name: "App", RedirectURI: "https://app.example.com/cb"}
+}
+
+func TestOAuthGrantReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		replay func(oas *oauthService, client *OAuthClient, code string, first *OAuthTokens) error
+	}{
+		{"code used twice", func(oas *oauthService, client *OAuthClient, code string, first *OAuthTokens) error {
+			_, err := oas.Exchange(client, code, "", testVerifier)
+			return err
+		}},
+		{"refresh token used twice", func(oas *oauthService, client *OAuthClient, code string, first *OAuthTokens) error {
+			if _, err := oas.Refresh(client, first.RefreshToken, nil); err != nil {
+				t.Fatal(err)
+			}
+			_, err := oas.Refresh(client, first.RefreshToken, nil)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		m := newMemGrants()
+		oas := testOAuthService(m)
+		client := testOAuthClient(1)
+		code := testAuthorize(t, oas, client)
+		first, err := oas.Exchange(client, code, "", testVerifier)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// another app the user authorized must not be affected
+		other := testOAuthClient(2)
+		otherTokens, err := oas.Exchange(other, testAuthorize(t, oas, other), "", testVerifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tt.replay(oas, client, code, first); err != ErrGrantInvalid {
+			t.Errorf("%s: expected ErrGrantInvalid. Received %v", tt.name, err)
+		}
+		if _, err := oas.tokens.ByToken(first.AccessToken.Token); err != ErrNotFound {
+			t.Errorf("%s: expected the access token to be revoked. Received %v", tt.name, err)
+		}
+		for _, rt := range m.refresh {
+			if rt.ClientID == client.ID {
+				t.Errorf("%s: expected the client's refresh tokens to be revoked", tt.name)
+			}
+		}
+		if _, err := oas.Refresh(other, otherTokens.RefreshToken, nil); err != nil {
+			t.Errorf("%s: expected other clients to keep their tokens. Received %v", tt.name, err)
+		}
+	}
+}
+
+func TestOAuthExpiredGrant(t *testing.T) {
+	m := newMemGrants()
+	oas := testOAuthService(m)
+	client := testOAuthClient(1)
+	first, err := oas.Exchange(client, testAuthorize(t, oas, client), "", testVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := testAuthorize(t, oas, client)
+	for _, c := range m.codes {
+		if c.UsedAt == nil {
+			c.ExpiresAt = time.Now().Add(-time.Second)
+		}
+	}
+	if _, err := oas.Exchange(client, code, "", testVerifier); err != ErrGrantInvalid {
+		t.Errorf("Expected ErrGrantInvalid. Received %v", err)
+	}
+	if _, err := oas.Refresh(client, first.RefreshToken, nil); err != ErrGrantInvalid {
+		t.Errorf("Expected presenting an expired code to revoke the client's tokens. Received %v", err)
+	}
+}
+
+func TestOAuthExchangeMismatch(t *testing.T) {
+	m := newMemGrants()
+	oas := testOAuthService(m)
+	client := testOAuthClient(1)
+	tests := []struct {
+		name     string
+		client   *OAuthClient
+		verifier string
+	}{
+		{"other client", testOAuthClient(2), testVerifier},
+		{"wrong verifier", client, strings.Repeat("a", 43)},
+	}
+	for _, tt := range tests {
+		code := testAuthorize(t, oas, client)
+		if _, err := oas.Exchange(tt.client, code, "", tt.verifier); err != ErrGrantInvalid {
+			t.Errorf("%s: expected ErrGrantInvalid. Received %v", tt.name, err)
+		}
+	}
+}
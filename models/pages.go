@@ -0,0 +1,229 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// GallerySort is the order galleries are listed in.
+type GallerySort string
+
+const (
+	// SortCreated lists the newest galleries first.
+	SortCreated GallerySort = "created"
+	// SortUpdated lists the most recently changed galleries first.
+	SortUpdated GallerySort = "updated"
+	// SortTitle lists galleries alphabetically.
+	SortTitle GallerySort = "title"
+	// SortImages lists the galleries with the most images first.
+	SortImages GallerySort = "images"
+
+	// sortPosition is the order images are listed in, it can't be
+	// used for galleries.
+	sortPosition = "position"
+)
+
+// imageCountSQL counts the images of each row of the galleries table.
+const imageCountSQL = "(SELECT COUNT(*) FROM images WHERE images.gallery_id = galleries.id)"
+
+// gallerySortColumns maps each sort to the expression galleries are ordered by.
+var gallerySortColumns = map[GallerySort]string{
+	SortCreated: "galleries.created_at",
+	SortUpdated: "galleries.updated_at",
+	SortTitle:   "galleries.title",
+	SortImages:  imageCountSQL,
+}
+
+// key returns the value galleries sorted by s are ordered by for the
+// gallery, formatted so Postgres can compare it with the sort column.
+func (s GallerySort) key(gallery *Gallery) string {
+	switch s {
+	case SortUpdated:
+		return gallery.UpdatedAt.Format(time.RFC3339Nano)
+	case SortTitle:
+		return gallery.Title
+	case SortImages:
+		return strconv.Itoa(gallery.ImageCount)
+	default:
+		return gallery.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
+// pageCursor points just past the last item of a page. Listings continue
+// with the items that sort after Key, using the ID to break ties. Cursors
+// are only valid for the sort they were created with.
+type pageCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   uint   `json:"i"`
+}
+
+func (c pageCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor decodes a cursor created for sort. An empty string is the
+// cursor of the first page, for which nil is returned.
+func parseCursor(s, sort string) (*pageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrCursorInvalid
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort || !c.keyValid() {
+		return nil, ErrCursorInvalid
+	}
+	return &c, nil
+}
+
+// keyValid reports whether the key can be compared with the column of the
+// cursor's sort, so tampered cursors are refused instead of failing the
+// query.
+func (c *pageCursor) keyValid() bool {
+	var err error
+	switch GallerySort(c.Sort) {
+	case SortCreated, SortUpdated:
+		_, err = time.Parse(time.RFC3339Nano, c.Key)
+	case SortImages, sortPosition:
+		_, err = strconv.Atoi(c.Key)
+	}
+	return err == nil
+}
+
+// after limits db to the rows sorting after the cursor in the order
+// column, which is descending when desc is set, and then idColumn.
+func (c *pageCursor) after(db *gorm.DB, column, idColumn string, desc bool) *gorm.DB {
+	if c == nil {
+		return db
+	}
+	op := ">"
+	if desc {
+		op = "<"
+	}
+	return db.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", column, idColumn, op), c.Key, c.ID)
+}
+
+func (gv *galleryValidator) ByUserIDPage(userID uint, cursor string, limit int, sort GallerySort) ([]Gallery, string, error) {
+	if sort == "" {
+		sort = SortCreated
+	}
+	if _, ok := gallerySortColumns[sort]; !ok {
+		return nil, "", ErrSortInvalid
+	}
+	if limit <= 0 {
+		return nil, "", ErrIDInvalid
+	}
+	return gv.GalleryDB.ByUserIDPage(userID, cursor, limit, sort)
+}
+
+func (gg *galleryGorm) ByUserIDPage(userID uint, cursor string, limit int, sort GallerySort) ([]Gallery, string, error) {
+	c, err := parseCursor(cursor, string(sort))
+	if err != nil {
+		return nil, "", err
+	}
+	column := gallerySortColumns[sort]
+	desc := sort != SortTitle
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	db := gg.db.Where("galleries.user_id = ? OR galleries.id IN "+
+		"(SELECT gallery_id FROM gallery_members WHERE user_id = ?)", userID, userID)
+	db = c.after(db, column, "galleries.id", desc)
+
+	var galleries []Gallery
+	// fetch one more gallery than asked for to tell if there is a next page
+	err = db.Order(column + direction).Order("galleries.id" + direction).
+		Limit(limit + 1).Find(&galleries).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if err := gg.setImageCounts(galleries); err != nil {
+		return nil, "", err
+	}
+	if len(galleries) <= limit {
+		return galleries, "", nil
+	}
+	galleries = galleries[:limit]
+	last := &galleries[limit-1]
+	next := pageCursor{Sort: string(sort), Key: sort.key(last), ID: last.ID}
+	return galleries, next.String(), nil
+}
+
+// setImageCounts sets the ImageCount of the galleries.
+func (gg *galleryGorm) setImageCounts(galleries []Gallery) error {
+	if len(galleries) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(galleries))
+	for i, gallery := range galleries {
+		ids[i] = gallery.ID
+	}
+	rows, err := gg.db.Model(&Image{}).Where("gallery_id IN (?)", ids).
+		Select("gallery_id, COUNT(*)").Group("gallery_id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := make(map[uint]int, len(galleries))
+	for rows.Next() {
+		var id uint
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return err
+		}
+		counts[id] = count
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range galleries {
+		galleries[i].ImageCount = counts[galleries[i].ID]
+	}
+	return nil
+}
+
+func (is *imageService) ByGalleryIDPage(galleryID uint, cursor string, limit int) ([]Image, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrIDInvalid
+	}
+	images, next, err := is.ImageDB.ByGalleryIDPage(galleryID, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range images {
+		is.setURL(&images[i])
+	}
+	return images, next, nil
+}
+
+func (ig *imageGorm) ByGalleryIDPage(galleryID uint, cursor string, limit int) ([]Image, string, error) {
+	c, err := parseCursor(cursor, sortPosition)
+	if err != nil {
+		return nil, "", err
+	}
+	db := ig.db.Where("gallery_id = ?", galleryID)
+	db = c.after(db, "position", "id", false)
+
+	var images []Image
+	err = db.Order("position asc, id asc").Limit(limit + 1).Find(&images).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if len(images) <= limit {
+		return images, "", nil
+	}
+	images = images[:limit]
+	last := &images[limit-1]
+	next := pageCursor{Sort: sortPosition, Key: strconv.Itoa(last.Position), ID: last.ID}
+	return images, next.String(), nil
+}
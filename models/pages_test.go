@@ -0,0 +1,47 @@
+package models
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestParseCursor(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	gallery := &Gallery{Title: "Beach", ImageCount: 3}
+	gallery.CreatedAt = created
+	gallery.UpdatedAt = created
+
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+		want   *pageCursor
+		err    error
+	}{
+		{"first page", "", string(SortCreated), nil, nil},
+		{"created", pageCursor{string(SortCreated), SortCreated.key(gallery), 7}.String(), string(SortCreated),
+			&pageCursor{string(SortCreated), created.Format(time.RFC3339Nano), 7}, nil},
+		{"title", pageCursor{string(SortTitle), SortTitle.key(gallery), 7}.String(), string(SortTitle),
+			&pageCursor{string(SortTitle), "Beach", 7}, nil},
+		{"images", pageCursor{string(SortImages), SortImages.key(gallery), 7}.String(), string(SortImages),
+			&pageCursor{string(SortImages), "3", 7}, nil},
+		{"position", pageCursor{sortPosition, "2", 7}.String(), sortPosition, &pageCursor{sortPosition, "2", 7}, nil},
+		{"other sort", pageCursor{string(SortTitle), "Beach", 7}.String(), string(SortCreated), nil, ErrCursorInvalid},
+		{"not base64", "!!!", string(SortCreated), nil, ErrCursorInvalid},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("{")), string(SortCreated), nil, ErrCursorInvalid},
+		{"bad time", pageCursor{string(SortUpdated), "yesterday", 7}.String(), string(SortUpdated), nil, ErrCursorInvalid},
+		{"bad count", pageCursor{string(SortImages), "1; DROP TABLE", 7}.String(), string(SortImages), nil, ErrCursorInvalid},
+		{"bad position", pageCursor{sortPosition, "", 7}.String(), sortPosition, nil, ErrCursorInvalid},
+	}
+	for _, tt := range tests {
+		c, err := parseCursor(tt.cursor, tt.sort)
+		if err != tt.err {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.err, err)
+			continue
+		}
+		if (c == nil) != (tt.want == nil) || (c != nil && *c != *tt.want) {
+			t.Errorf("%s: expected %+v. Received %+v", tt.name, tt.want, c)
+		}
+	}
+}
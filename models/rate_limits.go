@@ -0,0 +1,88 @@
+package models
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/ratelimit"
+)
+
+// rateLimitSweepInterval is how often expired rate limit counters are
+// deleted.
+const rateLimitSweepInterval = 10 * time.Minute
+
+// rateLimit is a counter of a ratelimit.Store kept in postgres, so it is
+// shared between servers.
+type rateLimit struct {
+	Key       string    `gorm:"primary_key"`
+	Count     int       `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// NewRateLimitStore returns a ratelimit.Store that keeps its counters in
+// the rate_limits table.
+func NewRateLimitStore(db *gorm.DB) ratelimit.Store {
+	return &rateLimitGorm{db: db}
+}
+
+type rateLimitGorm struct {
+	db        *gorm.DB
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+var _ ratelimit.Store = &rateLimitGorm{}
+
+// Incr increments the counter in a single statement, so concurrent
+// requests can't both see the old count.
+func (rlg *rateLimitGorm) Incr(key string, window time.Duration) (int, time.Duration, error) {
+	rlg.sweep()
+	now := time.Now()
+	var rl rateLimit
+	err := rlg.db.Raw(`INSERT INTO rate_limits (key, count, expires_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN rate_limits.expires_at <= ? THEN 1 ELSE rate_limits.count + 1 END,
+			expires_at = CASE WHEN rate_limits.expires_at <= ? THEN EXCLUDED.expires_at ELSE rate_limits.expires_at END
+		RETURNING count, expires_at`,
+		key, now.Add(window), now, now).Row().Scan(&rl.Count, &rl.ExpiresAt)
+	if err != nil {
+		return 0, 0, err
+	}
+	return rl.Count, rl.ExpiresAt.Sub(now), nil
+}
+
+func (rlg *rateLimitGorm) Get(key string) (int, time.Duration, error) {
+	now := time.Now()
+	var rl rateLimit
+	err := first(rlg.db.Where("key = ? AND expires_at > ?", key, now), &rl)
+	switch err {
+	case nil:
+		return rl.Count, rl.ExpiresAt.Sub(now), nil
+	case ErrNotFound:
+		return 0, 0, nil
+	default:
+		return 0, 0, err
+	}
+}
+
+func (rlg *rateLimitGorm) Reset(key string) error {
+	return rlg.db.Where("key = ?", key).Delete(&rateLimit{}).Error
+}
+
+// sweep deletes expired counters every so often, they would otherwise
+// pile up for every address that visited the site.
+func (rlg *rateLimitGorm) sweep() {
+	rlg.mu.Lock()
+	if time.Since(rlg.lastSweep) < rateLimitSweepInterval {
+		rlg.mu.Unlock()
+		return
+	}
+	rlg.lastSweep = time.Now()
+	rlg.mu.Unlock()
+	err := rlg.db.Where("expires_at <= ?", time.Now()).Delete(&rateLimit{}).Error
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+const maxSearchQueryLength = 200
+
+// Searches only return galleries the user can find: their own, those shared
+// with them and public galleries without a password. The userID is 0 for
+// visitors who are not signed in. Unlisted galleries are never returned.
+const searchableGalleries = `(galleries.user_id = ? OR
+	galleries.id IN (SELECT gallery_id FROM gallery_members WHERE user_id = ?) OR
+	(galleries.visibility = 'public' AND COALESCE(galleries.password_hash, '') = ''))`
+
+// galleryDocument and imageDocument are the texts matched by searches.
+// Tags are stored comma separated which the parser splits words on. The
+// year and month the image was taken are included so "beach 2023" works.
+const (
+	galleryDocument = `to_tsvector('english',
+	galleries.title || ' ' || galleries.tags)`
+	imageDocument = `to_tsvector('english',
+	COALESCE(images.title, '') || ' ' ||
+	COALESCE(images.caption, '') || ' ' ||
+	COALESCE(images.alt_text, '') || ' ' ||
+	images.tags || ' ' ||
+	COALESCE(images.camera_make, '') || ' ' ||
+	COALESCE(images.camera_model, '') || ' ' ||
+	COALESCE(images.lens_model, '') || ' ' ||
+	COALESCE(to_char(images.taken_at, 'YYYY FMMonth'), '') || ' ' ||
+	galleries.title || ' ' || galleries.tags)`
+
+	searchQuery = `plainto_tsquery('english', ?)`
+)
+
+// searchValid trims the query and makes sure it is not too long. It reports
+// false if there is nothing to search for.
+func searchValid(query *string, limit, offset int) (bool, error) {
+	*query = strings.TrimSpace(*query)
+	switch {
+	case *query == "":
+		return false, nil
+	case utf8.RuneCountInString(*query) > maxSearchQueryLength:
+		return false, ErrSearchQueryTooLong
+	case limit <= 0 || offset < 0:
+		return false, ErrIDInvalid
+	}
+	return true, nil
+}
+
+func (gv *galleryValidator) Search(userID uint, query string, limit, offset int) ([]Gallery, error) {
+	ok, err := searchValid(&query, limit, offset)
+	if !ok {
+		return nil, err
+	}
+	return gv.GalleryDB.Search(userID, query, limit, offset)
+}
+
+func (gg *galleryGorm) Search(userID uint, query string, limit, offset int) ([]Gallery, error) {
+	var galleries []Gallery
+	err := gg.db.
+		Where(searchableGalleries, userID, userID).
+		Where(galleryDocument+" @@ "+searchQuery, query).
+		Order(gorm.Expr("ts_rank("+galleryDocument+", "+searchQuery+") DESC", query)).
+		Order("galleries.id DESC").
+		Limit(limit).Offset(offset).
+		Find(&galleries).Error
+	if err != nil {
+		return nil, err
+	}
+	return galleries, nil
+}
+
+func (iv *imageValidator) Search(userID uint, query string, limit, offset int) ([]Image, error) {
+	ok, err := searchValid(&query, limit, offset)
+	if !ok {
+		return nil, err
+	}
+	return iv.ImageService.Search(userID, query, limit, offset)
+}
+
+func (is *imageService) Search(userID uint, query string, limit, offset int) ([]Image, error) {
+	images, err := is.ImageDB.Search(userID, query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		is.setURL(&images[i])
+	}
+	return images, nil
+}
+
+func (ig *imageGorm) Search(userID uint, query string, limit, offset int) ([]Image, error) {
+	var images []Image
+	err := ig.db.
+		Select("images.*").
+		Joins("JOIN galleries ON galleries.id = images.gallery_id AND galleries.deleted_at IS NULL").
+		Where(searchableGalleries, userID, userID).
+		Where(imageDocument+" @@ "+searchQuery, query).
+		Order(gorm.Expr("ts_rank("+imageDocument+", "+searchQuery+") DESC", query)).
+		Order("images.id DESC").
+		Limit(limit).Offset(offset).
+		Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+	return images, nil
+}
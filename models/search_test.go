@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	var many []string
+	for i := 0; i <= maxTags; i++ {
+		many = append(many, strings.Repeat("a", i+1))
+	}
+	tests := []struct {
+		tags string
+		want string
+		err  error
+	}{
+		{"", "", nil},
+		{" Beach,  SUNSET , ,beach", "beach,sunset", nil},
+		{"new   york,New York", "new york", nil},
+		{strings.Repeat("a", maxTagLength+1), "", ErrTagTooLong},
+		{strings.Join(many, ","), "", ErrTooManyTags},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTags(tt.tags)
+		if got != tt.want || err != tt.err {
+			t.Errorf("normalizeTags(%q) = %q, %v, want %q, %v", tt.tags, got, err, tt.want, tt.err)
+		}
+	}
+	if got := joinTags("beach,sunset"); got != "beach, sunset" {
+		t.Errorf("Expected tags to be joined for editing. Received %q", got)
+	}
+	if got := splitTags(""); got != nil {
+		t.Errorf("Expected no tags. Received %v", got)
+	}
+}
+
+func TestSearchValid(t *testing.T) {
+	tests := []struct {
+		query  string
+		limit  int
+		offset int
+		ok     bool
+		err    error
+	}{
+		{" beach ", 10, 0, true, nil},
+		{"   ", 10, 0, false, nil},
+		{strings.Repeat("a", maxSearchQueryLength+1), 10, 0, false, ErrSearchQueryTooLong},
+		{"beach", 0, 0, false, ErrIDInvalid},
+		{"beach", 10, -1, false, ErrIDInvalid},
+	}
+	for _, tt := range tests {
+		query := tt.query
+		ok, err := searchValid(&query, tt.limit, tt.offset)
+		if ok != tt.ok || err != tt.err {
+			t.Errorf("searchValid(%q, %d, %d) = %v, %v, want %v, %v", tt.query, tt.limit, tt.offset, ok, err, tt.ok, tt.err)
+		}
+	}
+}
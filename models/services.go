@@ -1,8 +1,14 @@
 package models
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"lenslocked.com/ratelimit"
+	"lenslocked.com/storage"
+	"lenslocked.com/webauthn"
 )
 
 type ServicesConfig func(*Services) error
@@ -25,23 +31,99 @@ func WithLogMode(logging bool) ServicesConfig {
 	}
 }
 
-func WithUser(hmacKey, pepper string) ServicesConfig {
+// WithRateLimits sets up the store rate limits are counted in. driver is
+// "memory" to count them in this process, or "postgres" to share them
+// between servers through the database.
+func WithRateLimits(driver string) ServicesConfig {
+	return func(s *Services) error {
+		switch strings.ToLower(driver) {
+		case "", "memory":
+			s.RateLimits = ratelimit.NewMemory()
+		case "postgres":
+			s.RateLimits = NewRateLimitStore(s.db)
+		default:
+			return fmt.Errorf("models: unknown rate limit driver %q", driver)
+		}
+		return nil
+	}
+}
+
+// rateLimits returns the store set up by WithRateLimits, counting in
+// memory if it wasn't used.
+func (s *Services) rateLimits() ratelimit.Store {
+	if s.RateLimits == nil {
+		s.RateLimits = ratelimit.NewMemory()
+	}
+	return s.RateLimits
+}
+
+// WithUser sets up the UserService, it must come after WithRateLimits.
+// mailer lets users know when their account was locked.
+func WithUser(hmacKey, pepper string, mailer LockoutMailer) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, hmacKey, pepper, s.rateLimits(), mailer)
+		return nil
+	}
+}
+
+// WithSession sets up the SessionService. hmacKey is used to hash session
+// tokens before they are stored.
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithTwoFactor sets up the TwoFactorService, it must come after WithUser.
+// hmacKey is used to hash recovery codes and sign login challenges.
+func WithTwoFactor(hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, hmacKey, pepper)
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, hmacKey)
 		return nil
 	}
 }
 
-func WithGallery() ServicesConfig {
+// WithGallery sets up the GalleryService, it must come after WithRateLimits.
+// hmacKey is used to sign share links and the pepper is added to gallery
+// passwords before hashing them.
+func WithGallery(hmacKey, pepper string) ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		s.Gallery = NewGalleryService(s.db, hmacKey, pepper, s.rateLimits())
 		return nil
 	}
 }
 
-func WithImage() ServicesConfig {
+// WithAccessToken sets up the AccessTokenService. hmacKey is used to hash
+// the tokens before they are stored.
+func WithAccessToken(hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.AccessToken = NewAccessTokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithOAuth sets up the OAuthService. hmacKey is used to hash client
+// secrets and the tokens issued to clients before they are stored.
+func WithOAuth(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.OAuth = NewOAuthService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithWebAuthn sets up the WebAuthnService for passkeys registered with rp.
+func WithWebAuthn(rp webauthn.RelyingParty) ServicesConfig {
+	return func(s *Services) error {
+		s.WebAuthn = NewWebAuthnService(s.db, rp)
+		return nil
+	}
+}
+
+// WithImage sets up the ImageService to keep image bytes in the provided BlobStore.
+func WithImage(store storage.BlobStore) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = NewImageService(s.db, store)
 		return nil
 	}
 }
@@ -69,10 +151,18 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 
 // Services contains all of our services
 type Services struct {
-	Gallery GalleryService
-	Image   ImageService
-	User    UserService
-	db      *gorm.DB
+	Gallery     GalleryService
+	Image       ImageService
+	User        UserService
+	Session     SessionService
+	TwoFactor   TwoFactorService
+	WebAuthn    WebAuthnService
+	AccessToken AccessTokenService
+	OAuth       OAuthService
+	// RateLimits is where login attempts and other rate limited requests
+	// are counted.
+	RateLimits ratelimit.Store
+	db         *gorm.DB
 }
 
 // Close closes the database connection.
@@ -82,7 +172,7 @@ func (s *Services) Close() error {
 
 // DestructiveReset drops all table and rebuilds them.
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Session{}, &recoveryCode{}, &WebAuthnCredential{}, &webauthnChallenge{}, &Gallery{}, &GalleryMember{}, &Image{}, &pwReset{}, &emailVerification{}, &AccessToken{}, &OAuthClient{}, &oauthCode{}, &oauthRefreshToken{}, &rateLimit{}).Error
 	if err != nil {
 		return err
 	}
@@ -91,5 +181,20 @@ func (s *Services) DestructiveReset() error {
 
 // AutoMigrate will attempt to automatically migrate all tables.
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}).Error
+	// users used to be signed in with a single remember token, which
+	// sessions replaced
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		if err := s.db.Model(&User{}).DropColumn("remember_hash").Error; err != nil {
+			return err
+		}
+	}
+	// users who signed up before email addresses were verified are
+	// treated as verified, so they can keep sharing their galleries
+	backfillVerified := s.db.HasTable(&User{}) && !s.db.Dialect().HasColumn("users", "verified_at")
+	err := s.db.AutoMigrate(&User{}, &Session{}, &recoveryCode{}, &WebAuthnCredential{}, &webauthnChallenge{}, &Gallery{}, &GalleryMember{}, &Image{}, &pwReset{}, &emailVerification{}, &AccessToken{}, &OAuthClient{}, &oauthCode{}, &oauthRefreshToken{}, &rateLimit{}).Error
+	if err != nil || !backfillVerified {
+		return err
+	}
+	return s.db.Model(&User{}).Where("verified_at IS NULL").
+		UpdateColumn("verified_at", gorm.Expr("created_at")).Error
 }
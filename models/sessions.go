@@ -0,0 +1,284 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+)
+
+const (
+	// SessionDuration is how long users stay signed in on a device.
+	SessionDuration = 30 * 24 * time.Hour
+
+	maxUserAgentLength = 255
+
+	// sessionTouchInterval is how often the last time a session was seen
+	// is recorded, so not every request needs to write to the DB.
+	sessionTouchInterval = time.Minute
+)
+
+// Session is a user signed in on one of their devices. Only a hash of the
+// token kept in the device's cookie is stored.
+type Session struct {
+	ID     uint `gorm:"primary_key"`
+	UserID uint `gorm:"not null;index"`
+	// Token is only set when the session is created.
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string `gorm:"not null;default:''"`
+	IP         string `gorm:"not null;default:''"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// sessionBrowsers and sessionPlatforms map user agent substrings to the
+// names shown to users, in the order they are checked.
+var (
+	sessionBrowsers = [][2]string{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"},
+	}
+	sessionPlatforms = [][2]string{
+		{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	}
+)
+
+// Device describes the browser and platform the session was created on,
+// e.g. "Firefox on Windows".
+func (s *Session) Device() string {
+	match := func(names [][2]string) string {
+		for _, n := range names {
+			if strings.Contains(s.UserAgent, n[0]) {
+				return n[1]
+			}
+		}
+		return ""
+	}
+	browser, platform := match(sessionBrowsers), match(sessionPlatforms)
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	default:
+		return "Unknown device"
+	}
+}
+
+// SessionDB is used to interact with the sessions table.
+type SessionDB interface {
+	// ByToken looks up a session by its unhashed token.
+	ByToken(token string) (*Session, error)
+	// ByUserID returns the user's sessions that haven't expired, most
+	// recently seen first.
+	ByUserID(userID uint) ([]Session, error)
+	// Create generates the session's token and stores its hash. The
+	// unhashed token is set on the Session and can't be retrieved again.
+	Create(session *Session) error
+	// Touch records that the session was just seen from ip.
+	Touch(session *Session, ip string) error
+	// Delete signs the user out of the session with id.
+	Delete(userID, id uint) error
+	// DeleteOthers signs the user out of every session but the one with
+	// keepID, pass 0 to sign them out everywhere.
+	DeleteOthers(userID, keepID uint) error
+}
+
+// SessionService is used to work with the sessions users are signed in
+// with.
+type SessionService interface {
+	// Authenticate returns the user a session token belongs to along with
+	// the session itself. ErrTokenInvalid is returned for unknown or
+	// expired sessions.
+	Authenticate(token, ip string) (*User, *Session, error)
+	SessionDB
+}
+
+// NewSessionService returns a SessionService storing sessions in db, with
+// their tokens hashed with hmacKey.
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			SessionDB: &sessionGorm{db},
+			hmac:      hash.NewHMAC(hmacKey),
+		},
+		userDB: &userGorm{db},
+	}
+}
+
+type sessionService struct {
+	SessionDB
+	userDB UserDB
+}
+
+func (ss *sessionService) Authenticate(token, ip string) (*User, *Session, error) {
+	session, err := ss.ByToken(token)
+	switch {
+	case err == ErrNotFound:
+		return nil, nil, ErrTokenInvalid
+	case err != nil:
+		return nil, nil, err
+	case !time.Now().Before(session.ExpiresAt):
+		if err := ss.Delete(session.UserID, session.ID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenInvalid
+	}
+	user, err := ss.userDB.ByID(session.UserID)
+	if err == ErrNotFound {
+		return nil, nil, ErrTokenInvalid
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Since(session.LastSeenAt) > sessionTouchInterval || session.IP != ip {
+		if err := ss.Touch(session, ip); err != nil {
+			return nil, nil, err
+		}
+	}
+	return user, session, nil
+}
+
+type sessionValFunc func(*Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{Token: token}
+	if err := sv.hmacToken(&session); err != nil {
+		return nil, err
+	}
+	if session.TokenHash == "" {
+		return nil, ErrNotFound
+	}
+	return sv.SessionDB.ByToken(session.TokenHash)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFuncs(session,
+		sv.requireUserID,
+		sv.trimUserAgent,
+		sv.setExpiry,
+		sv.setToken,
+		sv.hmacToken)
+	if err != nil {
+		return err
+	}
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Delete(userID, id uint) error {
+	if userID <= 0 || id <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.Delete(userID, id)
+}
+
+func (sv *sessionValidator) DeleteOthers(userID, keepID uint) error {
+	if userID <= 0 {
+		return ErrIDInvalid
+	}
+	return sv.SessionDB.DeleteOthers(userID, keepID)
+}
+
+func (sv *sessionValidator) requireUserID(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (sv *sessionValidator) trimUserAgent(session *Session) error {
+	if len(session.UserAgent) > maxUserAgentLength {
+		session.UserAgent = session.UserAgent[:maxUserAgentLength]
+	}
+	return nil
+}
+
+func (sv *sessionValidator) setExpiry(session *Session) error {
+	now := time.Now()
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(SessionDuration)
+	return nil
+}
+
+// setToken generates the token, it is never set by the caller.
+func (sv *sessionValidator) setToken(session *Session) error {
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	err := first(sg.db.Where("token_hash = ?", tokenHash), &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Touch(session *Session, ip string) error {
+	session.LastSeenAt = time.Now()
+	session.IP = ip
+	return sg.db.Model(session).UpdateColumns(map[string]interface{}{
+		"last_seen_at": session.LastSeenAt,
+		"ip":           ip,
+	}).Error
+}
+
+func (sg *sessionGorm) Delete(userID, id uint) error {
+	return sg.db.Where("user_id = ? AND id = ?", userID, id).Delete(&Session{}).Error
+}
+
+func (sg *sessionGorm) DeleteOthers(userID, keepID uint) error {
+	return sg.db.Where("user_id = ? AND id <> ?", userID, keepID).Delete(&Session{}).Error
+}
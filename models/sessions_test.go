@@ -0,0 +1,206 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+// memUsers is an in-memory UserDB.
+type memUsers map[uint]*User
+
+func (m memUsers) ByID(id uint) (*User, error) {
+	user, ok := m[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u := *user
+	return &u, nil
+}
+
+func (m memUsers) ByEmail(email string) (*User, error) {
+	for _, user := range m {
+		if user.Email == email {
+			u := *user
+			return &u, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m memUsers) Create(user *User) error {
+	user.ID = uint(len(m) + 1)
+	return m.Update(user)
+}
+
+func (m memUsers) Update(user *User) error {
+	u := *user
+	m[user.ID] = &u
+	return nil
+}
+
+func (m memUsers) Delete(id uint) error {
+	delete(m, id)
+	return nil
+}
+
+// memSessions is an in-memory SessionDB keyed by token hash.
+type memSessions map[string]*Session
+
+func (m memSessions) ByToken(tokenHash string) (*Session, error) {
+	session, ok := m[tokenHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	s := *session
+	return &s, nil
+}
+
+func (m memSessions) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	for _, session := range m {
+		if session.UserID == userID {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m memSessions) Create(session *Session) error {
+	session.ID = uint(len(m) + 1)
+	s := *session
+	m[session.TokenHash] = &s
+	return nil
+}
+
+func (m memSessions) Touch(session *Session, ip string) error {
+	session.IP = ip
+	session.LastSeenAt = time.Now()
+	s := *session
+	m[session.TokenHash] = &s
+	return nil
+}
+
+func (m memSessions) Delete(userID, id uint) error {
+	for k, session := range m {
+		if session.UserID == userID && session.ID == id {
+			delete(m, k)
+		}
+	}
+	return nil
+}
+
+func (m memSessions) DeleteOthers(userID, keepID uint) error {
+	for k, session := range m {
+		if session.UserID == userID && session.ID != keepID {
+			delete(m, k)
+		}
+	}
+	return nil
+}
+
+func testSessionService() (*sessionService, memSessions, memUsers) {
+	sessions, users := memSessions{}, memUsers{}
+	return &sessionService{
+		SessionDB: &sessionValidator{SessionDB: sessions, hmac: hash.NewHMAC("test-key")},
+		userDB:    users,
+	}, sessions, users
+}
+
+func TestSessionAuthenticate(t *testing.T) {
+	ss, sessions, users := testSessionService()
+	users.Create(&User{Name: "Jon"})
+	users.Create(&User{Name: "Sam"})
+
+	create := func(userID uint) *Session {
+		session := &Session{UserID: userID, UserAgent: strings.Repeat("a", 300), IP: "1.2.3.4"}
+		if err := ss.Create(session); err != nil {
+			t.Fatal(err)
+		}
+		return session
+	}
+	valid := create(1)
+	if len(valid.UserAgent) != maxUserAgentLength {
+		t.Errorf("Expected the user agent to be trimmed. Received %d characters", len(valid.UserAgent))
+	}
+	expired := create(1)
+	sessions[expired.TokenHash].ExpiresAt = time.Now().Add(-time.Second)
+	orphaned := create(2)
+	users.Delete(2)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid.Token, nil},
+		{"empty", "", ErrTokenInvalid},
+		{"unknown", valid.Token + "x", ErrTokenInvalid},
+		{"hash", valid.TokenHash, ErrTokenInvalid},
+		{"expired", expired.Token, ErrTokenInvalid},
+		{"deleted user", orphaned.Token, ErrTokenInvalid},
+	}
+	for _, tt := range tests {
+		if _, _, err := ss.Authenticate(tt.token, "1.2.3.4"); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+	if _, ok := sessions[expired.TokenHash]; ok {
+		t.Errorf("Expected expired sessions to be deleted")
+	}
+
+	user, session, err := ss.Authenticate(valid.Token, "5.6.7.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 1 || session.ID != valid.ID {
+		t.Errorf("Expected session %d of user 1. Received session %d of user %d", valid.ID, session.ID, user.ID)
+	}
+	if sessions[valid.TokenHash].IP != "5.6.7.8" {
+		t.Errorf("Expected the new IP to be recorded. Received %s", sessions[valid.TokenHash].IP)
+	}
+}
+
+func TestSessionDeleteOthers(t *testing.T) {
+	ss, sessions, _ := testSessionService()
+	keep := &Session{UserID: 1}
+	for _, session := range []*Session{keep, {UserID: 1}, {UserID: 2}} {
+		if err := ss.Create(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.DeleteOthers(0, keep.ID); err != ErrIDInvalid {
+		t.Errorf("Expected ErrIDInvalid. Received %v", err)
+	}
+	if err := ss.DeleteOthers(1, keep.ID); err != nil {
+		t.Fatal(err)
+	}
+	if left, _ := sessions.ByUserID(1); len(left) != 1 || left[0].ID != keep.ID {
+		t.Errorf("Expected only session %d to be left. Received %v", keep.ID, left)
+	}
+	if left, _ := sessions.ByUserID(2); len(left) != 1 {
+		t.Errorf("Expected other users to stay signed in. Received %v", left)
+	}
+}
+
+func TestSessionDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/115.0", "Firefox on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36 Edg/114.0.1823.82", "Edge on Windows"},
+		{"Mozilla/5.0 (Linux; Android 13) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"curl/8.1.2", "curl"},
+		{"", "Unknown device"},
+	}
+	for _, tt := range tests {
+		s := Session{UserAgent: tt.userAgent}
+		if got := s.Device(); got != tt.want {
+			t.Errorf("Device(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SharePerm is a set of permissions granted by a share link.
+type SharePerm uint8
+
+const (
+	// SharePermView allows viewing the gallery and the resized images.
+	SharePermView SharePerm = 1 << iota
+	// SharePermDownload additionally allows downloading the original images.
+	SharePermDownload
+)
+
+// Has reports whether all of perm are included in p.
+func (p SharePerm) Has(perm SharePerm) bool {
+	return p&perm == perm
+}
+
+// ShareLink grants access to a gallery, or to a single one of its images,
+// until it expires. Links are signed with the gallery's share secret so
+// rotating the secret revokes every link of the gallery.
+type ShareLink struct {
+	GalleryID uint
+	// ImageUID is empty for links to the whole gallery.
+	ImageUID  string
+	Perms     SharePerm
+	Expires   time.Time
+	Signature string
+}
+
+// Path returns the path of the shared gallery or image including
+// the query parameters that carry the signature. Image links point to
+// the original only when downloads are allowed.
+func (l *ShareLink) Path() string {
+	path := fmt.Sprintf("/galleries/%v", l.GalleryID)
+	switch {
+	case l.ImageUID != "" && l.Perms.Has(SharePermDownload):
+		path = imagesURL + l.ImageUID
+	case l.ImageUID != "":
+		path = imagesURL + l.ImageUID + "/large"
+	}
+	return path + "?" + l.Query().Encode()
+}
+
+// Query returns the query parameters a share link is made up of.
+func (l *ShareLink) Query() url.Values {
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	q.Set("perm", strconv.Itoa(int(l.Perms)))
+	q.Set("sig", l.Signature)
+	return q
+}
+
+// ParseShareLink reads a share link for the gallery or image from the
+// query parameters of a request. It returns nil if q does not contain a
+// share link. The link still needs to be verified with VerifyShareLink.
+func ParseShareLink(q url.Values, galleryID uint, imageUID string) *ShareLink {
+	sig := q.Get("sig")
+	if sig == "" {
+		return nil
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return nil
+	}
+	perms, err := strconv.ParseUint(q.Get("perm"), 10, 8)
+	if err != nil {
+		return nil
+	}
+	return &ShareLink{
+		GalleryID: galleryID,
+		ImageUID:  imageUID,
+		Perms:     SharePerm(perms),
+		Expires:   time.Unix(expires, 0),
+		Signature: sig,
+	}
+}
+
+// message returns the data signed for the link. The secret is
+// included so that links stop working once it is rotated.
+func (l *ShareLink) message(secret string) string {
+	return fmt.Sprintf("%v\n%s\n%d\n%d\n%s",
+		l.GalleryID, l.ImageUID, l.Expires.Unix(), l.Perms, secret)
+}
+
+// ShareLink signs a link granting perms to the gallery, or to the image
+// with imageUID when it is not empty, until expires.
+func (gs *galleryService) ShareLink(gallery *Gallery, imageUID string, perms SharePerm, expires time.Time) (*ShareLink, error) {
+	if gallery.ShareSecret == "" {
+		// galleries created before share links were added get a
+		// secret the first time they are saved.
+		if err := gs.Update(gallery); err != nil {
+			return nil, err
+		}
+	}
+	if !expires.After(time.Now()) {
+		return nil, ErrShareExpiryInvalid
+	}
+	link := ShareLink{
+		GalleryID: gallery.ID,
+		ImageUID:  imageUID,
+		Perms:     perms | SharePermView,
+		Expires:   expires,
+	}
+	link.Signature = gs.hmac.Hash(link.message(gallery.ShareSecret))
+	return &link, nil
+}
+
+// VerifyShareLink makes sure the link was signed for the gallery with its
+// current share secret and has not expired.
+func (gs *galleryService) VerifyShareLink(gallery *Gallery, link *ShareLink) error {
+	if link == nil || gallery.ShareSecret == "" || link.GalleryID != gallery.ID {
+		return ErrShareLinkInvalid
+	}
+	expected := gs.hmac.Hash(link.message(gallery.ShareSecret))
+	if !hmac.Equal([]byte(expected), []byte(link.Signature)) {
+		return ErrShareLinkInvalid
+	}
+	if time.Now().After(link.Expires) {
+		return ErrShareLinkExpired
+	}
+	return nil
+}
+
+// RevokeShareLinks rotates the gallery's share secret which invalidates
+// all of the share links created for it so far.
+func (gs *galleryService) RevokeShareLinks(gallery *Gallery) error {
+	gallery.ShareSecret = ""
+	return gs.Update(gallery)
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"lenslocked.com/hash"
+)
+
+func TestShareLink(t *testing.T) {
+	gs := &galleryService{hmac: hash.NewHMAC("test-key")}
+	gallery := &Gallery{ShareSecret: "secret"}
+	gallery.ID = 1
+	expires := time.Now().Add(time.Hour)
+	link, err := gs.ShareLink(gallery, "", SharePermDownload, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !link.Perms.Has(SharePermView | SharePermDownload) {
+		t.Errorf("Expected download links to allow viewing. Received %d", link.Perms)
+	}
+	if _, err := gs.ShareLink(gallery, "", SharePermView, time.Now().Add(-time.Second)); err != ErrShareExpiryInvalid {
+		t.Errorf("Expected ErrShareExpiryInvalid. Received %v", err)
+	}
+
+	// tampered links are parsed back from their query like requests are
+	parse := func(change func(q url.Values)) *ShareLink {
+		q := link.Query()
+		change(q)
+		return ParseShareLink(q, gallery.ID, "")
+	}
+	other := &Gallery{ShareSecret: "secret"}
+	other.ID = 2
+	rotated := &Gallery{ShareSecret: "rotated"}
+	rotated.ID = 1
+
+	tests := []struct {
+		name    string
+		gallery *Gallery
+		link    *ShareLink
+		want    error
+	}{
+		{"valid", gallery, parse(func(url.Values) {}), nil},
+		{"no link", gallery, nil, ErrShareLinkInvalid},
+		{"other gallery", other, link, ErrShareLinkInvalid},
+		{"rotated secret", rotated, link, ErrShareLinkInvalid},
+		{"other image", gallery, &ShareLink{GalleryID: 1, ImageUID: "abc", Perms: link.Perms, Expires: link.Expires, Signature: link.Signature}, ErrShareLinkInvalid},
+		{"extended", gallery, parse(func(q url.Values) { q.Set("expires", "9999999999") }), ErrShareLinkInvalid},
+		{"more perms", gallery, parse(func(q url.Values) { q.Set("perm", "255") }), ErrShareLinkInvalid},
+		{"bad signature", gallery, parse(func(q url.Values) { q.Set("sig", "x") }), ErrShareLinkInvalid},
+	}
+	for _, tt := range tests {
+		if err := gs.VerifyShareLink(tt.gallery, tt.link); err != tt.want {
+			t.Errorf("%s: expected %v. Received %v", tt.name, tt.want, err)
+		}
+	}
+
+	// links are signed with their expiry so the clock has to move instead
+	expired, err := gs.ShareLink(gallery, "", SharePermView, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.Expires = expired.Expires.Add(-2 * time.Second)
+	expired.Signature = gs.hmac.Hash(expired.message(gallery.ShareSecret))
+	if err := gs.VerifyShareLink(gallery, expired); err != ErrShareLinkExpired {
+		t.Errorf("Expected ErrShareLinkExpired. Received %v", err)
+	}
+}
+
+func TestParseShareLink(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"link", "expires=1600000000&perm=1&sig=abc", true},
+		{"no signature", "expires=1600000000&perm=1", false},
+		{"bad expiry", "expires=soon&perm=1&sig=abc", false},
+		{"bad perm", "expires=1600000000&perm=256&sig=abc", false},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link := ParseShareLink(q, 1, ""); (link != nil) != tt.ok {
+			t.Errorf("%s: expected a link %v. Received %+v", tt.name, tt.ok, link)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTags      = 20
+	maxTagLength = 30
+
+	// tagSep separates the tags of a gallery or image when stored.
+	tagSep = ","
+)
+
+// normalizeTags lowercases and trims the comma separated tags, dropping
+// empty and duplicate ones.
+func normalizeTags(tags string) (string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(tags, tagSep) {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return "", ErrTagTooLong
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return "", ErrTooManyTags
+	}
+	return strings.Join(normalized, tagSep), nil
+}
+
+// splitTags returns the stored tags as a slice.
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, tagSep)
+}
+
+// joinTags formats stored tags for editing in a form.
+func joinTags(tags string) string {
+	return strings.Join(splitTags(tags), tagSep+" ")
+}
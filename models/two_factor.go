@@ -0,0 +1,334 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base32"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/hash"
+	"lenslocked.com/rand"
+	"lenslocked.com/totp"
+)
+
+const (
+	// TOTPIssuer names us in the user's authenticator app.
+	TOTPIssuer = "LensLocked"
+
+	recoveryCodeCount = 10
+	// recoveryCodeBytes encode to 8 base32 characters.
+	recoveryCodeBytes = 5
+
+	// loginChallengeDuration is how long users have to enter their second
+	// factor after their password.
+	loginChallengeDuration = 5 * time.Minute
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// recoveryCode is a single-use code a user can sign in with when they
+// don't have their authenticator app. Only its hash is stored.
+type recoveryCode struct {
+	ID        uint   `gorm:"primary_key"`
+	UserID    uint   `gorm:"not null;index"`
+	Code      string `gorm:"-"`
+	CodeHash  string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// TwoFactorService is used to manage the optional second factor users
+// sign in with, a TOTP code from an authenticator app.
+type TwoFactorService interface {
+	// Setup generates a new TOTP secret for the user. Their second
+	// factor is only required once they confirmed it with Enable.
+	Setup(user *User) error
+	// Enable turns on two-factor authentication if code is valid for the
+	// secret created by Setup. The user's recovery codes are returned,
+	// they can't be retrieved again.
+	Enable(user *User, code string) ([]string, error)
+	// Disable turns off two-factor authentication once the user confirmed
+	// their password.
+	Disable(user *User, password string) error
+	// Verify checks the second factor of a user signing in, which is
+	// either a TOTP code or one of their recovery codes. Neither can be
+	// used twice. ErrTOTPCodeInvalid is returned if it doesn't match, and
+	// failures count towards locking the account like wrong passwords:
+	// ErrTooManyAttempts or ErrAccountLocked are returned once there were
+	// too many.
+	Verify(user *User, code string) error
+	// RecoveryCodesLeft returns the number of unused recovery codes.
+	RecoveryCodesLeft(user *User) (int, error)
+	// Challenge returns a token identifying a user that entered their
+	// password but still needs to enter their second factor.
+	Challenge(user *User) (string, error)
+	// ChallengeUser returns the user a token created by Challenge is for.
+	// ErrTokenInvalid is returned if it has been tampered with or expired.
+	ChallengeUser(token string) (*User, error)
+}
+
+// NewTwoFactorService returns a TwoFactorService using us to look up and
+// update users. hmacKey is used to hash recovery codes and sign login
+// challenges.
+func NewTwoFactorService(db *gorm.DB, us UserService, hmacKey string) TwoFactorService {
+	hmac := hash.NewHMAC(hmacKey)
+	return &twoFactorService{
+		us: us,
+		recoveryDB: &recoveryCodeValidator{
+			recoveryCodeDB: &recoveryCodeGorm{db},
+			hmac:           hmac,
+		},
+		stepDB: &totpStepGorm{db},
+		hmac:   hmac,
+	}
+}
+
+type twoFactorService struct {
+	us         UserService
+	recoveryDB recoveryCodeDB
+	stepDB     totpStepDB
+	hmac       hash.HMAC
+}
+
+func (tfs *twoFactorService) Setup(user *User) error {
+	if user.TOTPEnabled {
+		return ErrTwoFactorEnabled
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret = secret
+	user.TOTPLastStep = 0
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	switch {
+	case user.TOTPEnabled:
+		return nil, ErrTwoFactorEnabled
+	case user.TOTPSecret == "":
+		return nil, ErrTwoFactorNotSetUp
+	}
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return nil, ErrTOTPCodeInvalid
+	}
+	codes := make([]recoveryCode, recoveryCodeCount)
+	if err := tfs.recoveryDB.Replace(user.ID, codes); err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	if err := tfs.us.Update(user); err != nil {
+		return nil, err
+	}
+	values := make([]string, len(codes))
+	for i, code := range codes {
+		values[i] = code.Code
+	}
+	return values, nil
+}
+
+func (tfs *twoFactorService) Disable(user *User, password string) error {
+	if _, err := tfs.us.Authenticate(user.Email, password); err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	if err := tfs.us.Update(user); err != nil {
+		return err
+	}
+	return tfs.recoveryDB.DeleteByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.TOTPEnabled {
+		return ErrTOTPCodeInvalid
+	}
+	if err := tfs.us.CheckLogin(user); err != nil {
+		return err
+	}
+	err := tfs.verify(user, code)
+	switch err {
+	case nil:
+		tfs.us.LoginSucceeded(user)
+		return nil
+	case ErrTOTPCodeInvalid:
+		return tfs.us.LoginFailed(user, err)
+	default:
+		return err
+	}
+}
+
+func (tfs *twoFactorService) verify(user *User, code string) error {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if ok {
+		// codes can be replayed while they are valid unless we remember
+		// the last one used
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeInvalid
+		}
+		if err := tfs.stepDB.Use(user.ID, step); err != nil {
+			return err
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+	return tfs.recoveryDB.Use(user.ID, code)
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(user *User) (int, error) {
+	return tfs.recoveryDB.CountByUserID(user.ID)
+}
+
+func (tfs *twoFactorService) Challenge(user *User) (string, error) {
+	if user.ID <= 0 {
+		return "", ErrUserIDRequired
+	}
+	expires := time.Now().Add(loginChallengeDuration).Unix()
+	payload := fmt.Sprintf("%d.%d", user.ID, expires)
+	return payload + "." + tfs.sign(payload), nil
+}
+
+func (tfs *twoFactorService) ChallengeUser(token string) (*User, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+	payload := parts[0] + "." + parts[1]
+	if subtle.ConstantTimeCompare([]byte(tfs.sign(payload)), []byte(parts[2])) != 1 {
+		return nil, ErrTokenInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil, ErrTokenInvalid
+	}
+	user, err := tfs.us.ByID(uint(id))
+	if err == ErrNotFound {
+		return nil, ErrTokenInvalid
+	}
+	return user, err
+}
+
+// sign returns the signature of a login challenge. The HMAC key is shared
+// with other tokens so challenges are signed with a prefix of their own.
+func (tfs *twoFactorService) sign(payload string) string {
+	return tfs.hmac.Hash("login-challenge:" + payload)
+}
+
+// totpStepDB records the time step of the last TOTP code each user signed
+// in with.
+type totpStepDB interface {
+	// Use records step as the user's last one, returning
+	// ErrTOTPCodeInvalid unless it is later than the step recorded. Only
+	// one of several concurrent requests with the same code succeeds.
+	Use(userID uint, step int64) error
+}
+
+type totpStepGorm struct {
+	db *gorm.DB
+}
+
+func (tsg *totpStepGorm) Use(userID uint, step int64) error {
+	res := tsg.db.Model(&User{}).Where("id = ? AND totp_last_step < ?", userID, step).
+		UpdateColumn("totp_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTOTPCodeInvalid
+	}
+	return nil
+}
+
+// recoveryCodeDB is used to interact with the recovery_codes table.
+type recoveryCodeDB interface {
+	// Replace generates the codes and stores their hashes as the user's
+	// recovery codes, deleting any they had before.
+	Replace(userID uint, codes []recoveryCode) error
+	// Use deletes the user's recovery code, returning ErrTOTPCodeInvalid
+	// if they don't have it.
+	Use(userID uint, code string) error
+	CountByUserID(userID uint) (int, error)
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+func (rcv *recoveryCodeValidator) Replace(userID uint, codes []recoveryCode) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+	for i := range codes {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return err
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i].UserID = userID
+		codes[i].Code = code[:4] + "-" + code[4:]
+		codes[i].CodeHash = rcv.hmac.Hash(code)
+	}
+	return rcv.recoveryCodeDB.Replace(userID, codes)
+}
+
+// Use normalises the code the way it is hashed, users may leave out the
+// dash or change its case.
+func (rcv *recoveryCodeValidator) Use(userID uint, code string) error {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if userID <= 0 || code == "" {
+		return ErrTOTPCodeInvalid
+	}
+	return rcv.recoveryCodeDB.Use(userID, rcv.hmac.Hash(code))
+}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+func (rcg *recoveryCodeGorm) Replace(userID uint, codes []recoveryCode) error {
+	tx := rcg.db.Begin()
+	if err := tx.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i := range codes {
+		if err := tx.Create(&codes[i]).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func (rcg *recoveryCodeGorm) Use(userID uint, codeHash string) error {
+	res := rcg.db.Where("user_id = ? AND code_hash = ?", userID, codeHash).Delete(&recoveryCode{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrTOTPCodeInvalid
+	}
+	return nil
+}
+
+func (rcg *recoveryCodeGorm) CountByUserID(userID uint) (int, error) {
+	var count int
+	err := rcg.db.Model(&recoveryCode{}).Where("user_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Where("user_id = ?", userID).Delete(&recoveryCode{}).Error
+}
@@ -0,0 +1,325 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/hash"
+	"lenslocked.com/ratelimit"
+	"lenslocked.com/totp"
+)
+
+// memRecoveryCodes is an in-memory recoveryCodeDB holding code hashes by
+// user ID.
+type memRecoveryCodes map[uint][]string
+
+func (m memRecoveryCodes) Replace(userID uint, codes []recoveryCode) error {
+	m[userID] = nil
+	for _, code := range codes {
+		m[userID] = append(m[userID], code.CodeHash)
+	}
+	return nil
+}
+
+func (m memRecoveryCodes) Use(userID uint, codeHash string) error {
+	for i, h := range m[userID] {
+		if h == codeHash {
+			m[userID] = append(m[userID][:i], m[userID][i+1:]...)
+			return nil
+		}
+	}
+	return ErrTOTPCodeInvalid
+}
+
+func (m memRecoveryCodes) CountByUserID(userID uint) (int, error) {
+	return len(m[userID]), nil
+}
+
+func (m memRecoveryCodes) DeleteByUserID(userID uint) error {
+	delete(m, userID)
+	return nil
+}
+
+// memTOTPSteps is a totpStepDB recording steps on the users in a
+// memUsers.
+type memTOTPSteps memUsers
+
+func (m memTOTPSteps) Use(userID uint, step int64) error {
+	user, ok := m[userID]
+	if !ok || step <= user.TOTPLastStep {
+		return ErrTOTPCodeInvalid
+	}
+	user.TOTPLastStep = step
+	return nil
+}
+
+// testUserService returns a user service counting failed logins with
+// logins, or the usual backoff if it is nil.
+func testUserService(logins *ratelimit.Backoff) *userService {
+	store := ratelimit.NewMemory()
+	if logins == nil {
+		logins = newLoginBackoff(store)
+	}
+	return &userService{
+		UserDB: memUsers{},
+		pepper: "pepper",
+		hmac:   hash.NewHMAC("test-key"),
+		logins: logins,
+		resets: ratelimit.NewLimiter(store, "reset", resetLimit, resetWindow),
+	}
+}
+
+// testPasswordUser creates a user with the password "secret".
+func testPasswordUser(t *testing.T, us *userService, email string) *User {
+	b, err := bcrypt.GenerateFromPassword([]byte("secret"+us.pepper), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Name: "Jon", Email: email, PasswordHash: string(b)}
+	if err := us.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func testTwoFactorService(us *userService) *twoFactorService {
+	hmac := hash.NewHMAC("test-key")
+	return &twoFactorService{
+		us: us,
+		recoveryDB: &recoveryCodeValidator{
+			recoveryCodeDB: memRecoveryCodes{},
+			hmac:           hmac,
+		},
+		stepDB: memTOTPSteps(us.UserDB.(memUsers)),
+		hmac:   hmac,
+	}
+}
+
+// testTwoFactorUser creates a user with the password "secret" and a second
+// factor, returning them with their recovery codes.
+func testTwoFactorUser(t *testing.T, us *userService, tfs *twoFactorService) (*User, []string) {
+	user := testPasswordUser(t, us, "jon@example.com")
+	if err := tfs.Setup(user); err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(user.TOTPSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := tfs.Enable(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, codes
+}
+
+// nextCode returns the code for the step after the user's last one, so it
+// hasn't been used yet.
+func nextCode(t *testing.T, user *User) string {
+	code, err := totp.Code(user.TOTPSecret, user.TOTPLastStep+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTwoFactorEnable(t *testing.T) {
+	us := testUserService(nil)
+	tfs := testTwoFactorService(us)
+	user := testPasswordUser(t, us, "jon@example.com")
+
+	if _, err := tfs.Enable(user, "000000"); err != ErrTwoFactorNotSetUp {
+		t.Errorf("Expected ErrTwoFactorNotSetUp. Received %v", err)
+	}
+	if err := tfs.Setup(user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfs.Enable(user, "000000"); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected a wrong code to be refused. Received %v", err)
+	}
+	code, err := totp.Code(user.TOTPSecret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := tfs.Enable(user, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes. Received %d", recoveryCodeCount, len(codes))
+	}
+	if stored, _ := us.ByID(user.ID); !stored.TOTPEnabled {
+		t.Errorf("Expected two-factor authentication to be enabled")
+	}
+	if err := tfs.Setup(user); err != ErrTwoFactorEnabled {
+		t.Errorf("Expected ErrTwoFactorEnabled. Received %v", err)
+	}
+	// the code confirming the secret can't be used to sign in
+	if err := tfs.Verify(user, code); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected the code used to enable to be refused. Received %v", err)
+	}
+
+	if err := tfs.Disable(user, "wrong"); err != ErrPasswordIncorrect {
+		t.Errorf("Expected ErrPasswordIncorrect. Received %v", err)
+	}
+	if err := tfs.Disable(user, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := tfs.RecoveryCodesLeft(user); n != 0 {
+		t.Errorf("Expected the recovery codes to be deleted. Received %d", n)
+	}
+	if err := tfs.Verify(user, codes[0]); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected codes to be refused once disabled. Received %v", err)
+	}
+}
+
+func TestTwoFactorVerify(t *testing.T) {
+	us := testUserService(nil)
+	tfs := testTwoFactorService(us)
+	user, codes := testTwoFactorUser(t, us, tfs)
+
+	code := nextCode(t, user)
+	if err := tfs.Verify(user, code); err != nil {
+		t.Fatalf("Expected the next code to be accepted. Received %v", err)
+	}
+	if err := tfs.Verify(user, code); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected a replayed code to be refused. Received %v", err)
+	}
+
+	// users may type recovery codes without the dash or in capitals
+	for _, code := range []string{codes[0], strings.ToUpper(strings.Replace(codes[1], "-", "", 1))} {
+		if err := tfs.Verify(user, code); err != nil {
+			t.Errorf("%s: expected the recovery code to be accepted. Received %v", code, err)
+		}
+		if err := tfs.Verify(user, code); err != ErrTOTPCodeInvalid {
+			t.Errorf("%s: expected the recovery code to only work once. Received %v", code, err)
+		}
+	}
+	if n, _ := tfs.RecoveryCodesLeft(user); n != recoveryCodeCount-2 {
+		t.Errorf("Expected %d recovery codes left. Received %d", recoveryCodeCount-2, n)
+	}
+	if err := tfs.Verify(user, ""); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected an empty code to be refused. Received %v", err)
+	}
+}
+
+func TestTwoFactorVerifyConcurrent(t *testing.T) {
+	us := testUserService(nil)
+	tfs := testTwoFactorService(us)
+	user, _ := testTwoFactorUser(t, us, tfs)
+
+	// two requests load the user before either verifies the same code
+	first, _ := us.ByID(user.ID)
+	second, _ := us.ByID(user.ID)
+	code := nextCode(t, user)
+	if err := tfs.Verify(first, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfs.Verify(second, code); err != ErrTOTPCodeInvalid {
+		t.Errorf("Expected the code to only be accepted once. Received %v", err)
+	}
+}
+
+func TestTwoFactorChallenge(t *testing.T) {
+	us := testUserService(nil)
+	tfs := testTwoFactorService(us)
+	user := testPasswordUser(t, us, "jon@example.com")
+
+	token, err := tfs.Challenge(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := tfs.ChallengeUser(token)
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("Expected the challenge to be for user %d. Received %v", user.ID, err)
+	}
+
+	expired := fmt.Sprintf("%d.%d", user.ID, time.Now().Add(-time.Second).Unix())
+	parts := strings.SplitN(token, ".", 3)
+	for name, token := range map[string]string{
+		"other user": fmt.Sprintf("%d.%s.%s", user.ID+1, parts[1], parts[2]),
+		"extended":   fmt.Sprintf("%s.%d.%s", parts[0], time.Now().Add(time.Hour).Unix(), parts[2]),
+		"expired":    expired + "." + tfs.sign(expired),
+		"unsigned":   parts[0] + "." + parts[1],
+		"wrong key":  parts[0] + "." + parts[1] + "." + hash.NewHMAC("test-key").Hash(parts[0]+"."+parts[1]),
+	} {
+		if _, err := tfs.ChallengeUser(token); err != ErrTokenInvalid {
+			t.Errorf("%s: expected ErrTokenInvalid. Received %v", name, err)
+		}
+	}
+}
+
+func TestTwoFactorVerifyLockout(t *testing.T) {
+	tests := []struct {
+		name string
+		// between is done after all but one of the failures before the
+		// lockout, locked is whether the last one locks the account
+		between func(t *testing.T, us *userService, tfs *twoFactorService, user *User, codes []string)
+		locked  bool
+	}{
+		{"wrong codes", func(*testing.T, *userService, *twoFactorService, *User, []string) {}, true},
+		{"correct password", func(t *testing.T, us *userService, tfs *twoFactorService, user *User, codes []string) {
+			if _, err := us.Authenticate(user.Email, "secret"); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"recovery code", func(t *testing.T, us *userService, tfs *twoFactorService, user *User, codes []string) {
+			if err := tfs.Verify(user, codes[0]); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		us := testUserService(noWaitBackoff())
+		tfs := testTwoFactorService(us)
+		user, codes := testTwoFactorUser(t, us, tfs)
+
+		for i := 1; i < lockoutThreshold; i++ {
+			if err := tfs.Verify(user, "000000"); err != ErrTOTPCodeInvalid {
+				t.Fatalf("%s: guess %d: expected ErrTOTPCodeInvalid. Received %v", tt.name, i, err)
+			}
+		}
+		tt.between(t, us, tfs, user, codes)
+		err := tfs.Verify(user, "000000")
+		switch {
+		case tt.locked && err != ErrAccountLocked:
+			t.Errorf("%s: expected ErrAccountLocked. Received %v", tt.name, err)
+		case !tt.locked && err != ErrTOTPCodeInvalid:
+			t.Errorf("%s: expected the failures to be forgotten. Received %v", tt.name, err)
+		}
+		if !tt.locked {
+			continue
+		}
+		user, _ = us.ByID(user.ID)
+		if !user.Locked() {
+			t.Errorf("%s: expected the account to be locked", tt.name)
+		}
+		if err := tfs.Verify(user, codes[1]); err != ErrAccountLocked {
+			t.Errorf("%s: expected a locked account to refuse codes. Received %v", tt.name, err)
+		}
+	}
+}
+
+func TestTwoFactorVerifyBackoff(t *testing.T) {
+	us := testUserService(nil)
+	tfs := testTwoFactorService(us)
+	user, codes := testTwoFactorUser(t, us, tfs)
+
+	for i := 1; i <= loginFreeFailures; i++ {
+		if err := tfs.Verify(user, "000000"); err != ErrTOTPCodeInvalid {
+			t.Fatalf("Guess %d: expected ErrTOTPCodeInvalid. Received %v", i, err)
+		}
+	}
+	if err := tfs.Verify(user, "000000"); err != ErrTOTPCodeInvalid {
+		t.Fatalf("Expected the first failure past the free ones to count. Received %v", err)
+	}
+	if err := tfs.Verify(user, codes[0]); err != ErrTooManyAttempts {
+		t.Errorf("Expected to have to wait after %d failures. Received %v", loginFreeFailures+1, err)
+	}
+	if _, err := us.Authenticate(user.Email, "secret"); err != ErrTooManyAttempts {
+		t.Errorf("Expected passwords to wait as well. Received %v", err)
+	}
+}
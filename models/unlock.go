@@ -0,0 +1,93 @@
+package models
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/ratelimit"
+)
+
+const (
+	// unlockDuration is how long a password protected gallery stays unlocked.
+	unlockDuration = time.Hour
+
+	// unlockFreeFailures is the number of wrong passwords a gallery accepts
+	// before each further attempt has to wait, starting at unlockBackoffBase
+	// and doubling up to unlockBackoffMax. Gallery passwords can be short,
+	// so guessing them must be slow.
+	unlockFreeFailures = 5
+	unlockBackoffBase  = time.Second
+	unlockBackoffMax   = time.Minute
+	// unlockFailureWindow is how long wrong passwords are remembered.
+	unlockFailureWindow = time.Hour
+)
+
+// newUnlockBackoff returns the backoff wrong gallery passwords wait for,
+// keyed by gallery ID.
+func newUnlockBackoff(store ratelimit.Store) *ratelimit.Backoff {
+	return ratelimit.NewBackoff(store, "gallery-unlock", unlockFreeFailures,
+		unlockBackoffBase, unlockBackoffMax, unlockFailureWindow)
+}
+
+// Unlock checks password against the gallery's password and returns a
+// token proving the gallery was unlocked. Tokens are of the form
+// "expires.signature" and only cover the gallery they were created for.
+func (gs *galleryService) Unlock(gallery *Gallery, password string) (string, time.Time, error) {
+	if !gallery.HasPassword() {
+		return "", time.Time{}, ErrGalleryLocked
+	}
+	key := strconv.FormatUint(uint64(gallery.ID), 10)
+	wait, err := gs.unlocks.Wait(key)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if wait > 0 {
+		return "", time.Time{}, ErrTooManyAttempts
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password+gs.pepper))
+	if err != nil {
+		switch err {
+		case bcrypt.ErrMismatchedHashAndPassword:
+			if _, err := gs.unlocks.Fail(key); err != nil {
+				return "", time.Time{}, err
+			}
+			return "", time.Time{}, ErrPasswordIncorrect
+		default:
+			return "", time.Time{}, err
+		}
+	}
+	if err := gs.unlocks.Reset(key); err != nil {
+		log.Println(err)
+	}
+	expires := time.Now().Add(unlockDuration)
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + gs.unlockSignature(gallery, exp), expires, nil
+}
+
+func (gs *galleryService) VerifyUnlock(gallery *Gallery, token string) error {
+	parts := strings.SplitN(token, ".", 2)
+	if !gallery.HasPassword() || len(parts) != 2 {
+		return ErrGalleryLocked
+	}
+	expected := gs.unlockSignature(gallery, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return ErrGalleryLocked
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().After(time.Unix(exp, 0)) {
+		return ErrGalleryLocked
+	}
+	return nil
+}
+
+// unlockSignature signs the gallery and expiry of an unlock token. The
+// password hash is included so that changing the password locks the
+// gallery again for everyone.
+func (gs *galleryService) unlockSignature(gallery *Gallery, exp string) string {
+	return gs.hmac.Hash(fmt.Sprintf("unlock\n%v\n%s\n%s", gallery.ID, exp, gallery.PasswordHash))
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"lenslocked.com/hash"
+	"lenslocked.com/ratelimit"
+)
+
+func testGalleryService(store ratelimit.Store) *galleryService {
+	return &galleryService{
+		hmac:    hash.NewHMAC("test-key"),
+		pepper:  "pepper",
+		unlocks: newUnlockBackoff(store),
+	}
+}
+
+func testLockedGallery(t *testing.T, id uint, password string) *Gallery {
+	b, err := bcrypt.GenerateFromPassword([]byte(password+"pepper"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gallery{PasswordHash: string(b)}
+	g.ID = id
+	return g
+}
+
+func TestGalleryUnlock(t *testing.T) {
+	gs := testGalleryService(ratelimit.NewMemory())
+	gallery := testLockedGallery(t, 1, "secret")
+
+	if _, _, err := gs.Unlock(gallery, "guess"); err != ErrPasswordIncorrect {
+		t.Errorf("Expected ErrPasswordIncorrect. Received %v", err)
+	}
+	if _, _, err := gs.Unlock(&Gallery{}, "secret"); err != ErrGalleryLocked {
+		t.Errorf("Expected galleries without a password not to be unlocked. Received %v", err)
+	}
+	token, _, err := gs.Unlock(gallery, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.VerifyUnlock(gallery, token); err != nil {
+		t.Errorf("Expected the token to unlock the gallery. Received %v", err)
+	}
+	other := testLockedGallery(t, 2, "secret")
+	if err := gs.VerifyUnlock(other, token); err != ErrGalleryLocked {
+		t.Errorf("Expected the token not to unlock other galleries. Received %v", err)
+	}
+	if err := gs.VerifyUnlock(gallery, token+"x"); err != ErrGalleryLocked {
+		t.Errorf("Expected tampered tokens to be refused. Received %v", err)
+	}
+	past := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	if err := gs.VerifyUnlock(gallery, past+"."+gs.unlockSignature(gallery, past)); err != ErrGalleryLocked {
+		t.Errorf("Expected expired tokens to be refused. Received %v", err)
+	}
+	changed := testLockedGallery(t, 1, "secret2")
+	if err := gs.VerifyUnlock(changed, token); err != ErrGalleryLocked {
+		t.Errorf("Expected changing the password to lock the gallery again. Received %v", err)
+	}
+}
+
+func TestGalleryUnlockBackoff(t *testing.T) {
+	gs := testGalleryService(ratelimit.NewMemory())
+	gallery := testLockedGallery(t, 1, "secret")
+
+	for i := 1; i <= unlockFreeFailures+1; i++ {
+		if _, _, err := gs.Unlock(gallery, "guess"); err != ErrPasswordIncorrect {
+			t.Fatalf("Guess %d: expected ErrPasswordIncorrect. Received %v", i, err)
+		}
+	}
+	if _, _, err := gs.Unlock(gallery, "secret"); err != ErrTooManyAttempts {
+		t.Errorf("Expected guesses to have to wait. Received %v", err)
+	}
+	other := testLockedGallery(t, 2, "secret")
+	if _, _, err := gs.Unlock(other, "secret"); err != nil {
+		t.Errorf("Expected other galleries not to wait. Received %v", err)
+	}
+}
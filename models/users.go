@@ -10,7 +10,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"lenslocked.com/hash"
-	"lenslocked.com/rand"
+	"lenslocked.com/ratelimit"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -18,6 +18,10 @@ import (
 const (
 	minPasswordLength = 6
 	maxPasswordLength = 13
+
+	// emailVerificationDuration is how long the links we send to verify
+	// email addresses are valid for.
+	emailVerificationDuration = 48 * time.Hour
 )
 
 // User represents the use model in our DB.
@@ -29,8 +33,28 @@ type User struct {
 	Email        string `gorm:"not null;unique_index"`
 	Password     string `gorm:"-"` // do not store in the DB
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+	// ShowLocation controls whether the location photos were taken
+	// at is shown to visitors of the user's galleries.
+	ShowLocation bool `gorm:"not null;default:false"`
+	// TOTPSecret is the secret of the user's authenticator app. It is set
+	// while they set up two-factor authentication, which is only required
+	// once TOTPEnabled is set.
+	TOTPSecret  string `gorm:"not null;default:''"`
+	TOTPEnabled bool   `gorm:"not null;default:false"`
+	// TOTPLastStep is the time step of the last TOTP code the user signed
+	// in with, older codes are refused so they can't be replayed.
+	TOTPLastStep int64 `gorm:"not null;default:0"`
+	// VerifiedAt is when the user proved they own their email address, it
+	// is nil until they do.
+	VerifiedAt *time.Time
+	// LockedUntil is set when the account is locked after too many failed
+	// logins, no one can sign in with its password until then.
+	LockedUntil *time.Time
+}
+
+// Verified reports whether the user has verified their email address.
+func (u *User) Verified() bool {
+	return u.VerifiedAt != nil
 }
 
 // UserDB is used to interact with the users model.
@@ -46,12 +70,10 @@ type UserDB interface {
 	// Methods for querying for single users
 	ByID(id uint) (*User, error)
 	ByEmail(email string) (*User, error)
-	ByRemember(token string) (*User, error)
 
 	// Methods for altering users
 	Create(user *User) error
 	Update(user *User) error
-	UpdateRememberHash(user *User) error
 	Delete(id uint) error
 }
 
@@ -59,28 +81,64 @@ type UserDB interface {
 type UserService interface {
 	// Authenticate will verify the provided email and password. If correct, the matching
 	// user will be returned. Otherwise an error will be returned: ErrNotFound, ErrPasswordIncorrect,
-	// or another if something goes wrong.
+	// ErrTooManyAttempts while the user has to wait after failed attempts, ErrAccountLocked once
+	// there were too many, or another if something goes wrong.
 	Authenticate(email, password string) (*User, error)
 	// InitiateReset wwill start the reset password process, returning a reset token
-	// assigned to the user with the provided email address.
+	// assigned to the user with the provided email address. ErrTooManyResets is returned
+	// when too many were sent to the address recently.
 	InitiateReset(email string) (string, error)
 	// CompleteReset ends the reset password process, setting password to be newPw for
 	// the user with the provided token.
 	CompleteReset(token, newPw string) (*User, error)
+	// InitiateVerification starts verifying the user's email address,
+	// returning the token to email them.
+	InitiateVerification(user *User) (string, error)
+	// InitiateEmailChange starts changing the user's email address to
+	// email once they confirmed their password. Their address only changes
+	// once the returned token, which must be sent to the new address, is
+	// passed to CompleteVerification.
+	InitiateEmailChange(user *User, email, password string) (string, error)
+	// CompleteVerification marks the address the token was sent to as
+	// verified, making it the user's email address if they were changing
+	// it. ErrTokenInvalid is returned for unknown or expired tokens.
+	CompleteVerification(token string) (*User, error)
+	// UnlockAccount unlocks the account of the user the token was emailed
+	// to when it was locked. ErrTokenInvalid is returned for unknown tokens
+	// and once the account was unlocked.
+	UnlockAccount(token string) (*User, error)
+	// CheckLogin returns ErrAccountLocked or ErrTooManyAttempts if the
+	// user can't try to sign in right now, with their password or their
+	// second factor.
+	CheckLogin(user *User) error
+	// LoginFailed counts a wrong password or second factor towards
+	// locking the user's account. failure is returned, or ErrAccountLocked
+	// once there were too many.
+	LoginFailed(user *User, failure error) error
+	// LoginSucceeded forgets the user's failed logins.
+	LoginSucceeded(user *User)
 	UserDB
 }
 
 // NewUserService takes a connection string for the DB and returns a *UserService.
 // If the returned error is not nil, there was a problem opening the database.
-func NewUserService(db *gorm.DB, hmacKey, pepper string) UserService {
+// Failed logins and reset emails are counted in store, users are told
+// their account was locked through mailer.
+func NewUserService(db *gorm.DB, hmacKey, pepper string, store ratelimit.Store, mailer LockoutMailer) UserService {
 	ug := &userGorm{db}
 	hmac := hash.NewHMAC(hmacKey)
-	uv := newUserValidator(ug, hmac, pepper)
+	uv := newUserValidator(ug, pepper)
 
 	return &userService{
 		UserDB:    uv,
+		emailDB:   uv,
 		pepper:    pepper,
+		hmac:      hmac,
+		logins:    newLoginBackoff(store),
+		resets:    ratelimit.NewLimiter(store, "reset", resetLimit, resetWindow),
+		mailer:    mailer,
 		pwResetDB: newPwResetValidator(&pwResetGorm{db}, hmac),
+		verifyDB:  newEmailVerificationValidator(&emailVerificationGorm{db}, hmac),
 	}
 }
 
@@ -88,8 +146,14 @@ var _ UserService = &userService{}
 
 type userService struct {
 	UserDB
+	emailDB   userEmailDB
 	pepper    string
+	hmac      hash.HMAC
+	logins    *ratelimit.Backoff
+	resets    *ratelimit.Limiter
+	mailer    LockoutMailer
 	pwResetDB pwResetDB
+	verifyDB  emailVerificationDB
 }
 
 // Authenticate checks for a user with mathcing email and password.
@@ -98,15 +162,24 @@ func (us *userService) Authenticate(email, password string) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := us.CheckLogin(user); err != nil {
+		return nil, err
+	}
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper))
 	if err != nil {
 		switch err {
 		case bcrypt.ErrMismatchedHashAndPassword:
-			return nil, ErrPasswordIncorrect
+			return nil, us.LoginFailed(user, ErrPasswordIncorrect)
 		default:
 			return nil, err
 		}
 	}
+	// failed logins of users with a second factor are only forgotten
+	// once they entered it, otherwise knowing the password would be
+	// enough to keep guessing codes
+	if !user.TOTPEnabled {
+		us.LoginSucceeded(user)
+	}
 	return user, nil
 }
 
@@ -115,6 +188,9 @@ func (us *userService) InitiateReset(email string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := us.allowReset(user); err != nil {
+		return "", err
+	}
 	pwr := pwReset{UserID: user.ID}
 	if err := us.pwResetDB.Create(&pwr); err != nil {
 		return "", err
@@ -139,9 +215,17 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 		return nil, err
 	}
 	user.Password = newPw
+	// the reset link was sent to their email address, so they own it
+	if user.VerifiedAt == nil {
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+	// and setting a new password unlocks it
+	user.LockedUntil = nil
 	if err = us.Update(user); err != nil {
 		return nil, err
 	}
+	us.LoginSucceeded(user)
 	err = us.pwResetDB.Delete(pwr.ID)
 	if err != nil {
 		log.Println(err)
@@ -149,6 +233,60 @@ func (us *userService) CompleteReset(token, newPw string) (*User, error) {
 	return user, nil
 }
 
+func (us *userService) InitiateVerification(user *User) (string, error) {
+	ev := emailVerification{UserID: user.ID, Email: user.Email}
+	if err := us.verifyDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) InitiateEmailChange(user *User, email, password string) (string, error) {
+	if _, err := us.Authenticate(user.Email, password); err != nil {
+		return "", err
+	}
+	email, err := us.emailDB.checkEmail(user, email)
+	if err != nil {
+		return "", err
+	}
+	ev := emailVerification{UserID: user.ID, Email: email}
+	if err := us.verifyDB.Create(&ev); err != nil {
+		return "", err
+	}
+	return ev.Token, nil
+}
+
+func (us *userService) CompleteVerification(token string) (*User, error) {
+	ev, err := us.verifyDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+	if time.Since(ev.CreatedAt) > emailVerificationDuration {
+		return nil, ErrTokenInvalid
+	}
+	user, err := us.ByID(ev.UserID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user.VerifiedAt = &now
+	if ev.Email != user.Email {
+		err = us.emailDB.updateEmail(user, ev.Email)
+	} else {
+		err = us.Update(user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := us.verifyDB.DeleteByUserID(user.ID); err != nil {
+		log.Println(err)
+	}
+	return user, nil
+}
+
 type userValFunc func(*User) error
 
 func runUserValFuncs(user *User, fns ...userValFunc) error {
@@ -162,10 +300,20 @@ func runUserValFuncs(user *User, fns ...userValFunc) error {
 
 var _ UserDB = &userValidator{}
 
-func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator {
+// userEmailDB is used to change users' email addresses, which Update
+// refuses to do as new addresses must be verified first.
+type userEmailDB interface {
+	// checkEmail normalises email and checks it can become the user's new
+	// address.
+	checkEmail(user *User, email string) (string, error)
+	// updateEmail changes the user's email address to email, along with
+	// any other changes made to user.
+	updateEmail(user *User, email string) error
+}
+
+func newUserValidator(udb UserDB, pepper string) *userValidator {
 	return &userValidator{
 		UserDB:     udb,
-		hmac:       hmac,
 		emailRegex: regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,16}$`),
 		pepper:     pepper,
 	}
@@ -173,7 +321,6 @@ func newUserValidator(udb UserDB, hmac hash.HMAC, pepper string) *userValidator
 
 type userValidator struct {
 	UserDB
-	hmac       hash.HMAC
 	emailRegex *regexp.Regexp
 	pepper     string
 }
@@ -198,19 +345,6 @@ func (uv *userValidator) ByID(id uint) (*User, error) {
 	return uv.UserDB.ByID(id)
 }
 
-// ByRemember will hash the remember token and then calls
-// ByRemember on the gorm DB layer.
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{
-		Remember: token,
-	}
-	err := runUserValFuncs(&user, uv.hmacRemember)
-	if err != nil {
-		return nil, err
-	}
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user,
 		uv.requireName,
@@ -222,10 +356,6 @@ func (uv *userValidator) Create(user *User) error {
 		uv.passwordIsComplex(minPasswordLength, maxPasswordLength),
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.setDefaultRemember,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 	)
 	if err != nil {
 		return err
@@ -251,11 +381,9 @@ func (uv *userValidator) Update(user *User) error {
 		uv.passwordIsComplex(minPasswordLength, maxPasswordLength),
 		uv.bcryptPassword,
 		uv.passwordHashRequired,
-		uv.rememberMinBytes,
-		uv.hmacRemember,
-		uv.rememberHashRequired,
 		uv.emailFormat,
 		uv.normaliseEmail,
+		uv.emailUnchanged,
 		uv.emailIsAvail)
 	if err != nil {
 		return err
@@ -263,13 +391,37 @@ func (uv *userValidator) Update(user *User) error {
 	return uv.UserDB.Update(user)
 }
 
-// UpdateRememberHash takes a user and persists the hashed remember token if a remember token is set.
-func (uv *userValidator) UpdateRememberHash(user *User) error {
-	err := runUserValFuncs(user, uv.hmacRemember)
+func (uv *userValidator) checkEmail(user *User, email string) (string, error) {
+	candidate := User{Model: gorm.Model{ID: user.ID}, Email: email}
+	err := runUserValFuncs(&candidate,
+		uv.normaliseEmail,
+		uv.requireEmail,
+		uv.emailFormat,
+		uv.emailIsAvail)
+	if err != nil {
+		return "", err
+	}
+	if candidate.Email == user.Email {
+		return "", ErrEmailUnchanged
+	}
+	return candidate.Email, nil
+}
+
+func (uv *userValidator) updateEmail(user *User, email string) error {
+	email, err := uv.checkEmail(user, email)
+	if err != nil {
+		return err
+	}
+	user.Email = email
+	err = runUserValFuncs(user,
+		uv.requireName,
+		uv.passwordIsComplex(minPasswordLength, maxPasswordLength),
+		uv.bcryptPassword,
+		uv.passwordHashRequired)
 	if err != nil {
 		return err
 	}
-	return uv.UserDB.UpdateRememberHash(user)
+	return uv.UserDB.Update(user)
 }
 
 // bcryptPassword is a helper function to return a hash of the user's password.
@@ -288,47 +440,6 @@ func (uv *userValidator) bcryptPassword(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) setDefaultRemember(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-	rememberToken, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = rememberToken
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-	if n < rand.RememberTokenBytes {
-		return ErrRememberTooShort
-	}
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return ErrRememberHashRequired
-	}
-	return nil
-}
-
 func (uv *userValidator) idGreaterThan(n uint) userValFunc {
 	return userValFunc(func(user *User) error {
 		if user.ID <= n {
@@ -343,6 +454,19 @@ func (uv *userValidator) normaliseEmail(user *User) error {
 	return nil
 }
 
+// emailUnchanged keeps Update from changing the user's email address
+// without proof they own the new one, see InitiateEmailChange.
+func (uv *userValidator) emailUnchanged(user *User) error {
+	existing, err := uv.UserDB.ByID(user.ID)
+	if err != nil {
+		return err
+	}
+	if existing.Email != user.Email {
+		return ErrEmailChangeUnverified
+	}
+	return nil
+}
+
 func (uv *userValidator) requireEmail(user *User) error {
 	if user.Email == "" {
 		return ErrEmailRequired
@@ -466,17 +590,6 @@ func (ug *userGorm) ByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember looks up the user with the given remember token.
-// This method expects the rememberToken to be hashed for comparison with stored hashed token.
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	err := first(ug.db.Where("remember_hash = ?", rememberHash), &user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, err
-}
-
 // Create will create the provided user and backfill data
 // like the ID, CreatedAt and UpdatedAt fields.
 func (ug *userGorm) Create(user *User) error {
@@ -488,11 +601,6 @@ func (ug *userGorm) Update(user *User) error {
 	return ug.db.Save(user).Error
 }
 
-// UpdateRememberHash will update the remember hash stored on the user.
-func (ug *userGorm) UpdateRememberHash(user *User) error {
-	return ug.db.Model(user).Update("remember_hash", user.RememberHash).Error
-}
-
 // Delete will delete the given user from the db.
 func (ug *userGorm) Delete(id uint) error {
 	user := User{Model: gorm.Model{ID: id}}
@@ -16,7 +16,12 @@ func testingUserService() (*Services, error) {
 	)
 
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
-	services, err := NewServices(psqlInfo, true)
+	services, err := NewServices(
+		WithGorm("postgres", psqlInfo),
+		WithLogMode(true),
+		WithRateLimits("memory"),
+		WithUser("test-hmac-key", "test-pepper", nil),
+	)
 	if err != nil {
 		return nil, err
 	}
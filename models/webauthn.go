@@ -0,0 +1,431 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/webauthn"
+)
+
+const (
+	maxPasskeyNameLength = 100
+	defaultPasskeyName   = "Passkey"
+
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+// WebAuthnCredential is a passkey or security key a user can sign in with
+// in place of their password.
+type WebAuthnCredential struct {
+	ID     uint   `gorm:"primary_key"`
+	UserID uint   `gorm:"not null;index"`
+	Name   string `gorm:"not null"`
+	// CredentialID is the base64url encoded ID the authenticator knows
+	// the credential by.
+	CredentialID string `gorm:"not null;unique_index"`
+	// PublicKey is the COSE_Key encoding of the credential's public key.
+	PublicKey []byte `gorm:"not null"`
+	SignCount uint32 `gorm:"not null;default:0"`
+	// Format is the attestation format the credential was registered
+	// with.
+	Format     string `gorm:"not null;default:''"`
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// TableName keeps gorm from naming the table web_authn_credentials.
+func (c *WebAuthnCredential) TableName() string {
+	return "webauthn_credentials"
+}
+
+// webauthnChallenge is issued when a registration or sign in starts and
+// used up when it finishes, so responses can't be replayed.
+type webauthnChallenge struct {
+	ID        uint   `gorm:"primary_key"`
+	Challenge string `gorm:"not null;unique_index"`
+	// UserID is the user registering a credential, it is 0 for sign ins.
+	UserID    uint   `gorm:"not null;default:0"`
+	Ceremony  string `gorm:"not null"`
+	ExpiresAt time.Time
+}
+
+func (c *webauthnChallenge) TableName() string {
+	return "webauthn_challenges"
+}
+
+// WebAuthnCredentialDB is used to interact with the webauthn_credentials
+// table.
+type WebAuthnCredentialDB interface {
+	// ByCredentialID looks up a credential by its base64url encoded ID.
+	ByCredentialID(credentialID string) (*WebAuthnCredential, error)
+	// CredentialsByUserID returns the user's credentials, most recently
+	// registered first.
+	CredentialsByUserID(userID uint) ([]WebAuthnCredential, error)
+	CreateCredential(cred *WebAuthnCredential) error
+	// TouchCredential records that the credential was just used, and the
+	// signature counter it reported.
+	TouchCredential(cred *WebAuthnCredential, signCount uint32) error
+	// DeleteCredential deletes the user's credential with id.
+	DeleteCredential(userID, id uint) error
+}
+
+// WebAuthnService lets users register passkeys and sign in with them. It
+// works alongside passwords: users still have theirs and can sign in with
+// either.
+type WebAuthnService interface {
+	// BeginRegistration returns the options the user's browser creates a
+	// new credential with.
+	BeginRegistration(user *User) (*webauthn.CreationOptions, error)
+	// FinishRegistration verifies the browser's response to the options
+	// returned by BeginRegistration and stores the new credential as
+	// name. ErrPasskeyInvalid is returned if it can't be verified.
+	FinishRegistration(user *User, name string, resp *webauthn.AttestationResponse) (*WebAuthnCredential, error)
+	// BeginLogin returns the options the browser signs in with. Users pick
+	// one of their passkeys, so they don't enter their email address.
+	BeginLogin() (*webauthn.RequestOptions, error)
+	// FinishLogin verifies the browser's response to the options returned
+	// by BeginLogin and returns the user whose passkey signed it.
+	// ErrPasskeyInvalid is returned if it can't be verified, and
+	// ErrAccountLocked if the user's account is locked like it is for
+	// passwords.
+	FinishLogin(resp *webauthn.AssertionResponse) (*User, error)
+	WebAuthnCredentialDB
+}
+
+// NewWebAuthnService returns a WebAuthnService storing credentials and
+// challenges in db, for credentials registered with rp.
+func NewWebAuthnService(db *gorm.DB, rp webauthn.RelyingParty) WebAuthnService {
+	return &webauthnService{
+		WebAuthnCredentialDB: &webauthnCredentialValidator{
+			WebAuthnCredentialDB: &webauthnGorm{db},
+		},
+		challenges: &webauthnChallengeValidator{
+			webauthnChallengeDB: &webauthnGorm{db},
+		},
+		userDB: &userGorm{db},
+		rp:     rp,
+	}
+}
+
+type webauthnService struct {
+	WebAuthnCredentialDB
+	challenges webauthnChallengeDB
+	userDB     UserDB
+	rp         webauthn.RelyingParty
+}
+
+func (was *webauthnService) BeginRegistration(user *User) (*webauthn.CreationOptions, error) {
+	challenge := webauthnChallenge{UserID: user.ID, Ceremony: ceremonyRegister}
+	if err := was.challenges.CreateChallenge(&challenge); err != nil {
+		return nil, err
+	}
+	creds, err := was.CredentialsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make([][]byte, 0, len(creds))
+	for _, cred := range creds {
+		if id, err := webauthn.DecodeID(cred.CredentialID); err == nil {
+			exclude = append(exclude, id)
+		}
+	}
+	return was.rp.CreationOptions(webauthn.User{
+		ID:          userHandle(user.ID),
+		Name:        user.Email,
+		DisplayName: user.Name,
+	}, challenge.Challenge, exclude), nil
+}
+
+func (was *webauthnService) FinishRegistration(user *User, name string, resp *webauthn.AttestationResponse) (*WebAuthnCredential, error) {
+	challenge, err := was.useChallenge(resp.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.Ceremony != ceremonyRegister || challenge.UserID != user.ID {
+		return nil, ErrPasskeyInvalid
+	}
+	verified, err := was.rp.VerifyRegistration(challenge.Challenge, resp)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	cred := WebAuthnCredential{
+		UserID:       user.ID,
+		Name:         name,
+		CredentialID: webauthn.EncodeID(verified.ID),
+		PublicKey:    verified.PublicKey,
+		SignCount:    verified.SignCount,
+		Format:       verified.Format,
+	}
+	if err := was.CreateCredential(&cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+func (was *webauthnService) BeginLogin() (*webauthn.RequestOptions, error) {
+	challenge := webauthnChallenge{Ceremony: ceremonyLogin}
+	if err := was.challenges.CreateChallenge(&challenge); err != nil {
+		return nil, err
+	}
+	return was.rp.RequestOptions(challenge.Challenge, nil), nil
+}
+
+func (was *webauthnService) FinishLogin(resp *webauthn.AssertionResponse) (*User, error) {
+	challenge, err := was.useChallenge(resp.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.Ceremony != ceremonyLogin {
+		return nil, ErrPasskeyInvalid
+	}
+	cred, err := was.ByCredentialID(resp.ID)
+	if err == ErrNotFound {
+		return nil, ErrPasskeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the user handle is optional, but must be the credential's owner
+	// when it is provided
+	if resp.UserHandle != "" {
+		handle, err := webauthn.DecodeID(resp.UserHandle)
+		if err != nil || !bytes.Equal(handle, userHandle(cred.UserID)) {
+			return nil, ErrPasskeyInvalid
+		}
+	}
+	id, err := webauthn.DecodeID(cred.CredentialID)
+	if err != nil {
+		return nil, err
+	}
+	signCount, err := was.rp.VerifyAssertion(challenge.Challenge, &webauthn.Credential{
+		ID:        id,
+		PublicKey: cred.PublicKey,
+		SignCount: cred.SignCount,
+	}, resp)
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	if err := was.TouchCredential(cred, signCount); err != nil {
+		return nil, err
+	}
+	user, err := was.userDB.ByID(cred.UserID)
+	if err == ErrNotFound {
+		return nil, ErrPasskeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Locked() {
+		return nil, ErrAccountLocked
+	}
+	return user, nil
+}
+
+// useChallenge uses up the challenge a response claims to answer. It is
+// still up to the caller to verify the response answers it.
+func (was *webauthnService) useChallenge(claimed func() (string, error)) (*webauthnChallenge, error) {
+	value, err := claimed()
+	if err != nil {
+		return nil, ErrPasskeyInvalid
+	}
+	return was.challenges.UseChallenge(value)
+}
+
+// userHandle is the WebAuthn user handle of the user with id. It must not
+// contain personal information, so their ID is used.
+func userHandle(id uint) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// webauthnChallengeDB is used to interact with the webauthn_challenges
+// table.
+type webauthnChallengeDB interface {
+	// CreateChallenge generates the challenge, which expires with the
+	// browser's timeout.
+	CreateChallenge(challenge *webauthnChallenge) error
+	// UseChallenge looks up a challenge and deletes it so it can't be used
+	// again. ErrPasskeyInvalid is returned if it doesn't exist or has
+	// expired.
+	UseChallenge(challenge string) (*webauthnChallenge, error)
+}
+
+type webauthnChallengeValidator struct {
+	webauthnChallengeDB
+}
+
+func (wcv *webauthnChallengeValidator) CreateChallenge(challenge *webauthnChallenge) error {
+	value, err := webauthn.NewChallenge()
+	if err != nil {
+		return err
+	}
+	challenge.Challenge = value
+	challenge.ExpiresAt = time.Now().Add(webauthn.Timeout)
+	return wcv.webauthnChallengeDB.CreateChallenge(challenge)
+}
+
+func (wcv *webauthnChallengeValidator) UseChallenge(value string) (*webauthnChallenge, error) {
+	if value == "" {
+		return nil, ErrPasskeyInvalid
+	}
+	challenge, err := wcv.webauthnChallengeDB.UseChallenge(value)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(challenge.ExpiresAt) {
+		return nil, ErrPasskeyInvalid
+	}
+	return challenge, nil
+}
+
+type webauthnCredentialValFunc func(*WebAuthnCredential) error
+
+func runWebAuthnCredentialValFuncs(cred *WebAuthnCredential, fns ...webauthnCredentialValFunc) error {
+	for _, fn := range fns {
+		if err := fn(cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type webauthnCredentialValidator struct {
+	WebAuthnCredentialDB
+}
+
+// ByCredentialID accepts IDs with or without padding, they are stored
+// without.
+func (wcv *webauthnCredentialValidator) ByCredentialID(credentialID string) (*WebAuthnCredential, error) {
+	id, err := webauthn.DecodeID(credentialID)
+	if err != nil || len(id) == 0 {
+		return nil, ErrNotFound
+	}
+	return wcv.WebAuthnCredentialDB.ByCredentialID(webauthn.EncodeID(id))
+}
+
+func (wcv *webauthnCredentialValidator) CreateCredential(cred *WebAuthnCredential) error {
+	err := runWebAuthnCredentialValFuncs(cred,
+		wcv.requireUserID,
+		wcv.normalizeName,
+		wcv.credentialIDAvailable)
+	if err != nil {
+		return err
+	}
+	return wcv.WebAuthnCredentialDB.CreateCredential(cred)
+}
+
+func (wcv *webauthnCredentialValidator) DeleteCredential(userID, id uint) error {
+	if userID <= 0 || id <= 0 {
+		return ErrIDInvalid
+	}
+	return wcv.WebAuthnCredentialDB.DeleteCredential(userID, id)
+}
+
+func (wcv *webauthnCredentialValidator) requireUserID(cred *WebAuthnCredential) error {
+	if cred.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+	return nil
+}
+
+func (wcv *webauthnCredentialValidator) normalizeName(cred *WebAuthnCredential) error {
+	cred.Name = strings.TrimSpace(cred.Name)
+	switch {
+	case cred.Name == "":
+		cred.Name = defaultPasskeyName
+	case utf8.RuneCountInString(cred.Name) > maxPasskeyNameLength:
+		return ErrPasskeyNameTooLong
+	}
+	return nil
+}
+
+func (wcv *webauthnCredentialValidator) credentialIDAvailable(cred *WebAuthnCredential) error {
+	_, err := wcv.WebAuthnCredentialDB.ByCredentialID(cred.CredentialID)
+	switch err {
+	case ErrNotFound:
+		return nil
+	case nil:
+		return ErrPasskeyRegistered
+	default:
+		return err
+	}
+}
+
+// webauthnGorm implements both WebAuthnCredentialDB and
+// webauthnChallengeDB.
+type webauthnGorm struct {
+	db *gorm.DB
+}
+
+func (wg *webauthnGorm) ByCredentialID(credentialID string) (*WebAuthnCredential, error) {
+	var cred WebAuthnCredential
+	err := first(wg.db.Where("credential_id = ?", credentialID), &cred)
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+func (wg *webauthnGorm) CredentialsByUserID(userID uint) ([]WebAuthnCredential, error) {
+	var creds []WebAuthnCredential
+	err := wg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&creds).Error
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (wg *webauthnGorm) CreateCredential(cred *WebAuthnCredential) error {
+	return wg.db.Create(cred).Error
+}
+
+func (wg *webauthnGorm) TouchCredential(cred *WebAuthnCredential, signCount uint32) error {
+	now := time.Now()
+	cred.LastUsedAt = &now
+	cred.SignCount = signCount
+	return wg.db.Model(cred).UpdateColumns(map[string]interface{}{
+		"last_used_at": now,
+		"sign_count":   signCount,
+	}).Error
+}
+
+func (wg *webauthnGorm) DeleteCredential(userID, id uint) error {
+	return wg.db.Where("user_id = ? AND id = ?", userID, id).Delete(&WebAuthnCredential{}).Error
+}
+
+// CreateChallenge also deletes expired challenges, which are left behind
+// by ceremonies that were never finished.
+func (wg *webauthnGorm) CreateChallenge(challenge *webauthnChallenge) error {
+	err := wg.db.Where("expires_at < ?", time.Now()).Delete(&webauthnChallenge{}).Error
+	if err != nil {
+		return err
+	}
+	return wg.db.Create(challenge).Error
+}
+
+// UseChallenge deletes the challenge once it is found, only one of several
+// concurrent requests using it succeeds.
+func (wg *webauthnGorm) UseChallenge(value string) (*webauthnChallenge, error) {
+	var challenge webauthnChallenge
+	err := first(wg.db.Where("challenge = ?", value), &challenge)
+	if err == ErrNotFound {
+		return nil, ErrPasskeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := wg.db.Where("challenge = ?", value).Delete(&webauthnChallenge{})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrPasskeyInvalid
+	}
+	return &challenge, nil
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"lenslocked.com/webauthn"
+)
+
+var testRelyingParty = webauthn.RelyingParty{
+	ID:     "lenslocked.com",
+	Name:   "LensLocked",
+	Origin: "https://lenslocked.com",
+}
+
+// memWebAuthn is an in-memory WebAuthnCredentialDB and
+// webauthnChallengeDB.
+type memWebAuthn struct {
+	WebAuthnCredentialDB
+	credentials map[string]*WebAuthnCredential
+	challenges  map[string]*webauthnChallenge
+}
+
+func (m *memWebAuthn) ByCredentialID(credentialID string) (*WebAuthnCredential, error) {
+	cred, ok := m.credentials[credentialID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *cred
+	return &c, nil
+}
+
+func (m *memWebAuthn) TouchCredential(cred *WebAuthnCredential, signCount uint32) error {
+	m.credentials[cred.CredentialID].SignCount = signCount
+	return nil
+}
+
+func (m *memWebAuthn) CreateChallenge(challenge *webauthnChallenge) error {
+	c := *challenge
+	m.challenges[challenge.Challenge] = &c
+	return nil
+}
+
+func (m *memWebAuthn) UseChallenge(value string) (*webauthnChallenge, error) {
+	challenge, ok := m.challenges[value]
+	if !ok {
+		return nil, ErrPasskeyInvalid
+	}
+	delete(m.challenges, value)
+	return challenge, nil
+}
+
+// testPasskey is a software passkey with an Ed25519 key.
+type testPasskey struct {
+	id  []byte
+	key ed25519.PrivateKey
+}
+
+func newTestPasskey(t *testing.T) *testPasskey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := testPasskey{id: make([]byte, 16), key: key}
+	rand.Read(p.id)
+	return &p
+}
+
+// credential returns the passkey as it is stored once registered to
+// userID.
+func (p *testPasskey) credential(userID uint) *WebAuthnCredential {
+	// the COSE_Key map {kty: OKP, alg: EdDSA, crv: Ed25519, x: key}
+	coseKey := []byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21, 0x58, 0x20}
+	coseKey = append(coseKey, p.key.Public().(ed25519.PublicKey)...)
+	return &WebAuthnCredential{
+		UserID:       userID,
+		CredentialID: webauthn.EncodeID(p.id),
+		PublicKey:    coseKey,
+	}
+}
+
+// get signs challenge the way a browser does when signing in.
+func (p *testPasskey) get(challenge string) *webauthn.AssertionResponse {
+	cd, _ := json.Marshal(map[string]interface{}{
+		"type":      "webauthn.get",
+		"challenge": challenge,
+		"origin":    testRelyingParty.Origin,
+	})
+	rpIDHash := sha256.Sum256([]byte(testRelyingParty.ID))
+	// user present and verified, the signature counter is always 0
+	authData := append(rpIDHash[:], 0x05, 0, 0, 0, 0)
+	cdHash := sha256.Sum256(cd)
+	sig := ed25519.Sign(p.key, append(append([]byte(nil), authData...), cdHash[:]...))
+	return &webauthn.AssertionResponse{
+		ID:                webauthn.EncodeID(p.id),
+		ClientDataJSON:    webauthn.EncodeID(cd),
+		AuthenticatorData: webauthn.EncodeID(authData),
+		Signature:         webauthn.EncodeID(sig),
+	}
+}
+
+func TestWebAuthnFinishLogin(t *testing.T) {
+	db := &memWebAuthn{
+		credentials: map[string]*WebAuthnCredential{},
+		challenges:  map[string]*webauthnChallenge{},
+	}
+	users := memUsers{}
+	was := &webauthnService{
+		WebAuthnCredentialDB: &webauthnCredentialValidator{WebAuthnCredentialDB: db},
+		challenges:           &webauthnChallengeValidator{webauthnChallengeDB: db},
+		userDB:               users,
+		rp:                   testRelyingParty,
+	}
+	login := func(p *testPasskey) (*User, error) {
+		opts, err := was.BeginLogin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return was.FinishLogin(p.get(opts.Challenge))
+	}
+
+	until := time.Now().Add(time.Hour)
+	users[1] = &User{Model: gorm.Model{ID: 1}}
+	users[2] = &User{Model: gorm.Model{ID: 2}, LockedUntil: &until}
+	passkey, locked, unknown := newTestPasskey(t), newTestPasskey(t), newTestPasskey(t)
+	for userID, p := range map[uint]*testPasskey{1: passkey, 2: locked} {
+		cred := p.credential(userID)
+		db.credentials[cred.CredentialID] = cred
+	}
+
+	if user, err := login(passkey); err != nil || user.ID != 1 {
+		t.Fatalf("Expected the passkey to sign in user 1. Received %v", err)
+	}
+	if _, err := login(locked); err != ErrAccountLocked {
+		t.Errorf("Expected a locked account to be refused. Received %v", err)
+	}
+	if _, err := login(unknown); err != ErrPasskeyInvalid {
+		t.Errorf("Expected an unknown passkey to be refused. Received %v", err)
+	}
+
+	// the challenge is used up by the first response
+	opts, err := was.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := passkey.get(opts.Challenge)
+	if _, err := was.FinishLogin(resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := was.FinishLogin(resp); err != ErrPasskeyInvalid {
+		t.Errorf("Expected a replayed response to be refused. Received %v", err)
+	}
+}
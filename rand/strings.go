@@ -5,8 +5,19 @@ import (
 	"encoding/base64"
 )
 
-// RememberTokenBytes is the length of the byte slice used for generating the remember token.
-const RememberTokenBytes = 32
+const (
+	// RememberTokenBytes is the length of the byte slice used for generating the remember token.
+	RememberTokenBytes = 32
+
+	// ImageIDBytes is the length of the byte slice used for generating image IDs.
+	ImageIDBytes = 12
+
+	// GallerySlugBytes is the length of the byte slice used for generating gallery slugs.
+	GallerySlugBytes = 12
+
+	// ShareSecretBytes is the length of the byte slice used for generating gallery share secrets.
+	ShareSecretBytes = 32
+)
 
 // Bytes will generate n random bytes or return an error.
 // This uses the crypto/rand package so is safe for
@@ -43,3 +54,22 @@ func String(nBytes int) (string, error) {
 func RememberToken() (string, error) {
 	return String(RememberTokenBytes)
 }
+
+// ImageID is a helper function to generate the random IDs images are
+// stored and addressed by. 12 bytes encode to 16 URL safe characters
+// without padding.
+func ImageID() (string, error) {
+	return String(ImageIDBytes)
+}
+
+// GallerySlug is a helper function to generate the unguessable slugs
+// used in share links for unlisted galleries.
+func GallerySlug() (string, error) {
+	return String(GallerySlugBytes)
+}
+
+// ShareSecret is a helper function to generate the per-gallery
+// secrets share links are signed with.
+func ShareSecret() (string, error) {
+	return String(ShareSecretBytes)
+}
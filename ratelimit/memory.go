@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store deletes expired counters.
+const sweepInterval = time.Minute
+
+// NewMemory returns a Store keeping its counters in memory. They are lost
+// on restart and not shared with other servers.
+func NewMemory() *Memory {
+	return &Memory{
+		counters: make(map[string]*counter),
+		now:      time.Now,
+	}
+}
+
+// Memory is a Store that keeps its counters in a map.
+type Memory struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type counter struct {
+	n       int
+	expires time.Time
+}
+
+var _ Store = &Memory{}
+
+func (m *Memory) Incr(key string, window time.Duration) (int, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+	c, ok := m.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &counter{expires: now.Add(window)}
+		m.counters[key] = c
+	}
+	c.n++
+	return c.n, c.expires.Sub(now), nil
+}
+
+func (m *Memory) Get(key string) (int, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	c, ok := m.counters[key]
+	if !ok || !now.Before(c.expires) {
+		return 0, 0, nil
+	}
+	return c.n, c.expires.Sub(now), nil
+}
+
+func (m *Memory) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.counters, key)
+	return nil
+}
+
+// sweep deletes expired counters so keys that are never seen again, like
+// the addresses of past visitors, don't use memory forever. It must be
+// called with mu held.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, c := range m.counters {
+		if !now.Before(c.expires) {
+			delete(m.counters, key)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Package ratelimit counts events, such as login attempts, per key to limit
+// how often they can happen. Counts are kept in a Store, either in memory
+// for a single server or in a database shared between servers.
+package ratelimit
+
+import (
+	"time"
+)
+
+// Store keeps counters that expire. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Incr adds one to key's counter and returns it along with the time
+	// left until it expires. A counter that doesn't exist or has expired
+	// starts again at one and expires after window.
+	Incr(key string, window time.Duration) (int, time.Duration, error)
+	// Get returns key's counter and the time left until it expires, or
+	// zero for both when it doesn't exist or has expired.
+	Get(key string) (int, time.Duration, error)
+	// Reset deletes key's counter.
+	Reset(key string) error
+}
+
+// NewLimiter returns a Limiter allowing limit events per key in each
+// window. Its counters are kept in store, their keys start with name so
+// limiters can share a store.
+func NewLimiter(store Store, name string, limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		store:  store,
+		prefix: name + ":",
+		limit:  limit,
+		window: window,
+	}
+}
+
+// Limiter allows a fixed number of events per key in each window, e.g.
+// 20 login attempts per IP address every 15 minutes.
+type Limiter struct {
+	store  Store
+	prefix string
+	limit  int
+	window time.Duration
+}
+
+// Allow records an event for key and reports whether it is within the
+// limit. When it isn't, the time until the key is allowed events again is
+// returned too.
+func (l *Limiter) Allow(key string) (bool, time.Duration, error) {
+	n, ttl, err := l.store.Incr(l.prefix+key, l.window)
+	if err != nil {
+		return false, 0, err
+	}
+	if n > l.limit {
+		return false, ttl, nil
+	}
+	return true, 0, nil
+}
+
+// Reset forgets the events recorded for key.
+func (l *Limiter) Reset(key string) error {
+	return l.store.Reset(l.prefix + key)
+}
+
+// NewBackoff returns a Backoff that allows free failures per key before
+// delaying attempts, first by base and then twice as long after each
+// further failure up to max. Failures are forgotten window after the
+// first one. Its counters are kept in store with keys starting with name.
+func NewBackoff(store Store, name string, free int, base, max, window time.Duration) *Backoff {
+	return &Backoff{
+		store:  store,
+		prefix: name + ":",
+		free:   free,
+		base:   base,
+		max:    max,
+		window: window,
+	}
+}
+
+// Backoff makes attempts wait progressively longer after each failure,
+// e.g. failed logins to an account.
+type Backoff struct {
+	store  Store
+	prefix string
+	free   int
+	base   time.Duration
+	max    time.Duration
+	window time.Duration
+}
+
+// Wait returns how long key must wait before its next attempt, zero if it
+// may try now.
+func (b *Backoff) Wait(key string) (time.Duration, error) {
+	_, ttl, err := b.store.Get(b.waitKey(key))
+	return ttl, err
+}
+
+// Fail records a failed attempt for key, delaying its next one if it
+// failed too often. It returns the number of failures within the window.
+func (b *Backoff) Fail(key string) (int, error) {
+	n, _, err := b.store.Incr(b.failKey(key), b.window)
+	if err != nil {
+		return 0, err
+	}
+	if delay := b.Delay(n); delay > 0 {
+		// attempts are refused while waiting, so the previous delay has
+		// expired and this starts a new one
+		if _, _, err := b.store.Incr(b.waitKey(key), delay); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Reset forgets key's failures, e.g. after it succeeded.
+func (b *Backoff) Reset(key string) error {
+	if err := b.store.Reset(b.failKey(key)); err != nil {
+		return err
+	}
+	return b.store.Reset(b.waitKey(key))
+}
+
+// Delay returns how long to wait after the nth failure.
+func (b *Backoff) Delay(n int) time.Duration {
+	if n <= b.free {
+		return 0
+	}
+	delay := b.base
+	for i := b.free + 1; i < n && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay
+}
+
+func (b *Backoff) failKey(key string) string {
+	return b.prefix + "fail:" + key
+}
+
+func (b *Backoff) waitKey(key string) string {
+	return b.prefix + "wait:" + key
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// testMemory returns a memory store with a clock tests can move forward.
+func testMemory() (*Memory, *time.Time) {
+	m := NewMemory()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	return m, &now
+}
+
+func TestMemory(t *testing.T) {
+	m, now := testMemory()
+
+	for i := 1; i <= 3; i++ {
+		n, ttl, err := m.Incr("a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Errorf("Expected count %d. Received %d", i, n)
+		}
+		if ttl != time.Minute {
+			t.Errorf("Expected the window not to move. Received %v", ttl)
+		}
+	}
+	*now = now.Add(40 * time.Second)
+	if n, ttl, _ := m.Get("a"); n != 3 || ttl != 20*time.Second {
+		t.Errorf("Expected 3 expiring in 20s. Received %d expiring in %v", n, ttl)
+	}
+	if n, ttl, _ := m.Get("b"); n != 0 || ttl != 0 {
+		t.Errorf("Expected unknown keys to be zero. Received %d, %v", n, ttl)
+	}
+
+	*now = now.Add(20 * time.Second)
+	if n, _, _ := m.Get("a"); n != 0 {
+		t.Errorf("Expected the counter to expire. Received %d", n)
+	}
+	if n, ttl, _ := m.Incr("a", time.Hour); n != 1 || ttl != time.Hour {
+		t.Errorf("Expected a new window. Received %d expiring in %v", n, ttl)
+	}
+
+	if err := m.Reset("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := m.Get("a"); n != 0 {
+		t.Errorf("Expected Reset to delete the counter. Received %d", n)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	m, now := testMemory()
+	m.Incr("old", time.Second)
+	*now = now.Add(2 * sweepInterval)
+	m.Incr("new", time.Minute)
+	if _, ok := m.counters["old"]; ok {
+		t.Errorf("Expected expired counters to be swept")
+	}
+	if _, ok := m.counters["new"]; !ok {
+		t.Errorf("Expected current counters to be kept")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	m, now := testMemory()
+	l := NewLimiter(m, "login", 2, time.Minute)
+	other := NewLimiter(m, "forgot", 1, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if ok, _, err := l.Allow("1.2.3.4"); !ok || err != nil {
+			t.Fatalf("Expected attempt %d to be allowed. Received %v, %v", i+1, ok, err)
+		}
+	}
+	*now = now.Add(15 * time.Second)
+	ok, retry, err := l.Allow("1.2.3.4")
+	if ok || err != nil {
+		t.Fatalf("Expected the third attempt to be refused. Received %v, %v", ok, err)
+	}
+	if retry != 45*time.Second {
+		t.Errorf("Expected to retry in 45s. Received %v", retry)
+	}
+	if ok, _, _ := l.Allow("5.6.7.8"); !ok {
+		t.Errorf("Expected other keys to be limited separately")
+	}
+	if ok, _, _ := other.Allow("1.2.3.4"); !ok {
+		t.Errorf("Expected limiters sharing a store to be separate")
+	}
+
+	*now = now.Add(45 * time.Second)
+	if ok, _, _ := l.Allow("1.2.3.4"); !ok {
+		t.Errorf("Expected attempts to be allowed after the window")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := NewBackoff(NewMemory(), "login", 3, time.Second, 10*time.Second, time.Hour)
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := b.Delay(tt.n); got != tt.want {
+			t.Errorf("Delay(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	m, now := testMemory()
+	b := NewBackoff(m, "login", 1, time.Second, time.Minute, time.Hour)
+
+	if n, err := b.Fail("user"); n != 1 || err != nil {
+		t.Fatalf("Expected 1 failure. Received %d, %v", n, err)
+	}
+	if wait, _ := b.Wait("user"); wait != 0 {
+		t.Errorf("Expected free failures not to wait. Received %v", wait)
+	}
+	b.Fail("user")
+	if wait, _ := b.Wait("user"); wait != time.Second {
+		t.Errorf("Expected to wait 1s. Received %v", wait)
+	}
+	*now = now.Add(time.Second)
+	if wait, _ := b.Wait("user"); wait != 0 {
+		t.Errorf("Expected the wait to be over. Received %v", wait)
+	}
+	if n, _ := b.Fail("user"); n != 3 {
+		t.Errorf("Expected 3 failures. Received %d", n)
+	}
+	if wait, _ := b.Wait("user"); wait != 2*time.Second {
+		t.Errorf("Expected the wait to double. Received %v", wait)
+	}
+	if wait, _ := b.Wait("other"); wait != 0 {
+		t.Errorf("Expected other keys not to wait. Received %v", wait)
+	}
+
+	if err := b.Reset("user"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := b.Wait("user"); wait != 0 {
+		t.Errorf("Expected Reset to end the wait. Received %v", wait)
+	}
+	if n, _ := b.Fail("user"); n != 1 {
+		t.Errorf("Expected Reset to forget failures. Received %d", n)
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrNotFound is returned when a blob does not exist in the store.
+	ErrNotFound = errors.New("storage: blob not found")
+
+	// ErrKeyInvalid is returned when a key is empty or would escape the store,
+	// e.g. by containing ".." path elements.
+	ErrKeyInvalid = errors.New("storage: key is invalid")
+)
+
+// BlobStore is implemented by each of the backends we can store
+// image bytes in. Keys are slash separated paths such as
+// "galleries/1/image.jpg".
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob.
+	Put(key string, r io.Reader, contentType string) error
+	// Get returns the blob stored under key or ErrNotFound.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a
+	// missing blob is not an error.
+	Delete(key string) error
+	// List returns the keys of all blobs starting with prefix.
+	List(prefix string) ([]string, error)
+	// URL returns the URL the blob can be requested from by a browser.
+	URL(key string) string
+}
+
+// cleanKey normalises key and makes sure it can not be used
+// to reach outside of the store.
+func cleanKey(key string) (string, error) {
+	key = strings.TrimPrefix(path.Clean("/"+key), "/")
+	if key == "" || key == "." {
+		return "", ErrKeyInvalid
+	}
+	return key, nil
+}
+
+// joinURL appends the url encoded key to base.
+func joinURL(base, key string) string {
+	u := url.URL{Path: key}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(u.String(), "./")
+}
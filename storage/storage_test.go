@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	keys := []string{"galleries/1/a.jpg", "galleries/1/b.png", "galleries/2/c.gif"}
+	for _, key := range keys {
+		if err := store.Put(key, strings.NewReader("data:"+key), "image/jpeg"); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+	}
+
+	rc, err := store.Get("galleries/1/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "data:galleries/1/a.jpg" {
+		t.Errorf("Expected blob contents to round trip. Received %q", b)
+	}
+
+	listed, err := store.List("galleries/1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "galleries/1/a.jpg,galleries/1/b.png" {
+		t.Errorf("Expected gallery 1 keys. Received %v", listed)
+	}
+
+	if err := store.Delete("galleries/1/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("galleries/1/a.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after Delete. Received %v", err)
+	}
+	if err := store.Delete("galleries/1/a.jpg"); err != nil {
+		t.Errorf("Expected deleting a missing blob to succeed. Received %v", err)
+	}
+
+	if _, err := store.Get("../../etc/passwd"); err == nil {
+		t.Errorf("Expected keys escaping the store to be rejected")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store := NewMemory("/images")
+	testBlobStore(t, store)
+	if url := store.URL("galleries/1/my photo.jpg"); url != "/images/galleries/1/my%20photo.jpg" {
+		t.Errorf("Unexpected URL %q", url)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, NewLocal(dir, "/images/"))
+}
+
+// fakeS3 is a minimal MinIO-style stand-in that understands
+// the subset of the S3 API used by the s3 driver.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	key := strings.TrimPrefix(path, "/")
+	switch {
+	case r.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = string(b)
+	case r.Method == http.MethodGet && key == "":
+		var res listBucketResult
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				res.Contents = append(res.Contents, struct {
+					Key string `xml:"Key"`
+				}{k})
+			}
+		}
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(obj))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{bucket: "photos", objects: make(map[string]string)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	store := NewS3(S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "photos",
+		AccessKey: "access",
+		SecretKey: "secret",
+	}, srv.Client())
+	testBlobStore(t, store)
+	if url := store.URL("galleries/2/c.gif"); url != srv.URL+"/photos/galleries/2/c.gif" {
+		t.Errorf("Unexpected URL %q", url)
+	}
+}
+
+// TestSignV4 checks the signer against the get-vanilla case of
+// the AWS Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	emptySum := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	ts := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, emptySum, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", ts)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != expected {
+		t.Errorf("Unexpected Authorization header.\nExpected: %s\nReceived: %s", expected, got)
+	}
+}
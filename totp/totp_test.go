@@ -0,0 +1,82 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors,
+// "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// The RFC lists 8 digit codes, ours are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := Step(now)
+	for _, offset := range []int64{-1, 0, 1} {
+		code, _ := Code(rfcSecret, step+offset)
+		got, ok := Validate(rfcSecret, code, now)
+		if !ok || got != step+offset {
+			t.Errorf("Validate(%s) = %d, %v, want %d, true", code, got, ok, step+offset)
+		}
+	}
+	for _, offset := range []int64{-2, 2} {
+		code, _ := Code(rfcSecret, step+offset)
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("Validate accepted a code %d steps away", offset)
+		}
+	}
+	if _, ok := Validate(rfcSecret, "08180", now); ok {
+		t.Error("Validate accepted a short code")
+	}
+	if _, ok := Validate("not base32!", "081804", now); ok {
+		t.Error("Validate accepted an invalid secret")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Errorf("len(secret) = %d, want 32", len(secret))
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("LensLocked", "jon@example.com", rfcSecret)
+	if !strings.HasPrefix(uri, "otpauth://totp/LensLocked:jon@example.com?") {
+		t.Errorf("URI = %s", uri)
+	}
+	if !strings.Contains(uri, "secret="+rfcSecret) || !strings.Contains(uri, "issuer=LensLocked") {
+		t.Errorf("URI = %s", uri)
+	}
+}
@@ -0,0 +1,102 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// Attestation statement formats we verify.
+const (
+	FormatNone   = "none"
+	FormatPacked = "packed"
+)
+
+// idFIDOGenCEAAGUID is the certificate extension that packed attestation
+// certificates may carry the authenticator's AAGUID in.
+var idFIDOGenCEAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// verifyAttestation checks the attestation statement of a new credential.
+// signed is the authenticator data followed by the hash of the client
+// data, which packed statements sign.
+//
+// Full packed attestation is checked against the certificate in the
+// statement, but the certificate isn't chained to a trusted root as we
+// don't restrict which authenticators may be used.
+func verifyAttestation(format string, stmt cborMap, auth *authenticatorData, signed []byte) error {
+	switch format {
+	case FormatNone:
+		if len(stmt) != 0 {
+			return ErrAttestationInvalid
+		}
+		return nil
+	case FormatPacked:
+		return verifyPacked(stmt, auth, signed)
+	default:
+		return ErrAttestationUnsupported
+	}
+}
+
+// verifyPacked verifies a packed attestation statement, see
+// https://www.w3.org/TR/webauthn-2/#sctn-packed-attestation.
+func verifyPacked(stmt cborMap, auth *authenticatorData, signed []byte) error {
+	alg, algOK := stmt.int("alg")
+	sig, sigOK := stmt.bytes("sig")
+	if !algOK || !sigOK {
+		return ErrAttestationInvalid
+	}
+	x5c, ok := stmt["x5c"]
+	if !ok {
+		// self attestation is signed with the credential key itself
+		if alg != auth.credentialKey.alg {
+			return ErrAttestationInvalid
+		}
+		if err := verifySignature(alg, auth.credentialKey.key, signed, sig); err != nil {
+			return ErrAttestationInvalid
+		}
+		return nil
+	}
+	chain, ok := x5c.([]interface{})
+	if !ok || len(chain) == 0 {
+		return ErrAttestationInvalid
+	}
+	der, ok := chain[0].([]byte)
+	if !ok {
+		return ErrAttestationInvalid
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return ErrAttestationInvalid
+	}
+	if err := verifySignature(alg, cert.PublicKey, signed, sig); err != nil {
+		return ErrAttestationInvalid
+	}
+	return checkPackedCertificate(cert, auth.aaguid)
+}
+
+// checkPackedCertificate enforces the requirements on packed attestation
+// certificates, see
+// https://www.w3.org/TR/webauthn-2/#sctn-packed-attestation-cert-requirements.
+func checkPackedCertificate(cert *x509.Certificate, aaguid []byte) error {
+	subject := cert.Subject
+	switch {
+	case cert.Version != 3,
+		len(subject.Country) != 1,
+		len(subject.Organization) != 1,
+		len(subject.OrganizationalUnit) != 1 || subject.OrganizationalUnit[0] != "Authenticator Attestation",
+		subject.CommonName == "",
+		cert.IsCA:
+		return ErrAttestationInvalid
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idFIDOGenCEAAGUID) {
+			continue
+		}
+		var value []byte
+		rest, err := asn1.Unmarshal(ext.Value, &value)
+		if err != nil || len(rest) != 0 || ext.Critical || !bytes.Equal(value, aaguid) {
+			return ErrAttestationInvalid
+		}
+	}
+	return nil
+}
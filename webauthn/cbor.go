@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// maxCBORDepth limits how deeply CBOR arrays and maps may be nested, so a
+// malicious response can't exhaust the stack.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR data item of b, returning it and the
+// bytes that follow it. Only what WebAuthn uses is supported: indefinite
+// lengths, which CTAP2 forbids, are rejected and tags are dropped.
+//
+// Integers are decoded to int64, byte strings to []byte, text strings to
+// string, arrays to []interface{} and maps to map[interface{}]interface{}
+// with int64 or string keys.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth || len(b) == 0 {
+		return nil, nil, ErrMalformed
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+	if major == 7 {
+		return decodeCBORSimple(info, b)
+	}
+	arg, b, err := cborArgument(info, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrMalformed
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrMalformed
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrMalformed
+		}
+		s := b[:arg]
+		if major == 3 {
+			return string(s), b[arg:], nil
+		}
+		return append([]byte(nil), s...), b[arg:], nil
+	case 4:
+		// every item takes at least a byte, which also bounds the
+		// allocation below
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrMalformed
+		}
+		items := make([]interface{}, arg)
+		for i := range items {
+			items[i], b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, ErrMalformed
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrMalformed
+			}
+			if _, ok := m[key]; ok {
+				return nil, nil, ErrMalformed
+			}
+			value, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, b, nil
+	default: // 6, a tag followed by the item it applies to
+		return decodeCBORItem(b, depth+1)
+	}
+}
+
+// cborArgument reads the argument of a data item's head, which is its
+// value, length or tag depending on its major type.
+func cborArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		return 0, nil, ErrMalformed
+	}
+}
+
+func decodeCBORSimple(info byte, b []byte) (interface{}, []byte, error) {
+	switch {
+	case info == 20:
+		return false, b, nil
+	case info == 21:
+		return true, b, nil
+	case info == 22 || info == 23:
+		return nil, b, nil
+	case info == 26 && len(b) >= 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	default:
+		return nil, nil, ErrMalformed
+	}
+}
+
+// cborMap is a decoded CBOR map with helpers to read its values.
+type cborMap map[interface{}]interface{}
+
+func (m cborMap) int(key interface{}) (int64, bool) {
+	v, ok := m[key].(int64)
+	return v, ok
+}
+
+func (m cborMap) bytes(key interface{}) ([]byte, bool) {
+	v, ok := m[key].([]byte)
+	return v, ok
+}
+
+func (m cborMap) string(key interface{}) (string, bool) {
+	v, ok := m[key].(string)
+	return v, ok
+}
@@ -0,0 +1,139 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+)
+
+// COSE algorithm identifiers of the signatures we verify.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// COSE key types, curves and the labels of their parameters, see RFC 8152.
+const (
+	coseKeyType = 1
+	coseAlg     = 3
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+
+	// EC2 and OKP keys
+	coseCurve = -1
+	coseX     = -2
+	coseY     = -3
+	// RSA keys
+	coseN = -1
+	coseE = -2
+
+	// minRSABits refuses RSA keys too short to be safe.
+	minRSABits = 2048
+)
+
+// supportedAlgs are offered to authenticators in order of preference.
+var supportedAlgs = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// publicKey is a credential public key decoded from its COSE_Key
+// encoding.
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey decodes a COSE_Key. Only the key types and curves of
+// supportedAlgs are accepted.
+func parsePublicKey(b []byte) (*publicKey, error) {
+	v, rest, err := decodeCBOR(b)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+	return publicKeyFromMap(m)
+}
+
+func publicKeyFromMap(raw map[interface{}]interface{}) (*publicKey, error) {
+	m := cborMap(raw)
+	kty, _ := m.int(int64(coseKeyType))
+	alg, _ := m.int(int64(coseAlg))
+	switch {
+	case kty == coseKeyTypeEC2 && alg == AlgES256:
+		crv, _ := m.int(int64(coseCurve))
+		x, xOK := m.bytes(int64(coseX))
+		y, yOK := m.bytes(int64(coseY))
+		if crv != coseCurveP256 || !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+			return nil, ErrMalformed
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrMalformed
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == coseKeyTypeOKP && alg == AlgEdDSA:
+		crv, _ := m.int(int64(coseCurve))
+		x, ok := m.bytes(int64(coseX))
+		if crv != coseCurveEd25519 || !ok || len(x) != ed25519.PublicKeySize {
+			return nil, ErrMalformed
+		}
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == coseKeyTypeRSA && alg == AlgRS256:
+		n, nOK := m.bytes(int64(coseN))
+		e, eOK := m.bytes(int64(coseE))
+		if !nOK || !eOK || len(e) == 0 || len(e) > 4 {
+			return nil, ErrMalformed
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < minRSABits || key.E < 3 {
+			return nil, ErrMalformed
+		}
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == 0 || alg == 0:
+		return nil, ErrMalformed
+	default:
+		return nil, ErrAlgorithmUnsupported
+	}
+}
+
+// verifySignature checks sig over data with key, using the signature
+// algorithm alg.
+func verifySignature(alg int64, key crypto.PublicKey, data, sig []byte) error {
+	sum := sha256.Sum256(data)
+	ok := false
+	switch alg {
+	case AlgES256:
+		k, isEC := key.(*ecdsa.PublicKey)
+		ok = isEC && k.Curve == elliptic.P256() && ecdsa.VerifyASN1(k, sum[:], sig)
+	case AlgEdDSA:
+		k, isEd := key.(ed25519.PublicKey)
+		ok = isEd && ed25519.Verify(k, data, sig)
+	case AlgRS256:
+		k, isRSA := key.(*rsa.PublicKey)
+		ok = isRSA && rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+	default:
+		return ErrAlgorithmUnsupported
+	}
+	if !ok {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
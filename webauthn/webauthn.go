@@ -0,0 +1,503 @@
+// Package webauthn implements the relying party side of Web
+// Authentication (https://www.w3.org/TR/webauthn-2/), which lets users
+// register passkeys and security keys and sign in with them instead of a
+// password.
+//
+// The browser's navigator.credentials API is given the options returned
+// by CreationOptions and RequestOptions, and the credential it returns is
+// posted back with its binary fields base64url encoded. Credentials must
+// verify the user, with a PIN or biometrics, as they replace the password
+// rather than adding a second factor to it.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"lenslocked.com/rand"
+)
+
+const (
+	// Timeout is how long the browser waits for the user to use their
+	// authenticator.
+	Timeout = 5 * time.Minute
+
+	// challengeBytes follows the spec's advice of at least 16 random
+	// bytes.
+	challengeBytes = 32
+
+	// maxCredentialIDLength is the longest credential ID the spec
+	// allows.
+	maxCredentialIDLength = 1023
+
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+	flagExtensionData    = 0x80
+)
+
+var (
+	// ErrMalformed is returned when a response can't be decoded.
+	ErrMalformed = errors.New("webauthn: malformed response")
+	// ErrChallengeMismatch is returned when a response isn't for the
+	// challenge we issued.
+	ErrChallengeMismatch = errors.New("webauthn: challenge does not match")
+	// ErrOriginMismatch is returned when a response was made for another
+	// site, or the wrong ceremony.
+	ErrOriginMismatch = errors.New("webauthn: origin or relying party does not match")
+	// ErrUserNotVerified is returned when the authenticator didn't verify
+	// the user.
+	ErrUserNotVerified = errors.New("webauthn: user was not verified")
+	// ErrAlgorithmUnsupported is returned for credential keys we can't
+	// verify signatures of.
+	ErrAlgorithmUnsupported = errors.New("webauthn: unsupported public key algorithm")
+	// ErrAttestationUnsupported is returned for attestation formats other
+	// than none and packed.
+	ErrAttestationUnsupported = errors.New("webauthn: unsupported attestation format")
+	// ErrAttestationInvalid is returned when an attestation statement
+	// doesn't verify.
+	ErrAttestationInvalid = errors.New("webauthn: attestation statement is invalid")
+	// ErrSignatureInvalid is returned when an assertion isn't signed by
+	// the credential.
+	ErrSignatureInvalid = errors.New("webauthn: signature is invalid")
+	// ErrCredentialMismatch is returned when an assertion is for another
+	// credential.
+	ErrCredentialMismatch = errors.New("webauthn: credential does not match")
+	// ErrSignCount is returned when the signature counter of a credential
+	// didn't increase, which is a sign it has been cloned.
+	ErrSignCount = errors.New("webauthn: signature counter did not increase")
+)
+
+// encoding is used for every binary value exchanged with the browser.
+var encoding = base64.RawURLEncoding
+
+// RelyingParty is the site credentials are registered with.
+type RelyingParty struct {
+	// ID is the domain credentials are scoped to, e.g. "lenslocked.com".
+	ID string
+	// Name is shown to users by their browser.
+	Name string
+	// Origin is the scheme, host and port the pages using credentials
+	// are served from, e.g. "https://lenslocked.com".
+	Origin string
+}
+
+// User is the account a credential is registered for.
+type User struct {
+	// ID is the user handle, which must not contain personal information.
+	ID          []byte
+	Name        string
+	DisplayName string
+}
+
+// Credential is a verified public key credential.
+type Credential struct {
+	ID []byte
+	// PublicKey is the COSE_Key encoding of the credential's public key.
+	PublicKey []byte
+	SignCount uint32
+	// AAGUID identifies the model of the authenticator, it is all zeros
+	// unless the authenticator provides attestation.
+	AAGUID []byte
+	// Format is the attestation statement format the credential was
+	// registered with.
+	Format string
+}
+
+// CreationOptions are the PublicKeyCredentialCreationOptions given to
+// navigator.credentials.create, with binary values base64url encoded.
+type CreationOptions struct {
+	Challenge              string                 `json:"challenge"`
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the PublicKeyCredentialRequestOptions given to
+// navigator.credentials.get, with binary values base64url encoded.
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CredentialDescriptor identifies a credential in options.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// AttestationResponse is the credential returned by
+// navigator.credentials.create.
+type AttestationResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// AssertionResponse is the credential returned by
+// navigator.credentials.get.
+type AssertionResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+// Challenge returns the challenge the response claims to answer, so the
+// caller can look up the one it issued. It is verified by
+// VerifyRegistration.
+func (r *AttestationResponse) Challenge() (string, error) {
+	cd, err := parseClientData(r.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return cd.Challenge, nil
+}
+
+// Challenge returns the challenge the response claims to answer, so the
+// caller can look up the one it issued. It is verified by
+// VerifyAssertion.
+func (r *AssertionResponse) Challenge() (string, error) {
+	cd, err := parseClientData(r.ClientDataJSON)
+	if err != nil {
+		return "", err
+	}
+	return cd.Challenge, nil
+}
+
+// NewChallenge returns a random, base64url encoded challenge. Each may
+// only be used for a single ceremony.
+func NewChallenge() (string, error) {
+	b, err := rand.Bytes(challengeBytes)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// EncodeID base64url encodes a credential ID.
+func EncodeID(id []byte) string {
+	return encoding.EncodeToString(id)
+}
+
+// DecodeID decodes a base64url encoded credential ID or user handle.
+func DecodeID(s string) ([]byte, error) {
+	b, err := encoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	return b, nil
+}
+
+// CreationOptions returns the options to register a credential for user
+// with. Discoverable credentials are requested so the user can sign in
+// without entering their email address. exclude lists the IDs of the
+// credentials the user already has, so an authenticator isn't registered
+// twice.
+func (rp *RelyingParty) CreationOptions(user User, challenge string, exclude [][]byte) *CreationOptions {
+	opts := CreationOptions{
+		Challenge: challenge,
+		RP:        rpEntity{ID: rp.ID, Name: rp.Name},
+		User: userEntity{
+			ID:          encoding.EncodeToString(user.ID),
+			Name:        user.Name,
+			DisplayName: user.DisplayName,
+		},
+		Timeout:            int64(Timeout / time.Millisecond),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: FormatNone,
+	}
+	for _, alg := range supportedAlgs {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, credentialParameter{
+			Type: "public-key",
+			Alg:  alg,
+		})
+	}
+	return &opts
+}
+
+// RequestOptions returns the options to sign in with. With no allowed
+// credentials the user picks one of their discoverable credentials.
+func (rp *RelyingParty) RequestOptions(challenge string, allow [][]byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          int64(Timeout / time.Millisecond),
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+// VerifyRegistration verifies the response to a registration ceremony
+// started with challenge and returns the new credential, see
+// https://www.w3.org/TR/webauthn-2/#sctn-registering-a-new-credential.
+func (rp *RelyingParty) VerifyRegistration(challenge string, resp *AttestationResponse) (*Credential, error) {
+	cd, err := parseClientData(resp.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkClientData(cd, typeCreate, challenge); err != nil {
+		return nil, err
+	}
+	raw, err := decodeField(resp.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	v, rest, err := decodeCBOR(raw)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+	format, fmtOK := cborMap(obj).string("fmt")
+	authData, authOK := cborMap(obj).bytes("authData")
+	stmt, stmtOK := obj["attStmt"].(map[interface{}]interface{})
+	if !fmtOK || !authOK || !stmtOK {
+		return nil, ErrMalformed
+	}
+	auth, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthenticatorData(auth); err != nil {
+		return nil, err
+	}
+	if auth.credentialID == nil {
+		return nil, ErrMalformed
+	}
+	if id, err := DecodeID(resp.ID); err != nil || !bytes.Equal(id, auth.credentialID) {
+		return nil, ErrCredentialMismatch
+	}
+	signed := append(authData, cd.hash[:]...)
+	if err := verifyAttestation(format, cborMap(stmt), auth, signed); err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:        auth.credentialID,
+		PublicKey: auth.credentialKeyRaw,
+		SignCount: auth.signCount,
+		AAGUID:    auth.aaguid,
+		Format:    format,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an authentication ceremony
+// started with challenge, which must have been made with cred, see
+// https://www.w3.org/TR/webauthn-2/#sctn-verifying-assertion. The new
+// signature counter of the credential is returned, callers must store it.
+func (rp *RelyingParty) VerifyAssertion(challenge string, cred *Credential, resp *AssertionResponse) (uint32, error) {
+	if id, err := DecodeID(resp.ID); err != nil || !bytes.Equal(id, cred.ID) {
+		return 0, ErrCredentialMismatch
+	}
+	cd, err := parseClientData(resp.ClientDataJSON)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkClientData(cd, typeGet, challenge); err != nil {
+		return 0, err
+	}
+	authData, err := decodeField(resp.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	sig, err := decodeField(resp.Signature)
+	if err != nil {
+		return 0, err
+	}
+	auth, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+	if err := rp.checkAuthenticatorData(auth); err != nil {
+		return 0, err
+	}
+	key, err := parsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	signed := append(authData, cd.hash[:]...)
+	if err := verifySignature(key.alg, key.key, signed, sig); err != nil {
+		return 0, err
+	}
+	// authenticators that don't count signatures, like most passkeys,
+	// always report 0
+	if (auth.signCount != 0 || cred.SignCount != 0) && auth.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+	return auth.signCount, nil
+}
+
+// clientData is the collectedClientData the browser signs along with the
+// authenticator data.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+	// hash is the SHA-256 hash of the JSON the client data was decoded
+	// from.
+	hash [sha256.Size]byte
+}
+
+func parseClientData(s string) (*clientData, error) {
+	raw, err := decodeField(s)
+	if err != nil {
+		return nil, err
+	}
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, ErrMalformed
+	}
+	cd.hash = sha256.Sum256(raw)
+	return &cd, nil
+}
+
+func (rp *RelyingParty) checkClientData(cd *clientData, typ, challenge string) error {
+	if cd.Type != typ || cd.Origin != rp.Origin {
+		return ErrOriginMismatch
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return ErrChallengeMismatch
+	}
+	return nil
+}
+
+func (rp *RelyingParty) checkAuthenticatorData(auth *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(auth.rpIDHash, rpIDHash[:]) != 1 {
+		return ErrOriginMismatch
+	}
+	if auth.flags&flagUserPresent == 0 || auth.flags&flagUserVerified == 0 {
+		return ErrUserNotVerified
+	}
+	return nil
+}
+
+// authenticatorData is the data an authenticator signs, see
+// https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data.
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// The attested credential data is only included when a credential is
+	// registered.
+	aaguid           []byte
+	credentialID     []byte
+	credentialKeyRaw []byte
+	credentialKey    *publicKey
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrMalformed
+	}
+	auth := authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+	if auth.flags&flagAttestedCredData != 0 {
+		if len(rest) < 18 {
+			return nil, ErrMalformed
+		}
+		auth.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen > maxCredentialIDLength || idLen > len(rest) {
+			return nil, ErrMalformed
+		}
+		auth.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+		v, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, ErrMalformed
+		}
+		key, err := publicKeyFromMap(m)
+		if err != nil {
+			return nil, err
+		}
+		auth.credentialKeyRaw = rest[:len(rest)-len(after)]
+		auth.credentialKey = key
+		rest = after
+	}
+	if auth.flags&flagExtensionData != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, ErrMalformed
+	}
+	return &auth, nil
+}
+
+func decodeField(s string) ([]byte, error) {
+	if s == "" {
+		return nil, ErrMalformed
+	}
+	return DecodeID(s)
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, len(ids))
+	for i, id := range ids {
+		list[i] = CredentialDescriptor{Type: "public-key", ID: encoding.EncodeToString(id)}
+	}
+	return list
+}
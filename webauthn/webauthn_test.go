@@ -0,0 +1,457 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testRP = RelyingParty{
+	ID:     "lenslocked.com",
+	Name:   "LensLocked",
+	Origin: "https://lenslocked.com",
+}
+
+var testAAGUID = []byte("lenslocked-test!")
+
+// authenticator is a software authenticator holding a single credential.
+type authenticator struct {
+	credentialID []byte
+	signer       crypto.Signer
+	alg          int64
+	signCount    uint32
+	flags        byte
+	// attestation is "none", "packed" for self attestation or "x5c" for
+	// full packed attestation with attestationKey.
+	attestation string
+	// selfSigner signs self attestation statements in place of the
+	// credential key.
+	selfSigner     crypto.Signer
+	attestationKey *ecdsa.PrivateKey
+	attestationDER []byte
+}
+
+func newAuthenticator(t *testing.T, alg int64) *authenticator {
+	a := authenticator{
+		credentialID: make([]byte, 16),
+		alg:          alg,
+		flags:        flagUserPresent | flagUserVerified,
+		attestation:  FormatNone,
+	}
+	rand.Read(a.credentialID)
+	var err error
+	switch alg {
+	case AlgES256:
+		a.signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.signer, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &a
+}
+
+// withCertificate makes the authenticator use full packed attestation.
+func (a *authenticator) withCertificate(t *testing.T, ou string, aaguid []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := asn1.Marshal(aaguid)
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:            []string{"US"},
+			Organization:       []string{"Test Vendor"},
+			OrganizationalUnit: []string{ou},
+			CommonName:         "Test Authenticator",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions: []pkix.Extension{
+			{Id: idFIDOGenCEAAGUID, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.attestation = "x5c"
+	a.attestationKey = key
+	a.attestationDER = der
+}
+
+func (a *authenticator) coseKey() map[interface{}]interface{} {
+	switch k := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return map[interface{}]interface{}{
+			int64(coseKeyType): int64(coseKeyTypeEC2),
+			int64(coseAlg):     int64(AlgES256),
+			int64(coseCurve):   int64(coseCurveP256),
+			int64(coseX):       k.X.FillBytes(make([]byte, 32)),
+			int64(coseY):       k.Y.FillBytes(make([]byte, 32)),
+		}
+	case ed25519.PublicKey:
+		return map[interface{}]interface{}{
+			int64(coseKeyType): int64(coseKeyTypeOKP),
+			int64(coseAlg):     int64(AlgEdDSA),
+			int64(coseCurve):   int64(coseCurveEd25519),
+			int64(coseX):       []byte(k),
+		}
+	}
+	return nil
+}
+
+func (a *authenticator) authData(rpID string, attested bool) []byte {
+	hash := sha256.Sum256([]byte(rpID))
+	b := append([]byte(nil), hash[:]...)
+	flags := a.flags
+	if attested {
+		flags |= flagAttestedCredData
+	}
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+	if attested {
+		b = append(b, testAAGUID...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.credentialID)))
+		b = append(b, a.credentialID...)
+		b = append(b, encodeCBOR(a.coseKey())...)
+	}
+	return b
+}
+
+func (a *authenticator) sign(t *testing.T, signer crypto.Signer, data []byte) []byte {
+	var sig []byte
+	var err error
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		sig, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		sum := sha256.Sum256(data)
+		sig, err = signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func clientDataJSON(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+	return b
+}
+
+// create runs the authenticator's side of a registration ceremony.
+func (a *authenticator) create(t *testing.T, rpID, origin, challenge string) *AttestationResponse {
+	cd := clientDataJSON(typeCreate, challenge, origin)
+	authData := a.authData(rpID, true)
+	cdHash := sha256.Sum256(cd)
+	signed := append(append([]byte(nil), authData...), cdHash[:]...)
+	stmt := map[interface{}]interface{}{}
+	format := FormatPacked
+	switch a.attestation {
+	case FormatNone:
+		format = FormatNone
+	case FormatPacked:
+		signer := a.signer
+		if a.selfSigner != nil {
+			signer = a.selfSigner
+		}
+		stmt["alg"] = a.alg
+		stmt["sig"] = a.sign(t, signer, signed)
+	case "x5c":
+		stmt["alg"] = int64(AlgES256)
+		stmt["sig"] = a.sign(t, a.attestationKey, signed)
+		stmt["x5c"] = []interface{}{a.attestationDER}
+	}
+	obj := map[interface{}]interface{}{
+		"fmt":      format,
+		"attStmt":  stmt,
+		"authData": authData,
+	}
+	return &AttestationResponse{
+		ID:                encoding.EncodeToString(a.credentialID),
+		ClientDataJSON:    encoding.EncodeToString(cd),
+		AttestationObject: encoding.EncodeToString(encodeCBOR(obj)),
+	}
+}
+
+// get runs the authenticator's side of an authentication ceremony.
+func (a *authenticator) get(t *testing.T, rpID, origin, challenge string) *AssertionResponse {
+	a.signCount++
+	cd := clientDataJSON(typeGet, challenge, origin)
+	authData := a.authData(rpID, false)
+	cdHash := sha256.Sum256(cd)
+	signed := append(append([]byte(nil), authData...), cdHash[:]...)
+	return &AssertionResponse{
+		ID:                encoding.EncodeToString(a.credentialID),
+		ClientDataJSON:    encoding.EncodeToString(cd),
+		AuthenticatorData: encoding.EncodeToString(authData),
+		Signature:         encoding.EncodeToString(a.sign(t, a.signer, signed)),
+	}
+}
+
+func challenge(t *testing.T) string {
+	c, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	tests := []struct {
+		name        string
+		alg         int64
+		attestation string
+	}{
+		{"es256 none", AlgES256, FormatNone},
+		{"es256 self", AlgES256, FormatPacked},
+		{"eddsa self", AlgEdDSA, FormatPacked},
+		{"es256 full", AlgES256, "x5c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t, tt.alg)
+			a.attestation = tt.attestation
+			if tt.attestation == "x5c" {
+				a.withCertificate(t, "Authenticator Attestation", testAAGUID)
+			}
+			c := challenge(t)
+			resp := a.create(t, testRP.ID, testRP.Origin, c)
+			if got, err := resp.Challenge(); err != nil || got != c {
+				t.Fatalf("Challenge() = %q, %v; want %q", got, err, c)
+			}
+			cred, err := testRP.VerifyRegistration(c, resp)
+			if err != nil {
+				t.Fatalf("VerifyRegistration() err = %v", err)
+			}
+			wantFormat := FormatPacked
+			if tt.attestation == FormatNone {
+				wantFormat = FormatNone
+			}
+			if cred.Format != wantFormat || string(cred.AAGUID) != string(testAAGUID) {
+				t.Errorf("credential format %q aaguid %q", cred.Format, cred.AAGUID)
+			}
+
+			for i := 0; i < 2; i++ {
+				c = challenge(t)
+				count, err := testRP.VerifyAssertion(c, cred, a.get(t, testRP.ID, testRP.Origin, c))
+				if err != nil {
+					t.Fatalf("VerifyAssertion() err = %v", err)
+				}
+				if count != a.signCount {
+					t.Errorf("VerifyAssertion() count = %d, want %d", count, a.signCount)
+				}
+				cred.SignCount = count
+			}
+		})
+	}
+}
+
+func TestVerifyRegistrationErrors(t *testing.T) {
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tests := []struct {
+		name string
+		edit func(t *testing.T, a *authenticator)
+		// rpID and origin the authenticator is used with
+		rpID, origin string
+		// stale makes the authenticator answer another challenge
+		stale bool
+		want  error
+	}{
+		{"other origin", nil, testRP.ID, "https://evil.example", false, ErrOriginMismatch},
+		{"other rp", nil, "evil.example", testRP.Origin, false, ErrOriginMismatch},
+		{"stale challenge", nil, testRP.ID, testRP.Origin, true, ErrChallengeMismatch},
+		{"not verified", func(t *testing.T, a *authenticator) {
+			a.flags = flagUserPresent
+		}, testRP.ID, testRP.Origin, false, ErrUserNotVerified},
+		{"self attestation by another key", func(t *testing.T, a *authenticator) {
+			a.attestation = FormatPacked
+			a.selfSigner = otherKey
+		}, testRP.ID, testRP.Origin, false, ErrAttestationInvalid},
+		{"certificate without attestation ou", func(t *testing.T, a *authenticator) {
+			a.withCertificate(t, "Marketing", testAAGUID)
+		}, testRP.ID, testRP.Origin, false, ErrAttestationInvalid},
+		{"certificate for another aaguid", func(t *testing.T, a *authenticator) {
+			a.withCertificate(t, "Authenticator Attestation", []byte("another-aaguid!!"))
+		}, testRP.ID, testRP.Origin, false, ErrAttestationInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(t, AlgES256)
+			if tt.edit != nil {
+				tt.edit(t, a)
+			}
+			c := challenge(t)
+			used := c
+			if tt.stale {
+				used = challenge(t)
+			}
+			_, err := testRP.VerifyRegistration(c, a.create(t, tt.rpID, tt.origin, used))
+			if err != tt.want {
+				t.Errorf("VerifyRegistration() err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionErrors(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+	c := challenge(t)
+	cred, err := testRP.VerifyRegistration(c, a.create(t, testRP.ID, testRP.Origin, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = challenge(t)
+	resp := a.get(t, testRP.ID, testRP.Origin, c)
+	resp.Signature = encoding.EncodeToString(a.sign(t, a.signer, []byte("something else")))
+	if _, err := testRP.VerifyAssertion(c, cred, resp); err != ErrSignatureInvalid {
+		t.Errorf("wrong signature err = %v, want %v", err, ErrSignatureInvalid)
+	}
+
+	other := newAuthenticator(t, AlgES256)
+	if _, err := testRP.VerifyAssertion(c, cred, other.get(t, testRP.ID, testRP.Origin, c)); err != ErrCredentialMismatch {
+		t.Errorf("other credential err = %v, want %v", err, ErrCredentialMismatch)
+	}
+
+	// a register response can't be replayed as a login
+	reg := a.create(t, testRP.ID, testRP.Origin, c)
+	resp = a.get(t, testRP.ID, testRP.Origin, c)
+	resp.ClientDataJSON = reg.ClientDataJSON
+	if _, err := testRP.VerifyAssertion(c, cred, resp); err != ErrOriginMismatch {
+		t.Errorf("create client data err = %v, want %v", err, ErrOriginMismatch)
+	}
+
+	cred.SignCount = a.signCount + 10
+	if _, err := testRP.VerifyAssertion(c, cred, a.get(t, testRP.ID, testRP.Origin, c)); err != ErrSignCount {
+		t.Errorf("cloned err = %v, want %v", err, ErrSignCount)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want interface{}
+	}{
+		{"uint", []byte{0x18, 0x64}, int64(100)},
+		{"negative", []byte{0x39, 0x01, 0x00}, int64(-257)},
+		{"text", []byte{0x63, 'f', 'm', 't'}, "fmt"},
+		{"true", []byte{0xf5}, true},
+		{"tagged", []byte{0xc1, 0x01}, int64(1)},
+	}
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(tt.in)
+		if err != nil || len(rest) != 0 || got != tt.want {
+			t.Errorf("%s: decodeCBOR() = %v, %x, %v; want %v", tt.name, got, rest, err, tt.want)
+		}
+	}
+
+	bad := map[string][]byte{
+		"empty":              {},
+		"truncated string":   {0x45, 1, 2},
+		"indefinite array":   {0x9f, 0x01, 0xff},
+		"huge array":         {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"duplicate map keys": {0xa2, 0x01, 0x01, 0x01, 0x02},
+		"bytes map key":      {0xa1, 0x41, 0x00, 0x01},
+		"too deep":           append(bytes.Repeat([]byte{0x81}, maxCBORDepth+2), 0x01),
+	}
+	for name, in := range bad {
+		if _, _, err := decodeCBOR(in); err != ErrMalformed {
+			t.Errorf("%s: decodeCBOR() err = %v, want %v", name, err, ErrMalformed)
+		}
+	}
+}
+
+func TestCreationOptions(t *testing.T) {
+	opts := testRP.CreationOptions(User{ID: []byte{1}, Name: "jon@example.com", DisplayName: "Jon"}, "abc", [][]byte{{2}})
+	b, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	json.Unmarshal(b, &got)
+	if got["user"].(map[string]interface{})["id"] != "AQ" {
+		t.Errorf("user id = %v, want AQ", got["user"])
+	}
+	if ex := got["excludeCredentials"].([]interface{}); len(ex) != 1 || ex[0].(map[string]interface{})["id"] != "Ag" {
+		t.Errorf("excludeCredentials = %v", ex)
+	}
+	if len(opts.PubKeyCredParams) != len(supportedAlgs) || opts.PubKeyCredParams[0].Alg != AlgES256 {
+		t.Errorf("pubKeyCredParams = %v", opts.PubKeyCredParams)
+	}
+}
+
+// encodeCBOR encodes v in the canonical CTAP2 form authenticators use.
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n <= 0xff:
+			return []byte{major<<5 | 24, byte(n)}
+		case n <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+		}
+	}
+	switch v := v.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case []interface{}:
+		b := head(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case map[interface{}]interface{}:
+		type entry struct{ key, value []byte }
+		var entries []entry
+		for k, value := range v {
+			entries = append(entries, entry{encodeCBOR(k), encodeCBOR(value)})
+		}
+		// canonical CBOR sorts keys by length, then bytewise
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i].key, entries[j].key
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return string(a) < string(b)
+		})
+		b := head(5, uint64(len(v)))
+		for _, e := range entries {
+			b = append(append(b, e.key...), e.value...)
+		}
+		return b
+	}
+	panic("encodeCBOR: unsupported type")
+}